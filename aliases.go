@@ -0,0 +1,40 @@
+package main
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/distribution/reference"
+	"github.com/docker/docker/api/types/image"
+)
+
+// imageAliases returns the other local tags of an image, saved with it
+// with --all-tags so the target knows the image under the same names.
+// With --retag-prefix only tags inside the prefix are kept.
+func (b *Bundler) imageAliases(imageName string, inspect image.InspectResponse) []string {
+	if !b.opts.AllTags {
+		return nil
+	}
+	name := familiarName(imageName)
+	var aliases []string
+	for _, tag := range inspect.RepoTags {
+		if tag == "<none>:<none>" || familiarName(tag) == name {
+			continue
+		}
+		if b.opts.RetagPrefix != "" && !strings.HasPrefix(tag, strings.TrimSuffix(b.opts.RetagPrefix, "/")+"/") {
+			continue
+		}
+		aliases = append(aliases, tag)
+	}
+	sort.Strings(aliases)
+	return aliases
+}
+
+// familiarName normalizes an image reference like "docker.io/library/nginx" to "nginx:latest"
+func familiarName(imageName string) string {
+	named, err := reference.ParseNormalizedNamed(imageName)
+	if err != nil {
+		return imageName
+	}
+	return reference.FamiliarString(reference.TagNameOnly(named))
+}
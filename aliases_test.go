@@ -0,0 +1,55 @@
+package main
+
+import (
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"docker-compose-bundler/dockerclient"
+)
+
+func TestBundleAllTags(t *testing.T) {
+	source := dockerclient.NewFake()
+	source.AddImage("nginx:1.27", "nginx:1", "docker.io/library/nginx:1.27")
+	source.AddImage("redis:7")
+	outputFile := bundleWith(t, source, Options{AllTags: true}, writeCompose(t, webCompose))
+
+	manifest, _, err := readBundleMetadata(outputFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, img := range manifest.Images {
+		if img.Name == "nginx:1.27" && !slices.Equal(img.Aliases, []string{"nginx:1"}) {
+			t.Errorf("nginx:1.27 aliases %v, want nginx:1", img.Aliases)
+		}
+	}
+
+	// The aliases are saved in the same image tar and loaded with it
+	target := dockerclient.NewFake()
+	loader, err := LoadArchive(outputFile, filepath.Join(t.TempDir(), "shop"), target, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	web, err := target.ImageInspect(loader.ctx, "nginx:1.27")
+	if err != nil {
+		t.Fatal(err)
+	}
+	alias, err := target.ImageInspect(loader.ctx, "nginx:1")
+	if err != nil || alias.ID != web.ID {
+		t.Errorf("nginx:1 was not loaded as an alias of nginx:1.27: %v", err)
+	}
+}
+
+func TestFamiliarName(t *testing.T) {
+	for name, want := range map[string]string{
+		"docker.io/library/nginx":  "nginx:latest",
+		"nginx:1.27":               "nginx:1.27",
+		"ghcr.io/acme/app:2":       "ghcr.io/acme/app:2",
+		"registry:5000/team/app":   "registry:5000/team/app:latest",
+		"Not A Valid Reference!!!": "Not A Valid Reference!!!",
+	} {
+		if got := familiarName(name); got != want {
+			t.Errorf("familiarName(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
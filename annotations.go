@@ -0,0 +1,23 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// parseAnnotations parses the --annotation key=value flags
+func parseAnnotations(values []string) (map[string]string, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+	annotations := make(map[string]string, len(values))
+	for _, value := range values {
+		key, val, ok := strings.Cut(value, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" || strings.ContainsAny(key, " \t") {
+			return nil, fmt.Errorf("invalid annotation %q, use key=value", value)
+		}
+		annotations[key] = val
+	}
+	return annotations, nil
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"fmt"
+	"go.opentelemetry.io/otel/attribute"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+)
+
+// Append adds the services of composeFile to an existing bundle. Services with
+// the same name replace the bundled ones, images already in the bundle are
+// reused and images no longer referenced are dropped.
+func (b *Bundler) Append(bundleFile, composeFile, outputFile string) (err error) {
+	defer b.span("append", attribute.String("bundle", bundleFile), attribute.String("compose.file", composeFile))(&err)
+
+	release, err := lockBundleFiles(bundleFile, outputFile)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	tempDir, err := os.MkdirTemp("", "docker-compose-bundle-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temp directory: %w", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	fmt.Printf("Extracting %s...\n", bundleFile)
+	format, err := detectArchiveFile(bundleFile)
+	if err != nil {
+		return err
+	}
+	if b.opts.ArchiveFormat != "" {
+		format = b.opts.ArchiveFormat
+	}
+	if err := extractBundle(bundleFile, tempDir); err != nil {
+		return fmt.Errorf("failed to extract bundle: %w", err)
+	}
+	manifest, err := readManifest(tempDir)
+	if err != nil {
+		return fmt.Errorf("failed to read bundle manifest: %w", err)
+	}
+	b.stats.Name, b.stats.Version = manifest.Name, manifest.Version
+	compose, err := readBundleCompose(filepath.Join(tempDir, "docker-compose.yml"))
+	if err != nil {
+		return err
+	}
+
+	// The extra file may refer to services, networks and volumes of the bundle
+	opts, err := b.loadOptions()
+	if err != nil {
+		return err
+	}
+	extra, err := parseComposeFiles(append([]string{composeFile}, b.opts.Overrides...), opts)
+	if err != nil {
+		return fmt.Errorf("failed to parse compose file: %w", err)
+	}
+	b.recordInputs(composeFile)
+	if err := b.checkExtensions(extra); err != nil {
+		return err
+	}
+	if extra.XBundle != nil {
+		b.warnf("ignoring x-bundle of %s except its jobs, the bundle keeps %s %s", composeFile, manifest.Name, manifest.Version)
+	}
+
+	baseDir := filepath.Dir(composeFile)
+	if b.opts.HostsMap != "" {
+		hosts, err := loadHostsMap(b.opts.HostsMap)
+		if err != nil {
+			return fmt.Errorf("failed to read hosts map: %w", err)
+		}
+		addExtraHosts(extra, hosts)
+	}
+	if err := dropMissingEnvFiles(extra, baseDir); err != nil {
+		return fmt.Errorf("failed to bundle env files: %w", err)
+	}
+	b.lintExternalHosts(extra, baseDir)
+	licenses, err := b.checkLicenses(compose.XBundle, pulledImages(extra))
+	if err != nil {
+		return err
+	}
+	if b.annotations, err = parseAnnotations(b.opts.Annotations); err != nil {
+		return err
+	}
+	if b.buildSecrets, err = parseBuildSecrets(b.opts.BuildSecrets, extra.Secrets, baseDir); err != nil {
+		return err
+	}
+
+	if extra.XBundle != nil {
+		if err := b.runJobs(extra.XBundle.Jobs, baseDir); err != nil {
+			return err
+		}
+	}
+
+	images := make(map[string]string)
+	b.lock = &Lockfile{LockfileVersion: lockfileVersion, Services: make(map[string]LockedImage)}
+	for _, serviceName := range sortedServiceNames(extra) {
+		service := extra.Services[serviceName]
+		built := service.Build != nil
+		imageName, err := b.processServiceWithBundle(serviceName, service, baseDir, manifest.Name, manifest.Version)
+		if err != nil {
+			if b.skipMissingImage(serviceName, service, err) {
+				continue
+			}
+			return fmt.Errorf("failed to process service %s: %w", serviceName, err)
+		}
+		if imageName != "" {
+			if err := b.lockService(serviceName, imageName, built); err != nil {
+				return err
+			}
+			images[serviceName] = imageName
+		}
+	}
+	transformed, err := b.transformCompose(extra, manifest.Name, manifest.Version, baseDir, images, bundledEnvFiles(tempDir))
+	if err != nil {
+		return err
+	}
+	imageMap, err := b.bundledImages(images, transformed.Images)
+	if err != nil {
+		return err
+	}
+	if err := b.checkPlatforms(extra, imageMap); err != nil {
+		return err
+	}
+
+	if err := b.lintImageConfigs(extra); err != nil {
+		return err
+	}
+	if b.opts.NonRootUser != "" {
+		if err := b.enforceNonRoot(extra, b.opts.NonRootUser); err != nil {
+			return err
+		}
+	}
+	if err := b.bundleEnvFiles(transformed.EnvFiles, baseDir, tempDir); err != nil {
+		return fmt.Errorf("failed to bundle env files: %w", err)
+	}
+
+	compose.sopsEncrypted = extra.sopsEncrypted
+	for serviceName, service := range extra.Services {
+		if _, ok := compose.Services[serviceName]; ok {
+			b.decidef("Replacing service %s", serviceName)
+		}
+		compose.Services[serviceName] = service
+	}
+	mergeServiceExtensions(compose, extra)
+	mergeTopLevel(&compose.Networks, extra.Networks)
+	mergeTopLevel(&compose.Volumes, extra.Volumes)
+	mergeTopLevel(&compose.Secrets, extra.Secrets)
+	mergeTopLevel(&compose.Configs, extra.Configs)
+	if err := b.resolveLegacyReferences(compose); err != nil {
+		return err
+	}
+	if err := validateCompose(compose); err != nil {
+		return err
+	}
+
+	if err := b.updateBundleImages(manifest, tempDir, imageMap); err != nil {
+		return err
+	}
+	b.pruneBundleImages(manifest, compose, tempDir)
+	manifest.Lint = append(manifest.Lint, b.lint...)
+	manifest.Engine = engineRequirement(compose)
+	dropLicenses(manifest, pulledImages(extra))
+	manifest.Licenses = append(manifest.Licenses, licenses...)
+	for name, value := range extra.parameters {
+		if manifest.Parameters == nil {
+			manifest.Parameters = make(map[string]string)
+		}
+		manifest.Parameters[name] = value
+	}
+	for key, value := range b.annotations {
+		if manifest.Annotations == nil {
+			manifest.Annotations = make(map[string]string)
+		}
+		manifest.Annotations[key] = value
+	}
+	manifest.MissingImages = mergeMissingImages(manifest.MissingImages, extra, b.missingImages, manifest.Images)
+	manifest.Builds = mergeBuilds(manifest.Builds, b.builds, manifest.Images)
+	for _, file := range b.encryptedFiles {
+		if !slices.Contains(manifest.Encrypted, file) {
+			manifest.Encrypted = append(manifest.Encrypted, file)
+		}
+	}
+
+	if err := b.writeComposeFile(compose, filepath.Join(tempDir, "docker-compose.yml")); err != nil {
+		return fmt.Errorf("failed to write updated compose file: %w", err)
+	}
+	if err := b.recordBundler(tempDir, manifest); err != nil {
+		return err
+	}
+	if err := manifest.write(tempDir); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	if err := writeIndex(tempDir, buildIndex(compose, manifest)); err != nil {
+		return fmt.Errorf("failed to write index: %w", err)
+	}
+	if err := b.updateBundleLock(tempDir, compose); err != nil {
+		return fmt.Errorf("failed to update %s: %w", lockfileName, err)
+	}
+	b.recordImages(manifest)
+	if err := b.embedRunReport(tempDir, outputFile); err != nil {
+		return fmt.Errorf("failed to write run report: %w", err)
+	}
+	if err := manifest.recordFiles(tempDir); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+
+	// Write to a temporary file first, the output may be the bundle itself
+	partial := outputFile + ".partial"
+	if err := b.createArchive(tempDir, partial, format); err != nil {
+		os.Remove(partial)
+		return fmt.Errorf("failed to create bundle: %w", err)
+	}
+	if err := os.Rename(partial, outputFile); err != nil {
+		return err
+	}
+	b.recordBundleStats(manifest, outputFile)
+	if err := b.splitAndProtect(outputFile); err != nil {
+		return err
+	}
+	if err := b.writeMedia(outputFile, manifest); err != nil {
+		return err
+	}
+	if err := b.writeVerifierImage(outputFile, manifest); err != nil {
+		return err
+	}
+	if err := b.writeChunkStore(outputFile, manifest); err != nil {
+		return err
+	}
+	if err := b.writeFleetManifest(outputFile, buildIndex(compose, manifest)); err != nil {
+		return err
+	}
+
+	b.printLintReport()
+	b.printPartialReport(manifest)
+
+	b.cleanupRetaggedImages()
+	if err := b.cleanupFreshlyPulledImages(); err != nil {
+		b.warnf("failed to cleanup some freshly pulled images: %v", err)
+	}
+	return nil
+}
+
+// updateBundleImages saves the given images into the bundle, skipping images
+// whose ID matches the copy already bundled
+func (b *Bundler) updateBundleImages(manifest *Manifest, bundleDir string, imageMap map[string]string) error {
+	if err := b.useBasePack(); err != nil {
+		return err
+	}
+	for imageName, tarFileName := range imageMap {
+		inspect, err := b.client.ImageInspect(b.ctx, imageName)
+		if err != nil {
+			return fmt.Errorf("failed to inspect image %s: %w", imageName, err)
+		}
+
+		existing := -1
+		for i, img := range manifest.Images {
+			if img.Name == imageName {
+				existing = i
+			}
+		}
+		if existing >= 0 && manifest.Images[existing].ID == inspect.ID {
+			b.decidef("Image %s is already bundled, skipping", imageName)
+			continue
+		}
+		if existing >= 0 {
+			os.Remove(filepath.Join(bundleDir, filepath.FromSlash(manifest.Images[existing].File)))
+			manifest.Images = append(manifest.Images[:existing], manifest.Images[existing+1:]...)
+		}
+
+		file := filepath.Join("images", tarFileName)
+		aliases := b.imageAliases(imageName, inspect)
+		if err := b.saveImage(imageName, aliases, filepath.Join(bundleDir, file)); err != nil {
+			return fmt.Errorf("failed to save image %s: %w", imageName, err)
+		}
+		if err := manifest.addImage(imageName, inspect, aliases, bundleDir, file); err != nil {
+			return fmt.Errorf("failed to record image %s: %w", imageName, err)
+		}
+		if err := b.omitBaseLayers(manifest, &manifest.Images[len(manifest.Images)-1], bundleDir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pruneBundleImages drops images no service of the bundle uses anymore
+func (b *Bundler) pruneBundleImages(manifest *Manifest, compose *DockerCompose, bundleDir string) {
+	used := make(map[string]bool)
+	for _, service := range compose.Services {
+		used[service.Image] = true
+	}
+
+	images := manifest.Images[:0]
+	for _, img := range manifest.Images {
+		if used[img.Name] {
+			images = append(images, img)
+			continue
+		}
+		b.decidef("Removing unused image %s from the bundle", img.Name)
+		os.Remove(filepath.Join(bundleDir, filepath.FromSlash(img.File)))
+	}
+	manifest.Images = images
+}
+
+// mergeTopLevel adds the top-level networks, volumes, secrets or configs of
+// an appended file, keeping the bundled definition on conflicts
+func mergeTopLevel(target *map[string]interface{}, extra map[string]interface{}) {
+	for name, value := range extra {
+		if *target == nil {
+			*target = make(map[string]interface{})
+		}
+		if existing, ok := (*target)[name]; ok {
+			if !reflect.DeepEqual(existing, value) {
+				fmt.Printf("Warning: keeping the bundled definition of %s\n", name)
+			}
+			continue
+		}
+		(*target)[name] = value
+	}
+}
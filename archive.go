@@ -0,0 +1,369 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"docker-compose-bundler/bundlefile"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Archive formats of a bundle
+const (
+	archiveTarGz  = bundlefile.FormatTarGz
+	archiveTarZst = bundlefile.FormatTarZst
+	archiveZip    = bundlefile.FormatZip
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// parseArchiveFormat validates an --archive-format value
+func parseArchiveFormat(format string) (string, error) {
+	switch format {
+	case archiveTarGz, archiveTarZst, archiveZip:
+		return format, nil
+	case "tgz":
+		return archiveTarGz, nil
+	case "tzst":
+		return archiveTarZst, nil
+	}
+	return "", fmt.Errorf("invalid archive format %q, use tar.gz, tar.zst or zip", format)
+}
+
+// archiveFormatOf derives the format from the name of an archive, tar.gz by default
+func archiveFormatOf(name string) string {
+	switch {
+	case strings.HasSuffix(name, ".zip"):
+		return archiveZip
+	case strings.HasSuffix(name, ".tar.zst"), strings.HasSuffix(name, ".tzst"):
+		return archiveTarZst
+	}
+	return archiveTarGz
+}
+
+// detectArchiveFile determines the format of the archive at path
+func detectArchiveFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	header := make([]byte, 4)
+	n, _ := io.ReadFull(file, header)
+	format, err := bundlefile.DetectFormat(header[:n])
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", path, err)
+	}
+	return format, nil
+}
+
+// bundleEntry is a file or directory of a bundle archive
+type bundleEntry = bundlefile.Entry
+
+// archiveWriter writes the entries of a bundle archive in one format
+type archiveWriter interface {
+	WriteEntry(entry bundleEntry, content io.Reader) error
+	Close() error
+}
+
+// archiveReader iterates over the entries of a bundle archive
+type archiveReader = bundlefile.Reader
+
+// newArchiveWriter creates a writer for format on top of w, Close does not close w
+func newArchiveWriter(w io.Writer, format string) (archiveWriter, error) {
+	switch format {
+	case archiveTarGz:
+		gzWriter := &gzipMembers{w: w, level: gzip.DefaultCompression, current: gzip.NewWriter(w)}
+		return &tarArchiveWriter{tw: tar.NewWriter(gzWriter), compressor: gzWriter, gzip: gzWriter}, nil
+	case archiveTarZst:
+		zstdWriter, err := zstd.NewWriter(w)
+		if err != nil {
+			return nil, err
+		}
+		return &tarArchiveWriter{tw: tar.NewWriter(zstdWriter), compressor: zstdWriter}, nil
+	case archiveZip:
+		return &zipArchiveWriter{zw: zip.NewWriter(w)}, nil
+	}
+	return nil, fmt.Errorf("unsupported archive format %q", format)
+}
+
+type tarArchiveWriter struct {
+	tw         *tar.Writer
+	compressor io.WriteCloser
+	gzip       *gzipMembers // Set for tar.gz, switches off compression for precompressed entries
+}
+
+func (t *tarArchiveWriter) WriteEntry(entry bundleEntry, content io.Reader) error {
+	header := &tar.Header{Name: entry.Name, Mode: entry.Mode, Size: entry.Size, ModTime: entry.ModTime, Typeflag: tar.TypeReg}
+	if entry.IsDir {
+		header.Name, header.Size, header.Typeflag = entry.Name+"/", 0, tar.TypeDir
+	}
+	if t.gzip != nil && !entry.IsDir {
+		// The padding of the previous entry belongs to the member it was written to
+		if err := t.tw.Flush(); err != nil {
+			return err
+		}
+		if err := t.gzip.setLevel(gzip.DefaultCompression); err != nil {
+			return err
+		}
+	}
+	if err := t.tw.WriteHeader(header); err != nil {
+		return err
+	}
+	if entry.IsDir {
+		return nil
+	}
+	if t.gzip != nil {
+		if strings.HasSuffix(entry.Name, ".tar") {
+			return t.copyTarFiles(content)
+		}
+		return t.copyCompressible(content, entry.Size)
+	}
+	_, err := io.Copy(t.tw, content)
+	return err
+}
+
+// copyCompressible copies size bytes of content into the current entry,
+// compressed only if they are worth it
+func (t *tarArchiveWriter) copyCompressible(content io.Reader, size int64) error {
+	content, compress := compressible(content, size)
+	level := gzip.DefaultCompression
+	if !compress {
+		level = gzip.NoCompression
+	}
+	if err := t.gzip.setLevel(level); err != nil {
+		return err
+	}
+	_, err := io.CopyN(t.tw, content, size)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// copyTarFiles copies an image tar into the current entry, deciding the
+// compression of every file inside it on its own: OCI layouts hold gzip or
+// zstd layer blobs next to small JSON files, legacy layouts uncompressed
+// layer tars. The bytes are copied as they are, a tar that cannot be
+// followed is compressed from there on.
+func (t *tarArchiveWriter) copyTarFiles(content io.Reader) error {
+	buffered := bufio.NewReaderSize(content, compressionSample)
+	block := make([]byte, 512)
+	for {
+		n, err := io.ReadFull(buffered, block)
+		if err := t.gzip.setLevel(gzip.DefaultCompression); err != nil {
+			return err
+		}
+		if _, err := t.tw.Write(block[:n]); err != nil {
+			return err
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		size, ok := tarBlockSize(block)
+		if !ok {
+			_, err := io.Copy(t.tw, buffered)
+			return err
+		}
+		// File data is padded to whole blocks
+		if err := t.copyCompressible(buffered, (size+511)&^511); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// tarBlockSize returns the size of the data following a tar header block,
+// zero for the end of archive blocks. It fails for blocks that are no header.
+func tarBlockSize(block []byte) (int64, bool) {
+	if bytes.Equal(block, make([]byte, len(block))) {
+		return 0, true
+	}
+	// Sizes of 8 GiB and more are base-256 encoded
+	field := block[124:136]
+	if field[0]&0x80 != 0 {
+		var size int64
+		for _, b := range field[1:] {
+			if size > math.MaxInt64>>8 {
+				return 0, false
+			}
+			size = size<<8 | int64(b)
+		}
+		return size, true
+	}
+	size, err := strconv.ParseInt(strings.TrimSpace(strings.TrimRight(string(field), "\x00")), 8, 64)
+	return size, err == nil && size >= 0
+}
+
+func (t *tarArchiveWriter) Close() error {
+	if err := t.tw.Close(); err != nil {
+		return err
+	}
+	return t.compressor.Close()
+}
+
+// zipArchiveWriter stores the mode of every entry in the Unix attributes of
+// the zip, which unzip and Info-ZIP based tools restore. Tools that ignore
+// them, e.g. the Windows Explorer, lose the executable bit of the scripts.
+type zipArchiveWriter struct {
+	zw *zip.Writer
+}
+
+func (z *zipArchiveWriter) WriteEntry(entry bundleEntry, content io.Reader) error {
+	header := &zip.FileHeader{Name: entry.Name, Method: zip.Deflate, Modified: entry.ModTime}
+	mode := os.FileMode(entry.Mode).Perm()
+	if entry.IsDir {
+		header.Name, header.Method = entry.Name+"/", zip.Store
+		mode |= os.ModeDir
+	}
+	header.SetMode(mode)
+	if !entry.IsDir {
+		var compress bool
+		if content, compress = compressible(content, entry.Size); !compress {
+			header.Method = zip.Store
+		}
+	}
+	w, err := z.zw.CreateHeader(header)
+	if err != nil || entry.IsDir {
+		return err
+	}
+	_, err = io.Copy(w, content)
+	return err
+}
+
+func (z *zipArchiveWriter) Close() error {
+	return z.zw.Close()
+}
+
+// compressionSample is the start of an entry compressed on trial to decide
+// whether compressing all of it pays off. Smaller entries are always compressed.
+const compressionSample = 1 << 20
+
+// compressible tells whether size bytes of content are worth compressing,
+// from a trial compression of their start. Another compression pass over
+// gzip or zstd layers costs a lot of CPU for next to nothing. It returns the
+// content to write instead of content.
+func compressible(content io.Reader, size int64) (io.Reader, bool) {
+	if size < compressionSample {
+		return content, true
+	}
+	buffered := bufio.NewReaderSize(content, compressionSample)
+	sample, _ := buffered.Peek(compressionSample)
+	var compressed countingWriter
+	fw, _ := flate.NewWriter(&compressed, flate.BestSpeed)
+	fw.Write(sample)
+	fw.Close()
+	// Less than 5% saved is not worth it
+	return buffered, compressed.n < int64(len(sample))*95/100
+}
+
+type countingWriter struct {
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
+
+// gzipMembers writes a gzip stream of one or more members, a new member
+// starts when the compression level changes. Readers decompress the members
+// as one stream.
+type gzipMembers struct {
+	w       io.Writer
+	level   int
+	current *gzip.Writer
+}
+
+func (g *gzipMembers) setLevel(level int) error {
+	if level == g.level {
+		return nil
+	}
+	if err := g.current.Close(); err != nil {
+		return err
+	}
+	current, err := gzip.NewWriterLevel(g.w, level)
+	if err != nil {
+		return err
+	}
+	g.current, g.level = current, level
+	return nil
+}
+
+func (g *gzipMembers) Write(p []byte) (int, error) {
+	return g.current.Write(p)
+}
+
+func (g *gzipMembers) Close() error {
+	return g.current.Close()
+}
+
+// extractBundle extracts a bundle archive of any format into dest
+func extractBundle(archive, dest string) error {
+	reader, _, err := bundlefile.OpenReader(archive)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	extractor, err := newExtractor(dest, 0)
+	if err != nil {
+		return err
+	}
+	defer extractor.Close()
+
+	for {
+		entry, content, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := extractor.extract(entry, content); err != nil {
+			return err
+		}
+	}
+}
+
+// addArchiveFile streams the file at path into the archive as name
+func addArchiveFile(w archiveWriter, name, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	entry := bundleEntry{Name: filepath.ToSlash(name), Mode: bundlefile.MemberMode(name, info.IsDir()), Size: info.Size(), ModTime: info.ModTime(), IsDir: info.IsDir()}
+	return w.WriteEntry(entry, file)
+}
+
+// writeArchiveFile writes data into the archive as name
+func writeArchiveFile(w archiveWriter, name string, data []byte) error {
+	entry := bundleEntry{Name: name, Mode: bundlefile.MemberMode(name, false), Size: int64(len(data)), ModTime: time.Now()}
+	return w.WriteEntry(entry, bytes.NewReader(data))
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/rand"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"docker-compose-bundler/bundlefile"
+)
+
+// ociImageTar returns an image tar with an incompressible layer blob first,
+// followed by an uncompressed layer and JSON files
+func ociImageTar(t *testing.T) []byte {
+	t.Helper()
+	compressed := make([]byte, 2<<20)
+	rand.Read(compressed)
+	files := [][2]string{
+		{"oci-layout", `{"imageLayoutVersion":"1.0.0"}`},
+		{"blobs/sha256/aaaa", string(compressed)},
+		{"blobs/sha256/bbbb", strings.Repeat("usr/share/doc/nginx/README ", 80000)},
+		{"index.json", `{"schemaVersion":2,"manifests":[]}`},
+	}
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, file := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: file[0], Mode: 0644, Size: int64(len(file[1])), ModTime: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(tw, file[1])
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestTarGzCompressesImageTarPerFile(t *testing.T) {
+	image := ociImageTar(t)
+	var out bytes.Buffer
+	w, err := newArchiveWriter(&out, archiveTarGz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeArchiveFile(w, "manifest.json", []byte(`{"name":"shop"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeArchiveFile(w, "images/app.tar", image); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The random blob is stored, the 2 MiB of text next to it are compressed
+	if size := out.Len(); size < 2<<20 || size > 2<<20+256<<10 {
+		t.Errorf("the bundle has %d bytes for a 2 MiB incompressible blob and 2 MiB of text", size)
+	}
+
+	reader, err := bundlefile.NewStreamReader(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	for {
+		entry, content, err := reader.Next()
+		if err == io.EOF {
+			t.Fatal("the image tar is missing")
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry.Name == "images/app.tar" {
+			data, err := io.ReadAll(content)
+			if err != nil || !bytes.Equal(data, image) {
+				t.Fatalf("the image tar changed (%d of %d bytes): %v", len(data), len(image), err)
+			}
+			return
+		}
+	}
+}
+
+func TestTarGzCopiesMalformedTarMembers(t *testing.T) {
+	// Not a tar despite its name, it is copied compressed as it is
+	data := []byte(strings.Repeat("not a tar header ", 1000))
+	var out bytes.Buffer
+	w, err := newArchiveWriter(&out, archiveTarGz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeArchiveFile(w, "images/broken.tar", data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	reader, err := bundlefile.NewStreamReader(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	_, content, err := reader.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := io.ReadAll(content); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("the member changed: %v", err)
+	}
+}
+
+func TestTarBlockSize(t *testing.T) {
+	header := func(size string) []byte {
+		block := make([]byte, 512)
+		copy(block, "layer.tar")
+		copy(block[124:], size)
+		return block
+	}
+	base256 := header("")
+	base256[124] = 0x80
+	base256[135] = 0x02
+
+	for _, test := range []struct {
+		name  string
+		block []byte
+		size  int64
+		ok    bool
+	}{
+		{"octal", header("00000001750\x00"), 1000, true},
+		{"octal with spaces", header("   1750 \x00"), 1000, true},
+		{"base-256", base256, 2, true},
+		{"end of archive", make([]byte, 512), 0, true},
+		{"no header", header("xyz"), 0, false},
+	} {
+		size, ok := tarBlockSize(test.block)
+		if size != test.size || ok != test.ok {
+			t.Errorf("%s: tarBlockSize = %d, %v, want %d, %v", test.name, size, ok, test.size, test.ok)
+		}
+	}
+}
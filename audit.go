@@ -0,0 +1,160 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"text/tabwriter"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+)
+
+// auditResult compares one container of the stack with the bundle
+type auditResult struct {
+	Service   string
+	Container string
+	Expected  string // Bundled image ID
+	Running   string // Image ID the container runs
+	Digest    string // Registry digest of the running image, if the daemon knows one
+	Status    string // ok, drift, missing, unknown or extra
+	Detail    string
+}
+
+// Audit compares the image of every container of the deployed stack with
+// the image bundled for its service, flagging drift like a manual docker pull
+func (l *Loader) Audit() ([]auditResult, error) {
+	lock, err := readLockfile(filepath.Join(l.dir, lockfileName))
+	if errors.Is(err, fs.ErrNotExist) {
+		lock = &Lockfile{} // Bundle created before lockfiles, the manifest IDs suffice
+	} else if err != nil {
+		return nil, err
+	}
+
+	containers, err := l.client.ContainerList(l.ctx, container.ListOptions{
+		All:     true,
+		Filters: filters.NewArgs(filters.Arg("label", composeProjectLabel+"="+l.manifest.ProjectName)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	byService := make(map[string][]container.Summary)
+	for _, c := range containers {
+		service := c.Labels[composeServiceLabel]
+		byService[service] = append(byService[service], c)
+	}
+
+	var results []auditResult
+	for _, serviceName := range sortedServiceNames(l.compose) {
+		imageName := l.compose.Services[serviceName].Image
+		expected := ""
+		for _, img := range l.manifest.Images {
+			if img.Name == imageName {
+				expected = img.ID
+			}
+		}
+		locked := lock.Services[serviceName]
+
+		if len(byService[serviceName]) == 0 {
+			results = append(results, auditResult{Service: serviceName, Expected: expected, Status: "missing", Detail: "no container"})
+			continue
+		}
+		for _, c := range byService[serviceName] {
+			result := auditResult{Service: serviceName, Container: containerName(c), Expected: expected, Running: c.ImageID}
+			var digests []string
+			if inspect, err := l.client.ImageInspect(l.ctx, c.ImageID); err == nil {
+				digests = inspect.RepoDigests
+			}
+			if len(digests) > 0 {
+				result.Digest = digests[0]
+			}
+
+			switch {
+			case expected == "":
+				result.Status, result.Detail = "unknown", "no image ID recorded in the bundle"
+			case c.ImageID == expected:
+				result.Status = "ok"
+			case locked.Digest != "" && slices.Contains(digests, locked.Digest):
+				result.Status, result.Detail = "ok", "matches the locked digest"
+			default:
+				result.Status = "drift"
+				result.Detail = fmt.Sprintf("runs %s instead of the bundled %s", shortID(c.ImageID), imageName)
+				if locked.Digest != "" {
+					result.Detail += ", locked " + locked.Digest
+				}
+			}
+			results = append(results, result)
+		}
+	}
+
+	extra := make(map[string]bool)
+	for service := range byService {
+		if _, ok := l.compose.Services[service]; !ok {
+			extra[service] = true
+		}
+	}
+	for _, service := range sortedSet(extra) {
+		for _, c := range byService[service] {
+			results = append(results, auditResult{Service: service, Container: containerName(c), Running: c.ImageID, Status: "extra", Detail: "service is not part of the bundle"})
+		}
+	}
+	return results, nil
+}
+
+func containerName(c container.Summary) string {
+	if len(c.Names) > 0 {
+		return c.Names[0][1:] // Names start with a slash
+	}
+	return shortID(c.ID)
+}
+
+func printAuditResults(results []auditResult) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SERVICE\tCONTAINER\tBUNDLED\tRUNNING\tSTATUS\tDETAIL")
+	for _, r := range results {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", r.Service, orDash(r.Container), orDash(shortID(r.Expected)), orDash(shortID(r.Running)), r.Status, r.Detail)
+	}
+	w.Flush()
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func runAudit(args []string) {
+	flags := flag.NewFlagSet("audit", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Println("Usage: docker-compose-bundler audit [bundle-dir]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	loader, err := NewLoader(bundleDirArg(flags))
+	if err != nil {
+		log.Fatal(err)
+	}
+	results, err := loader.Audit()
+	if err != nil {
+		log.Fatal(err)
+	}
+	printAuditResults(results)
+
+	drifted := 0
+	for _, r := range results {
+		if r.Status == "drift" || r.Status == "missing" {
+			drifted++
+		}
+	}
+	if drifted > 0 {
+		log.Fatalf("%d container(s) do not match the bundle", drifted)
+	}
+	fmt.Println("All containers run the bundled images")
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// BasePackRef identifies the base pack a bundle shares layers with
+type BasePackRef struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+// basePack is a bundle of common base images. Bundles created with
+// --base-pack leave out the layers they share with one of its images, the
+// Docker daemon skips layers it already has when loading an image.
+type basePack struct {
+	ref    BasePackRef
+	images []ManifestImage
+}
+
+// loadBasePack reads the manifest of a base pack bundle or bundle URL
+func loadBasePack(source string) (*basePack, error) {
+	manifest, _, err := openBundleMetadata(source)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read base pack %s: %w", source, err)
+	}
+	if manifest.BasePack != nil {
+		return nil, fmt.Errorf("%s uses the base pack %s %s itself and cannot be a base pack", source, manifest.BasePack.Name, manifest.BasePack.Version)
+	}
+	for _, img := range manifest.Images {
+		if len(img.Layers) == 0 {
+			return nil, fmt.Errorf("base pack %s does not record the layers of %s, bundle it again with this version", source, img.Name)
+		}
+	}
+	fmt.Printf("Using base pack %s %s with %d image(s)\n", manifest.Name, manifest.Version, len(manifest.Images))
+	return &basePack{ref: BasePackRef{Name: manifest.Name, Version: manifest.Version}, images: manifest.Images}, nil
+}
+
+// useBasePack reads the --base-pack bundle once
+func (b *Bundler) useBasePack() error {
+	if b.opts.BasePack == "" || b.basePack != nil {
+		return nil
+	}
+	pack, err := loadBasePack(b.opts.BasePack)
+	if err != nil {
+		return err
+	}
+	b.basePack = pack
+	return nil
+}
+
+// match returns the image of the pack sharing the most bottom layers with layers
+func (p *basePack) match(layers []string) (string, int) {
+	var best string
+	var shared int
+	for _, img := range p.images {
+		n := 0
+		for n < len(layers) && n < len(img.Layers) && layers[n] == img.Layers[n] {
+			n++
+		}
+		if n > shared {
+			best, shared = img.Name, n
+		}
+	}
+	return best, shared
+}
+
+// omitBaseLayers removes the layers img shares with the base pack from its tar
+func (b *Bundler) omitBaseLayers(manifest *Manifest, img *ManifestImage, bundleDir string) error {
+	if b.basePack == nil {
+		return nil
+	}
+	base, shared := b.basePack.match(img.Layers)
+	if shared == 0 {
+		return nil
+	}
+
+	if manifest.BasePack != nil && *manifest.BasePack != b.basePack.ref {
+		return fmt.Errorf("the bundle already uses the base pack %s %s, not %s %s", manifest.BasePack.Name, manifest.BasePack.Version, b.basePack.ref.Name, b.basePack.ref.Version)
+	}
+
+	tarPath := filepath.Join(bundleDir, filepath.FromSlash(img.File))
+	entries, err := scanImageTar(tarPath)
+	if err != nil {
+		return err
+	}
+	manifests, err := readSavedManifests(tarPath, entries)
+	if err != nil {
+		return err
+	}
+	omitted := make(map[string]bool)
+	for _, layer := range manifests[0].Layers[:shared] {
+		omitted[path.Clean(layer)] = true
+	}
+	// Kept entries are copied under their own name
+	keep := make(map[string]string)
+	for name := range entries {
+		if !omitted[name] {
+			keep[name] = name
+		}
+	}
+	if err := rewriteImageTar(tarPath, keep, nil); err != nil {
+		return fmt.Errorf("failed to omit the base layers of %s: %w", img.Name, err)
+	}
+
+	size, digest, err := fileDigest(tarPath)
+	if err != nil {
+		return err
+	}
+	b.decidef("Image %s shares %d of %d layer(s) with %s of the base pack, saved %s", img.Name, shared, len(img.Layers), base, formatBytes(img.Size-size))
+	img.Size, img.SHA256, img.Base, img.BaseLayers = size, digest, base, shared
+	manifest.BasePack = &b.basePack.ref
+	return nil
+}
+
+// CheckBasePack fails if images the bundle shares layers with are missing on
+// the target, their layers are not part of the bundle
+func (l *Loader) CheckBasePack() error {
+	pack := l.manifest.BasePack
+	if pack == nil {
+		return nil
+	}
+	var missing []string
+	for _, img := range l.manifest.Images {
+		if img.Base == "" || slices.Contains(missing, img.Base) {
+			continue
+		}
+		if _, err := l.client.ImageInspect(l.ctx, img.Base); err != nil {
+			missing = append(missing, img.Base)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("load the base pack %s %s first, this bundle leaves out the layers of %s", pack.Name, pack.Version, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// basePackSection tells in the bundle README which base pack to load first
+func basePackSection(c *catalog, pack *BasePackRef) string {
+	return c.t("readme.base_pack", pack.Name, pack.Version)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"docker-compose-bundler/dockerclient"
+)
+
+func TestBasePack(t *testing.T) {
+	source := dockerclient.NewFake()
+	source.AddImage("alpine:3.20").Layers = []string{"alpine rootfs"}
+	source.AddImage("shop/app:1.2.0").Layers = []string{"alpine rootfs", "app binary"}
+	basePackFile := bundleWith(t, source, Options{}, writeCompose(t, `services:
+  alpine:
+    image: alpine:3.20
+    command: ["true"]
+x-bundle:
+  name: base
+  version: 1.0.0
+`))
+	appCompose := writeCompose(t, `services:
+  app:
+    image: shop/app:1.2.0
+    command: ["/app"]
+x-bundle:
+  name: shop
+  version: 1.2.0
+`)
+	outputFile := bundleWith(t, source, Options{BasePack: basePackFile}, appCompose)
+
+	manifest, _, err := readBundleMetadata(outputFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.BasePack == nil || *manifest.BasePack != (BasePackRef{Name: "base", Version: "1.0.0"}) {
+		t.Fatalf("base pack %+v, want base 1.0.0", manifest.BasePack)
+	}
+	app := manifest.Images[0]
+	if app.Base != "alpine:3.20" || app.BaseLayers != 1 {
+		t.Errorf("app shares %d layer(s) with %q, want 1 with alpine:3.20", app.BaseLayers, app.Base)
+	}
+
+	// The target needs the base pack first, the app tar lacks its layer
+	target := dockerclient.NewFake()
+	_, err = LoadArchive(outputFile, filepath.Join(t.TempDir(), "shop"), target, 0)
+	if err == nil || !strings.Contains(err.Error(), "load the base pack base 1.0.0 first") {
+		t.Fatalf("LoadArchive error %v, want the missing base pack", err)
+	}
+	if _, err := LoadArchive(basePackFile, filepath.Join(t.TempDir(), "base"), target, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadArchive(outputFile, filepath.Join(t.TempDir(), "shop"), target, 0); err != nil {
+		t.Fatalf("LoadArchive after the base pack: %v", err)
+	}
+	loaded, err := target.ImageInspect(t.Context(), "shop/app:1.2.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, _ := source.ImageInspect(t.Context(), "shop/app:1.2.0"); loaded.ID != want.ID {
+		t.Errorf("app loaded as %s, want %s", loaded.ID, want.ID)
+	}
+}
+
+func TestBasePackMatch(t *testing.T) {
+	pack := &basePack{images: []ManifestImage{
+		{Name: "alpine:3.20", Layers: []string{"a"}},
+		{Name: "node:22", Layers: []string{"a", "n1", "n2"}},
+	}}
+	if name, shared := pack.match([]string{"a", "n1", "app"}); name != "node:22" || shared != 2 {
+		t.Errorf("match = %s, %d, want node:22 sharing 2 layers", name, shared)
+	}
+	if _, shared := pack.match([]string{"b"}); shared != 0 {
+		t.Errorf("an image without common layers shares %d", shared)
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/distribution/reference"
+)
+
+// SizeBudgets is x-bundle.budgets, sizes like 500M or 2G
+type SizeBudgets struct {
+	Image   string            `yaml:"image,omitempty"`   // Default maximum size of every image
+	Images  map[string]string `yaml:"images,omitempty"`  // Service, image or repository -> maximum size
+	Total   string            `yaml:"total,omitempty"`   // Maximum size of the compressed bundle
+	Enforce string            `yaml:"enforce,omitempty"` // "fail" (default) or "warn"
+}
+
+// sizeBudgets combines x-bundle.budgets with the command line flags, which take precedence
+func (b *Bundler) sizeBudgets(xBundle *XBundle) (SizeBudgets, error) {
+	var budgets SizeBudgets
+	if xBundle != nil && xBundle.Budgets != nil {
+		budgets = *xBundle.Budgets
+	}
+	if b.opts.MaxImageSize != "" {
+		budgets.Image = b.opts.MaxImageSize
+	}
+	if b.opts.MaxBundleSize != "" {
+		budgets.Total = b.opts.MaxBundleSize
+	}
+	if b.opts.WarnBudgets {
+		budgets.Enforce = "warn"
+	}
+	if budgets.Enforce != "" && budgets.Enforce != "fail" && budgets.Enforce != "warn" {
+		return budgets, fmt.Errorf("invalid budget enforcement %q, use fail or warn", budgets.Enforce)
+	}
+	return budgets, nil
+}
+
+// imageBudget returns the budget of a service's image in bytes, zero if there is none
+func (s SizeBudgets) imageBudget(serviceName, imageName string) (int64, error) {
+	budget, ok := s.Images[serviceName]
+	if !ok {
+		budget, ok = s.Images[imageName]
+	}
+	if named, err := reference.ParseNormalizedNamed(imageName); !ok && err == nil {
+		budget, ok = s.Images[reference.FamiliarName(named)]
+	}
+	if !ok {
+		budget = s.Image
+	}
+	if budget == "" {
+		return 0, nil
+	}
+	size, err := parseByteSize(budget)
+	if err != nil {
+		return 0, fmt.Errorf("invalid budget for %s: %w", serviceName, err)
+	}
+	return size, nil
+}
+
+// checkImageBudgets compares the size of every bundled image with its budget
+func (b *Bundler) checkImageBudgets(budgets SizeBudgets, compose *DockerCompose, imageMap map[string]string) error {
+	limits := make(map[string]int64)
+	for _, serviceName := range sortedServiceNames(compose) {
+		imageName := compose.Services[serviceName].Image
+		if _, ok := imageMap[imageName]; !ok {
+			continue
+		}
+		limit, err := budgets.imageBudget(serviceName, imageName)
+		if err != nil {
+			return err
+		}
+		// Services sharing an image get the tightest budget
+		if current, ok := limits[imageName]; limit > 0 && (!ok || limit < current) {
+			limits[imageName] = limit
+		}
+	}
+
+	names := make([]string, 0, len(limits))
+	for imageName := range limits {
+		names = append(names, imageName)
+	}
+	sort.Strings(names)
+
+	var violations []string
+	for _, imageName := range names {
+		inspect, err := b.client.ImageInspect(b.ctx, imageName)
+		if err != nil {
+			return fmt.Errorf("failed to inspect image %s: %w", imageName, err)
+		}
+		if inspect.Size <= limits[imageName] {
+			continue
+		}
+		violation := fmt.Sprintf("image %s is %s, its budget is %s", imageName, formatBytes(inspect.Size), formatBytes(limits[imageName]))
+		if breakdown, err := b.layerBreakdown(imageName); err == nil {
+			violation += "\n" + breakdown
+		}
+		violations = append(violations, violation)
+	}
+	return b.reportBudgetViolations(budgets, violations)
+}
+
+// layerBreakdown lists the largest layers of an image with the instruction that created them
+func (b *Bundler) layerBreakdown(imageName string) (string, error) {
+	history, err := b.client.ImageHistory(b.ctx, imageName)
+	if err != nil {
+		return "", err
+	}
+	sort.SliceStable(history, func(i, j int) bool { return history[i].Size > history[j].Size })
+
+	var sb strings.Builder
+	sb.WriteString("    largest layers:")
+	for i, layer := range history {
+		if i == 5 || layer.Size == 0 {
+			break
+		}
+		createdBy := strings.TrimPrefix(layer.CreatedBy, "/bin/sh -c ")
+		createdBy = strings.TrimSpace(strings.TrimPrefix(createdBy, "#(nop)"))
+		if len(createdBy) > 80 {
+			createdBy = createdBy[:77] + "..."
+		}
+		fmt.Fprintf(&sb, "\n    %10s  %s", formatBytes(layer.Size), createdBy)
+	}
+	return sb.String(), nil
+}
+
+// checkBundleBudget compares the size of the written archive with the total
+// budget, the archive is removed if the budget is enforced
+func (b *Bundler) checkBundleBudget(budgets SizeBudgets, outputFile string, manifest *Manifest) error {
+	if budgets.Total == "" {
+		return nil
+	}
+	limit, err := parseByteSize(budgets.Total)
+	if err != nil {
+		return fmt.Errorf("invalid total budget: %w", err)
+	}
+	info, err := os.Stat(outputFile)
+	if err != nil {
+		return err
+	}
+	if info.Size() <= limit {
+		return nil
+	}
+
+	images := append([]ManifestImage(nil), manifest.Images...)
+	sort.SliceStable(images, func(i, j int) bool { return images[i].Size > images[j].Size })
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "bundle is %s, its budget is %s\n    images (uncompressed):", formatBytes(info.Size()), formatBytes(limit))
+	for _, img := range images {
+		fmt.Fprintf(&sb, "\n    %10s  %s", formatBytes(img.Size), img.Name)
+	}
+
+	err = b.reportBudgetViolations(budgets, []string{sb.String()})
+	if err != nil {
+		os.Remove(outputFile)
+	}
+	return err
+}
+
+// reportBudgetViolations prints violations as warnings or turns them into an error
+func (b *Bundler) reportBudgetViolations(budgets SizeBudgets, violations []string) error {
+	if len(violations) == 0 {
+		return nil
+	}
+	if budgets.Enforce == "warn" {
+		for _, violation := range violations {
+			b.warnf("size budget exceeded: %s", violation)
+		}
+		return nil
+	}
+	return fmt.Errorf("%d size budget(s) exceeded:\n  %s", len(violations), strings.Join(violations, "\n  "))
+}
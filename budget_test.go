@@ -0,0 +1,61 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"docker-compose-bundler/dockerclient"
+)
+
+func TestImageBudget(t *testing.T) {
+	budgets := SizeBudgets{Image: "1G", Images: map[string]string{"web": "100M", "redis": "50M"}}
+	tests := []struct {
+		service, image string
+		want           int64
+	}{
+		{"web", "nginx:1.27", 100 << 20},
+		{"cache", "redis:7", 50 << 20}, // Repository without tag
+		{"db", "postgres:16", 1 << 30},
+	}
+	for _, tt := range tests {
+		got, err := budgets.imageBudget(tt.service, tt.image)
+		if err != nil || got != tt.want {
+			t.Errorf("imageBudget(%s, %s) = %d, %v, want %d", tt.service, tt.image, got, err, tt.want)
+		}
+	}
+}
+
+func TestBundleEnforcesImageBudgets(t *testing.T) {
+	compose := strings.Replace(webCompose, "  version: 1.2.0\n", "  version: 1.2.0\n  budgets:\n    images:\n      web: 512K\n", 1)
+	fake := dockerclient.NewFake()
+	fake.AddImage("nginx:1.27") // 1 MiB
+	fake.AddImage("redis:7")
+
+	outputFile := filepath.Join(t.TempDir(), "bundle.tar.gz")
+	err := NewBundlerWithClient(Options{VersionScheme: VersionSchemeSemver}, fake).Bundle(writeCompose(t, compose), outputFile)
+	if err == nil || !strings.Contains(err.Error(), "image nginx:1.27 is 1.0 MiB") || !strings.Contains(err.Error(), "largest layers") {
+		t.Fatalf("Bundle error %v, want the nginx budget with its layers", err)
+	}
+	if _, statErr := os.Stat(outputFile); !os.IsNotExist(statErr) {
+		t.Error("a bundle over budget was written")
+	}
+
+	bundleWith(t, fake, Options{WarnBudgets: true}, writeCompose(t, compose))
+}
+
+func TestBundleEnforcesTotalBudget(t *testing.T) {
+	fake := dockerclient.NewFake()
+	fake.AddImage("nginx:1.27")
+	fake.AddImage("redis:7")
+
+	outputFile := filepath.Join(t.TempDir(), "bundle.tar.gz")
+	err := NewBundlerWithClient(Options{VersionScheme: VersionSchemeSemver, MaxBundleSize: "100"}, fake).Bundle(writeCompose(t, webCompose), outputFile)
+	if err == nil || !strings.Contains(err.Error(), "its budget is 100 B") {
+		t.Fatalf("Bundle error %v, want the total budget", err)
+	}
+	if _, statErr := os.Stat(outputFile); !os.IsNotExist(statErr) {
+		t.Error("a bundle over budget was kept")
+	}
+}
@@ -8,7 +8,7 @@ echo "Building docker-compose-bundler..."
 go mod download
 
 # Build the binary
-go build -o docker-compose-bundler main.go
+go build -o docker-compose-bundler .
 
 if [ $? -eq 0 ]; then
     echo "Build successful! Binary created: docker-compose-bundler"
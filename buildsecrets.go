@@ -0,0 +1,382 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+// Sources of build secrets
+const (
+	secretSourceEnv   = "env"
+	secretSourceFile  = "file"
+	secretSourceVault = "vault"
+)
+
+// buildSecret is a BuildKit secret builds can mount with RUN --mount=type=secret.
+// The value is read when a build first needs it and never written anywhere.
+type buildSecret struct {
+	id       string
+	source   string // env, file or vault
+	ref      string // Variable, path or Vault path[#field]
+	fromFlag bool   // Given with --build-secret, mounted into builds that declare no secrets
+	value    []byte
+	loaded   bool
+}
+
+// parseBuildSecrets collects the --build-secret flags and the top-level
+// secrets of the compose file with a file or environment source. Flags win
+// over compose secrets of the same name.
+func parseBuildSecrets(flags []string, declared map[string]interface{}, baseDir string) (map[string]*buildSecret, error) {
+	secrets := make(map[string]*buildSecret)
+	for name, definition := range declared {
+		config, _ := definition.(map[string]interface{})
+		if file, ok := config["file"].(string); ok {
+			if !filepath.IsAbs(file) {
+				file = filepath.Join(baseDir, file)
+			}
+			secrets[name] = &buildSecret{id: name, source: secretSourceFile, ref: file}
+		} else if variable, ok := config["environment"].(string); ok {
+			secrets[name] = &buildSecret{id: name, source: secretSourceEnv, ref: variable}
+		}
+	}
+
+	for _, spec := range flags {
+		secret := &buildSecret{fromFlag: true}
+		for _, field := range strings.Split(spec, ",") {
+			key, value, _ := strings.Cut(field, "=")
+			switch key {
+			case "id":
+				secret.id = value
+			case "env":
+				secret.source, secret.ref = secretSourceEnv, value
+			case "src", "source", "file":
+				secret.source, secret.ref = secretSourceFile, value
+			case "vault":
+				secret.source, secret.ref = secretSourceVault, value
+			default:
+				return nil, fmt.Errorf("invalid --build-secret %q: unknown field %q", spec, key)
+			}
+		}
+		if secret.id == "" || secret.source == "" || secret.ref == "" {
+			return nil, fmt.Errorf("invalid --build-secret %q, use id=<id> with env=<variable>, src=<file> or vault=<path>[#field]", spec)
+		}
+		secrets[secret.id] = secret
+	}
+	return secrets, nil
+}
+
+// read returns the value of the secret, fetching it on first use
+func (s *buildSecret) read() ([]byte, error) {
+	if s.loaded {
+		return s.value, nil
+	}
+	var err error
+	switch s.source {
+	case secretSourceEnv:
+		value, ok := os.LookupEnv(s.ref)
+		if !ok {
+			return nil, fmt.Errorf("build secret %s: environment variable %s is not set", s.id, s.ref)
+		}
+		s.value = []byte(value)
+	case secretSourceFile:
+		if s.value, err = os.ReadFile(s.ref); err != nil {
+			return nil, fmt.Errorf("failed to read build secret %s: %w", s.id, err)
+		}
+	case secretSourceVault:
+		if s.value, err = readVaultSecret(s.ref); err != nil {
+			return nil, fmt.Errorf("failed to read build secret %s from Vault: %w", s.id, err)
+		}
+	}
+	s.loaded = true
+	return s.value, nil
+}
+
+// secretsForBuild returns the secrets of a build by the ID the Dockerfile
+// mounts them with: those listed in build.secrets, or every --build-secret
+// if the service lists none
+func (b *Bundler) secretsForBuild(config *BuildConfig) (map[string][]byte, []string, error) {
+	type mount struct{ source, target string }
+	var mounts []mount
+	if refs, ok := config.Extra["secrets"].([]interface{}); ok {
+		for _, ref := range refs {
+			switch v := ref.(type) {
+			case string:
+				mounts = append(mounts, mount{v, v})
+			case map[string]interface{}:
+				source, _ := v["source"].(string)
+				target, _ := v["target"].(string)
+				if target == "" {
+					target = source
+				}
+				mounts = append(mounts, mount{source, target})
+			}
+		}
+	} else {
+		for id, secret := range b.buildSecrets {
+			if secret.fromFlag {
+				mounts = append(mounts, mount{id, id})
+			}
+		}
+	}
+
+	secrets := make(map[string][]byte)
+	var ids []string
+	for _, m := range mounts {
+		secret, ok := b.buildSecrets[m.source]
+		if !ok {
+			return nil, nil, fmt.Errorf("build secret %s is neither a file or environment secret of the compose file nor given with --build-secret", m.source)
+		}
+		value, err := secret.read()
+		if err != nil {
+			return nil, nil, err
+		}
+		secrets[m.target] = value
+		ids = append(ids, m.target)
+	}
+	slices.Sort(ids)
+	return secrets, ids, nil
+}
+
+// readVaultSecret reads a field of a Vault secret through the HTTP API, with
+// the address and token from VAULT_ADDR and VAULT_TOKEN (or ~/.vault-token).
+// ref is the API path, e.g. secret/data/ci/npm for a KV v2 engine, followed
+// by #field unless the secret has a single field.
+func readVaultSecret(ref string) ([]byte, error) {
+	secretPath, field, _ := strings.Cut(ref, "#")
+	addr := os.Getenv("VAULT_ADDR")
+	if addr == "" {
+		return nil, fmt.Errorf("VAULT_ADDR is not set")
+	}
+	token := os.Getenv("VAULT_TOKEN")
+	if token == "" {
+		if home, err := os.UserHomeDir(); err == nil {
+			data, _ := os.ReadFile(filepath.Join(home, ".vault-token"))
+			token = strings.TrimSpace(string(data))
+		}
+	}
+	if token == "" {
+		return nil, fmt.Errorf("VAULT_TOKEN is not set")
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if caFile := os.Getenv("VAULT_CACERT"); caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read VAULT_CACERT: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in VAULT_CACERT %s", caFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(addr, "/")+"/v1/"+strings.TrimPrefix(secretPath, "/"), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	if namespace := os.Getenv("VAULT_NAMESPACE"); namespace != "" {
+		req.Header.Set("X-Vault-Namespace", namespace)
+	}
+	resp, err := (&http.Client{Timeout: 30 * time.Second, Transport: transport}).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", secretPath, resp.Status)
+	}
+
+	var body struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&body); err != nil {
+		return nil, fmt.Errorf("invalid response for %s: %w", secretPath, err)
+	}
+	data := body.Data
+	// KV v2 nests the fields next to the version metadata
+	if nested, ok := data["data"].(map[string]interface{}); ok && data["metadata"] != nil {
+		data = nested
+	}
+	if field == "" {
+		if len(data) != 1 {
+			return nil, fmt.Errorf("%s has %d fields (%s), select one with #field", secretPath, len(data), strings.Join(slices.Sorted(maps.Keys(data)), ", "))
+		}
+		for name := range data {
+			field = name
+		}
+	}
+	value, ok := data[field].(string)
+	if !ok {
+		return nil, fmt.Errorf("%s has no string field %s", secretPath, field)
+	}
+	return []byte(value), nil
+}
+
+// Headers of the BuildKit session protocol on POST /session
+const (
+	headerSessionID        = "X-Docker-Expose-Session-Uuid"
+	headerSessionName      = "X-Docker-Expose-Session-Name"
+	headerSessionSharedKey = "X-Docker-Expose-Session-Sharedkey"
+	headerSessionMethod    = "X-Docker-Expose-Session-Grpc-Method"
+)
+
+// startBuildSession offers the secrets to BuildKit over a session on the
+// daemon connection, as docker build --secret does. It returns the session
+// ID for the build and a function ending the session.
+func (b *Bundler) startBuildSession(secrets map[string][]byte) (string, func(), error) {
+	id := make([]byte, 16)
+	rand.Read(id)
+	sessionID := hex.EncodeToString(id)
+
+	server := grpc.NewServer(grpc.ForceServerCodec(sessionCodec{}))
+	healthServer := health.NewServer()
+	healthServer.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
+	healthpb.RegisterHealthServer(server, healthServer)
+	server.RegisterService(&secretsServiceDesc, &secretsService{secrets: secrets})
+
+	meta := map[string][]string{
+		headerSessionID:        {sessionID},
+		headerSessionName:      {"docker-compose-bundler"},
+		headerSessionSharedKey: {sessionID},
+	}
+	for name, service := range server.GetServiceInfo() {
+		for _, method := range service.Methods {
+			meta[headerSessionMethod] = append(meta[headerSessionMethod], "/"+name+"/"+method.Name)
+		}
+	}
+	conn, err := b.client.DialHijack(b.ctx, "/session", "h2c", meta)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to start BuildKit session: %w", daemonError(err))
+	}
+	go (&http2.Server{}).ServeConn(conn, &http2.ServeConnOpts{Context: b.ctx, Handler: server})
+	return sessionID, func() {
+		conn.Close()
+		server.Stop()
+	}, nil
+}
+
+// secretsService implements moby.buildkit.secrets.v1.Secrets
+type secretsService struct {
+	secrets map[string][]byte
+}
+
+type secretsServer interface {
+	getSecret(id string) ([]byte, error)
+}
+
+func (s *secretsService) getSecret(id string) ([]byte, error) {
+	value, ok := s.secrets[id]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "secret %s not found", id)
+	}
+	return value, nil
+}
+
+var secretsServiceDesc = grpc.ServiceDesc{
+	ServiceName: "moby.buildkit.secrets.v1.Secrets",
+	HandlerType: (*secretsServer)(nil),
+	Methods: []grpc.MethodDesc{{
+		MethodName: "GetSecret",
+		Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, _ grpc.UnaryServerInterceptor) (interface{}, error) {
+			var req getSecretRequest
+			if err := dec(&req); err != nil {
+				return nil, err
+			}
+			data, err := srv.(secretsServer).getSecret(req.ID)
+			if err != nil {
+				return nil, err
+			}
+			return &getSecretResponse{Data: data}, nil
+		},
+	}},
+	Metadata: "secrets.proto",
+}
+
+// getSecretRequest is the GetSecretRequest message, the annotations are not used
+type getSecretRequest struct {
+	ID string
+}
+
+func (r *getSecretRequest) unmarshal(data []byte) error {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+		if num == 1 && typ == protowire.BytesType {
+			value, n := protowire.ConsumeBytes(data)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			r.ID = string(value)
+			data = data[n:]
+			continue
+		}
+		if n = protowire.ConsumeFieldValue(num, typ, data); n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+// getSecretResponse is the GetSecretResponse message
+type getSecretResponse struct {
+	Data []byte
+}
+
+func (r *getSecretResponse) marshal() []byte {
+	return protowire.AppendBytes(protowire.AppendTag(nil, 1, protowire.BytesType), r.Data)
+}
+
+// sessionCodec encodes the generated health messages with protobuf and the
+// secrets messages by hand, the bundler does not depend on BuildKit
+type sessionCodec struct{}
+
+func (sessionCodec) Marshal(v interface{}) ([]byte, error) {
+	switch m := v.(type) {
+	case proto.Message:
+		return proto.Marshal(m)
+	case *getSecretResponse:
+		return m.marshal(), nil
+	}
+	return nil, fmt.Errorf("cannot encode %T", v)
+}
+
+func (sessionCodec) Unmarshal(data []byte, v interface{}) error {
+	switch m := v.(type) {
+	case proto.Message:
+		return proto.Unmarshal(data, m)
+	case *getSecretRequest:
+		return m.unmarshal(data)
+	}
+	return fmt.Errorf("cannot decode %T", v)
+}
+
+func (sessionCodec) Name() string {
+	return "proto"
+}
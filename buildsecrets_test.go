@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"docker-compose-bundler/dockerclient"
+)
+
+// rawCodec passes protobuf messages encoded by the test through
+type rawCodec struct{}
+
+func (rawCodec) Marshal(v interface{}) ([]byte, error) { return *v.(*[]byte), nil }
+func (rawCodec) Unmarshal(data []byte, v interface{}) error {
+	*v.(*[]byte) = append([]byte(nil), data...)
+	return nil
+}
+func (rawCodec) Name() string { return "proto" }
+
+// sessionClient is the daemon end of a session, over which BuildKit asks for secrets
+func sessionClient(t *testing.T, conn net.Conn) *grpc.ClientConn {
+	t.Helper()
+	client, err := grpc.NewClient("passthrough:///session",
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) { return conn, nil }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(rawCodec{})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// getSecret asks the session like BuildKit does when a build mounts a secret
+func getSecret(t *testing.T, client *grpc.ClientConn, id string) ([]byte, error) {
+	t.Helper()
+	req := protowire.AppendString(protowire.AppendTag(nil, 1, protowire.BytesType), id)
+	var resp []byte
+	if err := client.Invoke(t.Context(), "/moby.buildkit.secrets.v1.Secrets/GetSecret", &req, &resp); err != nil {
+		return nil, err
+	}
+	_, _, n := protowire.ConsumeTag(resp)
+	value, _ := protowire.ConsumeBytes(resp[n:])
+	return value, nil
+}
+
+func TestBuildSessionServesSecrets(t *testing.T) {
+	fake := dockerclient.NewFake()
+	b := NewBundlerWithClient(Options{}, fake)
+	sessionID, stop, err := b.startBuildSession(map[string][]byte{"npm": []byte("s3cr3t")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+
+	session := fake.Sessions[0]
+	if session.Meta[headerSessionID][0] != sessionID || !slices.Contains(session.Meta[headerSessionMethod], "/moby.buildkit.secrets.v1.Secrets/GetSecret") {
+		t.Errorf("session headers %v", session.Meta)
+	}
+	client := sessionClient(t, session.Conn)
+	value, err := getSecret(t, client, "npm")
+	if err != nil || string(value) != "s3cr3t" {
+		t.Errorf("GetSecret(npm) = %q, %v", value, err)
+	}
+	if _, err := getSecret(t, client, "other"); err == nil || !strings.Contains(err.Error(), "secret other not found") {
+		t.Errorf("GetSecret(other) error %v, want not found", err)
+	}
+}
+
+func TestBundleBuildsWithSecrets(t *testing.T) {
+	composeFile := writeCompose(t, `services:
+  app:
+    image: shop/app:1.2.0
+    build:
+      context: .
+      secrets:
+        - npm
+        - source: cert
+          target: ca.pem
+    command: ["/app"]
+secrets:
+  npm:
+    environment: NPM_TOKEN
+  cert:
+    file: ./ca.pem
+x-bundle:
+  name: shop
+  version: 1.2.0
+`)
+	dir := filepath.Dir(composeFile)
+	if err := os.WriteFile(filepath.Join(dir, "Dockerfile"), []byte("FROM scratch\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "ca.pem"), []byte("certificate"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("NPM_TOKEN", "s3cr3t")
+
+	fake := dockerclient.NewFake()
+	outputFile := bundleWith(t, fake, Options{}, composeFile)
+	if len(fake.BuildKit) != 1 || len(fake.Sessions) != 1 {
+		t.Fatalf("built %v with %d session(s), want one BuildKit build with a session", fake.BuildKit, len(fake.Sessions))
+	}
+	manifest, _, err := readBundleMetadata(outputFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Builds) != 1 || !slices.Equal(manifest.Builds[0].Secrets, []string{"ca.pem", "npm"}) {
+		t.Errorf("recorded builds %+v, want the secret IDs ca.pem and npm", manifest.Builds)
+	}
+}
+
+func TestParseBuildSecrets(t *testing.T) {
+	secrets, err := parseBuildSecrets([]string{"id=npm,env=NPM_TOKEN", "id=key,src=/run/key"}, map[string]interface{}{
+		"npm": map[string]interface{}{"file": "npm.txt"},
+		"tls": map[string]interface{}{"external": true},
+	}, "/compose")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if npm := secrets["npm"]; npm.source != secretSourceEnv || !npm.fromFlag {
+		t.Errorf("npm is %+v, the flag has to win over the compose secret", npm)
+	}
+	if _, ok := secrets["tls"]; ok {
+		t.Error("an external compose secret was offered to builds")
+	}
+	if _, err := parseBuildSecrets([]string{"id=npm"}, nil, "."); err == nil {
+		t.Error("a secret without source was accepted")
+	}
+}
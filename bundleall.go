@@ -0,0 +1,261 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"docker-compose-bundler/composetransform"
+)
+
+// sharedImages coordinates the bundlers of a bundle-all run that share one
+// Docker daemon: an image is pulled once, and the images and tags a bundle
+// created are only removed after every bundle is done with them
+type sharedImages struct {
+	mu       sync.Mutex
+	locks    map[string]*sync.Mutex // Held while an image is pulled
+	pulled   map[string]bool        // Images pulled during this run
+	fresh    map[string]bool        // Freshly pulled images to remove at the end
+	retagged map[string]bool        // --retag-prefix tags to remove at the end
+}
+
+func newSharedImages() *sharedImages {
+	return &sharedImages{
+		locks:    make(map[string]*sync.Mutex),
+		pulled:   make(map[string]bool),
+		fresh:    make(map[string]bool),
+		retagged: make(map[string]bool),
+	}
+}
+
+// lock serializes pulls of imageName and returns the unlock function
+func (s *sharedImages) lock(imageName string) func() {
+	s.mu.Lock()
+	l, ok := s.locks[imageName]
+	if !ok {
+		l = &sync.Mutex{}
+		s.locks[imageName] = l
+	}
+	s.mu.Unlock()
+	l.Lock()
+	return l.Unlock
+}
+
+func (s *sharedImages) markPulled(imageName string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pulled[imageName] = true
+}
+
+func (s *sharedImages) wasPulled(imageName string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.pulled[imageName]
+}
+
+// keep takes over images and tags a bundler would remove when it finishes
+func (s *sharedImages) keep(images, tags map[string]bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for imageName := range images {
+		s.fresh[imageName] = true
+		delete(images, imageName)
+	}
+	for tag := range tags {
+		s.retagged[tag] = true
+		delete(tags, tag)
+	}
+}
+
+// cleanup removes what the bundlers of the run left behind
+func (s *sharedImages) cleanup(cli DockerClient, opts Options) {
+	b := NewBundlerWithClient(opts, cli)
+	b.retaggedImages, b.freshlyPulledImages = s.retagged, s.fresh
+	b.cleanupRetaggedImages()
+	if err := b.cleanupFreshlyPulledImages(); err != nil {
+		fmt.Printf("Warning: failed to cleanup some images: %v\n", err)
+	}
+}
+
+// bundleJob is one compose file of a bundle-all run
+type bundleJob struct {
+	ComposeFile string
+	OutputFile  string
+	Duration    time.Duration
+	Stats       bundleStats
+	Err         error
+}
+
+// bundleOutputs names every bundle after the directory of its compose file
+func bundleOutputs(composeFiles []string, outputDir, format string) ([]*bundleJob, error) {
+	jobs := make([]*bundleJob, 0, len(composeFiles))
+	seen := make(map[string]string)
+	for _, composeFile := range composeFiles {
+		abs, err := filepath.Abs(composeFile)
+		if err != nil {
+			return nil, err
+		}
+		name := filepath.Base(filepath.Dir(abs))
+		if other, ok := seen[name]; ok {
+			return nil, fmt.Errorf("%s and %s would both be bundled as %s.%s", other, composeFile, name, format)
+		}
+		seen[name] = composeFile
+		jobs = append(jobs, &bundleJob{ComposeFile: composeFile, OutputFile: filepath.Join(outputDir, name+"."+format)})
+	}
+	return jobs, nil
+}
+
+// BundleAll bundles every job with up to parallel bundlers at a time that
+// share the Docker client and its images. Failed bundles do not stop the others.
+func BundleAll(jobs []*bundleJob, opts Options, cli DockerClient, parallel int) {
+	shared := newSharedImages()
+	sem := make(chan struct{}, max(parallel, 1))
+	var wg sync.WaitGroup
+	for _, job := range jobs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			jobOpts := opts
+			jobOpts.RunReport = strings.TrimSuffix(job.OutputFile, "."+archiveFormatOf(job.OutputFile)) + "." + runReportName
+			b := NewBundlerWithClient(jobOpts, cli)
+			b.shared = shared
+			start := time.Now()
+			job.Err = b.Bundle(job.ComposeFile, job.OutputFile)
+			job.Duration = time.Since(start)
+			if err := b.writeRunReport(job.OutputFile, job.Err); err != nil {
+				fmt.Printf("Warning: %s: %v\n", job.ComposeFile, err)
+			}
+			job.Stats = b.stats
+			if job.Err != nil {
+				// Bundle only cleans up after success, keep the run's images consistent
+				shared.keep(b.freshlyPulledImages, b.retaggedImages)
+			}
+		}()
+	}
+	wg.Wait()
+	shared.cleanup(cli, opts)
+}
+
+func printBundleAllReport(jobs []*bundleJob) {
+	sorted := append([]*bundleJob(nil), jobs...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].ComposeFile < sorted[j].ComposeFile })
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "COMPOSE FILE\tBUNDLE\tVERSION\tIMAGES\tSIZE\tDURATION\tSTATUS")
+	for _, job := range sorted {
+		status := "ok"
+		if job.Err != nil {
+			status = "failed"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\t%s\n", job.ComposeFile, job.OutputFile, orDash(job.Stats.Version),
+			job.Stats.Images, formatBytes(job.Stats.BundleBytes), job.Duration.Round(time.Second), status)
+	}
+	w.Flush()
+	for _, job := range sorted {
+		if job.Err != nil {
+			fmt.Printf("\n%s: %v\n", job.ComposeFile, job.Err)
+		}
+	}
+}
+
+func runBundleAll(args []string) {
+	var opts Options
+	flags := flag.NewFlagSet("bundle-all", flag.ExitOnError)
+	registerBundleFlags(flags, &opts)
+	parallel := flags.Int("parallel", 1, "Number of bundles created at the same time")
+	outputDir := flags.String("output-dir", ".", "`directory` the bundles are written to, each named after the directory of its compose file")
+	flags.Usage = func() {
+		fmt.Println("Usage: docker-compose-bundler bundle-all [flags] <docker-compose.yml>...")
+		fmt.Println("Example: docker-compose-bundler bundle-all --parallel 3 ./deployments/*/docker-compose.yml")
+		flags.PrintDefaults()
+	}
+
+	// Flags may follow the compose files, e.g. after a shell glob
+	var composeFiles []string
+	for {
+		flags.Parse(args)
+		if flags.NArg() == 0 {
+			break
+		}
+		composeFiles = append(composeFiles, flags.Arg(0))
+		args = flags.Args()[1:]
+	}
+	if len(composeFiles) == 0 {
+		flags.Usage()
+		os.Exit(1)
+	}
+	if opts.ShowComposeDiff {
+		log.Fatal("--show-compose-diff is not supported by bundle-all")
+	}
+	if opts.RunReport != "" {
+		log.Fatal("--run-report is not supported by bundle-all, the reports are written next to the bundles")
+	}
+	if opts.FleetManifest != "" {
+		log.Fatal("--fleet-manifest is not supported by bundle-all, write one per bundle with bundle")
+	}
+	opts.Flags = givenFlags(flags)
+	format := archiveTarGz
+	if opts.ArchiveFormat != "" {
+		var err error
+		if format, err = parseArchiveFormat(opts.ArchiveFormat); err != nil {
+			log.Fatal(err)
+		}
+		opts.ArchiveFormat = format
+	}
+	if _, err := parseSaveCompat(opts.SaveCompat); err != nil {
+		log.Fatal(err)
+	}
+	if _, err := parseLanguages(opts.Languages); err != nil {
+		log.Fatal(err)
+	}
+	if _, err := parseOutputFormat(opts.OutputFormat); err != nil {
+		log.Fatal(err)
+	}
+	if _, err := parseTagConflict(opts.TagConflict); err != nil {
+		log.Fatal(err)
+	}
+	if _, err := composetransform.ParseExtensionPolicy(opts.Extensions); err != nil {
+		log.Fatal(err)
+	}
+	if err := checkComposePlugins(opts.ComposePlugins); err != nil {
+		log.Fatal(err)
+	}
+
+	jobs, err := bundleOutputs(composeFiles, *outputDir, format)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.MkdirAll(*outputDir, 0755); err != nil {
+		log.Fatal(err)
+	}
+
+	err = withTracing(func() error {
+		BundleAll(jobs, opts, &lazyDockerClient{}, *parallel)
+		return nil
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println()
+	printBundleAllReport(jobs)
+
+	var failed []string
+	for _, job := range jobs {
+		if job.Err != nil {
+			failed = append(failed, job.ComposeFile)
+		}
+	}
+	if len(failed) > 0 {
+		log.Fatalf("%d of %d bundle(s) failed: %s", len(failed), len(jobs), strings.Join(failed, ", "))
+	}
+}
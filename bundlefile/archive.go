@@ -0,0 +1,367 @@
+package bundlefile
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Archive formats of a bundle
+const (
+	FormatDirectory = "dir" // An extracted bundle
+	FormatTarGz     = "tar.gz"
+	FormatTarZst    = "tar.zst"
+	FormatZip       = "zip"
+)
+
+var splitPartPattern = regexp.MustCompile(`\.\d{3}$`)
+
+// Entry is a file or directory of a bundle
+type Entry struct {
+	Name    string // Slash separated path inside the bundle
+	Mode    int64
+	Size    int64
+	ModTime time.Time
+	IsDir   bool
+}
+
+// Reader iterates over the entries of a bundle archive in order, the content
+// of an entry can be read until Next is called again
+type Reader interface {
+	Next() (*Entry, io.Reader, error) // io.EOF after the last entry
+	Close() error
+}
+
+// MemberMode returns the mode of a bundle member by the bundle convention:
+// directories, scripts and loader binaries are executable
+func MemberMode(name string, isDir bool) int64 {
+	if isDir || strings.HasSuffix(name, ".sh") || strings.HasSuffix(name, ".bat") || strings.HasPrefix(filepath.ToSlash(name), "loader/") {
+		return 0755
+	}
+	return 0644
+}
+
+// DetectFormat determines the format of an archive from its first bytes
+func DetectFormat(header []byte) (string, error) {
+	switch {
+	case bytes.HasPrefix(header, []byte{0x1f, 0x8b}):
+		return FormatTarGz, nil
+	case bytes.HasPrefix(header, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return FormatTarZst, nil
+	case bytes.HasPrefix(header, []byte("PK\x03\x04")):
+		return FormatZip, nil
+	}
+	return "", fmt.Errorf("not a bundle archive (tar.gz, tar.zst or zip)")
+}
+
+// parts reads the parts of a split archive (archive.001, archive.002, ...)
+// as one file, an archive that is not split is a single part
+type parts struct {
+	files []*os.File
+	ends  []int64 // Offset after each part
+}
+
+// SplitParts returns the parts of a split archive in order, or the archive
+// itself, and the path the archive had before it was split. path may be the
+// archive, its first part or the name before splitting. A gap in the part
+// numbers is an error.
+func SplitParts(path string) ([]string, string, error) {
+	base := path
+	if splitPartPattern.MatchString(path) {
+		base = strings.TrimSuffix(path, filepath.Ext(path))
+	}
+	names, err := filepath.Glob(base + ".[0-9][0-9][0-9]")
+	if err != nil {
+		return nil, "", err
+	}
+	if len(names) == 0 {
+		return []string{path}, base, nil
+	}
+	slices.Sort(names)
+	for i, name := range names {
+		if want := fmt.Sprintf("%s.%03d", base, i+1); name != want {
+			return nil, "", fmt.Errorf("part %s is missing", filepath.Base(want))
+		}
+	}
+	return names, base, nil
+}
+
+// openParts opens the archive at path, see SplitParts
+func openParts(path string) (*parts, error) {
+	names, _, err := SplitParts(path)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parts{}
+	var end int64
+	for _, name := range names {
+		file, err := os.Open(name)
+		if err != nil {
+			p.Close()
+			return nil, err
+		}
+		p.files = append(p.files, file)
+		info, err := file.Stat()
+		if err != nil {
+			p.Close()
+			return nil, err
+		}
+		end += info.Size()
+		p.ends = append(p.ends, end)
+	}
+	return p, nil
+}
+
+func (p *parts) size() int64 {
+	return p.ends[len(p.ends)-1]
+}
+
+func (p *parts) ReadAt(b []byte, off int64) (int, error) {
+	var n int
+	for n < len(b) {
+		i, _ := slices.BinarySearch(p.ends, off+1)
+		if i >= len(p.files) {
+			return n, io.EOF
+		}
+		start := p.ends[i] - p.sizeOf(i)
+		m, err := p.files[i].ReadAt(b[n:min(len(b), n+int(p.ends[i]-off))], off-start)
+		n += m
+		off += int64(m)
+		if err != nil && err != io.EOF {
+			return n, err
+		}
+		if m == 0 {
+			return n, io.ErrUnexpectedEOF
+		}
+	}
+	return n, nil
+}
+
+func (p *parts) sizeOf(i int) int64 {
+	if i == 0 {
+		return p.ends[0]
+	}
+	return p.ends[i] - p.ends[i-1]
+}
+
+func (p *parts) Close() error {
+	var err error
+	for _, file := range p.files {
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// OpenReader opens the archive at path for iterating its entries and
+// returns its format. path is an archive or a split archive, see SplitParts.
+func OpenReader(path string) (Reader, string, error) {
+	p, err := openParts(path)
+	if err != nil {
+		return nil, "", err
+	}
+	header := make([]byte, 4)
+	n, _ := p.ReadAt(header, 0)
+	format, err := DetectFormat(header[:n])
+	if err != nil {
+		p.Close()
+		return nil, "", fmt.Errorf("%s: %w", path, err)
+	}
+
+	if format == FormatZip {
+		zr, err := zip.NewReader(p, p.size())
+		if err != nil {
+			p.Close()
+			return nil, "", err
+		}
+		return &zipReader{zr: zr, parts: p}, format, nil
+	}
+	reader, err := newTarReader(bufio.NewReaderSize(io.NewSectionReader(p, 0, p.size()), 1<<20), format)
+	if err != nil {
+		p.Close()
+		return nil, "", err
+	}
+	reader.parts = p
+	return reader, format, nil
+}
+
+// NewStreamReader reads a tar based bundle from a stream, zip bundles keep
+// their directory at the end and need random access
+func NewStreamReader(r io.Reader) (Reader, error) {
+	buffered := bufio.NewReader(r)
+	header, _ := buffered.Peek(4)
+	format, err := DetectFormat(header)
+	if err != nil {
+		return nil, err
+	}
+	if format == FormatZip {
+		return nil, fmt.Errorf("zip bundles cannot be read as a stream, download the bundle first")
+	}
+	return newTarReader(buffered, format)
+}
+
+func newTarReader(r io.Reader, format string) (*tarReader, error) {
+	var decompressed io.ReadCloser
+	switch format {
+	case FormatTarGz:
+		gzReader, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		decompressed = gzReader
+	case FormatTarZst:
+		zstdReader, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		decompressed = zstdReader.IOReadCloser()
+	default:
+		return nil, fmt.Errorf("unsupported archive format %q", format)
+	}
+	return &tarReader{tr: tar.NewReader(decompressed), decompressed: decompressed}, nil
+}
+
+type tarReader struct {
+	tr           *tar.Reader
+	decompressed io.ReadCloser
+	parts        *parts // Closed with the reader if set
+}
+
+func (t *tarReader) Next() (*Entry, io.Reader, error) {
+	header, err := t.tr.Next()
+	if err != nil {
+		return nil, nil, err
+	}
+	entry := &Entry{Name: strings.TrimSuffix(header.Name, "/"), Mode: header.Mode, Size: header.Size, ModTime: header.ModTime}
+	switch header.Typeflag {
+	case tar.TypeDir:
+		entry.IsDir = true
+	case tar.TypeReg:
+	default:
+		return nil, nil, fmt.Errorf("unsupported entry %s in bundle", header.Name)
+	}
+	return entry, t.tr, nil
+}
+
+func (t *tarReader) Close() error {
+	err := t.decompressed.Close()
+	if t.parts != nil {
+		t.parts.Close()
+	}
+	return err
+}
+
+type zipReader struct {
+	zr      *zip.Reader
+	parts   *parts
+	next    int
+	current io.ReadCloser
+}
+
+func (z *zipReader) Next() (*Entry, io.Reader, error) {
+	if z.current != nil {
+		z.current.Close()
+		z.current = nil
+	}
+	if z.next >= len(z.zr.File) {
+		return nil, nil, io.EOF
+	}
+	f := z.zr.File[z.next]
+	z.next++
+
+	name := strings.TrimSuffix(f.Name, "/")
+	if f.Mode()&(fs.ModeType&^fs.ModeDir) != 0 {
+		return nil, nil, fmt.Errorf("unsupported entry %s in bundle", f.Name)
+	}
+	entry := &Entry{Name: name, Mode: int64(f.Mode().Perm()), Size: int64(f.UncompressedSize64), ModTime: f.Modified, IsDir: f.FileInfo().IsDir()}
+	// Archives repacked on Windows carry no Unix modes, fall back to the bundle convention
+	if entry.Mode == 0 || f.CreatorVersion>>8 != 3 {
+		entry.Mode = MemberMode(name, entry.IsDir)
+	}
+	if entry.IsDir {
+		return entry, bytes.NewReader(nil), nil
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return nil, nil, err
+	}
+	z.current = rc
+	return entry, rc, nil
+}
+
+func (z *zipReader) Close() error {
+	if z.current != nil {
+		z.current.Close()
+	}
+	return z.parts.Close()
+}
+
+// dirReader iterates the files of an extracted bundle in lexical order
+type dirReader struct {
+	root    string
+	names   []string
+	current *os.File
+}
+
+func newDirReader(root string) (*dirReader, error) {
+	d := &dirReader{root: root}
+	err := filepath.WalkDir(root, func(path string, _ os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path != root {
+			rel, _ := filepath.Rel(root, path)
+			d.names = append(d.names, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *dirReader) Next() (*Entry, io.Reader, error) {
+	if d.current != nil {
+		d.current.Close()
+		d.current = nil
+	}
+	if len(d.names) == 0 {
+		return nil, nil, io.EOF
+	}
+	name := d.names[0]
+	d.names = d.names[1:]
+	file, err := os.Open(filepath.Join(d.root, filepath.FromSlash(name)))
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	d.current = file
+	return &Entry{Name: name, Mode: int64(info.Mode().Perm()), Size: info.Size(), ModTime: info.ModTime(), IsDir: info.IsDir()}, file, nil
+}
+
+func (d *dirReader) Close() error {
+	if d.current != nil {
+		return d.current.Close()
+	}
+	return nil
+}
@@ -0,0 +1,247 @@
+// Package bundlefile reads bundles written by docker-compose-bundler, so
+// tooling can consume them without running the CLI. A bundle is opened from
+// an archive (tar.gz, tar.zst or zip), the parts of a split archive or an
+// extracted bundle directory:
+//
+//	b, err := bundlefile.Open("my-stack-1.2.0.tar.gz")
+//	if err != nil {
+//		return err
+//	}
+//	for _, desc := range b.Images() {
+//		rc, err := b.OpenImage(desc)
+//		...
+//	}
+//
+// Archives are compressed streams, so every Open and OpenImage reads the
+// archive from the start up to the member. Walk visits all members in one pass.
+package bundlefile
+
+import (
+	_ "crypto/sha256" // Registers the digest algorithm of the manifest checksums
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Media types of the image tars in Images. Tars saved by Docker Engine 25
+// and later hold both layouts, they are reported as Docker archives unless
+// the bundle was written with --save-compat oci.
+const (
+	MediaTypeDockerArchive = "application/vnd.docker.image.archive.v1+tar"
+	MediaTypeOCILayout     = "application/vnd.oci.image.layout.v1+tar"
+)
+
+// Annotations of the descriptors in Images besides the OCI ones
+const (
+	AnnotationImageID = "com.docker-compose-bundler.image.id"
+	AnnotationAliases = "com.docker-compose-bundler.image.aliases" // Comma separated
+)
+
+// ManifestName is the path of the manifest inside a bundle
+const ManifestName = "manifest.json"
+
+// Bundle is an opened bundle
+type Bundle struct {
+	path     string
+	format   string
+	manifest *Manifest
+}
+
+// Open opens the bundle at path and reads its manifest. path is a bundle
+// archive, the first part of a split archive (bundle.tar.gz.001), the name
+// the archive had before it was split or an extracted bundle directory.
+func Open(path string) (*Bundle, error) {
+	b := &Bundle{path: path}
+	info, err := os.Stat(path)
+	switch {
+	case err == nil && info.IsDir():
+		b.format = FormatDirectory
+	case err != nil && !os.IsNotExist(err):
+		return nil, err
+	}
+
+	rc, err := b.Open(ManifestName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+	if b.manifest, err = ParseManifest(data); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Format returns the archive format of the bundle, FormatDirectory for an
+// extracted bundle
+func (b *Bundle) Format() string {
+	return b.format
+}
+
+// Manifest returns the manifest of the bundle
+func (b *Bundle) Manifest() *Manifest {
+	return b.manifest
+}
+
+// Images returns the image tars of the bundle as OCI descriptors. The digest
+// and size are the ones of the tar, the ref name annotation is the image
+// name and the title annotation the path of the tar in the bundle.
+func (b *Bundle) Images() []ocispec.Descriptor {
+	var descs []ocispec.Descriptor
+	for _, img := range b.manifest.Images {
+		mediaType := MediaTypeDockerArchive
+		if img.Format == "oci" {
+			mediaType = MediaTypeOCILayout
+		}
+		annotations := map[string]string{
+			ocispec.AnnotationRefName: img.Name,
+			ocispec.AnnotationTitle:   img.File,
+		}
+		if img.ID != "" {
+			annotations[AnnotationImageID] = img.ID
+		}
+		if len(img.Aliases) > 0 {
+			annotations[AnnotationAliases] = strings.Join(img.Aliases, ",")
+		}
+		descs = append(descs, ocispec.Descriptor{
+			MediaType:   mediaType,
+			Digest:      digest.NewDigestFromEncoded(digest.SHA256, img.SHA256),
+			Size:        img.Size,
+			Annotations: annotations,
+		})
+	}
+	return descs
+}
+
+// Open returns the content of the bundle member name, a slash separated
+// path like "docker-compose.yml". Missing members return an error wrapping
+// fs.ErrNotExist.
+func (b *Bundle) Open(name string) (io.ReadCloser, error) {
+	if !fs.ValidPath(name) {
+		return nil, fmt.Errorf("invalid bundle member %q", name)
+	}
+	if b.format == FormatDirectory {
+		return os.Open(filepath.Join(b.path, filepath.FromSlash(name)))
+	}
+
+	reader, format, err := OpenReader(b.path)
+	if err != nil {
+		return nil, err
+	}
+	b.format = format
+	for {
+		entry, content, err := reader.Next()
+		if err == io.EOF {
+			reader.Close()
+			return nil, fmt.Errorf("%s: %s: %w", b.path, name, fs.ErrNotExist)
+		}
+		if err != nil {
+			reader.Close()
+			return nil, err
+		}
+		if entry.Name == name && !entry.IsDir {
+			return &memberReader{Reader: content, closer: reader}, nil
+		}
+	}
+}
+
+// OpenImage returns the tar of an image of Images. Reading it to the end
+// fails if its content does not match the digest.
+func (b *Bundle) OpenImage(desc ocispec.Descriptor) (io.ReadCloser, error) {
+	name := desc.Annotations[ocispec.AnnotationTitle]
+	if name == "" {
+		return nil, fmt.Errorf("descriptor %s has no %s annotation", desc.Digest, ocispec.AnnotationTitle)
+	}
+	rc, err := b.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := desc.Digest.Validate(); err != nil {
+		rc.Close()
+		return nil, fmt.Errorf("invalid digest of %s: %w", name, err)
+	}
+	return &verifyingReader{rc: rc, name: name, size: desc.Size, verifier: desc.Digest.Verifier()}, nil
+}
+
+// WalkFunc is called by Walk for every member, content is only valid until it returns
+type WalkFunc func(entry Entry, content io.Reader) error
+
+// SkipAll returned by a WalkFunc stops Walk without an error
+var SkipAll = fs.SkipAll
+
+// Walk calls fn for every member of the bundle in archive order, reading the
+// archive once. Directory bundles are walked in lexical order.
+func (b *Bundle) Walk(fn WalkFunc) error {
+	var reader Reader
+	var err error
+	if b.format == FormatDirectory {
+		reader, err = newDirReader(b.path)
+	} else {
+		reader, b.format, err = OpenReader(b.path)
+	}
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	for {
+		entry, content, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(*entry, content); err != nil {
+			if errors.Is(err, SkipAll) {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// memberReader is a member of an archive, closing it closes the archive
+type memberReader struct {
+	io.Reader
+	closer io.Closer
+}
+
+func (m *memberReader) Close() error {
+	return m.closer.Close()
+}
+
+// verifyingReader checks the digest of an image tar when it was read completely
+type verifyingReader struct {
+	rc       io.ReadCloser
+	name     string
+	size     int64
+	read     int64
+	verifier digest.Verifier
+}
+
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	n, err := v.rc.Read(p)
+	v.verifier.Write(p[:n])
+	v.read += int64(n)
+	if err == io.EOF {
+		if v.read != v.size || !v.verifier.Verified() {
+			return n, fmt.Errorf("checksum mismatch for %s: the bundle is damaged", v.name)
+		}
+	}
+	return n, err
+}
+
+func (v *verifyingReader) Close() error {
+	return v.rc.Close()
+}
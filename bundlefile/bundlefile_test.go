@@ -0,0 +1,318 @@
+package bundlefile
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const imageTar = "image tar of nginx:1.27"
+
+// testMembers returns the members of a bundle with one image in archive order
+func testMembers(t *testing.T, imageSHA256 string) [][2]string {
+	t.Helper()
+	manifest, err := json.Marshal(Manifest{
+		SchemaVersion: 1,
+		Name:          "shop",
+		Version:       "1.2.0",
+		Images:        []Image{{Name: "nginx:1.27", ID: "sha256:abc", File: "images/nginx.tar", Size: int64(len(imageTar)), SHA256: imageSHA256}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return [][2]string{
+		{ManifestName, string(manifest)},
+		{"docker-compose.yml", "services:\n  web:\n    image: nginx:1.27\n"},
+		{"images/nginx.tar", imageTar},
+		{"load-images.sh", "#!/bin/sh\n"},
+	}
+}
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// writeBundle writes members as a bundle in format and returns its path
+func writeBundle(t *testing.T, dir, format string, members [][2]string) string {
+	t.Helper()
+	path := filepath.Join(dir, "shop-1.2.0."+format)
+	if format == FormatDirectory {
+		path = filepath.Join(dir, "shop-1.2.0")
+		for _, member := range members {
+			target := filepath.Join(path, filepath.FromSlash(member[0]))
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(target, []byte(member[1]), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return path
+	}
+
+	var buf bytes.Buffer
+	if format == FormatZip {
+		zw := zip.NewWriter(&buf)
+		for _, member := range members {
+			w, err := zw.Create(member[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			io.WriteString(w, member[1])
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+	} else {
+		var compressor io.WriteCloser = gzip.NewWriter(&buf)
+		if format == FormatTarZst {
+			zw, err := zstd.NewWriter(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			compressor = zw
+		}
+		tw := tar.NewWriter(compressor)
+		for _, member := range members {
+			header := &tar.Header{Name: member[0], Mode: MemberMode(member[0], false), Size: int64(len(member[1])), ModTime: time.Now(), Typeflag: tar.TypeReg}
+			if err := tw.WriteHeader(header); err != nil {
+				t.Fatal(err)
+			}
+			io.WriteString(tw, member[1])
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := compressor.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestOpen(t *testing.T) {
+	for _, format := range []string{FormatTarGz, FormatTarZst, FormatZip, FormatDirectory} {
+		t.Run(format, func(t *testing.T) {
+			path := writeBundle(t, t.TempDir(), format, testMembers(t, sha256Hex(imageTar)))
+			b, err := Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if b.Format() != format {
+				t.Errorf("format %s, want %s", b.Format(), format)
+			}
+			if m := b.Manifest(); m.Name != "shop" || m.Version != "1.2.0" || len(m.Raw) == 0 {
+				t.Errorf("manifest %+v", m)
+			}
+
+			images := b.Images()
+			if len(images) != 1 {
+				t.Fatalf("images %v", images)
+			}
+			desc := images[0]
+			if desc.MediaType != MediaTypeDockerArchive || desc.Annotations[ocispec.AnnotationRefName] != "nginx:1.27" || desc.Annotations[AnnotationImageID] != "sha256:abc" {
+				t.Errorf("descriptor %+v", desc)
+			}
+			rc, err := b.OpenImage(desc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := io.ReadAll(rc)
+			rc.Close()
+			if err != nil || string(data) != imageTar {
+				t.Errorf("image tar %q: %v", data, err)
+			}
+
+			var names []string
+			err = b.Walk(func(entry Entry, content io.Reader) error {
+				names = append(names, entry.Name)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Directories are walked with their subdirectories in lexical order
+			want := []string{ManifestName, "docker-compose.yml", "images/nginx.tar", "load-images.sh"}
+			if format == FormatDirectory {
+				want = []string{"docker-compose.yml", "images", "images/nginx.tar", "load-images.sh", ManifestName}
+			}
+			if !slices.Equal(names, want) {
+				t.Errorf("walked %q, want %q", names, want)
+			}
+
+			if _, err := b.Open("missing.txt"); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("opening a missing member: %v", err)
+			}
+			if _, err := b.Open("../manifest.json"); err == nil {
+				t.Error("an invalid member name was opened")
+			}
+		})
+	}
+}
+
+func TestOpenImageDetectsDamage(t *testing.T) {
+	path := writeBundle(t, t.TempDir(), FormatTarGz, testMembers(t, sha256Hex("another image")))
+	b, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc, err := b.OpenImage(b.Images()[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	if _, err := io.ReadAll(rc); err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Errorf("reading a damaged image tar: %v", err)
+	}
+}
+
+// split cuts the archive at path into parts of size bytes and removes it
+func split(t *testing.T, path string, size int) []string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var parts []string
+	for i := 0; len(data) > 0; i++ {
+		n := min(size, len(data))
+		part := fmt.Sprintf("%s.%03d", path, i+1)
+		if err := os.WriteFile(part, data[:n], 0644); err != nil {
+			t.Fatal(err)
+		}
+		parts = append(parts, part)
+		data = data[n:]
+	}
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	return parts
+}
+
+func TestOpenSplitArchive(t *testing.T) {
+	for _, format := range []string{FormatTarGz, FormatZip} {
+		t.Run(format, func(t *testing.T) {
+			path := writeBundle(t, t.TempDir(), format, testMembers(t, sha256Hex(imageTar)))
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			parts := split(t, path, int(info.Size())/3+1)
+			if len(parts) != 3 {
+				t.Fatalf("split into %d parts", len(parts))
+			}
+
+			for _, name := range []string{path, parts[0]} {
+				got, base, err := SplitParts(name)
+				if err != nil || !slices.Equal(got, parts) || base != path {
+					t.Errorf("SplitParts(%s) = %q, %s, %v", filepath.Base(name), got, base, err)
+				}
+				b, err := Open(name)
+				if err != nil {
+					t.Fatalf("Open(%s): %v", filepath.Base(name), err)
+				}
+				rc, err := b.OpenImage(b.Images()[0])
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, err := io.ReadAll(rc); err != nil {
+					t.Errorf("reading the image tar across parts: %v", err)
+				}
+				rc.Close()
+			}
+
+			if err := os.Remove(parts[1]); err != nil {
+				t.Fatal(err)
+			}
+			if _, _, err := SplitParts(path); err == nil || !strings.Contains(err.Error(), filepath.Base(parts[1])+" is missing") {
+				t.Errorf("SplitParts with a missing part: %v", err)
+			}
+			if _, err := Open(parts[0]); err == nil || !strings.Contains(err.Error(), "is missing") {
+				t.Errorf("Open with a missing part: %v", err)
+			}
+		})
+	}
+}
+
+func TestSplitPartsUnsplit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bundle.tar.gz")
+	parts, base, err := SplitParts(path)
+	if err != nil || !slices.Equal(parts, []string{path}) || base != path {
+		t.Errorf("SplitParts = %q, %s, %v", parts, base, err)
+	}
+}
+
+func TestNewStreamReader(t *testing.T) {
+	path := writeBundle(t, t.TempDir(), FormatTarZst, testMembers(t, sha256Hex(imageTar)))
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	reader, err := NewStreamReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	entry, _, err := reader.Next()
+	if err != nil || entry.Name != ManifestName {
+		t.Errorf("first entry %v: %v", entry, err)
+	}
+
+	zipPath := writeBundle(t, t.TempDir(), FormatZip, testMembers(t, sha256Hex(imageTar)))
+	data, err := os.ReadFile(zipPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewStreamReader(bytes.NewReader(data)); err == nil {
+		t.Error("a zip bundle was read as a stream")
+	}
+	if _, err := NewStreamReader(strings.NewReader("plain text")); err == nil {
+		t.Error("a file that is no archive was read")
+	}
+}
+
+func TestZipMemberModes(t *testing.T) {
+	// Zip archives written on Windows carry no Unix modes
+	path := writeBundle(t, t.TempDir(), FormatZip, testMembers(t, sha256Hex(imageTar)))
+	reader, _, err := OpenReader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	modes := make(map[string]int64)
+	for {
+		entry, _, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		modes[entry.Name] = entry.Mode
+	}
+	if modes["load-images.sh"] != 0755 || modes["docker-compose.yml"] != 0644 {
+		t.Errorf("modes %v", modes)
+	}
+}
@@ -0,0 +1,49 @@
+package bundlefile
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Manifest is the manifest.json of a bundle. It covers the fields tooling
+// needs to identify a bundle and its images, Raw holds the complete document.
+type Manifest struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	Name          string            `json:"name"`
+	Version       string            `json:"version"`
+	ProjectName   string            `json:"projectName"`
+	CreatedAt     time.Time         `json:"createdAt"`
+	Images        []Image           `json:"images"`
+	Parameters    map[string]string `json:"parameters,omitempty"`  // Resolved x-bundle parameters
+	Annotations   map[string]string `json:"annotations,omitempty"` // --annotation values, also labels of built images
+	Languages     []string          `json:"languages,omitempty"`   // Languages of the README and scripts besides English
+
+	Raw json.RawMessage `json:"-"`
+}
+
+// Image is an image tar of a bundle
+type Image struct {
+	Name    string   `json:"name"`
+	ID      string   `json:"id,omitempty"`
+	File    string   `json:"file"` // Path of the tar relative to the bundle root
+	Size    int64    `json:"size"`
+	SHA256  string   `json:"sha256"`
+	Aliases []string `json:"aliases,omitempty"` // Other tags saved with --all-tags
+	Parent  string   `json:"parent,omitempty"`  // Parent image ID of locally built images
+	Format  string   `json:"format,omitempty"`  // Layout of the tar, docker-legacy or oci
+	Layers  []string `json:"layers,omitempty"`  // sha256 of the layer files, base first
+	Base    string   `json:"base,omitempty"`    // Image of the base pack the first BaseLayers layers are taken from
+	// BaseLayers are left out of the tar, the target has them from the base pack
+	BaseLayers int `json:"baseLayers,omitempty"`
+}
+
+// ParseManifest parses the content of a manifest.json
+func ParseManifest(data []byte) (*Manifest, error) {
+	var manifest Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest: %w", err)
+	}
+	manifest.Raw = json.RawMessage(data)
+	return &manifest, nil
+}
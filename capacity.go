@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// ResourceHint declares the expected footprint of a service in x-bundle.resources
+type ResourceHint struct {
+	Memory string  `yaml:"memory,omitempty"` // e.g. 512M, 2G
+	CPUs   float64 `yaml:"cpus,omitempty"`
+	Disk   string  `yaml:"disk,omitempty"` // Data the service writes to volumes
+}
+
+// CapacityEstimate is the expected host footprint of the stack
+type CapacityEstimate struct {
+	Services    []ServiceCapacity `json:"services"`
+	TotalMemory int64             `json:"totalMemoryBytes"`
+	TotalCPUs   float64           `json:"totalCpus"`
+	TotalDisk   int64             `json:"totalDiskBytes"` // Unique image sizes plus declared data
+}
+
+// ServiceCapacity is the estimated footprint of a single service, zero means unknown
+type ServiceCapacity struct {
+	Service   string  `json:"service"`
+	Memory    int64   `json:"memoryBytes"`
+	CPUs      float64 `json:"cpus"`
+	ImageSize int64   `json:"imageSizeBytes"`
+	Disk      int64   `json:"diskBytes"`
+}
+
+// estimateCapacity combines x-bundle hints, deploy.resources and image sizes.
+// Hints take precedence over reservations, which take precedence over limits.
+func (b *Bundler) estimateCapacity(compose *DockerCompose) (*CapacityEstimate, error) {
+	estimate := &CapacityEstimate{}
+	countedImages := make(map[string]bool)
+
+	for _, name := range sortedServiceNames(compose) {
+		service := compose.Services[name]
+		capacity := ServiceCapacity{Service: name}
+
+		limits, reservations := serviceResources(service)
+		for _, source := range []map[string]interface{}{limits, reservations} {
+			if memory, err := parseByteSize(fmt.Sprint(source["memory"])); err == nil {
+				capacity.Memory = memory
+			}
+			if cpus, err := strconv.ParseFloat(fmt.Sprint(source["cpus"]), 64); err == nil {
+				capacity.CPUs = cpus
+			}
+		}
+
+		if hint, ok := compose.XBundle.Resources[name]; ok {
+			if hint.Memory != "" {
+				memory, err := parseByteSize(hint.Memory)
+				if err != nil {
+					return nil, fmt.Errorf("x-bundle resources of %s: %w", name, err)
+				}
+				capacity.Memory = memory
+			}
+			if hint.CPUs > 0 {
+				capacity.CPUs = hint.CPUs
+			}
+			if hint.Disk != "" {
+				disk, err := parseByteSize(hint.Disk)
+				if err != nil {
+					return nil, fmt.Errorf("x-bundle resources of %s: %w", name, err)
+				}
+				capacity.Disk = disk
+			}
+		}
+
+		if service.Image != "" && !b.isMissing(service.Image) {
+			inspect, err := b.client.ImageInspect(b.ctx, service.Image)
+			if err != nil {
+				return nil, fmt.Errorf("failed to inspect image %s: %w", service.Image, err)
+			}
+			capacity.ImageSize = inspect.Size
+			if !countedImages[service.Image] {
+				countedImages[service.Image] = true
+				estimate.TotalDisk += inspect.Size
+			}
+		}
+
+		estimate.TotalMemory += capacity.Memory
+		estimate.TotalCPUs += capacity.CPUs
+		estimate.TotalDisk += capacity.Disk
+		estimate.Services = append(estimate.Services, capacity)
+	}
+	return estimate, nil
+}
+
+// serviceResources returns deploy.resources limits and reservations, with the
+// legacy mem_limit/cpus keys as limits
+func serviceResources(service Service) (map[string]interface{}, map[string]interface{}) {
+	limits := make(map[string]interface{})
+	if memLimit, ok := service.Extra["mem_limit"]; ok {
+		limits["memory"] = memLimit
+	}
+	if cpus, ok := service.Extra["cpus"]; ok {
+		limits["cpus"] = cpus
+	}
+
+	deploy, _ := service.Extra["deploy"].(map[string]interface{})
+	resources, _ := deploy["resources"].(map[string]interface{})
+	if deployLimits, ok := resources["limits"].(map[string]interface{}); ok {
+		for key, value := range deployLimits {
+			limits[key] = value
+		}
+	}
+	reservations, _ := resources["reservations"].(map[string]interface{})
+	return limits, reservations
+}
+
+// parseByteSize parses sizes like 512M, 1.5g, 2GB or plain bytes (binary units)
+func parseByteSize(s string) (int64, error) {
+	value := strings.ToLower(strings.TrimSpace(s))
+	value = strings.TrimSuffix(value, "b")
+	multiplier := 1.0
+	if value != "" {
+		switch value[len(value)-1] {
+		case 'k':
+			multiplier = 1 << 10
+		case 'm':
+			multiplier = 1 << 20
+		case 'g':
+			multiplier = 1 << 30
+		case 't':
+			multiplier = 1 << 40
+		}
+		if multiplier > 1 {
+			value = value[:len(value)-1]
+		}
+	}
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil || number < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(math.Round(number * multiplier)), nil
+}
+
+// formatBytes formats a byte count for humans, zero is shown as unknown
+func formatBytes(n int64) string {
+	if n <= 0 {
+		return "-"
+	}
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	value := float64(n)
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%d B", n)
+	}
+	return fmt.Sprintf("%.1f %s", value, units[unit])
+}
+
+func formatCPUs(cpus float64) string {
+	if cpus <= 0 {
+		return "-"
+	}
+	return strconv.FormatFloat(cpus, 'f', -1, 64)
+}
+
+// readmeSection renders the estimate as a README section
+func (e *CapacityEstimate) readmeSection(c *catalog) string {
+	var sb strings.Builder
+	sb.WriteString(c.t("readme.capacity") + "\n")
+	sb.WriteString(c.t("readme.capacity.columns") + "\n")
+	sb.WriteString("|---------|--------|------|------------|------|\n")
+	for _, s := range e.Services {
+		fmt.Fprintf(&sb, "| %s | %s | %s | %s | %s |\n", s.Service, formatBytes(s.Memory), formatCPUs(s.CPUs), formatBytes(s.ImageSize), formatBytes(s.Disk))
+	}
+	fmt.Fprintf(&sb, "| **%s** | %s | %s | | %s |\n", c.t("readme.capacity.total"), formatBytes(e.TotalMemory), formatCPUs(e.TotalCPUs), formatBytes(e.TotalDisk))
+	sb.WriteString("\n" + c.t("readme.capacity.note"))
+	return sb.String()
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/bits"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"docker-compose-bundler/bundlefile"
+)
+
+// Chunking algorithms of --chunking
+const (
+	ChunkingFastCDC = "fastcdc" // Content-defined boundaries, an insertion only changes the chunks around it
+	ChunkingFixed   = "fixed"
+)
+
+const (
+	chunkIndexSchemaVersion = 1
+	defaultChunkSize        = "1M"
+	chunkCatalogName        = "bundles.json"
+)
+
+// ChunkIndex describes a bundle stored in a chunk store: its files in bundle
+// order with the chunks their content is made of
+type ChunkIndex struct {
+	SchemaVersion int           `json:"schemaVersion"`
+	Name          string        `json:"name"`
+	Version       string        `json:"version"`
+	CreatedAt     time.Time     `json:"createdAt"`
+	Chunking      string        `json:"chunking"`
+	ChunkSize     int64         `json:"chunkSize"` // Average size with fastcdc
+	Files         []ChunkedFile `json:"files"`
+}
+
+// ChunkedFile is a member of the bundle
+type ChunkedFile struct {
+	Name    string     `json:"name"`
+	Mode    int64      `json:"mode"`
+	ModTime time.Time  `json:"modTime"`
+	IsDir   bool       `json:"dir,omitempty"`
+	Size    int64      `json:"size,omitempty"`
+	SHA256  string     `json:"sha256,omitempty"`
+	Chunks  []ChunkRef `json:"chunks,omitempty"`
+}
+
+// ChunkRef is a chunk in the chunks/ directory of the store
+type ChunkRef struct {
+	SHA256 string `json:"sha256"`
+	Size   int64  `json:"size"`
+}
+
+// ChunkCatalog lists the bundles of a chunk store in bundles.json, so a store
+// served over HTTP can be synchronized without listing directories
+type ChunkCatalog struct {
+	Bundles []ChunkCatalogEntry `json:"bundles"`
+}
+
+// ChunkCatalogEntry points to the index of a bundle
+type ChunkCatalogEntry struct {
+	Name      string    `json:"name"`
+	Version   string    `json:"version"`
+	CreatedAt time.Time `json:"createdAt"`
+	Index     string    `json:"index"` // Path of the ChunkIndex relative to the store
+}
+
+func parseChunking(value string) (string, error) {
+	switch strings.ToLower(value) {
+	case "", ChunkingFastCDC:
+		return ChunkingFastCDC, nil
+	case ChunkingFixed:
+		return ChunkingFixed, nil
+	}
+	return "", fmt.Errorf("invalid --chunking %q, use fastcdc or fixed", value)
+}
+
+func parseChunkSize(value string) (int64, error) {
+	size, err := parseByteSize(cmp.Or(value, defaultChunkSize))
+	if err != nil {
+		return 0, fmt.Errorf("invalid --chunk-size: %w", err)
+	}
+	if size < 4<<10 || size > 64<<20 {
+		return 0, fmt.Errorf("--chunk-size must be between 4K and 64M")
+	}
+	return size, nil
+}
+
+// chunkStore is a directory of content-addressed chunks and the indexes of
+// the bundles made of them
+type chunkStore string
+
+func (s chunkStore) chunkPath(digest string) string {
+	return filepath.Join(string(s), "chunks", digest[:2], digest)
+}
+
+// hasChunk reports whether the store holds the chunk with the right size
+func (s chunkStore) hasChunk(ref ChunkRef) bool {
+	info, err := os.Stat(s.chunkPath(ref.SHA256))
+	return err == nil && info.Size() == ref.Size
+}
+
+// putChunk stores data unless the store has it, it reports whether it was new
+func (s chunkStore) putChunk(ref ChunkRef, data []byte) (bool, error) {
+	if s.hasChunk(ref) {
+		return false, nil
+	}
+	target := s.chunkPath(ref.SHA256)
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return false, err
+	}
+	// Written under a temporary name, an interrupted transfer leaves no truncated chunk
+	tmp, err := os.CreateTemp(filepath.Dir(target), ref.SHA256+".*.tmp")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return false, err
+	}
+	if err := tmp.Close(); err != nil {
+		return false, err
+	}
+	return true, os.Rename(tmp.Name(), target)
+}
+
+func (s chunkStore) readCatalog() (*ChunkCatalog, error) {
+	var catalog ChunkCatalog
+	data, err := os.ReadFile(filepath.Join(string(s), chunkCatalogName))
+	if os.IsNotExist(err) {
+		return &catalog, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &catalog); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", chunkCatalogName, err)
+	}
+	return &catalog, nil
+}
+
+// addIndex writes the index of a bundle and lists it in the catalog,
+// replacing an earlier index of the same version
+func (s chunkStore) addIndex(index *ChunkIndex) error {
+	name := "indexes/" + index.Name + "-" + index.Version + ".json"
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Join(string(s), "indexes"), 0755); err != nil {
+		return err
+	}
+	if err := writeStoreFile(filepath.Join(string(s), filepath.FromSlash(name)), data); err != nil {
+		return err
+	}
+
+	// Parallel bundle runs add their indexes to the same catalog
+	catalogPath := filepath.Join(string(s), chunkCatalogName)
+	release, err := waitRunLock(catalogPath, 30*time.Second)
+	if err != nil {
+		return err
+	}
+	defer release()
+	catalog, err := s.readCatalog()
+	if err != nil {
+		return err
+	}
+	catalog.Bundles = slices.DeleteFunc(catalog.Bundles, func(e ChunkCatalogEntry) bool {
+		return e.Name == index.Name && e.Version == index.Version
+	})
+	catalog.Bundles = append(catalog.Bundles, ChunkCatalogEntry{Name: index.Name, Version: index.Version, CreatedAt: index.CreatedAt, Index: name})
+	slices.SortStableFunc(catalog.Bundles, func(a, b ChunkCatalogEntry) int {
+		return a.CreatedAt.Compare(b.CreatedAt)
+	})
+	if data, err = json.MarshalIndent(catalog, "", "  "); err != nil {
+		return err
+	}
+	return writeStoreFile(catalogPath, data)
+}
+
+// writeStoreFile replaces a file of the store, readers never see it half written
+func writeStoreFile(target string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(target), filepath.Base(target)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), target)
+}
+
+// writeChunkStore adds the finished bundle to the --chunk-store. Chunks an
+// earlier delivery stored are reused, sync only transfers the new ones.
+func (b *Bundler) writeChunkStore(outputFile string, manifest *Manifest) error {
+	if b.opts.ChunkStore == "" {
+		return nil
+	}
+	chunking, err := parseChunking(b.opts.Chunking)
+	if err != nil {
+		return err
+	}
+	chunkSize, err := parseChunkSize(b.opts.ChunkSize)
+	if err != nil {
+		return err
+	}
+	bundle, err := bundlefile.Open(outputFile)
+	if err != nil {
+		return err
+	}
+
+	store := chunkStore(b.opts.ChunkStore)
+	index := &ChunkIndex{SchemaVersion: chunkIndexSchemaVersion, Name: manifest.Name, Version: manifest.Version,
+		CreatedAt: manifest.CreatedAt, Chunking: chunking, ChunkSize: chunkSize}
+	var chunks, newChunks int
+	var total, transfer int64
+	err = bundle.Walk(func(entry bundlefile.Entry, content io.Reader) error {
+		file := ChunkedFile{Name: entry.Name, Mode: entry.Mode, ModTime: entry.ModTime, IsDir: entry.IsDir}
+		if entry.IsDir {
+			index.Files = append(index.Files, file)
+			return nil
+		}
+		hash := sha256.New()
+		chunker := newChunker(io.TeeReader(content, hash), chunking, int(chunkSize))
+		for {
+			data, err := chunker.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			sum := sha256.Sum256(data)
+			ref := ChunkRef{SHA256: hex.EncodeToString(sum[:]), Size: int64(len(data))}
+			added, err := store.putChunk(ref, data)
+			if err != nil {
+				return fmt.Errorf("failed to store chunk: %w", err)
+			}
+			file.Chunks = append(file.Chunks, ref)
+			file.Size += ref.Size
+			chunks++
+			total += ref.Size
+			if added {
+				newChunks++
+				transfer += ref.Size
+			}
+		}
+		file.SHA256 = hex.EncodeToString(hash.Sum(nil))
+		index.Files = append(index.Files, file)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write chunk store: %w", err)
+	}
+	if err := store.addIndex(index); err != nil {
+		return fmt.Errorf("failed to write chunk store: %w", err)
+	}
+	fmt.Printf("Chunk store %s: %d of %d chunks are new (%s of %s)\n", b.opts.ChunkStore, newChunks, chunks, formatBytes(transfer), formatBytes(total))
+	return nil
+}
+
+// chunker splits a stream into chunks of a fixed size or with FastCDC
+// boundaries. The returned chunk is only valid until the next call.
+type chunker struct {
+	r          io.Reader
+	cdc        bool
+	min, avg   int
+	buf        []byte // Holds up to the maximum chunk size
+	start, end int
+	eof        bool
+}
+
+func newChunker(r io.Reader, chunking string, size int) *chunker {
+	if chunking == ChunkingFixed {
+		return &chunker{r: r, buf: make([]byte, size)}
+	}
+	return &chunker{r: r, cdc: true, min: size / 4, avg: size, buf: make([]byte, size*8)}
+}
+
+func (c *chunker) Next() ([]byte, error) {
+	if c.end-c.start < len(c.buf) && !c.eof {
+		c.end = copy(c.buf, c.buf[c.start:c.end])
+		c.start = 0
+		n, err := io.ReadFull(c.r, c.buf[c.end:])
+		c.end += n
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			c.eof = true
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	if c.start == c.end {
+		return nil, io.EOF
+	}
+	data := c.buf[c.start:c.end]
+	if c.cdc {
+		data = data[:c.cut(data)]
+	}
+	c.start += len(data)
+	return data, nil
+}
+
+// cut returns the length of the next FastCDC chunk of data. Normalized
+// chunking uses a stricter mask before the average size and a looser one
+// after it, so chunk sizes cluster around the average.
+func (c *chunker) cut(data []byte) int {
+	if len(data) <= c.min {
+		return len(data)
+	}
+	normal := min(c.avg, len(data))
+	avgBits := bits.Len(uint(c.avg)) - 1
+	strict, loose := gearMask(avgBits+2), gearMask(avgBits-2)
+	var hash uint64
+	for i := c.min; i < len(data); i++ {
+		hash = hash<<1 + gearTable[data[i]]
+		mask := loose
+		if i < normal {
+			mask = strict
+		}
+		if hash&mask == 0 {
+			return i + 1
+		}
+	}
+	return len(data)
+}
+
+// gearMask has the n most significant bits set, they depend on the most input bytes
+func gearMask(n int) uint64 {
+	return ^uint64(0) << (64 - n)
+}
+
+// gearTable holds the random values of the gear hash. It is generated from a
+// fixed seed, chunk boundaries must not change between releases or stores
+// would stop deduplicating.
+var gearTable = func() (table [256]uint64) {
+	state := uint64(0)
+	for i := range table {
+		// splitmix64
+		state += 0x9e3779b97f4a7c15
+		z := state
+		z = (z ^ z>>30) * 0xbf58476d1ce4e5b9
+		z = (z ^ z>>27) * 0x94d049bb133111eb
+		table[i] = z ^ z>>31
+	}
+	return table
+}()
+
+// chunkIndexPath checks the index path of a catalog entry, a store may come
+// from an untrusted link
+func chunkIndexPath(entry ChunkCatalogEntry) (string, error) {
+	if !validMemberPath(entry.Index) || path.Ext(entry.Index) != ".json" {
+		return "", fmt.Errorf("invalid index path %q in %s", entry.Index, chunkCatalogName)
+	}
+	return entry.Index, nil
+}
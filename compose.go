@@ -0,0 +1,978 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// XBundle holds bundle metadata
+type XBundle struct {
+	Name         string                     `yaml:"name"`
+	Version      string                     `yaml:"version"`
+	Resources    map[string]ResourceHint    `yaml:"resources,omitempty"`    // Per service sizing hints
+	Parameters   map[string]BundleParameter `yaml:"parameters,omitempty"`   // Values substituted as ${name}, see --values
+	Licenses     *LicenseConfig             `yaml:"licenses,omitempty"`     // Acknowledged redistribution terms
+	Budgets      *SizeBudgets               `yaml:"budgets,omitempty"`      // Maximum image and bundle sizes
+	Host         *HostRequirements          `yaml:"host,omitempty"`         // Storage driver, cgroup, IPv6 and sysctls the target needs
+	Jobs         []BundleJob                `yaml:"jobs,omitempty"`         // Containers run before the services are built
+	Healthchecks map[string]HealthcheckHint `yaml:"healthchecks,omitempty"` // Per service healthchecks to synthesize
+	Expires      string                     `yaml:"expires,omitempty"`      // End of the evaluation period, YYYY-MM-DD
+	ExpiryPolicy string                     `yaml:"expiryPolicy,omitempty"` // warn (default) or refuse to load expired bundles
+}
+
+type DockerCompose struct {
+	Version    string                 `yaml:"version,omitempty"`
+	Name       string                 `yaml:"name,omitempty"`
+	Services   map[string]Service     `yaml:"services"`
+	Networks   map[string]interface{} `yaml:"networks,omitempty"`
+	Volumes    map[string]interface{} `yaml:"volumes,omitempty"`
+	Configs    map[string]interface{} `yaml:"configs,omitempty"`
+	Secrets    map[string]interface{} `yaml:"secrets,omitempty"`
+	XBundle    *XBundle               `yaml:"x-bundle"`
+	Extensions map[string]interface{} `yaml:",inline"` // Other x-* top-level entries
+
+	sopsEncrypted bool               // Read from SOPS-encrypted files, the bundled copy has to be encrypted too
+	parameters    map[string]string  // Resolved x-bundle parameters
+	extensions    *composeExtensions // x-* entries as written, see --extensions
+}
+
+type Service struct {
+	Image       string                 `yaml:"image,omitempty"`
+	Build       *BuildConfig           `yaml:"build,omitempty"`
+	Environment Environment            `yaml:"environment,omitempty"`
+	EnvFile     EnvFiles               `yaml:"env_file,omitempty"`
+	Volumes     []ServiceVolume        `yaml:"volumes,omitempty"`
+	Ports       []ServicePort          `yaml:"ports,omitempty"`
+	Networks    ServiceNetworks        `yaml:"networks,omitempty"`
+	DependsOn   DependsOn              `yaml:"depends_on,omitempty"`
+	Command     ShellCommand           `yaml:"command,omitempty"`
+	Entrypoint  ShellCommand           `yaml:"entrypoint,omitempty"`
+	Restart     string                 `yaml:"restart,omitempty"`
+	User        string                 `yaml:"user,omitempty"`
+	Extra       map[string]interface{} `yaml:",inline"`
+}
+
+// BuildConfig is the build section of a service (short "context" or long syntax)
+type BuildConfig struct {
+	Context    string                 `yaml:"context,omitempty"`
+	Dockerfile string                 `yaml:"dockerfile,omitempty"`
+	Args       Environment            `yaml:"args,omitempty"`
+	Target     string                 `yaml:"target,omitempty"`
+	Labels     Environment            `yaml:"labels,omitempty"`
+	Extra      map[string]interface{} `yaml:",inline"`
+}
+
+func (c *BuildConfig) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		*c = BuildConfig{Context: node.Value}
+		return nil
+	}
+	type plain BuildConfig
+	return node.Decode((*plain)(c))
+}
+
+// ServicePort is a ports entry in short ("[ip:][published:]target[/protocol]") or long syntax
+type ServicePort struct {
+	Target      string `yaml:"target"`
+	Published   string `yaml:"published,omitempty"`
+	HostIP      string `yaml:"host_ip,omitempty"`
+	Protocol    string `yaml:"protocol,omitempty"`
+	Mode        string `yaml:"mode,omitempty"`
+	Name        string `yaml:"name,omitempty"`
+	AppProtocol string `yaml:"app_protocol,omitempty"`
+	long        bool
+}
+
+func (p *ServicePort) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.MappingNode {
+		type plain ServicePort
+		if err := node.Decode((*plain)(p)); err != nil {
+			return err
+		}
+		p.long = true
+		return nil
+	}
+	if node.Kind != yaml.ScalarNode {
+		return fmt.Errorf("line %d: invalid port definition", node.Line)
+	}
+	port, err := parsePortSpec(node.Value)
+	if err != nil {
+		return fmt.Errorf("line %d: %w", node.Line, err)
+	}
+	*p = port
+	return nil
+}
+
+func (p ServicePort) MarshalYAML() (interface{}, error) {
+	if !p.long {
+		return p.String(), nil
+	}
+	type plain ServicePort
+	var node yaml.Node
+	if err := node.Encode(plain(p)); err != nil {
+		return nil, err
+	}
+	// Plain numbers are written as integers, ranges stay strings
+	for i := 1; i < len(node.Content); i += 2 {
+		key := node.Content[i-1].Value
+		if key == "target" || key == "published" {
+			if _, err := strconv.Atoi(node.Content[i].Value); err == nil {
+				node.Content[i].Tag = "!!int"
+				node.Content[i].Style = 0
+			}
+		}
+	}
+	return &node, nil
+}
+
+// String formats the port in short syntax
+func (p ServicePort) String() string {
+	spec := p.Target
+	if p.Published != "" {
+		spec = p.Published + ":" + spec
+	}
+	if p.HostIP != "" {
+		hostIP := p.HostIP
+		if strings.Contains(hostIP, ":") {
+			hostIP = "[" + hostIP + "]"
+		}
+		if p.Published == "" {
+			spec = ":" + spec
+		}
+		spec = hostIP + ":" + spec
+	}
+	if p.Protocol != "" {
+		spec += "/" + p.Protocol
+	}
+	return spec
+}
+
+func parsePortSpec(spec string) (ServicePort, error) {
+	var port ServicePort
+	rest := spec
+	if i := strings.LastIndex(rest, "/"); i >= 0 {
+		port.Protocol = rest[i+1:]
+		rest = rest[:i]
+	}
+
+	// IPv6 host addresses are wrapped in brackets
+	if strings.HasPrefix(rest, "[") {
+		end := strings.Index(rest, "]")
+		if end < 0 || end+1 >= len(rest) || rest[end+1] != ':' {
+			return port, fmt.Errorf("invalid port %q", spec)
+		}
+		port.HostIP = rest[1:end]
+		rest = rest[end+2:]
+		published, target, found := strings.Cut(rest, ":")
+		if !found {
+			return port, fmt.Errorf("invalid port %q", spec)
+		}
+		port.Published, port.Target = published, target
+		return port, nil
+	}
+
+	parts := strings.Split(rest, ":")
+	switch len(parts) {
+	case 1:
+		port.Target = parts[0]
+	case 2:
+		port.Published, port.Target = parts[0], parts[1]
+	case 3:
+		port.HostIP, port.Published, port.Target = parts[0], parts[1], parts[2]
+	default:
+		return port, fmt.Errorf("invalid port %q", spec)
+	}
+	if port.Target == "" {
+		return port, fmt.Errorf("invalid port %q", spec)
+	}
+	return port, nil
+}
+
+// ServiceVolume is a volumes entry in short ("source:target[:mode]") or long syntax
+type ServiceVolume struct {
+	Type     string                 `yaml:"type"`
+	Source   string                 `yaml:"source,omitempty"`
+	Target   string                 `yaml:"target"`
+	ReadOnly bool                   `yaml:"read_only,omitempty"`
+	Extra    map[string]interface{} `yaml:",inline"` // bind/volume/tmpfs options
+	Mode     string                 `yaml:"-"`       // Short syntax access mode like "ro,z"
+	long     bool
+}
+
+func (v *ServiceVolume) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.MappingNode {
+		type plain ServiceVolume
+		if err := node.Decode((*plain)(v)); err != nil {
+			return err
+		}
+		v.long = true
+		return nil
+	}
+	if node.Kind != yaml.ScalarNode {
+		return fmt.Errorf("line %d: invalid volume definition", node.Line)
+	}
+	*v = parseVolumeSpec(node.Value)
+	return nil
+}
+
+func (v ServiceVolume) MarshalYAML() (interface{}, error) {
+	if v.long {
+		type plain ServiceVolume
+		return plain(v), nil
+	}
+	return v.String(), nil
+}
+
+// String formats the volume in short syntax
+func (v ServiceVolume) String() string {
+	if v.Source == "" {
+		return v.Target
+	}
+	spec := v.Source + ":" + v.Target
+	if v.Mode != "" {
+		spec += ":" + v.Mode
+	} else if v.ReadOnly {
+		spec += ":ro"
+	}
+	return spec
+}
+
+// IsBind reports whether the volume mounts a host path
+func (v ServiceVolume) IsBind() bool {
+	return v.Type == "bind"
+}
+
+func parseVolumeSpec(spec string) ServiceVolume {
+	var parts []string
+	rest := spec
+	// Keep Windows drive letters ("C:\data") together with the path
+	if len(rest) > 2 && rest[1] == ':' && (rest[2] == '\\' || rest[2] == '/') {
+		head, tail, _ := strings.Cut(rest[2:], ":")
+		parts = append(parts, rest[:2]+head)
+		if tail != "" {
+			parts = append(parts, strings.Split(tail, ":")...)
+		}
+	} else {
+		parts = strings.Split(rest, ":")
+	}
+
+	volume := ServiceVolume{Type: "volume"}
+	switch len(parts) {
+	case 1:
+		volume.Target = parts[0]
+		return volume
+	case 2:
+		volume.Source, volume.Target = parts[0], parts[1]
+	default:
+		volume.Source, volume.Target, volume.Mode = parts[0], parts[1], strings.Join(parts[2:], ":")
+	}
+
+	for _, option := range strings.Split(volume.Mode, ",") {
+		if option == "ro" {
+			volume.ReadOnly = true
+		}
+	}
+	if isHostPath(volume.Source) {
+		volume.Type = "bind"
+	}
+	return volume
+}
+
+func isHostPath(source string) bool {
+	if strings.HasPrefix(source, "/") || strings.HasPrefix(source, ".") || strings.HasPrefix(source, "~") {
+		return true
+	}
+	return len(source) > 1 && source[1] == ':'
+}
+
+// ServiceNetwork is a single network attachment of a service
+type ServiceNetwork struct {
+	Name   string
+	Config map[string]interface{} // aliases, ipv4_address, ... (nil in list syntax)
+}
+
+// ServiceNetworks holds networks in declaration order, list or map syntax
+type ServiceNetworks struct {
+	Networks []ServiceNetwork
+	isMap    bool
+}
+
+// Names returns the attached network names
+func (n ServiceNetworks) Names() []string {
+	names := make([]string, len(n.Networks))
+	for i, network := range n.Networks {
+		names[i] = network.Name
+	}
+	return names
+}
+
+func (n ServiceNetworks) IsZero() bool {
+	return len(n.Networks) == 0
+}
+
+func (n *ServiceNetworks) UnmarshalYAML(node *yaml.Node) error {
+	n.Networks = nil
+	switch node.Kind {
+	case yaml.SequenceNode:
+		var names []string
+		if err := node.Decode(&names); err != nil {
+			return err
+		}
+		for _, name := range names {
+			n.Networks = append(n.Networks, ServiceNetwork{Name: name})
+		}
+	case yaml.MappingNode:
+		n.isMap = true
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			network := ServiceNetwork{Name: node.Content[i].Value}
+			if err := node.Content[i+1].Decode(&network.Config); err != nil {
+				return err
+			}
+			n.Networks = append(n.Networks, network)
+		}
+	default:
+		return fmt.Errorf("line %d: networks must be a list or a map", node.Line)
+	}
+	return nil
+}
+
+func (n ServiceNetworks) MarshalYAML() (interface{}, error) {
+	if !n.isMap {
+		return n.Names(), nil
+	}
+	node := &yaml.Node{Kind: yaml.MappingNode}
+	for _, network := range n.Networks {
+		value := yaml.Node{Kind: yaml.ScalarNode, Tag: "!!null", Value: "null"}
+		if network.Config != nil {
+			if err := value.Encode(network.Config); err != nil {
+				return nil, err
+			}
+		}
+		node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: network.Name}, &value)
+	}
+	return node, nil
+}
+
+// Dependency is a single depends_on entry
+type Dependency struct {
+	Service   string `yaml:"-"`
+	Condition string `yaml:"condition,omitempty"`
+	Restart   *bool  `yaml:"restart,omitempty"`
+	Required  *bool  `yaml:"required,omitempty"`
+}
+
+// DependsOn holds depends_on in declaration order, list or map syntax
+type DependsOn struct {
+	Dependencies []Dependency
+	isMap        bool
+}
+
+// Services returns the names of all services depended on
+func (d DependsOn) Services() []string {
+	names := make([]string, len(d.Dependencies))
+	for i, dep := range d.Dependencies {
+		names[i] = dep.Service
+	}
+	return names
+}
+
+func (d DependsOn) IsZero() bool {
+	return len(d.Dependencies) == 0
+}
+
+func (d *DependsOn) UnmarshalYAML(node *yaml.Node) error {
+	d.Dependencies = nil
+	switch node.Kind {
+	case yaml.SequenceNode:
+		var names []string
+		if err := node.Decode(&names); err != nil {
+			return err
+		}
+		for _, name := range names {
+			d.Dependencies = append(d.Dependencies, Dependency{Service: name})
+		}
+	case yaml.MappingNode:
+		d.isMap = true
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			dep := Dependency{Service: node.Content[i].Value}
+			if err := node.Content[i+1].Decode(&dep); err != nil {
+				return err
+			}
+			d.Dependencies = append(d.Dependencies, dep)
+		}
+	default:
+		return fmt.Errorf("line %d: depends_on must be a list or a map", node.Line)
+	}
+	return nil
+}
+
+func (d DependsOn) MarshalYAML() (interface{}, error) {
+	if !d.isMap {
+		return d.Services(), nil
+	}
+	node := &yaml.Node{Kind: yaml.MappingNode}
+	for _, dep := range d.Dependencies {
+		var value yaml.Node
+		if err := value.Encode(dep); err != nil {
+			return nil, err
+		}
+		node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: dep.Service}, &value)
+	}
+	return node, nil
+}
+
+// ShellCommand is a command or entrypoint, either a shell string or an exec list
+type ShellCommand struct {
+	Shell string   // Set when the string form was used
+	Exec  []string // Set when the list form was used
+}
+
+func (c ShellCommand) IsZero() bool {
+	return c.Shell == "" && c.Exec == nil
+}
+
+func (c *ShellCommand) UnmarshalYAML(node *yaml.Node) error {
+	*c = ShellCommand{}
+	switch node.Kind {
+	case yaml.ScalarNode:
+		if node.Tag != "!!null" {
+			c.Shell = node.Value
+		}
+		return nil
+	case yaml.SequenceNode:
+		c.Exec = []string{}
+		return node.Decode(&c.Exec)
+	default:
+		return fmt.Errorf("line %d: command must be a string or a list", node.Line)
+	}
+}
+
+func (c ShellCommand) MarshalYAML() (interface{}, error) {
+	if c.Exec != nil {
+		return c.Exec, nil
+	}
+	return c.Shell, nil
+}
+
+// loadOptions are the bundle time inputs applied while loading compose files
+type loadOptions struct {
+	values map[string]string // x-bundle parameter values
+	sets   []string          // path=value overrides
+}
+
+// loadComposeFiles reads the given compose files, merges later files into
+// earlier ones, interpolates variables and parameter values, applies --set
+// overrides and validates the result
+func loadComposeFiles(files []string, opts loadOptions) (*DockerCompose, error) {
+	compose, err := parseComposeFiles(files, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateCompose(compose); err != nil {
+		return nil, err
+	}
+	return compose, nil
+}
+
+// parseComposeFiles is loadComposeFiles without validation, for fragments
+// that refer to services defined elsewhere
+func parseComposeFiles(files []string, opts loadOptions) (*DockerCompose, error) {
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no compose file given")
+	}
+
+	// Values of an encrypted .env end up in the model, the bundled compose file has to be encrypted too
+	env, encrypted, err := interpolationEnvironment(filepath.Dir(files[0]))
+	if err != nil {
+		return nil, err
+	}
+
+	var roots []*yaml.Node
+	for _, file := range files {
+		data, sopsEncrypted, err := readSecretFile(file, sopsYAML)
+		if err != nil {
+			return nil, err
+		}
+		encrypted = encrypted || sopsEncrypted
+		var doc yaml.Node
+		if err := yaml.Unmarshal(data, &doc); err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		if len(doc.Content) == 0 {
+			roots = append(roots, nil)
+			continue
+		}
+		roots = append(roots, resolveAnchors(doc.Content[0]))
+	}
+
+	// Parameters may be declared in any of the files and used in all of them
+	parameters, err := resolveParameters(roots, opts.values, env)
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range parameters {
+		env[name] = value
+	}
+
+	// Extensions are kept as written, merged like the rest of the files
+	var merged, raw *yaml.Node
+	for i, root := range roots {
+		if root == nil {
+			continue
+		}
+		written := resolveAnchors(root)
+		if err := interpolateNode(root, env); err != nil {
+			return nil, fmt.Errorf("%s: %w", files[i], err)
+		}
+		if merged == nil {
+			merged, raw = root, written
+		} else {
+			mergeNodes(merged, root, "")
+			mergeNodes(raw, written, "")
+		}
+	}
+	if merged == nil {
+		return nil, fmt.Errorf("%s is empty", files[0])
+	}
+	for _, set := range opts.sets {
+		if err := applySet(merged, set); err != nil {
+			return nil, err
+		}
+		if err := applySet(raw, set); err != nil {
+			return nil, err
+		}
+	}
+
+	var compose DockerCompose
+	if err := merged.Decode(&compose); err != nil {
+		return nil, err
+	}
+	compose.sopsEncrypted = encrypted
+	compose.parameters = parameters
+	compose.extensions = captureExtensions(raw)
+	return &compose, nil
+}
+
+// readBundleCompose reads the compose file written into a bundle, undoing
+// the "$" escaping applied when it was written
+func readBundleCompose(path string) (*DockerCompose, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseBundleCompose(data)
+}
+
+func parseBundleCompose(data []byte) (*DockerCompose, error) {
+	if isSOPSEncrypted(data, sopsYAML) {
+		return nil, fmt.Errorf("the bundled docker-compose.yml is SOPS-encrypted, decrypt it first with: sops --decrypt --in-place docker-compose.yml")
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("failed to parse bundled compose file: %w", err)
+	}
+	if len(doc.Content) == 0 {
+		return nil, fmt.Errorf("bundled compose file is empty")
+	}
+	// Extensions were written without escaping
+	extensions := captureExtensions(resolveAnchors(doc.Content[0]))
+	unescapeDollars(doc.Content[0])
+
+	var compose DockerCompose
+	if err := doc.Content[0].Decode(&compose); err != nil {
+		return nil, fmt.Errorf("failed to parse bundled compose file: %w", err)
+	}
+	compose.extensions = extensions
+	return &compose, nil
+}
+
+func unescapeDollars(node *yaml.Node) {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		node.Value = strings.ReplaceAll(node.Value, "$$", "$")
+	case yaml.MappingNode:
+		for i := 1; i < len(node.Content); i += 2 {
+			unescapeDollars(node.Content[i])
+		}
+	default:
+		for _, child := range node.Content {
+			unescapeDollars(child)
+		}
+	}
+}
+
+// resolveAnchors returns a deep copy of node with every alias replaced by a
+// copy of its anchor and "<<" merge keys expanded, so later processing never
+// modifies shared nodes and the written compose file is self-contained
+func resolveAnchors(node *yaml.Node) *yaml.Node {
+	if node.Kind == yaml.AliasNode {
+		return resolveAnchors(node.Alias)
+	}
+
+	copied := *node
+	copied.Anchor = ""
+	copied.Content = nil
+
+	if node.Kind != yaml.MappingNode {
+		for _, child := range node.Content {
+			copied.Content = append(copied.Content, resolveAnchors(child))
+		}
+		return &copied
+	}
+
+	// Explicit keys win over merged ones, earlier merge sources over later ones
+	var merged []*yaml.Node
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		if key.Tag == "!!merge" || (key.Value == "<<" && key.Style == 0) {
+			value = resolveAnchors(value)
+			if value.Kind == yaml.SequenceNode {
+				merged = append(merged, value.Content...)
+			} else {
+				merged = append(merged, value)
+			}
+			continue
+		}
+		copied.Content = append(copied.Content, resolveAnchors(key), resolveAnchors(value))
+	}
+
+	for _, source := range merged {
+		if source.Kind != yaml.MappingNode {
+			continue
+		}
+		for i := 0; i+1 < len(source.Content); i += 2 {
+			if mappingValue(&copied, source.Content[i].Value) == nil {
+				copied.Content = append(copied.Content, source.Content[i], source.Content[i+1])
+			}
+		}
+	}
+	return &copied
+}
+
+// mappingValue returns the value node for key in a mapping node
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// interpolationEnvironment returns the process environment on top of the
+// project's .env file, like compose does, and whether the .env file is
+// SOPS-encrypted
+func interpolationEnvironment(projectDir string) (map[string]string, bool, error) {
+	env := make(map[string]string)
+	data, encrypted, err := readSecretFile(filepath.Join(projectDir, ".env"), sopsDotenv)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, false, err
+	}
+	if err == nil {
+		env = parseDotEnv(data)
+	}
+	for _, kv := range os.Environ() {
+		if key, value, found := strings.Cut(kv, "="); found {
+			env[key] = value
+		}
+	}
+	return env, encrypted, nil
+}
+
+// parseDotEnv parses KEY=VALUE lines, ignoring comments and "export " prefixes
+func parseDotEnv(data []byte) map[string]string {
+	env := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		key, value, found := strings.Cut(line, "=")
+		if !found {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		env[strings.TrimSpace(key)] = value
+	}
+	return env
+}
+
+// interpolateNode substitutes ${VAR} style references in all scalar values
+func interpolateNode(node *yaml.Node, env map[string]string) error {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		if !strings.Contains(node.Value, "$") {
+			return nil
+		}
+		value, err := interpolate(node.Value, env)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", node.Line, err)
+		}
+		if value != node.Value {
+			node.Value = value
+			if node.Style == 0 {
+				node.Tag = "" // Let the decoder resolve the substituted value
+			}
+		}
+	case yaml.MappingNode:
+		// Only values are interpolated, keys are taken literally
+		for i := 1; i < len(node.Content); i += 2 {
+			if err := interpolateNode(node.Content[i], env); err != nil {
+				return err
+			}
+		}
+	default:
+		for _, child := range node.Content {
+			if err := interpolateNode(child, env); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+var variableNameRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*`)
+
+// interpolate expands $VAR, ${VAR} and the ${VAR:-default}, ${VAR-default},
+// ${VAR:?error}, ${VAR?error}, ${VAR:+alt} and ${VAR+alt} forms. "$$" is a literal "$".
+func interpolate(s string, env map[string]string) (string, error) {
+	var out strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '$' || i+1 == len(s) {
+			out.WriteByte(s[i])
+			continue
+		}
+
+		next := s[i+1]
+		switch {
+		case next == '$':
+			out.WriteByte('$')
+			i++
+		case next == '{':
+			end := matchingBrace(s, i+1)
+			if end < 0 {
+				return "", fmt.Errorf("unterminated variable in %q", s)
+			}
+			value, err := expandBraced(s[i+2:end], env)
+			if err != nil {
+				return "", err
+			}
+			out.WriteString(value)
+			i = end
+		default:
+			name := variableNameRegex.FindString(s[i+1:])
+			if name == "" {
+				out.WriteByte('$')
+				continue
+			}
+			out.WriteString(env[name])
+			i += len(name)
+		}
+	}
+	return out.String(), nil
+}
+
+func matchingBrace(s string, open int) int {
+	depth := 0
+	for i := open; i < len(s); i++ {
+		switch s[i] {
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+func expandBraced(expr string, env map[string]string) (string, error) {
+	name := variableNameRegex.FindString(expr)
+	if name == "" {
+		return "", fmt.Errorf("invalid variable reference ${%s}", expr)
+	}
+	op := expr[len(name):]
+	value, set := env[name]
+	if op == "" {
+		return value, nil
+	}
+
+	checkEmpty := strings.HasPrefix(op, ":")
+	op = strings.TrimPrefix(op, ":")
+	if op == "" {
+		return "", fmt.Errorf("invalid variable reference ${%s}", expr)
+	}
+	unset := !set || (checkEmpty && value == "")
+	arg := op[1:]
+
+	switch op[0] {
+	case '-':
+		if unset {
+			return interpolate(arg, env)
+		}
+		return value, nil
+	case '?':
+		if unset {
+			return "", fmt.Errorf("required variable %s is missing a value: %s", name, arg)
+		}
+		return value, nil
+	case '+':
+		if !unset {
+			return interpolate(arg, env)
+		}
+		return "", nil
+	default:
+		return "", fmt.Errorf("invalid variable reference ${%s}", expr)
+	}
+}
+
+// appendedKeys are service sequences that are concatenated instead of
+// replaced when an override file is merged
+var appendedKeys = map[string]bool{
+	"ports": true, "expose": true, "volumes": true, "secrets": true, "configs": true,
+	"dns": true, "dns_search": true, "tmpfs": true, "cap_add": true, "cap_drop": true,
+	"devices": true, "extra_hosts": true, "env_file": true, "external_links": true,
+}
+
+// keyedKeys are sequences in KEY=VALUE form that are merged by key
+var keyedKeys = map[string]bool{"environment": true, "labels": true, "args": true}
+
+// mergeNodes merges override into base following the compose merge rules
+func mergeNodes(base, override *yaml.Node, key string) {
+	// A list and a mapping of the same keyed entries merge like two mappings
+	if keyedKeys[key] && base.Kind != override.Kind && isKeyedNode(base) && isKeyedNode(override) {
+		*base = *keyedMapping(base)
+		override = keyedMapping(override)
+	}
+	if base.Kind == yaml.MappingNode && override.Kind == yaml.MappingNode {
+		for i := 0; i+1 < len(override.Content); i += 2 {
+			k, v := override.Content[i], override.Content[i+1]
+			found := false
+			for j := 0; j+1 < len(base.Content); j += 2 {
+				if base.Content[j].Value == k.Value {
+					mergeNodes(base.Content[j+1], v, k.Value)
+					found = true
+					break
+				}
+			}
+			if !found {
+				base.Content = append(base.Content, k, v)
+			}
+		}
+		return
+	}
+
+	if base.Kind == yaml.SequenceNode && override.Kind == yaml.SequenceNode {
+		if appendedKeys[key] {
+			base.Content = append(base.Content, override.Content...)
+			return
+		}
+		if keyedKeys[key] {
+			for _, item := range override.Content {
+				name, _, _ := strings.Cut(item.Value, "=")
+				replaced := false
+				for j, existing := range base.Content {
+					if existingName, _, _ := strings.Cut(existing.Value, "="); existingName == name {
+						base.Content[j] = item
+						replaced = true
+						break
+					}
+				}
+				if !replaced {
+					base.Content = append(base.Content, item)
+				}
+			}
+			return
+		}
+	}
+
+	*base = *override
+}
+
+func isKeyedNode(node *yaml.Node) bool {
+	return node.Kind == yaml.MappingNode || node.Kind == yaml.SequenceNode
+}
+
+// keyedMapping returns the mapping form of a KEY=VALUE sequence, a KEY
+// without value maps to null like in compose
+func keyedMapping(node *yaml.Node) *yaml.Node {
+	if node.Kind == yaml.MappingNode {
+		return node
+	}
+	mapping := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map", Line: node.Line, Column: node.Column}
+	for _, item := range node.Content {
+		name, value, hasValue := strings.Cut(item.Value, "=")
+		valueNode := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!null", Line: item.Line, Column: item.Column}
+		if hasValue {
+			valueNode = &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: value, Line: item.Line, Column: item.Column}
+		}
+		mapping.Content = append(mapping.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: name, Line: item.Line, Column: item.Column}, valueNode)
+	}
+	return mapping
+}
+
+// validateCompose checks references between services and top-level elements
+func validateCompose(compose *DockerCompose) error {
+	var problems []string
+
+	for _, name := range sortedServiceNames(compose) {
+		service := compose.Services[name]
+		if service.Image == "" && service.Build == nil {
+			problems = append(problems, fmt.Sprintf("service %s has neither an image nor a build section", name))
+		}
+		for _, dep := range service.DependsOn.Dependencies {
+			if _, ok := compose.Services[dep.Service]; !ok {
+				problems = append(problems, fmt.Sprintf("service %s depends on undefined service %s", name, dep.Service))
+			}
+		}
+		for _, network := range service.Networks.Names() {
+			if _, ok := compose.Networks[network]; !ok && network != "default" {
+				problems = append(problems, fmt.Sprintf("service %s refers to undefined network %s", name, network))
+			}
+		}
+		for _, volume := range service.Volumes {
+			if volume.Type != "volume" || volume.Source == "" {
+				continue
+			}
+			if _, ok := compose.Volumes[volume.Source]; !ok {
+				problems = append(problems, fmt.Sprintf("service %s refers to undefined volume %s", name, volume.Source))
+			}
+		}
+		for _, key := range []string{"secrets", "configs"} {
+			declared := compose.Secrets
+			if key == "configs" {
+				declared = compose.Configs
+			}
+			refs, _ := service.Extra[key].([]interface{})
+			for _, ref := range refs {
+				source, _ := ref.(string)
+				if m, ok := ref.(map[string]interface{}); ok {
+					source, _ = m["source"].(string)
+				}
+				if _, ok := declared[source]; !ok {
+					problems = append(problems, fmt.Sprintf("service %s refers to undefined %s entry %s", name, strings.TrimSuffix(key, "s"), source))
+				}
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid compose file:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
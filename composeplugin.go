@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+)
+
+// composePluginPrefix starts the names of the docker compose release binaries
+const composePluginPrefix = "docker-compose-"
+
+// composePluginArches maps the architectures in the names of the docker
+// compose release binaries to Go architectures
+var composePluginArches = map[string]string{
+	"x86_64":  "amd64",
+	"aarch64": "arm64",
+	"armv6":   "arm/v6",
+	"armv7":   "arm/v7",
+	"ppc64le": "ppc64le",
+	"riscv64": "riscv64",
+	"s390x":   "s390x",
+}
+
+// unameMachines are the uname -m values of the hosts a plugin architecture runs on
+var unameMachines = map[string][]string{
+	"amd64":   {"x86_64"},
+	"arm64":   {"aarch64", "arm64"},
+	"arm/v6":  {"armv6l"},
+	"arm/v7":  {"armv7l"},
+	"ppc64le": {"ppc64le"},
+	"riscv64": {"riscv64"},
+	"s390x":   {"s390x"},
+}
+
+// ManifestComposePlugin is a docker compose plugin binary in the bundle
+type ManifestComposePlugin struct {
+	Platform string `json:"platform"` // os/arch[/variant]
+	File     string `json:"file"`
+	Size     int64  `json:"size"`
+	SHA256   string `json:"sha256"`
+}
+
+// composePluginPlatform returns the platform of a docker-compose-<os>-<arch>
+// binary as released by Docker, e.g. docker-compose-linux-x86_64
+func composePluginPlatform(name string) (string, bool) {
+	rest, ok := strings.CutPrefix(strings.TrimSuffix(name, ".exe"), composePluginPrefix)
+	goos, arch, ok2 := strings.Cut(rest, "-")
+	goarch, known := composePluginArches[arch]
+	if !ok || !ok2 || goos == "" || !known {
+		return "", false
+	}
+	return goos + "/" + goarch, true
+}
+
+// checkComposePlugins validates the names of the --compose-plugin binaries
+func checkComposePlugins(paths []string) error {
+	for _, p := range paths {
+		if _, ok := composePluginPlatform(filepath.Base(p)); !ok {
+			return fmt.Errorf("compose plugin %s must be named as released by Docker, %s<os>-<arch>[.exe] like docker-compose-linux-x86_64", p, composePluginPrefix)
+		}
+	}
+	return nil
+}
+
+// embedComposePlugins copies the --compose-plugin binaries into bundleDir
+func (b *Bundler) embedComposePlugins(bundleDir string, manifest *Manifest) error {
+	if err := checkComposePlugins(b.opts.ComposePlugins); err != nil {
+		return err
+	}
+	for _, source := range b.opts.ComposePlugins {
+		name := filepath.Base(source)
+		platform, _ := composePluginPlatform(name)
+		if slices.ContainsFunc(manifest.ComposePlugins, func(p ManifestComposePlugin) bool { return p.Platform == platform }) {
+			return fmt.Errorf("more than one compose plugin for %s", platform)
+		}
+		file := "compose-plugin/" + name
+		target := filepath.Join(bundleDir, filepath.FromSlash(file))
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		if err := copyFile(source, target); err != nil {
+			return fmt.Errorf("failed to embed compose plugin: %w", err)
+		}
+		if err := os.Chmod(target, 0755); err != nil {
+			return err
+		}
+		size, digest, err := fileDigest(target)
+		if err != nil {
+			return err
+		}
+		manifest.ComposePlugins = append(manifest.ComposePlugins, ManifestComposePlugin{Platform: platform, File: file, Size: size, SHA256: digest})
+		b.decidef("Embedded the %s docker compose plugin in the bundle", platform)
+	}
+	slices.SortFunc(manifest.ComposePlugins, func(a, b ManifestComposePlugin) int { return strings.Compare(a.Platform, b.Platform) })
+	return nil
+}
+
+// composePluginInstaller is the part of load-images.sh that installs the
+// bundled plugin for the host if it has neither docker compose nor
+// docker-compose. Only Linux plugins are installed, Docker Desktop comes with
+// compose.
+func composePluginInstaller(plugins []ManifestComposePlugin) string {
+	var cases strings.Builder
+	for _, plugin := range plugins {
+		goos, arch, _ := strings.Cut(plugin.Platform, "/")
+		if goos != "linux" {
+			continue
+		}
+		for _, machine := range unameMachines[arch] {
+			fmt.Fprintf(&cases, "        %s) PLUGIN=%s; PLUGIN_SHA256=%s ;;\n", machine, plugin.File, plugin.SHA256)
+		}
+	}
+	if cases.Len() == 0 {
+		return ""
+	}
+	return `
+# Install the bundled docker compose plugin on hosts without compose
+if ! docker compose version >/dev/null 2>&1 && ! command -v docker-compose >/dev/null 2>&1 && [ "$(uname -s)" = Linux ]; then
+    PLUGIN=""
+    case "$(uname -m)" in
+` + cases.String() + `    esac
+    if [ -n "$PLUGIN" ]; then
+        echo "$PLUGIN_SHA256  $PLUGIN" | sha256sum -c --quiet
+        if [ "$(id -u)" -eq 0 ]; then
+            PLUGIN_DIR=/usr/local/lib/docker/cli-plugins
+        else
+            PLUGIN_DIR="$HOME/.docker/cli-plugins"
+        fi
+        mkdir -p "$PLUGIN_DIR"
+        install -m 0755 "$PLUGIN" "$PLUGIN_DIR/docker-compose"
+        printf "$MSG_COMPOSE_INSTALLED\n" "$PLUGIN_DIR/docker-compose"
+    fi
+fi
+`
+}
+
+// composeInstalled reports whether the host has docker compose or docker-compose
+func composeInstalled() bool {
+	if exec.Command("docker", "compose", "version").Run() == nil {
+		return true
+	}
+	_, err := exec.LookPath("docker-compose")
+	return err == nil
+}
+
+// composePlugin returns the compose plugin of the bundle for this host, nil
+// if it has none. ARM plugins are sorted v6 first, which runs on v7 as well.
+func (l *Loader) composePlugin() *ManifestComposePlugin {
+	for i, plugin := range l.manifest.ComposePlugins {
+		goos, arch, _ := strings.Cut(plugin.Platform, "/")
+		arch, _, _ = strings.Cut(arch, "/")
+		if goos == runtime.GOOS && arch == runtime.GOARCH && validMemberPath(plugin.File) {
+			return &l.manifest.ComposePlugins[i]
+		}
+	}
+	return nil
+}
+
+// composePluginDir is where the docker CLI looks for plugins of the user,
+// root installs them for all users
+func composePluginDir() (string, error) {
+	if runtime.GOOS == "linux" && os.Geteuid() == 0 {
+		return "/usr/local/lib/docker/cli-plugins", nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".docker", "cli-plugins"), nil
+}
+
+// InstallComposePlugin installs the compose plugin of the bundle if the host
+// has no compose, which deploy needs to start the stack
+func (l *Loader) InstallComposePlugin() error {
+	plugin := l.composePlugin()
+	if plugin == nil || composeInstalled() {
+		return nil
+	}
+	dir, err := composePluginDir()
+	if err != nil {
+		return fmt.Errorf("failed to locate the docker CLI plugin directory: %w", err)
+	}
+	target := filepath.Join(dir, "docker-compose")
+	if runtime.GOOS == "windows" {
+		target += ".exe"
+	}
+	if err := installLoader(filepath.Join(l.dir, filepath.FromSlash(plugin.File)), target, plugin.SHA256); err != nil {
+		return fmt.Errorf("failed to install the compose plugin: %w", err)
+	}
+	fmt.Printf("Docker compose is not installed, installed the bundled %s plugin to %s\n", path.Base(plugin.File), target)
+	return nil
+}
@@ -0,0 +1,431 @@
+// Package composetransform applies the compose file rewriting of
+// docker-compose-bundler without Docker, so other tools produce the same
+// compose file the bundler writes into a bundle:
+//
+//	result, err := composetransform.Transform(data, composetransform.Options{})
+//	if err != nil {
+//		return err
+//	}
+//	os.WriteFile("docker-compose.yml", result.Compose, 0644)
+//
+// Services with a build section get the image the bundler builds for them,
+// pull policies that would pull at an offline site become missing, images are
+// optionally moved under a prefix or pinned to digests, and env_file paths
+// point to the copies in the env/ directory of the bundle. Develop sections
+// are removed, legacy syntax is modernized and extensions are stripped on
+// request. Variables are not interpolated and other keys are kept as they are.
+// The bundler writes its compose file through TransformNode.
+package composetransform
+
+import (
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	"gopkg.in/yaml.v3"
+)
+
+// Compose pull_policy values the transformation keeps, every other policy
+// pulls at the target
+const (
+	PullPolicyNever        = "never"
+	PullPolicyMissing      = "missing"
+	PullPolicyIfNotPresent = "if_not_present"
+)
+
+// Options of Transform
+type Options struct {
+	// Name and Version of the bundle, taken from x-bundle if empty. They
+	// name the images of services with a build section.
+	Name    string
+	Version string
+	// RetagPrefix moves every image under this namespace like --retag-prefix
+	RetagPrefix string
+	// Digests pins images to a registry digest, keyed by the image as
+	// written, e.g. from bundle.lock. The bundler itself keeps tags.
+	Digests map[string]string
+	// Images replaces the image of services by service name, e.g. a build
+	// the bundler tagged with a suffix after a tag conflict. Digests and
+	// RetagPrefix still apply.
+	Images map[string]string
+	// Unbundled lists services whose image is not in the bundle, e.g. left
+	// out with --allow-partial. Their image and pull_policy are kept as written.
+	Unbundled []string
+	// KeepDevelop keeps the develop sections and the bind mounts of watched
+	// sources like --keep-develop, relative paths are resolved against BaseDir
+	KeepDevelop bool
+	BaseDir     string
+	// Modernize rewrites legacy compose 2.x/3.x syntax like --modernize
+	Modernize bool
+	// Extensions is preserve (default), strip or error like --extensions
+	Extensions string
+	// UsedEnvFiles are names already taken in the env/ directory, e.g. by
+	// the bundle services are appended to
+	UsedEnvFiles []string
+}
+
+// Result of Transform
+type Result struct {
+	Compose []byte
+	// EnvFiles maps the env_file paths as written in the compose file to
+	// their path in the bundle, the files have to be copied there
+	EnvFiles map[string]string
+	// Images are the images of the transformed services by service name
+	Images map[string]string
+	// Changes describes the removed develop sections, extensions and
+	// rewritten pull policies
+	Changes []string
+	// Modernized describes the changes of Options.Modernize
+	Modernized []string
+}
+
+// BuiltImage is the image the bundler builds for a service with a build section
+func BuiltImage(bundleName, serviceName, bundleVersion string) string {
+	return fmt.Sprintf("bundles/%s/%s:%s", bundleName, serviceName, bundleVersion)
+}
+
+// Retag moves an image reference under prefix, dropping the registry,
+// Docker Hub's "library/" and the "bundles/" namespace of built images:
+// postgres:15 -> customer-x/postgres:15, bundles/app/web:1.0.0 -> customer-x/app/web:1.0.0
+func Retag(imageName, prefix string) (string, error) {
+	named, err := reference.ParseNormalizedNamed(imageName)
+	if err != nil {
+		return "", err
+	}
+
+	path := reference.Path(named)
+	path = strings.TrimPrefix(path, "library/")
+	path = strings.TrimPrefix(path, "bundles/")
+
+	tag := "latest"
+	if tagged, ok := named.(reference.Tagged); ok {
+		tag = tagged.Tag()
+	} else if digested, ok := named.(reference.Digested); ok {
+		tag = digested.Digest().Encoded()[:12]
+	}
+
+	retagged := strings.TrimSuffix(prefix, "/") + "/" + path + ":" + tag
+	if _, err := reference.ParseNormalizedNamed(retagged); err != nil {
+		return "", fmt.Errorf("invalid retagged name %s: %w", retagged, err)
+	}
+	return retagged, nil
+}
+
+// PinDigest adds a digest to an image reference, keeping its tag for readers
+func PinDigest(imageName, dgst string) (string, error) {
+	named, err := reference.ParseNormalizedNamed(imageName)
+	if err != nil {
+		return "", err
+	}
+	d, err := digest.Parse(dgst)
+	if err != nil {
+		return "", fmt.Errorf("invalid digest for %s: %w", imageName, err)
+	}
+	if digested, ok := named.(reference.Digested); ok && digested.Digest() != d {
+		return "", fmt.Errorf("image %s is already pinned to another digest", imageName)
+	}
+	pinned, err := reference.WithDigest(named, d)
+	if err != nil {
+		return "", err
+	}
+	return reference.FamiliarString(pinned), nil
+}
+
+// BundledPullPolicy returns the pull_policy of a service in the bundle and
+// whether it has one: built services lose it with their build section, and
+// policies that would pull an image already loaded from the bundle become
+// missing, pulls fail at offline sites
+func BundledPullPolicy(policy string, built bool) (string, bool) {
+	switch {
+	case built:
+		return "", false
+	case policy != PullPolicyNever && policy != PullPolicyMissing && policy != PullPolicyIfNotPresent:
+		return PullPolicyMissing, true
+	}
+	return policy, true
+}
+
+// EnvFileName returns the name of an env file in the env/ directory of the
+// bundle, numbering names already used
+func EnvFileName(used map[string]bool, source string) string {
+	base := path.Base(strings.ReplaceAll(source, `\`, "/"))
+	name := base
+	for i := 1; used[name]; i++ {
+		name = fmt.Sprintf("%d-%s", i, base)
+	}
+	used[name] = true
+	return name
+}
+
+// Transform rewrites a compose file like the bundler does for the bundle
+func Transform(data []byte, opts Options) (*Result, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if len(doc.Content) == 0 {
+		return nil, fmt.Errorf("empty compose file")
+	}
+	result, err := TransformNode(doc.Content[0], opts)
+	if err != nil {
+		return nil, err
+	}
+	if result.Compose, err = yaml.Marshal(&doc); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// TransformNode rewrites the root mapping of a parsed compose file in place,
+// Result.Compose stays empty
+func TransformNode(root *yaml.Node, opts Options) (*Result, error) {
+	if root.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("compose file is not a mapping")
+	}
+	if opts.RetagPrefix != "" && len(opts.Digests) > 0 {
+		return nil, fmt.Errorf("retagged images have no registry digest, Digests cannot be combined with RetagPrefix")
+	}
+	policy, err := ParseExtensionPolicy(opts.Extensions)
+	if err != nil {
+		return nil, err
+	}
+	if xBundle := mappingValue(root, "x-bundle"); xBundle != nil {
+		if opts.Name == "" {
+			opts.Name = scalarValue(mappingValue(xBundle, "name"))
+		}
+		if opts.Version == "" {
+			opts.Version = scalarValue(mappingValue(xBundle, "version"))
+		}
+	}
+
+	result := &Result{EnvFiles: make(map[string]string), Images: make(map[string]string)}
+	services := mappingValue(root, "services")
+	if services == nil {
+		services = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	}
+	if services.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("services is not a mapping")
+	}
+	// A service is rewritten on a copy with merge keys resolved, anchored
+	// mappings may be shared with other services or extensions
+	var names []string
+	for i := 0; i+1 < len(services.Content); i += 2 {
+		service := resolveAlias(services.Content[i+1])
+		if service.Kind != yaml.MappingNode {
+			return nil, fmt.Errorf("service %s is not a mapping", services.Content[i].Value)
+		}
+		services.Content[i+1] = flattenMapping(service)
+		names = append(names, services.Content[i].Value)
+	}
+	// Sorted like the bundler numbers env files with the same name
+	slices.Sort(names)
+
+	if found := applyExtensionPolicy(root, policy); len(found) > 0 {
+		if policy == ExtensionsError {
+			return nil, extensionsError(found)
+		}
+		if policy == ExtensionsStrip {
+			result.Changes = append(result.Changes, "Stripped extensions "+strings.Join(found, ", "))
+		}
+	}
+	if opts.Modernize {
+		result.Modernized = modernize(root, services, names)
+	}
+	if !opts.KeepDevelop {
+		for _, name := range names {
+			result.Changes = append(result.Changes, stripDevelop(name, mappingValue(services, name), opts.BaseDir)...)
+		}
+	}
+
+	used := make(map[string]bool)
+	for _, name := range opts.UsedEnvFiles {
+		used[name] = true
+	}
+	for _, name := range names {
+		if err := transformService(name, mappingValue(services, name), opts, result, used); err != nil {
+			return nil, fmt.Errorf("service %s: %w", name, err)
+		}
+	}
+	return result, nil
+}
+
+func transformService(name string, service *yaml.Node, opts Options, result *Result, used map[string]bool) error {
+	built := mappingValue(service, "build") != nil
+	image := scalarValue(mappingValue(service, "image"))
+	if built {
+		if opts.Name == "" || opts.Version == "" {
+			return fmt.Errorf("naming the built image needs the bundle name and version")
+		}
+		image = BuiltImage(opts.Name, name, opts.Version)
+		deleteKey(service, "build")
+	}
+	if override, ok := opts.Images[name]; ok {
+		image = override
+	}
+	unbundled := slices.Contains(opts.Unbundled, name)
+
+	if policy := mappingValue(service, "pull_policy"); policy != nil && !unbundled {
+		switch bundled, ok := BundledPullPolicy(policy.Value, built); {
+		case !ok:
+			deleteKey(service, "pull_policy")
+		case bundled != policy.Value:
+			result.Changes = append(result.Changes, fmt.Sprintf("Service %s: pull_policy %s is bundled as %s, the image is loaded from the bundle", name, policy.Value, bundled))
+			setScalar(service, "pull_policy", bundled)
+		}
+	}
+
+	if image != "" && !unbundled {
+		var err error
+		if dgst, ok := opts.Digests[image]; ok {
+			if image, err = PinDigest(image, dgst); err != nil {
+				return err
+			}
+		}
+		if opts.RetagPrefix != "" {
+			if image, err = Retag(image, opts.RetagPrefix); err != nil {
+				return err
+			}
+		}
+		setScalar(service, "image", image)
+		result.Images[name] = image
+	}
+
+	envFile := resolveAlias(mappingValue(service, "env_file"))
+	if envFile == nil {
+		return nil
+	}
+	var paths []*yaml.Node
+	switch envFile.Kind {
+	case yaml.ScalarNode:
+		paths = append(paths, envFile)
+	case yaml.SequenceNode:
+		for _, entry := range envFile.Content {
+			entry = resolveAlias(entry)
+			if entry.Kind == yaml.MappingNode {
+				entry = mappingValue(entry, "path")
+			}
+			if entry != nil && entry.Kind == yaml.ScalarNode {
+				paths = append(paths, entry)
+			}
+		}
+	}
+	for _, p := range paths {
+		target, ok := result.EnvFiles[p.Value]
+		if !ok {
+			target = "./env/" + EnvFileName(used, p.Value)
+			result.EnvFiles[p.Value] = target
+		}
+		p.Value = target
+	}
+	return nil
+}
+
+func resolveAlias(node *yaml.Node) *yaml.Node {
+	for node != nil && node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	return node
+}
+
+func mappingValue(mapping *yaml.Node, key string) *yaml.Node {
+	mapping = resolveAlias(mapping)
+	if mapping == nil || mapping.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			return resolveAlias(mapping.Content[i+1])
+		}
+	}
+	return nil
+}
+
+func scalarValue(node *yaml.Node) string {
+	if node == nil || node.Kind != yaml.ScalarNode {
+		return ""
+	}
+	return node.Value
+}
+
+func deleteKey(mapping *yaml.Node, key string) {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			mapping.Content = slices.Delete(mapping.Content, i, i+2)
+			return
+		}
+	}
+}
+
+func setScalar(mapping *yaml.Node, key, value string) {
+	setValue(mapping, key, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: value})
+}
+
+func setValue(mapping *yaml.Node, key string, value *yaml.Node) {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			mapping.Content[i+1] = value
+			return
+		}
+	}
+	mapping.Content = append(mapping.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, value)
+}
+
+func sortedKeys(mapping *yaml.Node) []string {
+	var keys []string
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		keys = append(keys, mapping.Content[i].Value)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// flattenMapping returns a deep copy of mapping with the keys of << merged in,
+// keys of the mapping itself and earlier merged mappings take precedence
+func flattenMapping(mapping *yaml.Node) *yaml.Node {
+	flat := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map", Style: mapping.Style, Line: mapping.Line, Column: mapping.Column}
+	var merged []*yaml.Node
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		key, value := mapping.Content[i], resolveAlias(mapping.Content[i+1])
+		if key.Value == "<<" && key.Kind == yaml.ScalarNode {
+			if value.Kind == yaml.SequenceNode {
+				for _, m := range value.Content {
+					merged = append(merged, resolveAlias(m))
+				}
+			} else {
+				merged = append(merged, value)
+			}
+			continue
+		}
+		flat.Content = append(flat.Content, copyNode(key), copyNode(value))
+	}
+	for _, m := range merged {
+		if m.Kind != yaml.MappingNode {
+			continue
+		}
+		m = flattenMapping(m)
+		for i := 0; i+1 < len(m.Content); i += 2 {
+			if mappingValue(flat, m.Content[i].Value) == nil {
+				flat.Content = append(flat.Content, m.Content[i], m.Content[i+1])
+			}
+		}
+	}
+	return flat
+}
+
+// copyNode copies a node and its children, resolving aliases
+func copyNode(node *yaml.Node) *yaml.Node {
+	node = resolveAlias(node)
+	if node.Kind == yaml.MappingNode {
+		return flattenMapping(node)
+	}
+	c := *node
+	c.Anchor = ""
+	c.Content = nil
+	for _, child := range node.Content {
+		c.Content = append(c.Content, copyNode(child))
+	}
+	return &c
+}
@@ -0,0 +1,274 @@
+package composetransform
+
+import (
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+// transform runs Transform and decodes the result for comparisons
+func transform(t *testing.T, compose string, opts Options) (*Result, map[string]interface{}) {
+	t.Helper()
+	result, err := Transform([]byte(compose), opts)
+	if err != nil {
+		t.Fatalf("Transform: %v", err)
+	}
+	var doc map[string]interface{}
+	if err := yaml.Unmarshal(result.Compose, &doc); err != nil {
+		t.Fatal(err)
+	}
+	return result, doc
+}
+
+func service(doc map[string]interface{}, name string) map[string]interface{} {
+	return doc["services"].(map[string]interface{})[name].(map[string]interface{})
+}
+
+func TestTransform(t *testing.T) {
+	compose := `services:
+  app:
+    build: ./app
+    pull_policy: build
+    env_file: [./config/app.env, {path: ./local.env, required: false}]
+    develop:
+      watch:
+        - action: sync
+          path: ./app/src
+          target: /app/src
+    volumes:
+      - ./app/src:/app/src
+      - type: bind
+        source: ./app/static
+        target: /srv/static
+      - ./data:/data
+      - cache:/cache
+  db:
+    image: postgres:16
+    pull_policy: always
+    env_file: ./config/app.env
+  worker:
+    image: shop/worker:1.0
+    pull_policy: never
+x-bundle:
+  name: shop
+  version: 1.2.0
+`
+	result, doc := transform(t, compose, Options{
+		RetagPrefix: "customer-x",
+		Images:      map[string]string{"app": "bundles/shop/app:1.2.0-0123456789ab"},
+		BaseDir:     "/src",
+	})
+
+	app, db, worker := service(doc, "app"), service(doc, "db"), service(doc, "worker")
+	if app["image"] != "customer-x/shop/app:1.2.0-0123456789ab" {
+		t.Errorf("app image is %v", app["image"])
+	}
+	for _, key := range []string{"build", "pull_policy", "develop"} {
+		if _, ok := app[key]; ok {
+			t.Errorf("app keeps %s", key)
+		}
+	}
+	// Only the mounts of watched sources go, ./app/static is a sibling of ./app/src
+	if want := []interface{}{map[string]interface{}{"type": "bind", "source": "./app/static", "target": "/srv/static"}, "./data:/data", "cache:/cache"}; !reflect.DeepEqual(app["volumes"], want) {
+		t.Errorf("app volumes %v, want %v", app["volumes"], want)
+	}
+	if db["image"] != "customer-x/postgres:16" || db["pull_policy"] != PullPolicyMissing {
+		t.Errorf("db is %v with pull_policy %v", db["image"], db["pull_policy"])
+	}
+	if worker["pull_policy"] != PullPolicyNever {
+		t.Errorf("worker pull_policy is %v", worker["pull_policy"])
+	}
+
+	if want := map[string]string{"./config/app.env": "./env/app.env", "./local.env": "./env/local.env"}; !reflect.DeepEqual(result.EnvFiles, want) {
+		t.Errorf("env files %v, want %v", result.EnvFiles, want)
+	}
+	if db["env_file"] != "./env/app.env" {
+		t.Errorf("db env_file is %v", db["env_file"])
+	}
+	if want := map[string]string{"app": "customer-x/shop/app:1.2.0-0123456789ab", "db": "customer-x/postgres:16", "worker": "customer-x/shop/worker:1.0"}; !reflect.DeepEqual(result.Images, want) {
+		t.Errorf("images %v, want %v", result.Images, want)
+	}
+	want := []string{
+		"Removed develop section of service app",
+		"Removed bind mount ./app/src:/app/src of service app, it mounts watched sources",
+		"Service db: pull_policy always is bundled as missing, the image is loaded from the bundle",
+	}
+	if !slices.Equal(result.Changes, want) {
+		t.Errorf("changes %q, want %q", result.Changes, want)
+	}
+}
+
+func TestTransformKeepsDevelop(t *testing.T) {
+	compose := `services:
+  app:
+    image: shop/app:1.0
+    develop:
+      watch: [{action: rebuild, path: .}]
+    volumes: [".:/app"]
+`
+	_, doc := transform(t, compose, Options{KeepDevelop: true})
+	if app := service(doc, "app"); app["develop"] == nil || len(app["volumes"].([]interface{})) != 1 {
+		t.Errorf("KeepDevelop changed app to %v", app)
+	}
+	_, doc = transform(t, compose, Options{BaseDir: filepath.FromSlash("/src")})
+	if app := service(doc, "app"); app["develop"] != nil || app["volumes"] != nil && len(app["volumes"].([]interface{})) != 0 {
+		t.Errorf("develop and the mount of the watched directory are kept: %v", app)
+	}
+}
+
+func TestTransformDigestsAndUnbundled(t *testing.T) {
+	dgst := "sha256:" + strings.Repeat("a", 64)
+	compose := `services:
+  web:
+    image: nginx:1.27
+  metrics:
+    image: prom/prometheus:v2
+    pull_policy: always
+`
+	result, doc := transform(t, compose, Options{Digests: map[string]string{"nginx:1.27": dgst}, Unbundled: []string{"metrics"}})
+	if got := service(doc, "web")["image"]; got != "nginx:1.27@"+dgst {
+		t.Errorf("web image is %v", got)
+	}
+	if metrics := service(doc, "metrics"); metrics["image"] != "prom/prometheus:v2" || metrics["pull_policy"] != "always" {
+		t.Errorf("the unbundled service changed to %v", metrics)
+	}
+	if _, ok := result.Images["metrics"]; ok {
+		t.Errorf("the unbundled image is listed in %v", result.Images)
+	}
+
+	if _, err := Transform([]byte(compose), Options{Digests: map[string]string{"nginx:1.27": dgst}, RetagPrefix: "x"}); err == nil {
+		t.Error("Digests were combined with RetagPrefix")
+	}
+	if _, err := Transform([]byte("services:\n  app:\n    build: .\n"), Options{}); err == nil {
+		t.Error("a built image was named without bundle name and version")
+	}
+}
+
+func TestTransformModernize(t *testing.T) {
+	compose := `version: "2.4"
+services:
+  web:
+    image: nginx:1.27
+    net: host
+    links: [api:backend, cache, legacy-db]
+    depends_on: [cache]
+  api:
+    build: ./api
+    dockerfile: Dockerfile.prod
+    log_driver: syslog
+    log_opt: {tag: api}
+  cache:
+    image: redis:7
+    networks: [backend]
+volumes:
+  data:
+    external:
+      name: shop_data
+x-bundle:
+  name: shop
+  version: 1.2.0
+`
+	result, doc := transform(t, compose, Options{Modernize: true})
+	if _, ok := doc["version"]; ok {
+		t.Error("version is kept")
+	}
+	web, api := service(doc, "web"), service(doc, "api")
+	if web["network_mode"] != "host" || web["net"] != nil {
+		t.Errorf("net became %v", web["network_mode"])
+	}
+	if !reflect.DeepEqual(web["depends_on"], []interface{}{"cache", "api"}) {
+		t.Errorf("depends_on is %v", web["depends_on"])
+	}
+	// legacy-db is no service, its link stays
+	if !reflect.DeepEqual(web["links"], []interface{}{"legacy-db"}) {
+		t.Errorf("links are %v", web["links"])
+	}
+	if want := map[string]interface{}{"default": map[string]interface{}{"aliases": []interface{}{"backend"}}}; !reflect.DeepEqual(api["networks"], want) {
+		t.Errorf("api networks %v, want %v", api["networks"], want)
+	}
+	if want := map[string]interface{}{"driver": "syslog", "options": map[string]interface{}{"tag": "api"}}; !reflect.DeepEqual(api["logging"], want) {
+		t.Errorf("api logging %v, want %v", api["logging"], want)
+	}
+	if want := map[string]interface{}{"external": true, "name": "shop_data"}; !reflect.DeepEqual(doc["volumes"].(map[string]interface{})["data"], want) {
+		t.Errorf("volume data is %v", doc["volumes"].(map[string]interface{})["data"])
+	}
+	if !slices.Contains(result.Modernized, "service api: dockerfile moved into build") || len(result.Modernized) != 9 {
+		t.Errorf("modernized %q", result.Modernized)
+	}
+	if result.Changes != nil {
+		t.Errorf("changes %q without develop sections, extensions or pull policies", result.Changes)
+	}
+}
+
+func TestTransformModernizeDockerfile(t *testing.T) {
+	compose := `services:
+  api:
+    build: ./api
+    dockerfile: Dockerfile.prod
+`
+	var doc yaml.Node
+	if err := yaml.Unmarshal([]byte(compose), &doc); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := TransformNode(doc.Content[0], Options{Name: "shop", Version: "1.2.0", Modernize: true}); err != nil {
+		t.Fatal(err)
+	}
+	// The build section is gone by now, modernize ran before
+	api := mappingValue(mappingValue(doc.Content[0], "services"), "api")
+	if mappingValue(api, "dockerfile") != nil || mappingValue(api, "build") != nil {
+		t.Errorf("api is %v", api.Content)
+	}
+}
+
+func TestTransformExtensions(t *testing.T) {
+	compose := `services:
+  web:
+    image: nginx:1.27
+    x-monitoring: {port: 9113}
+x-defaults: &defaults
+  restart: always
+x-bundle:
+  name: shop
+  version: 1.2.0
+`
+	_, doc := transform(t, compose, Options{})
+	if doc["x-defaults"] == nil || service(doc, "web")["x-monitoring"] == nil {
+		t.Errorf("extensions were not preserved: %v", doc)
+	}
+
+	result, doc := transform(t, compose, Options{Extensions: ExtensionsStrip})
+	if doc["x-defaults"] != nil || service(doc, "web")["x-monitoring"] != nil || doc["x-bundle"] == nil {
+		t.Errorf("stripping left %v", doc)
+	}
+	if want := []string{"Stripped extensions x-defaults, services.web.x-monitoring"}; !slices.Equal(result.Changes, want) {
+		t.Errorf("changes %q, want %q", result.Changes, want)
+	}
+
+	if _, err := Transform([]byte(compose), Options{Extensions: ExtensionsError}); err == nil || !strings.Contains(err.Error(), "x-defaults, services.web.x-monitoring") {
+		t.Errorf("Transform with ExtensionsError: %v", err)
+	}
+	var root yaml.Node
+	if err := yaml.Unmarshal([]byte(compose), &root); err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckExtensions(root.Content[0], ExtensionsError); err == nil {
+		t.Error("CheckExtensions accepted the extensions")
+	}
+	if err := CheckExtensions(root.Content[0], ExtensionsStrip); err != nil || len(root.Content[0].Content) != 6 {
+		t.Errorf("CheckExtensions with strip: %v, %d keys left", err, len(root.Content[0].Content)/2)
+	}
+	if _, err := ParseExtensionPolicy("drop"); err == nil {
+		t.Error("invalid policy accepted")
+	}
+}
+
+func TestTransformUsedEnvFiles(t *testing.T) {
+	result, _ := transform(t, "services:\n  web:\n    image: nginx:1.27\n    env_file: ./web/app.env\n", Options{UsedEnvFiles: []string{"app.env"}})
+	if got := result.EnvFiles["./web/app.env"]; got != "./env/1-app.env" {
+		t.Errorf("env file is bundled as %s, want ./env/1-app.env", got)
+	}
+}
@@ -0,0 +1,117 @@
+package composetransform
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// stripDevelop removes the develop section of a service, which only docker
+// compose watch uses, together with the bind mounts of the sources it
+// watches since a production host has no source tree. It returns what was removed.
+func stripDevelop(name string, service *yaml.Node, baseDir string) []string {
+	develop := mappingValue(service, "develop")
+	if develop == nil {
+		return nil
+	}
+	var paths, targets []string
+	if watch := mappingValue(develop, "watch"); watch != nil && watch.Kind == yaml.SequenceNode {
+		for _, rule := range watch.Content {
+			if p := scalarValue(mappingValue(rule, "path")); p != "" {
+				paths = append(paths, resolveHostPath(p, baseDir))
+			}
+			if target := scalarValue(mappingValue(rule, "target")); target != "" {
+				targets = append(targets, filepath.ToSlash(filepath.Clean(target)))
+			}
+		}
+	}
+	deleteKey(service, "develop")
+	removed := []string{fmt.Sprintf("Removed develop section of service %s", name)}
+
+	volumes := mappingValue(service, "volumes")
+	if volumes == nil || volumes.Kind != yaml.SequenceNode {
+		return removed
+	}
+	volumes.Content = slices.DeleteFunc(volumes.Content, func(volume *yaml.Node) bool {
+		spec, source, target := bindMount(resolveAlias(volume))
+		if source == "" {
+			return false
+		}
+		source = resolveHostPath(source, baseDir)
+		devOnly := slices.Contains(targets, filepath.ToSlash(filepath.Clean(target))) ||
+			slices.ContainsFunc(paths, func(p string) bool { return pathsOverlap(source, p) })
+		if devOnly {
+			removed = append(removed, fmt.Sprintf("Removed bind mount %s of service %s, it mounts watched sources", spec, name))
+		}
+		return devOnly
+	})
+	return removed
+}
+
+// bindMount returns the short syntax, host path and target of a bind mount
+// volumes entry, an empty source for other volumes
+func bindMount(volume *yaml.Node) (spec, source, target string) {
+	switch volume.Kind {
+	case yaml.ScalarNode:
+		source, target = splitVolumeSpec(volume.Value)
+		if !isHostPath(source) {
+			return "", "", ""
+		}
+		return volume.Value, source, target
+	case yaml.MappingNode:
+		if scalarValue(mappingValue(volume, "type")) != "bind" {
+			return "", "", ""
+		}
+		source, target = scalarValue(mappingValue(volume, "source")), scalarValue(mappingValue(volume, "target"))
+		spec = source + ":" + target
+		if scalarValue(mappingValue(volume, "read_only")) == "true" {
+			spec += ":ro"
+		}
+		return spec, source, target
+	}
+	return "", "", ""
+}
+
+// splitVolumeSpec splits a short syntax volume into source and target,
+// keeping Windows drive letters ("C:\data") together with the path
+func splitVolumeSpec(spec string) (source, target string) {
+	rest, drive := spec, ""
+	if len(rest) > 2 && isLetter(rest[0]) && rest[1] == ':' && (rest[2] == '\\' || rest[2] == '/') {
+		drive, rest = rest[:2], rest[2:]
+	}
+	parts := strings.Split(rest, ":")
+	if len(parts) == 1 {
+		return "", drive + parts[0]
+	}
+	return drive + parts[0], parts[1]
+}
+
+func isLetter(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+func isHostPath(source string) bool {
+	if strings.HasPrefix(source, "/") || strings.HasPrefix(source, ".") || strings.HasPrefix(source, "~") {
+		return true
+	}
+	return len(source) > 1 && source[1] == ':'
+}
+
+func resolveHostPath(p, baseDir string) string {
+	if !filepath.IsAbs(p) {
+		p = filepath.Join(baseDir, p)
+	}
+	return filepath.Clean(p)
+}
+
+// pathsOverlap reports whether one path is the other or contains it
+func pathsOverlap(a, b string) bool {
+	within := func(p, dir string) bool {
+		rel, err := filepath.Rel(dir, p)
+		return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+	}
+	return within(a, b) || within(b, a)
+}
@@ -0,0 +1,76 @@
+package composetransform
+
+import (
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// What Options.Extensions does with x-* entries other than x-bundle, on the
+// top level and in services
+const (
+	ExtensionsPreserve = "preserve" // Keep them as written
+	ExtensionsStrip    = "strip"
+	ExtensionsError    = "error"
+)
+
+// IsExtension reports whether key is an x-* entry the bundler does not use
+func IsExtension(key string) bool {
+	return strings.HasPrefix(key, "x-") && key != "x-bundle"
+}
+
+// ParseExtensionPolicy validates an Options.Extensions value, empty means preserve
+func ParseExtensionPolicy(value string) (string, error) {
+	switch value {
+	case "", ExtensionsPreserve:
+		return ExtensionsPreserve, nil
+	case ExtensionsStrip, ExtensionsError:
+		return value, nil
+	}
+	return "", fmt.Errorf("invalid --extensions %q, use preserve, strip or error", value)
+}
+
+// CheckExtensions fails if policy is error and the root mapping of a compose
+// file has extensions, so callers can refuse them before any other work
+func CheckExtensions(root *yaml.Node, policy string) error {
+	policy, err := ParseExtensionPolicy(policy)
+	if err != nil || policy != ExtensionsError {
+		return err
+	}
+	if found := applyExtensionPolicy(copyNode(root), policy); len(found) > 0 {
+		return extensionsError(found)
+	}
+	return nil
+}
+
+// applyExtensionPolicy returns the extensions of root in file order,
+// removing them if policy is strip
+func applyExtensionPolicy(root *yaml.Node, policy string) []string {
+	var found []string
+	strip := func(mapping *yaml.Node, path string) {
+		for i := 0; i+1 < len(mapping.Content); {
+			if key := mapping.Content[i].Value; IsExtension(key) {
+				found = append(found, path+key)
+				if policy == ExtensionsStrip {
+					mapping.Content = append(mapping.Content[:i], mapping.Content[i+2:]...)
+					continue
+				}
+			}
+			i += 2
+		}
+	}
+	strip(root, "")
+	if services := mappingValue(root, "services"); services != nil && services.Kind == yaml.MappingNode {
+		for i := 0; i+1 < len(services.Content); i += 2 {
+			if service := resolveAlias(services.Content[i+1]); service.Kind == yaml.MappingNode {
+				strip(service, "services."+services.Content[i].Value+".")
+			}
+		}
+	}
+	return found
+}
+
+func extensionsError(found []string) error {
+	return fmt.Errorf("the compose file has extensions the bundler does not use, remove them or use --extensions preserve or strip: %s", strings.Join(found, ", "))
+}
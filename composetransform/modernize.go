@@ -0,0 +1,200 @@
+package composetransform
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// modernize rewrites legacy compose 2.x/3.x constructs into their
+// compose-spec form and returns a description of every change
+func modernize(root, services *yaml.Node, names []string) []string {
+	var changes []string
+	if version := mappingValue(root, "version"); version != nil {
+		changes = append(changes, fmt.Sprintf("removed obsolete version %q", version.Value))
+		deleteKey(root, "version")
+	}
+
+	for _, name := range names {
+		changes = append(changes, modernizeServiceKeys(name, mappingValue(services, name))...)
+	}
+	// Links rewrite other services too, the keys are modern by now
+	for _, name := range names {
+		changes = append(changes, modernizeLinks(services, name)...)
+	}
+
+	for _, section := range []struct{ kind, key string }{{"volume", "volumes"}, {"network", "networks"}, {"config", "configs"}, {"secret", "secrets"}} {
+		entries := mappingValue(root, section.key)
+		if entries == nil || entries.Kind != yaml.MappingNode {
+			continue
+		}
+		for _, name := range sortedKeys(entries) {
+			entry := mappingValue(entries, name)
+			external := mappingValue(entry, "external")
+			if external == nil || external.Kind != yaml.MappingNode {
+				continue
+			}
+			// external.name was replaced by a top-level name
+			externalName := scalarValue(mappingValue(external, "name"))
+			setValue(entry, "external", &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!bool", Value: "true"})
+			if externalName != "" {
+				setScalar(entry, "name", externalName)
+			}
+			changes = append(changes, fmt.Sprintf("%s %s: external.name became name", section.kind, name))
+		}
+	}
+	return changes
+}
+
+// modernizeServiceKeys renames the compose v1/v2 keys of a service
+func modernizeServiceKeys(name string, service *yaml.Node) []string {
+	var changes []string
+	if net := mappingValue(service, "net"); net != nil && net.Kind == yaml.ScalarNode {
+		deleteKey(service, "net")
+		if mappingValue(service, "network_mode") == nil {
+			setScalar(service, "network_mode", net.Value)
+		}
+		changes = append(changes, fmt.Sprintf("service %s: net became network_mode", name))
+	}
+
+	driver, options := mappingValue(service, "log_driver"), mappingValue(service, "log_opt")
+	if driver != nil || options != nil {
+		logging := mappingValue(service, "logging")
+		if logging == nil || logging.Kind != yaml.MappingNode {
+			logging = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+			setValue(service, "logging", logging)
+		}
+		if driver != nil {
+			setValue(logging, "driver", driver)
+		}
+		if options != nil {
+			setValue(logging, "options", options)
+		}
+		deleteKey(service, "log_driver")
+		deleteKey(service, "log_opt")
+		changes = append(changes, fmt.Sprintf("service %s: log_driver/log_opt became logging", name))
+	}
+
+	if dockerfile := mappingValue(service, "dockerfile"); dockerfile != nil && dockerfile.Kind == yaml.ScalarNode {
+		if build := mappingValue(service, "build"); build != nil {
+			deleteKey(service, "dockerfile")
+			if build.Kind == yaml.ScalarNode {
+				context := build.Value
+				build = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+				setScalar(build, "context", context)
+				setValue(service, "build", build)
+			}
+			if scalarValue(mappingValue(build, "dockerfile")) == "" {
+				setScalar(build, "dockerfile", dockerfile.Value)
+			}
+			changes = append(changes, fmt.Sprintf("service %s: dockerfile moved into build", name))
+		}
+	}
+
+	if mappingValue(service, "volume_driver") != nil {
+		changes = append(changes, fmt.Sprintf("service %s: volume_driver is deprecated, kept as is; declare the driver on the named volumes instead", name))
+	}
+	return changes
+}
+
+// modernizeLinks replaces the links of a service with depends_on. Services on
+// a shared network resolve each other by name, aliases become network aliases
+// of the linked service when it only uses the default network.
+func modernizeLinks(services *yaml.Node, name string) []string {
+	service := mappingValue(services, name)
+	links := mappingValue(service, "links")
+	if links == nil || links.Kind != yaml.SequenceNode {
+		return nil
+	}
+
+	var changes, kept []string
+	var remaining []*yaml.Node
+	for _, link := range links.Content {
+		spec := scalarValue(resolveAlias(link))
+		target, alias, _ := strings.Cut(spec, ":")
+		linked := mappingValue(services, target)
+		if linked == nil {
+			remaining = append(remaining, link)
+			kept = append(kept, spec)
+			continue
+		}
+
+		if alias != "" && alias != target {
+			if !addDefaultNetworkAlias(linked, alias) {
+				remaining = append(remaining, link)
+				kept = append(kept, spec)
+				continue
+			}
+			changes = append(changes, fmt.Sprintf("service %s: link alias %s became a network alias of service %s", name, alias, target))
+		}
+		addDependency(service, target)
+		changes = append(changes, fmt.Sprintf("service %s: link %s became depends_on", name, spec))
+	}
+
+	if len(remaining) == 0 {
+		deleteKey(service, "links")
+	} else {
+		links.Content = remaining
+		changes = append(changes, fmt.Sprintf("service %s: kept links %s, their services are missing or use custom networks", name, strings.Join(kept, ", ")))
+	}
+	return changes
+}
+
+// addDependency adds target to the depends_on of a service in its syntax
+func addDependency(service *yaml.Node, target string) {
+	dependsOn := mappingValue(service, "depends_on")
+	switch {
+	case dependsOn == nil || dependsOn.Kind == yaml.ScalarNode:
+		dependsOn = &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+		setValue(service, "depends_on", dependsOn)
+		fallthrough
+	case dependsOn.Kind == yaml.SequenceNode:
+		if !slices.ContainsFunc(dependsOn.Content, func(n *yaml.Node) bool { return scalarValue(resolveAlias(n)) == target }) {
+			dependsOn.Content = append(dependsOn.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: target})
+		}
+	case dependsOn.Kind == yaml.MappingNode:
+		if mappingValue(dependsOn, target) == nil {
+			condition := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+			setScalar(condition, "condition", "service_started")
+			setValue(dependsOn, target, condition)
+		}
+	}
+}
+
+// addDefaultNetworkAlias adds alias on the default network of a service that
+// is not attached to other networks
+func addDefaultNetworkAlias(service *yaml.Node, alias string) bool {
+	networks := mappingValue(service, "networks")
+	var config *yaml.Node
+	switch {
+	case networks == nil:
+	case networks.Kind == yaml.SequenceNode:
+		if len(networks.Content) != 1 || scalarValue(resolveAlias(networks.Content[0])) != "default" {
+			return false
+		}
+	case networks.Kind == yaml.MappingNode:
+		if len(networks.Content) != 2 || networks.Content[0].Value != "default" {
+			return false
+		}
+		config = mappingValue(networks, "default")
+	default:
+		return false
+	}
+	if config == nil || config.Kind != yaml.MappingNode {
+		config = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	}
+	aliases := mappingValue(config, "aliases")
+	if aliases == nil || aliases.Kind != yaml.SequenceNode {
+		aliases = &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+		setValue(config, "aliases", aliases)
+	}
+	if !slices.ContainsFunc(aliases.Content, func(n *yaml.Node) bool { return scalarValue(resolveAlias(n)) == alias }) {
+		aliases.Content = append(aliases.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: alias})
+	}
+	networks = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	setValue(networks, "default", config)
+	setValue(service, "networks", networks)
+	return true
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/build"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/api/types/system"
+	"github.com/docker/docker/api/types/volume"
+	"github.com/docker/docker/client"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"docker-compose-bundler/dockerclient"
+)
+
+// DockerClient is the subset of the Docker API used by the bundler and the
+// loader, see the dockerclient package for its in-memory fake
+type DockerClient = dockerclient.Client
+
+func newDockerClient() (DockerClient, error) {
+	return client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+}
+
+// lazyDockerClient creates the Docker client on first use, so commands and
+// dry runs that never talk to the daemon work on hosts without Docker
+type lazyDockerClient struct {
+	once sync.Once
+	cli  DockerClient
+	err  error
+}
+
+func (l *lazyDockerClient) get() (DockerClient, error) {
+	l.once.Do(func() {
+		if l.cli, l.err = newDockerClient(); l.err != nil {
+			l.err = fmt.Errorf("failed to create Docker client: %w", l.err)
+		}
+	})
+	return l.cli, l.err
+}
+
+// daemonError explains that the operation needs a reachable Docker daemon
+func daemonError(err error) error {
+	if client.IsErrConnectionFailed(err) {
+		return fmt.Errorf("this operation needs a running Docker daemon: %w", err)
+	}
+	return err
+}
+
+func (l *lazyDockerClient) ImageBuild(ctx context.Context, buildContext io.Reader, options build.ImageBuildOptions) (build.ImageBuildResponse, error) {
+	cli, err := l.get()
+	if err != nil {
+		return build.ImageBuildResponse{}, err
+	}
+	resp, err := cli.ImageBuild(ctx, buildContext, options)
+	return resp, daemonError(err)
+}
+
+func (l *lazyDockerClient) ImagePull(ctx context.Context, ref string, options image.PullOptions) (io.ReadCloser, error) {
+	cli, err := l.get()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := cli.ImagePull(ctx, ref, options)
+	return resp, daemonError(err)
+}
+
+func (l *lazyDockerClient) ImagePush(ctx context.Context, ref string, options image.PushOptions) (io.ReadCloser, error) {
+	cli, err := l.get()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := cli.ImagePush(ctx, ref, options)
+	return resp, daemonError(err)
+}
+
+func (l *lazyDockerClient) ImageInspect(ctx context.Context, imageID string, opts ...client.ImageInspectOption) (image.InspectResponse, error) {
+	cli, err := l.get()
+	if err != nil {
+		return image.InspectResponse{}, err
+	}
+	resp, err := cli.ImageInspect(ctx, imageID, opts...)
+	return resp, daemonError(err)
+}
+
+func (l *lazyDockerClient) ImageHistory(ctx context.Context, imageID string, opts ...client.ImageHistoryOption) ([]image.HistoryResponseItem, error) {
+	cli, err := l.get()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := cli.ImageHistory(ctx, imageID, opts...)
+	return resp, daemonError(err)
+}
+
+func (l *lazyDockerClient) ImageSave(ctx context.Context, imageIDs []string, opts ...client.ImageSaveOption) (io.ReadCloser, error) {
+	cli, err := l.get()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := cli.ImageSave(ctx, imageIDs, opts...)
+	return resp, daemonError(err)
+}
+
+func (l *lazyDockerClient) ImageLoad(ctx context.Context, input io.Reader, opts ...client.ImageLoadOption) (image.LoadResponse, error) {
+	cli, err := l.get()
+	if err != nil {
+		return image.LoadResponse{}, err
+	}
+	resp, err := cli.ImageLoad(ctx, input, opts...)
+	return resp, daemonError(err)
+}
+
+func (l *lazyDockerClient) ImageRemove(ctx context.Context, imageID string, options image.RemoveOptions) ([]image.DeleteResponse, error) {
+	cli, err := l.get()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := cli.ImageRemove(ctx, imageID, options)
+	return resp, daemonError(err)
+}
+
+func (l *lazyDockerClient) ImageTag(ctx context.Context, source, target string) error {
+	cli, err := l.get()
+	if err != nil {
+		return err
+	}
+	return daemonError(cli.ImageTag(ctx, source, target))
+}
+
+func (l *lazyDockerClient) ContainerList(ctx context.Context, options container.ListOptions) ([]container.Summary, error) {
+	cli, err := l.get()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := cli.ContainerList(ctx, options)
+	return resp, daemonError(err)
+}
+
+func (l *lazyDockerClient) ContainerInspect(ctx context.Context, containerID string) (container.InspectResponse, error) {
+	cli, err := l.get()
+	if err != nil {
+		return container.InspectResponse{}, err
+	}
+	resp, err := cli.ContainerInspect(ctx, containerID)
+	return resp, daemonError(err)
+}
+
+func (l *lazyDockerClient) ContainerCreate(ctx context.Context, config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, platform *ocispec.Platform, containerName string) (container.CreateResponse, error) {
+	cli, err := l.get()
+	if err != nil {
+		return container.CreateResponse{}, err
+	}
+	resp, err := cli.ContainerCreate(ctx, config, hostConfig, networkingConfig, platform, containerName)
+	return resp, daemonError(err)
+}
+
+func (l *lazyDockerClient) ContainerStart(ctx context.Context, containerID string, options container.StartOptions) error {
+	cli, err := l.get()
+	if err != nil {
+		return err
+	}
+	return daemonError(cli.ContainerStart(ctx, containerID, options))
+}
+
+func (l *lazyDockerClient) ContainerWait(ctx context.Context, containerID string, condition container.WaitCondition) (<-chan container.WaitResponse, <-chan error) {
+	cli, err := l.get()
+	if err != nil {
+		errs := make(chan error, 1)
+		errs <- err
+		return make(chan container.WaitResponse), errs
+	}
+	return cli.ContainerWait(ctx, containerID, condition)
+}
+
+func (l *lazyDockerClient) ContainerLogs(ctx context.Context, containerID string, options container.LogsOptions) (io.ReadCloser, error) {
+	cli, err := l.get()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := cli.ContainerLogs(ctx, containerID, options)
+	return resp, daemonError(err)
+}
+
+func (l *lazyDockerClient) ContainerRemove(ctx context.Context, containerID string, options container.RemoveOptions) error {
+	cli, err := l.get()
+	if err != nil {
+		return err
+	}
+	return daemonError(cli.ContainerRemove(ctx, containerID, options))
+}
+
+func (l *lazyDockerClient) NetworkList(ctx context.Context, options network.ListOptions) ([]network.Summary, error) {
+	cli, err := l.get()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := cli.NetworkList(ctx, options)
+	return resp, daemonError(err)
+}
+
+func (l *lazyDockerClient) VolumeInspect(ctx context.Context, volumeID string) (volume.Volume, error) {
+	cli, err := l.get()
+	if err != nil {
+		return volume.Volume{}, err
+	}
+	resp, err := cli.VolumeInspect(ctx, volumeID)
+	return resp, daemonError(err)
+}
+
+func (l *lazyDockerClient) VolumeRemove(ctx context.Context, volumeID string, force bool) error {
+	cli, err := l.get()
+	if err != nil {
+		return err
+	}
+	return daemonError(cli.VolumeRemove(ctx, volumeID, force))
+}
+
+func (l *lazyDockerClient) ServerVersion(ctx context.Context) (types.Version, error) {
+	cli, err := l.get()
+	if err != nil {
+		return types.Version{}, err
+	}
+	resp, err := cli.ServerVersion(ctx)
+	return resp, daemonError(err)
+}
+
+func (l *lazyDockerClient) Info(ctx context.Context) (system.Info, error) {
+	cli, err := l.get()
+	if err != nil {
+		return system.Info{}, err
+	}
+	resp, err := cli.Info(ctx)
+	return resp, daemonError(err)
+}
+
+func (l *lazyDockerClient) DialHijack(ctx context.Context, url, proto string, meta map[string][]string) (net.Conn, error) {
+	cli, err := l.get()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := cli.DialHijack(ctx, url, proto, meta)
+	return conn, daemonError(err)
+}
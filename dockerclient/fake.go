@@ -0,0 +1,610 @@
+package dockerclient
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+
+	cerrdefs "github.com/containerd/errdefs"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/build"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/api/types/system"
+	"github.com/docker/docker/api/types/volume"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+	dockerspec "github.com/moby/docker-image-spec/specs-go/v1"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// FakeImage is an image known to Fake
+type FakeImage struct {
+	ID          string
+	Tags        []string
+	Size        int64
+	User        string   // Default user of the image
+	RepoDigests []string // Digests of the image in its registries, empty for local builds
+	Platform    string   // os/arch[/variant], the fake daemon's linux/amd64 if empty
+	Layers      []string // Content of the layers, base first
+	Exposed     []string // EXPOSE ports of the image, e.g. 8080/tcp
+	Entrypoint  []string // ENTRYPOINT of the image
+	Cmd         []string // CMD of the image
+	// OtherPlatforms makes it a multi-platform image, the content size of every other platform
+	OtherPlatforms map[string]int64
+}
+
+// FakeContainer is a container known to Fake
+type FakeContainer struct {
+	Summary container.Summary
+	State   container.State
+	exited  chan struct{} // Closed when a container created on the fake exits
+}
+
+// Fake is an in-memory Client. Pulls and builds create
+// images, saved images are tar archives that can be loaded again.
+type Fake struct {
+	mu         sync.Mutex
+	Images     []*FakeImage
+	Containers []FakeContainer
+	Networks   []network.Summary
+	Volumes    map[string]volume.Volume
+	Version    types.Version
+	SystemInfo system.Info
+	Pulled     []string // Every reference passed to ImagePull
+	Built      []string // Every tag passed to ImageBuild
+	Pushed     []string // Every reference passed to ImagePush
+	PullErrors map[string]error
+	ExitCodes  map[string]int64 // Exit code of containers run from an image, 0 if unset
+	Ran        []FakeRun        // Every container started
+	Sessions   []FakeSession    // Every BuildKit session opened
+	BuildKit   []string         // Tags built with the BuildKit builder
+}
+
+// FakeSession is a BuildKit session opened on Fake, Conn is the
+// end the daemon would talk gRPC on
+type FakeSession struct {
+	Meta map[string][]string
+	Conn net.Conn
+}
+
+// FakeRun is a container started on Fake
+type FakeRun struct {
+	Config     container.Config
+	HostConfig container.HostConfig
+}
+
+var _ Client = (*Fake)(nil)
+
+// NewFake returns an empty fake speaking the current API version
+func NewFake() *Fake {
+	return &Fake{
+		Volumes:    make(map[string]volume.Volume),
+		PullErrors: make(map[string]error),
+		ExitCodes:  make(map[string]int64),
+		Version:    types.Version{Version: "28.3.0", APIVersion: "1.51", MinAPIVersion: "1.24", Os: "linux", Arch: "amd64"},
+		SystemInfo: system.Info{Driver: "overlay2", CgroupVersion: "2", OSType: "linux"},
+	}
+}
+
+// AddImage registers an image under the given tags and returns it
+func (f *Fake) AddImage(tags ...string) *FakeImage {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.addImage(tags...)
+}
+
+func (f *Fake) addImage(tags ...string) *FakeImage {
+	sum := sha256.Sum256([]byte(strings.Join(tags, ",")))
+	img := &FakeImage{ID: "sha256:" + hex.EncodeToString(sum[:]), Size: 1 << 20}
+	f.Images = append(f.Images, img)
+	for _, tag := range tags {
+		f.tag(img, tag)
+	}
+	return img
+}
+
+// tag points tag at img, removing it from any other image
+func (f *Fake) tag(img *FakeImage, tag string) {
+	for _, other := range f.Images {
+		other.Tags = slices.DeleteFunc(other.Tags, func(t string) bool { return t == tag })
+	}
+	img.Tags = append(img.Tags, tag)
+}
+
+func (img *FakeImage) platform() string {
+	if img.Platform == "" {
+		return "linux/amd64"
+	}
+	return img.Platform
+}
+
+// parsePlatform splits an os/arch[/variant] platform
+func parsePlatform(spec string) ocispec.Platform {
+	parts := strings.SplitN(spec, "/", 3)
+	p := ocispec.Platform{OS: parts[0]}
+	if len(parts) > 1 {
+		p.Architecture = parts[1]
+	}
+	if len(parts) > 2 {
+		p.Variant = parts[2]
+	}
+	return p
+}
+
+func (f *Fake) find(ref string) *FakeImage {
+	for _, img := range f.Images {
+		if img.ID == ref || slices.Contains(img.Tags, ref) {
+			return img
+		}
+	}
+	return nil
+}
+
+func notFound(kind, ref string) error {
+	return fmt.Errorf("no such %s: %s: %w", kind, ref, cerrdefs.ErrNotFound)
+}
+
+func (f *Fake) ImageBuild(ctx context.Context, buildContext io.Reader, options build.ImageBuildOptions) (build.ImageBuildResponse, error) {
+	if _, err := io.Copy(io.Discard, buildContext); err != nil {
+		return build.ImageBuildResponse{}, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	img := f.addImage(options.Tags...)
+	img.Platform = options.Platform
+	f.Built = append(f.Built, options.Tags...)
+	if options.Version == build.BuilderBuildKit {
+		f.BuildKit = append(f.BuildKit, options.Tags...)
+	}
+	return build.ImageBuildResponse{Body: jsonMessages(
+		map[string]interface{}{"aux": map[string]string{"ID": img.ID}},
+		map[string]string{"stream": "Successfully built\n"},
+	)}, nil
+}
+
+func (f *Fake) ImagePull(ctx context.Context, ref string, options image.PullOptions) (io.ReadCloser, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Pulled = append(f.Pulled, ref)
+	if err := f.PullErrors[ref]; err != nil {
+		return nil, err
+	}
+	if img := f.find(ref); img == nil || (options.Platform != "" && img.platform() != options.Platform) {
+		img = f.addImage(ref)
+		if options.Platform != "" {
+			// Another platform of the same tag is another image
+			sum := sha256.Sum256([]byte(ref + "@" + options.Platform))
+			img.ID, img.Platform = "sha256:"+hex.EncodeToString(sum[:]), options.Platform
+		}
+	}
+	return jsonMessages(map[string]string{"status": "Downloaded newer image for " + ref}), nil
+}
+
+func (f *Fake) ImagePush(ctx context.Context, ref string, options image.PushOptions) (io.ReadCloser, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	img := f.find(ref)
+	if img == nil {
+		return nil, notFound("image", ref)
+	}
+	f.Pushed = append(f.Pushed, ref)
+	return jsonMessages(map[string]string{"status": "Pushed " + ref}), nil
+}
+
+func (f *Fake) ImageInspect(ctx context.Context, imageID string, opts ...client.ImageInspectOption) (image.InspectResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	img := f.find(imageID)
+	if img == nil {
+		return image.InspectResponse{}, notFound("image", imageID)
+	}
+	platform := parsePlatform(img.platform())
+	var exposed map[string]struct{}
+	for _, port := range img.Exposed {
+		if exposed == nil {
+			exposed = make(map[string]struct{})
+		}
+		exposed[port] = struct{}{}
+	}
+	return image.InspectResponse{
+		ID:           img.ID,
+		RepoTags:     slices.Clone(img.Tags),
+		RepoDigests:  slices.Clone(img.RepoDigests),
+		Size:         img.Size,
+		Os:           platform.OS,
+		Architecture: platform.Architecture,
+		Variant:      platform.Variant,
+		Config:       &dockerspec.DockerOCIImageConfig{ImageConfig: ocispec.ImageConfig{User: img.User, ExposedPorts: exposed, Entrypoint: img.Entrypoint, Cmd: img.Cmd}},
+		Manifests:    img.manifests(platform),
+	}, nil
+}
+
+// manifests lists the platforms of a multi-platform image like the
+// containerd image store does, nil for single-platform images
+func (img *FakeImage) manifests(own ocispec.Platform) []image.ManifestSummary {
+	if len(img.OtherPlatforms) == 0 {
+		return nil
+	}
+	manifest := func(p ocispec.Platform, size int64) image.ManifestSummary {
+		sum := sha256.Sum256([]byte(img.ID + path.Join(p.OS, p.Architecture, p.Variant)))
+		m := image.ManifestSummary{ID: "sha256:" + hex.EncodeToString(sum[:]), Available: true, Kind: image.ManifestKindImage}
+		m.Size.Content = size
+		m.ImageData = &image.ImageProperties{Platform: p}
+		return m
+	}
+	manifests := []image.ManifestSummary{manifest(own, img.Size)}
+	for _, name := range slices.Sorted(maps.Keys(img.OtherPlatforms)) {
+		manifests = append(manifests, manifest(parsePlatform(name), img.OtherPlatforms[name]))
+	}
+	return manifests
+}
+
+// ImageHistory reports the image as a single layer
+func (f *Fake) ImageHistory(ctx context.Context, imageID string, opts ...client.ImageHistoryOption) ([]image.HistoryResponseItem, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	img := f.find(imageID)
+	if img == nil {
+		return nil, notFound("image", imageID)
+	}
+	return []image.HistoryResponseItem{{ID: img.ID, CreatedBy: "/bin/sh -c #(nop) ADD rootfs", Size: img.Size, Tags: slices.Clone(img.Tags)}}, nil
+}
+
+// fakeSavedImage is the content of the manifest.json written by ImageSave
+type fakeSavedImage struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+	Size     int64
+	User     string
+}
+
+// fakeLayerFile is the path of a layer in a saved image, like docker save
+func fakeLayerFile(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:]) + "/layer.tar"
+}
+
+func (f *Fake) ImageSave(ctx context.Context, imageIDs []string, opts ...client.ImageSaveOption) (io.ReadCloser, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var saved []fakeSavedImage
+	for _, ref := range imageIDs {
+		img := f.find(ref)
+		if img == nil {
+			return nil, notFound("image", ref)
+		}
+		// References to the same image share one entry, like docker save
+		if i := slices.IndexFunc(saved, func(s fakeSavedImage) bool { return s.Config == img.ID }); i >= 0 {
+			saved[i].RepoTags = append(saved[i].RepoTags, ref)
+			continue
+		}
+		s := fakeSavedImage{Config: img.ID, RepoTags: []string{ref}, Size: img.Size, User: img.User}
+		for _, layer := range img.Layers {
+			s.Layers = append(s.Layers, fakeLayerFile(layer))
+		}
+		saved = append(saved, s)
+	}
+	data, err := json.Marshal(saved)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	written := make(map[string]bool)
+	for _, ref := range imageIDs {
+		for _, layer := range f.find(ref).Layers {
+			name := fakeLayerFile(layer)
+			if written[name] {
+				continue
+			}
+			written[name] = true
+			if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(layer))}); err != nil {
+				return nil, err
+			}
+			if _, err := tw.Write([]byte(layer)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: "manifest.json", Mode: 0644, Size: int64(len(data))}); err != nil {
+		return nil, err
+	}
+	if _, err := tw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	return io.NopCloser(&buf), nil
+}
+
+func (f *Fake) ImageLoad(ctx context.Context, input io.Reader, opts ...client.ImageLoadOption) (image.LoadResponse, error) {
+	tr := tar.NewReader(input)
+	var saved []fakeSavedImage
+	layerFiles := make(map[string]string)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return image.LoadResponse{}, err
+		}
+		if header.Name == "manifest.json" {
+			if err := json.NewDecoder(tr).Decode(&saved); err != nil {
+				return image.LoadResponse{}, err
+			}
+		} else if strings.HasSuffix(header.Name, "/layer.tar") {
+			data, err := io.ReadAll(tr)
+			if err != nil {
+				return image.LoadResponse{}, err
+			}
+			layerFiles[header.Name] = string(data)
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	// Like the daemon, every loaded tag is reported, untagged images by ID
+	var loaded []interface{}
+	for _, s := range saved {
+		// Like the daemon, layer files may be missing if the image below them is present
+		layers, err := f.loadedLayers(s.Layers, layerFiles)
+		if err != nil {
+			return image.LoadResponse{}, err
+		}
+		img := f.find(s.Config)
+		if img == nil {
+			img = &FakeImage{ID: s.Config, Size: s.Size, User: s.User, Layers: layers}
+			f.Images = append(f.Images, img)
+		}
+		for _, tag := range s.RepoTags {
+			f.tag(img, tag)
+			loaded = append(loaded, map[string]string{"stream": "Loaded image: " + tag + "\n"})
+		}
+		if len(s.RepoTags) == 0 {
+			loaded = append(loaded, map[string]string{"stream": "Loaded image ID: " + img.ID + "\n"})
+		}
+	}
+	return image.LoadResponse{Body: jsonMessages(loaded...), JSON: true}, nil
+}
+
+// loadedLayers returns the content of the layers of a loaded image, taken
+// from the tar or from a present image with the same layers below
+func (f *Fake) loadedLayers(files []string, layerFiles map[string]string) ([]string, error) {
+	var layers []string
+	for i, file := range files {
+		if content, ok := layerFiles[file]; ok {
+			layers = append(layers, content)
+			continue
+		}
+		found := false
+		for _, img := range f.Images {
+			if len(img.Layers) > i && fakeLayerFile(img.Layers[i]) == file && slices.Equal(img.Layers[:i], layers) {
+				layers, found = append(layers, img.Layers[i]), true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("open %s: no such file or directory", file)
+		}
+	}
+	return layers, nil
+}
+
+func (f *Fake) ImageRemove(ctx context.Context, imageID string, options image.RemoveOptions) ([]image.DeleteResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	img := f.find(imageID)
+	if img == nil {
+		return nil, notFound("image", imageID)
+	}
+	if img.ID != imageID && len(img.Tags) > 1 {
+		img.Tags = slices.DeleteFunc(img.Tags, func(t string) bool { return t == imageID })
+		return []image.DeleteResponse{{Untagged: imageID}}, nil
+	}
+	f.Images = slices.DeleteFunc(f.Images, func(other *FakeImage) bool { return other == img })
+	return []image.DeleteResponse{{Deleted: img.ID}}, nil
+}
+
+func (f *Fake) ImageTag(ctx context.Context, source, target string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	img := f.find(source)
+	if img == nil {
+		return notFound("image", source)
+	}
+	f.tag(img, target)
+	return nil
+}
+
+func (f *Fake) ContainerList(ctx context.Context, options container.ListOptions) ([]container.Summary, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var result []container.Summary
+	for _, c := range f.Containers {
+		if !options.All && c.State.Status != "running" {
+			continue
+		}
+		matches := true
+		for _, label := range options.Filters.Get("label") {
+			key, value, hasValue := strings.Cut(label, "=")
+			actual, ok := c.Summary.Labels[key]
+			matches = matches && ok && (!hasValue || actual == value)
+		}
+		if matches {
+			result = append(result, c.Summary)
+		}
+	}
+	return result, nil
+}
+
+func (f *Fake) ContainerInspect(ctx context.Context, containerID string) (container.InspectResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, c := range f.Containers {
+		if c.Summary.ID == containerID {
+			state := c.State
+			return container.InspectResponse{ContainerJSONBase: &container.ContainerJSONBase{ID: c.Summary.ID, Image: c.Summary.ImageID, State: &state}}, nil
+		}
+	}
+	return container.InspectResponse{}, notFound("container", containerID)
+}
+
+func (f *Fake) ContainerCreate(ctx context.Context, config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, platform *ocispec.Platform, containerName string) (container.CreateResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	img := f.find(config.Image)
+	if img == nil {
+		return container.CreateResponse{}, notFound("image", config.Image)
+	}
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s-%d", config.Image, len(f.Ran)+len(f.Containers))))
+	id := hex.EncodeToString(sum[:])
+	f.Containers = append(f.Containers, FakeContainer{
+		Summary: container.Summary{ID: id, Names: []string{"/" + containerName}, Image: config.Image, ImageID: img.ID, Labels: config.Labels},
+		State:   container.State{Status: container.StateCreated},
+		exited:  make(chan struct{}),
+	})
+	f.Ran = append(f.Ran, FakeRun{Config: *config, HostConfig: *hostConfig})
+	return container.CreateResponse{ID: id}, nil
+}
+
+func (f *Fake) ContainerStart(ctx context.Context, containerID string, options container.StartOptions) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c := f.container(containerID)
+	if c == nil {
+		return notFound("container", containerID)
+	}
+	// Containers run to completion immediately
+	c.State = container.State{Status: container.StateExited, ExitCode: int(f.ExitCodes[c.Summary.Image])}
+	if c.exited != nil {
+		close(c.exited)
+	}
+	return nil
+}
+
+func (f *Fake) ContainerWait(ctx context.Context, containerID string, condition container.WaitCondition) (<-chan container.WaitResponse, <-chan error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	responses, errs := make(chan container.WaitResponse, 1), make(chan error, 1)
+	c := f.container(containerID)
+	if c == nil {
+		errs <- notFound("container", containerID)
+		return responses, errs
+	}
+	exited := c.exited
+	go func() {
+		if exited != nil {
+			<-exited
+		}
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if c := f.container(containerID); c != nil {
+			responses <- container.WaitResponse{StatusCode: int64(c.State.ExitCode)}
+		}
+	}()
+	return responses, errs
+}
+
+func (f *Fake) ContainerLogs(ctx context.Context, containerID string, options container.LogsOptions) (io.ReadCloser, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c := f.container(containerID)
+	if c == nil {
+		return nil, notFound("container", containerID)
+	}
+	var buf bytes.Buffer
+	stdcopy.NewStdWriter(&buf, stdcopy.Stdout).Write([]byte("container of " + c.Summary.Image + " ran\n"))
+	return io.NopCloser(&buf), nil
+}
+
+func (f *Fake) ContainerRemove(ctx context.Context, containerID string, options container.RemoveOptions) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.container(containerID) == nil {
+		return notFound("container", containerID)
+	}
+	f.Containers = slices.DeleteFunc(f.Containers, func(c FakeContainer) bool { return c.Summary.ID == containerID })
+	return nil
+}
+
+func (f *Fake) container(id string) *FakeContainer {
+	for i := range f.Containers {
+		if f.Containers[i].Summary.ID == id {
+			return &f.Containers[i]
+		}
+	}
+	return nil
+}
+
+func (f *Fake) NetworkList(ctx context.Context, options network.ListOptions) ([]network.Summary, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.Networks), nil
+}
+
+func (f *Fake) VolumeInspect(ctx context.Context, volumeID string) (volume.Volume, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if v, ok := f.Volumes[volumeID]; ok {
+		return v, nil
+	}
+	return volume.Volume{}, notFound("volume", volumeID)
+}
+
+func (f *Fake) VolumeRemove(ctx context.Context, volumeID string, force bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.Volumes[volumeID]; !ok {
+		return notFound("volume", volumeID)
+	}
+	delete(f.Volumes, volumeID)
+	return nil
+}
+
+func (f *Fake) ServerVersion(ctx context.Context) (types.Version, error) {
+	return f.Version, nil
+}
+
+func (f *Fake) Info(ctx context.Context) (system.Info, error) {
+	return f.SystemInfo, nil
+}
+
+// DialHijack accepts BuildKit sessions, the daemon end is kept in Sessions
+func (f *Fake) DialHijack(ctx context.Context, url, proto string, meta map[string][]string) (net.Conn, error) {
+	if url != "/session" {
+		return nil, fmt.Errorf("unsupported hijacked endpoint %s", url)
+	}
+	daemon, conn := net.Pipe()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Sessions = append(f.Sessions, FakeSession{Meta: meta, Conn: daemon})
+	return conn, nil
+}
+
+// jsonMessages returns a stream of JSON messages like the daemon sends
+func jsonMessages(messages ...interface{}) io.ReadCloser {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, message := range messages {
+		encoder.Encode(message)
+	}
+	return io.NopCloser(&buf)
+}
@@ -0,0 +1,52 @@
+package dockerclient
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	"github.com/docker/docker/api/types/image"
+)
+
+func TestFakeSaveLoad(t *testing.T) {
+	ctx := context.Background()
+	source := NewFake()
+	img := source.AddImage("app:1", "app:latest")
+	img.Layers = []string{"base", "app"}
+
+	saved, err := source.ImageSave(ctx, []string{"app:1", "app:latest"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := NewFake()
+	resp, err := target.ImageLoad(ctx, saved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+
+	for _, ref := range []string{"app:1", "app:latest"} {
+		inspect, err := target.ImageInspect(ctx, ref)
+		if err != nil {
+			t.Fatalf("%s was not loaded: %v", ref, err)
+		}
+		if inspect.ID != img.ID {
+			t.Errorf("%s loaded as %s, want %s", ref, inspect.ID, img.ID)
+		}
+	}
+}
+
+func TestFakeRemoveUntags(t *testing.T) {
+	ctx := context.Background()
+	fake := NewFake()
+	fake.AddImage("app:1")
+	if _, err := fake.ImageRemove(ctx, "app:1", image.RemoveOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fake.ImageInspect(ctx, "app:1"); err == nil {
+		t.Error("app:1 is still present after removing it")
+	}
+	if _, err := fake.ImageRemove(ctx, "app:1", image.RemoveOptions{}); err == nil {
+		t.Error("removing a missing image succeeded")
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	cerrdefs "github.com/containerd/errdefs"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+)
+
+// DryRun reports what deploy would do on this host without changing anything:
+// images to load, containers to create or recreate, ports to bind and
+// volumes to create
+func (l *Loader) DryRun() error {
+	fmt.Printf("Dry run for %s %s (project %s), nothing is changed\n\n", l.manifest.Name, l.manifest.Version, l.manifest.ProjectName)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+
+	imageIDs := make(map[string]string) // Image name -> ID after loading
+	fmt.Fprintln(w, "IMAGE\tACTION")
+	for _, img := range l.manifest.Images {
+		action := "load"
+		inspect, err := l.client.ImageInspect(l.ctx, img.Name)
+		switch {
+		case cerrdefs.IsNotFound(err):
+		case err != nil:
+			return fmt.Errorf("failed to inspect image %s: %w", img.Name, err)
+		case img.ID == "":
+			action = "load (present, unknown if identical)"
+		case inspect.ID == img.ID:
+			action = "skip (already present)"
+		default:
+			action = "load (replaces local " + shortID(inspect.ID) + ")"
+		}
+		imageIDs[img.Name] = img.ID
+		fmt.Fprintf(w, "%s\t%s\n", img.Name, action)
+	}
+	fmt.Fprintln(w)
+
+	containers, err := l.client.ContainerList(l.ctx, container.ListOptions{
+		All:     true,
+		Filters: filters.NewArgs(filters.Arg("label", composeProjectLabel+"="+l.manifest.ProjectName)),
+	})
+	if err != nil {
+		return err
+	}
+	byService := make(map[string][]container.Summary)
+	for _, c := range containers {
+		byService[c.Labels[composeServiceLabel]] = append(byService[c.Labels[composeServiceLabel]], c)
+	}
+
+	fmt.Fprintln(w, "SERVICE\tACTION")
+	for _, serviceName := range sortedServiceNames(l.compose) {
+		action := "create"
+		if existing := byService[serviceName]; len(existing) > 0 {
+			action = "keep, recreated only if its configuration changed"
+			if id := imageIDs[l.compose.Services[serviceName].Image]; id != "" && existing[0].ImageID != id {
+				action = "recreate (new image)"
+			}
+		}
+		delete(byService, serviceName)
+		fmt.Fprintf(w, "%s\t%s\n", serviceName, action)
+	}
+	var orphans []string
+	for serviceName := range byService {
+		orphans = append(orphans, serviceName)
+	}
+	sort.Strings(orphans)
+	for _, serviceName := range orphans {
+		fmt.Fprintf(w, "%s\tkeep (orphan, not part of the bundle)\n", serviceName)
+	}
+	fmt.Fprintln(w)
+
+	fmt.Fprintln(w, "PORT\tSERVICE")
+	for _, serviceName := range sortedServiceNames(l.compose) {
+		for _, port := range l.compose.Services[serviceName].Ports {
+			if port.Published == "" {
+				continue
+			}
+			hostIP := port.HostIP
+			if hostIP == "" {
+				hostIP = "0.0.0.0"
+			}
+			protocol := port.Protocol
+			if protocol == "" {
+				protocol = "tcp"
+			}
+			fmt.Fprintf(w, "%s:%s/%s\t%s\n", hostIP, port.Published, protocol, serviceName)
+		}
+	}
+	fmt.Fprintln(w)
+
+	fmt.Fprintln(w, "VOLUME\tACTION")
+	for _, name := range sortedKeys(l.compose.Volumes) {
+		volumeName, external := l.resourceName(name, l.compose.Volumes[name])
+		action := "create"
+		_, err := l.client.VolumeInspect(l.ctx, volumeName)
+		switch {
+		case err == nil:
+			action = "reuse (exists)"
+		case !cerrdefs.IsNotFound(err):
+			return fmt.Errorf("failed to inspect volume %s: %w", volumeName, err)
+		case external:
+			action = "missing (external, has to be created first)"
+		}
+		fmt.Fprintf(w, "%s\t%s\n", volumeName, action)
+	}
+	w.Flush()
+
+	fmt.Println()
+	portConflicts, err := l.portConflicts()
+	if err != nil {
+		return fmt.Errorf("failed to check ports: %w", err)
+	}
+	subnetConflicts, err := l.subnetConflicts()
+	if err != nil {
+		return fmt.Errorf("failed to check networks: %w", err)
+	}
+	conflicts := append(portConflicts, subnetConflicts...)
+	if len(conflicts) == 0 {
+		fmt.Println("No port or subnet conflicts found")
+	}
+	for _, conflict := range conflicts {
+		fmt.Printf("Conflict: %s\n", conflict)
+	}
+	return nil
+}
+
+// resourceName returns the name compose uses for a top-level volume or
+// network definition and whether it is external
+func (l *Loader) resourceName(key string, definition interface{}) (string, bool) {
+	config, _ := definition.(map[string]interface{})
+	external := config["external"] == true
+	if name, ok := config["name"].(string); ok && name != "" {
+		return name, external
+	}
+	if external {
+		return key, true
+	}
+	return l.manifest.ProjectName + "_" + key, false
+}
+
+func shortID(id string) string {
+	if len(id) > 19 {
+		return id[:19] // "sha256:" and 12 hex digits
+	}
+	return id
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"docker-compose-bundler/bundlefile"
+
+	"github.com/distribution/reference"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Edit removes and adds images of a bundle. The archive is rewritten entry by
+// entry without extracting it, only added images are staged on disk.
+// Services using a removed image switch to an added image of the same repository.
+func (b *Bundler) Edit(bundleFile, outputFile string, remove, add []string) (err error) {
+	defer b.span("edit", attribute.String("bundle", bundleFile))(&err)
+
+	release, err := lockBundleFiles(bundleFile, outputFile)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	manifest, compose, err := readBundleMetadata(bundleFile)
+	if err != nil {
+		return err
+	}
+
+	licenses, err := b.checkLicenses(compose.XBundle, add)
+	if err != nil {
+		return err
+	}
+	dropLicenses(manifest, append(slices.Clone(remove), add...))
+	manifest.Licenses = append(manifest.Licenses, licenses...)
+
+	dropped := make(map[string]bool) // Archive entries not copied to the output
+	var removedNames []string
+	for _, imageName := range remove {
+		i := manifestImageIndex(manifest, imageName)
+		if i < 0 {
+			return fmt.Errorf("image %s is not part of the bundle", imageName)
+		}
+		fmt.Printf("Removing image %s...\n", imageName)
+		dropped[manifest.Images[i].File] = true
+		manifest.Images = append(manifest.Images[:i], manifest.Images[i+1:]...)
+		removedNames = append(removedNames, imageName)
+	}
+
+	stagingDir, err := os.MkdirTemp("", "docker-compose-bundle-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temp directory: %w", err)
+	}
+	defer os.RemoveAll(stagingDir)
+	if err := os.MkdirAll(filepath.Join(stagingDir, "images"), 0755); err != nil {
+		return err
+	}
+
+	var added []ManifestImage
+	for _, imageName := range add {
+		if err := b.pullImageIfNotExists(imageName); err != nil {
+			return fmt.Errorf("failed to pull image %s: %w", imageName, err)
+		}
+		inspect, err := b.client.ImageInspect(b.ctx, imageName)
+		if err != nil {
+			return fmt.Errorf("failed to inspect image %s: %w", imageName, err)
+		}
+		if i := manifestImageIndex(manifest, imageName); i >= 0 {
+			fmt.Printf("Replacing bundled image %s\n", imageName)
+			dropped[manifest.Images[i].File] = true
+			manifest.Images = append(manifest.Images[:i], manifest.Images[i+1:]...)
+		}
+
+		file := filepath.Join("images", sanitizeFilename(imageName)+".tar")
+		aliases := b.imageAliases(imageName, inspect)
+		if err := b.saveImage(imageName, aliases, filepath.Join(stagingDir, file)); err != nil {
+			return fmt.Errorf("failed to save image %s: %w", imageName, err)
+		}
+		if err := manifest.addImage(imageName, inspect, aliases, stagingDir, file); err != nil {
+			return fmt.Errorf("failed to record image %s: %w", imageName, err)
+		}
+		img := manifest.Images[len(manifest.Images)-1]
+		dropped[img.File] = true // A stale file of the same name
+		added = append(added, img)
+	}
+
+	replaceServiceImages(compose, removedNames, add)
+	// Removed and replaced images no longer match their build records
+	manifest.Builds = slices.DeleteFunc(manifest.Builds, func(record BuildRecord) bool {
+		return slices.Contains(add, record.Image) || manifestImageIndex(manifest, record.Image) < 0
+	})
+
+	composeData, err := marshalCompose(compose)
+	if err != nil {
+		return err
+	}
+	indexData, err := buildIndex(compose, manifest).marshal()
+	if err != nil {
+		return err
+	}
+	manifest.Files = slices.DeleteFunc(manifest.Files, func(f ManifestFile) bool { return dropped[f.File] })
+	manifest.setFile("docker-compose.yml", composeData)
+	manifest.setFile("index.json", indexData)
+	manifestData, err := manifest.marshal()
+	if err != nil {
+		return err
+	}
+	metadata := map[string][]byte{"manifest.json": manifestData, "index.json": indexData, "docker-compose.yml": composeData}
+
+	partial := outputFile + ".partial"
+	if err := rewriteBundle(bundleFile, partial, metadata, dropped, func(w archiveWriter) error {
+		for _, img := range added {
+			if err := addArchiveFile(w, img.File, filepath.Join(stagingDir, filepath.FromSlash(img.File))); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		os.Remove(partial)
+		return fmt.Errorf("failed to rewrite bundle: %w", err)
+	}
+	if err := os.Rename(partial, outputFile); err != nil {
+		return err
+	}
+
+	if err := b.cleanupFreshlyPulledImages(); err != nil {
+		fmt.Printf("Warning: failed to cleanup some freshly pulled images: %v\n", err)
+	}
+	return nil
+}
+
+func manifestImageIndex(manifest *Manifest, imageName string) int {
+	for i, img := range manifest.Images {
+		if img.Name == imageName {
+			return i
+		}
+	}
+	return -1
+}
+
+// replaceServiceImages points services using a removed image to the added
+// image of the same repository, e.g. foo:1.0 -> foo:1.1
+func replaceServiceImages(compose *DockerCompose, removed, added []string) {
+	repository := func(imageName string) string {
+		named, err := reference.ParseNormalizedNamed(imageName)
+		if err != nil {
+			return imageName
+		}
+		return named.Name()
+	}
+
+	for _, imageName := range removed {
+		replacement := ""
+		for _, candidate := range added {
+			if repository(candidate) == repository(imageName) {
+				replacement = candidate
+			}
+		}
+		for _, serviceName := range sortedServiceNames(compose) {
+			service := compose.Services[serviceName]
+			if service.Image != imageName {
+				continue
+			}
+			if replacement == "" {
+				fmt.Printf("Warning: service %s uses the removed image %s, it has to exist on the target\n", serviceName, imageName)
+				continue
+			}
+			fmt.Printf("Service %s now uses %s\n", serviceName, replacement)
+			service.Image = replacement
+			compose.Services[serviceName] = service
+		}
+	}
+}
+
+// readBundleMetadata reads the manifest and compose file of a bundle archive
+func readBundleMetadata(bundleFile string) (*Manifest, *DockerCompose, error) {
+	reader, _, err := bundlefile.OpenReader(bundleFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer reader.Close()
+	return readBundleMetadataEntries(reader, bundleFile)
+}
+
+// readBundleMetadataFrom reads the metadata of a tar based bundle from a stream
+func readBundleMetadataFrom(r io.Reader, bundleFile string) (*Manifest, *DockerCompose, error) {
+	reader, err := bundlefile.NewStreamReader(r)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", bundleFile, err)
+	}
+	defer reader.Close()
+	return readBundleMetadataEntries(reader, bundleFile)
+}
+
+// readBundleMetadataEntries reads the archive until it found the manifest and
+// compose file, which bundles store at the start
+func readBundleMetadataEntries(reader archiveReader, bundleFile string) (*Manifest, *DockerCompose, error) {
+	var manifest *Manifest
+	var compose *DockerCompose
+	for manifest == nil || compose == nil {
+		entry, content, err := reader.Next()
+		if err == io.EOF {
+			return nil, nil, fmt.Errorf("%s is missing manifest.json or docker-compose.yml", bundleFile)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		switch entry.Name {
+		case "manifest.json":
+			data, err := io.ReadAll(content)
+			if err != nil {
+				return nil, nil, err
+			}
+			if manifest, err = parseManifest(data); err != nil {
+				return nil, nil, err
+			}
+		case "docker-compose.yml":
+			data, err := io.ReadAll(content)
+			if err != nil {
+				return nil, nil, err
+			}
+			if compose, err = parseBundleCompose(data); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	return manifest, compose, nil
+}
+
+// rewriteBundle writes the new metadata files, copies all other entries of a
+// bundle archive except the dropped ones, then lets appendEntries add new ones.
+// The rewritten bundle keeps the archive format.
+func rewriteBundle(bundleFile, outputFile string, metadata map[string][]byte, dropped map[string]bool, appendEntries func(w archiveWriter) error) error {
+	reader, format, err := bundlefile.OpenReader(bundleFile)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	out, err := os.Create(outputFile)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	writer, err := newArchiveWriter(out, format)
+	if err != nil {
+		return err
+	}
+	for _, name := range bundleMetadataFiles {
+		if err := writeArchiveFile(writer, name, metadata[name]); err != nil {
+			return err
+		}
+	}
+
+	for {
+		entry, content, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if dropped[entry.Name] || slices.Contains(bundleMetadataFiles, entry.Name) {
+			continue
+		}
+		if err := writer.WriteEntry(*entry, content); err != nil {
+			return err
+		}
+	}
+
+	if err := appendEntries(writer); err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+func runEdit(args []string) {
+	var remove, add []string
+	flags := flag.NewFlagSet("edit", flag.ExitOnError)
+	flags.Var((*stringList)(&remove), "remove-image", "Remove this `image` from the bundle (repeatable)")
+	flags.Var((*stringList)(&add), "add-image", "Add this `image` to the bundle, replacing a bundled image of the same name (repeatable)")
+	var opts Options
+	flags.Var((*stringList)(&opts.AcknowledgedLicenses), "acknowledge-license", "Acknowledge the redistribution terms of this `image` (or repository) from a restricted registry (repeatable)")
+	flags.BoolVar(&opts.AllTags, "all-tags", false, "Save every local tag pointing at an added image")
+	flags.StringVar(&opts.SaveCompat, "save-compat", "", "Store added images in this `layout`: docker-legacy or oci (default as the Docker daemon saves them)")
+	output := flags.String("output", "", "Write the edited bundle to this `file` instead of replacing the bundle")
+	flags.Usage = func() {
+		fmt.Println("Usage: docker-compose-bundler edit [flags] <bundle.tar.gz>")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 || len(remove)+len(add) == 0 {
+		flags.Usage()
+		os.Exit(1)
+	}
+	if _, err := parseSaveCompat(opts.SaveCompat); err != nil {
+		log.Fatal(err)
+	}
+
+	bundleFile := flags.Arg(0)
+	outputFile := bundleFile
+	if *output != "" {
+		outputFile = *output
+	}
+
+	bundler := NewBundler(opts)
+	if err := withTracing(func() error { return bundler.Edit(bundleFile, outputFile, remove, add) }); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Successfully updated bundle: %s\n", outputFile)
+}
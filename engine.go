@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/docker/docker/api"
+	"github.com/docker/docker/api/types/versions"
+)
+
+// baseEngineRequirement is what every bundle needs: image load and the
+// compose file format written by the bundler
+var baseEngineRequirement = EngineRequirement{MinAPIVersion: "1.25", MinEngineVersion: "1.13"}
+
+// EngineRequirement is the Docker Engine a bundle needs on the target
+type EngineRequirement struct {
+	MinAPIVersion    string   `json:"minApiVersion"`
+	MinEngineVersion string   `json:"minEngineVersion"`
+	MaxAPIVersion    string   `json:"maxApiVersion"` // Newest API the bundler knows about
+	Features         []string `json:"features,omitempty"`
+}
+
+// engineFeature is a compose feature that needs a newer engine than the base
+type engineFeature struct {
+	Name          string
+	APIVersion    string
+	EngineVersion string
+	Used          func(service Service) bool
+}
+
+var engineFeatures = []engineFeature{
+	{"healthcheck", "1.24", "1.12", func(s Service) bool {
+		_, ok := s.Extra["healthcheck"]
+		return ok
+	}},
+	{"init", "1.25", "1.13", func(s Service) bool {
+		return s.Extra["init"] == true
+	}},
+	{"gpus", "1.40", "19.03", usesGPUs},
+	{"healthcheck start_interval", "1.44", "25.0", func(s Service) bool {
+		healthcheck, _ := s.Extra["healthcheck"].(map[string]interface{})
+		_, ok := healthcheck["start_interval"]
+		return ok
+	}},
+}
+
+// usesGPUs reports GPU device reservations (deploy.resources.reservations.devices
+// with the gpu capability) or the gpus shorthand
+func usesGPUs(service Service) bool {
+	if _, ok := service.Extra["gpus"]; ok {
+		return true
+	}
+	deploy, _ := service.Extra["deploy"].(map[string]interface{})
+	resources, _ := deploy["resources"].(map[string]interface{})
+	reservations, _ := resources["reservations"].(map[string]interface{})
+	devices, _ := reservations["devices"].([]interface{})
+	for _, device := range devices {
+		config, _ := device.(map[string]interface{})
+		capabilities, _ := config["capabilities"].([]interface{})
+		for _, capability := range capabilities {
+			if capability == "gpu" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// engineRequirement derives the minimum engine from the features the services use
+func engineRequirement(compose *DockerCompose) *EngineRequirement {
+	requirement := baseEngineRequirement
+	requirement.MaxAPIVersion = api.DefaultVersion
+
+	used := make(map[string]bool)
+	for _, name := range sortedServiceNames(compose) {
+		for _, feature := range engineFeatures {
+			if !feature.Used(compose.Services[name]) {
+				continue
+			}
+			used[feature.Name] = true
+			if versions.LessThan(requirement.MinAPIVersion, feature.APIVersion) {
+				requirement.MinAPIVersion = feature.APIVersion
+				requirement.MinEngineVersion = feature.EngineVersion
+			}
+		}
+	}
+	for name := range used {
+		requirement.Features = append(requirement.Features, name)
+	}
+	sort.Strings(requirement.Features)
+	return &requirement
+}
+
+// CheckEngine compares the target daemon with the engine the bundle requires
+func (l *Loader) CheckEngine() error {
+	requirement := l.manifest.Engine
+	if requirement == nil {
+		return nil // Bundle created before engine requirements were recorded
+	}
+
+	server, err := l.client.ServerVersion(l.ctx)
+	if err != nil {
+		return fmt.Errorf("failed to query the Docker daemon version: %w", err)
+	}
+	if versions.LessThan(server.APIVersion, requirement.MinAPIVersion) {
+		return fmt.Errorf("docker engine %s (API %s) is too old, the bundle requires engine %s (API %s) or newer for: %v",
+			server.Version, server.APIVersion, requirement.MinEngineVersion, requirement.MinAPIVersion, requirement.Features)
+	}
+	if requirement.MaxAPIVersion != "" && versions.GreaterThan(server.MinAPIVersion, requirement.MaxAPIVersion) {
+		return fmt.Errorf("docker engine %s no longer supports API %s used by this bundle (minimum API %s)",
+			server.Version, requirement.MaxAPIVersion, server.MinAPIVersion)
+	}
+	return nil
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// EnvVar is a single environment entry. A nil Value means the variable is
+// passed through from the host environment at runtime ("KEY" without "=").
+type EnvVar struct {
+	Name  string
+	Value *string
+}
+
+// Environment holds a service environment in declaration order. Compose
+// accepts both the list ("KEY=value") and the map form, the original form is
+// kept so the bundled compose file looks like the input.
+type Environment struct {
+	Vars  []EnvVar
+	isMap bool
+}
+
+// Get returns the value of name and whether it is set to a value
+func (e Environment) Get(name string) (string, bool) {
+	for _, v := range e.Vars {
+		if v.Name == name && v.Value != nil {
+			return *v.Value, true
+		}
+	}
+	return "", false
+}
+
+// Map returns all variables that have a value
+func (e Environment) Map() map[string]string {
+	result := make(map[string]string, len(e.Vars))
+	for _, v := range e.Vars {
+		if v.Value != nil {
+			result[v.Name] = *v.Value
+		}
+	}
+	return result
+}
+
+// Set overrides or appends a variable, keeping its position if it exists
+func (e *Environment) Set(name, value string) {
+	for i := range e.Vars {
+		if e.Vars[i].Name == name {
+			e.Vars[i].Value = &value
+			return
+		}
+	}
+	e.Vars = append(e.Vars, EnvVar{Name: name, Value: &value})
+}
+
+func (e Environment) IsZero() bool {
+	return len(e.Vars) == 0
+}
+
+func (e *Environment) UnmarshalYAML(node *yaml.Node) error {
+	e.Vars = nil
+	switch node.Kind {
+	case yaml.MappingNode:
+		e.isMap = true
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			v := EnvVar{Name: node.Content[i].Value}
+			if valueNode := node.Content[i+1]; valueNode.Tag != "!!null" {
+				value := valueNode.Value
+				v.Value = &value
+			}
+			e.Vars = append(e.Vars, v)
+		}
+	case yaml.SequenceNode:
+		e.isMap = false
+		for _, item := range node.Content {
+			if item.Kind != yaml.ScalarNode {
+				return fmt.Errorf("line %d: environment entries must be strings", item.Line)
+			}
+			name, value, found := strings.Cut(item.Value, "=")
+			v := EnvVar{Name: name}
+			if found {
+				v.Value = &value
+			}
+			e.Vars = append(e.Vars, v)
+		}
+	case yaml.ScalarNode:
+		if node.Tag != "!!null" {
+			return fmt.Errorf("line %d: environment must be a list or a map", node.Line)
+		}
+	default:
+		return fmt.Errorf("line %d: environment must be a list or a map", node.Line)
+	}
+	return nil
+}
+
+func (e Environment) MarshalYAML() (interface{}, error) {
+	if e.isMap {
+		node := &yaml.Node{Kind: yaml.MappingNode}
+		for _, v := range e.Vars {
+			valueNode := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!null", Value: "null"}
+			if v.Value != nil {
+				valueNode = &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: *v.Value}
+			}
+			node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: v.Name}, valueNode)
+		}
+		return node, nil
+	}
+
+	list := make([]string, 0, len(e.Vars))
+	for _, v := range e.Vars {
+		if v.Value == nil {
+			list = append(list, v.Name)
+		} else {
+			list = append(list, v.Name+"="+*v.Value)
+		}
+	}
+	return list, nil
+}
+
+// EnvFile is a single env_file entry (short "path" or long {path, required} syntax)
+type EnvFile struct {
+	Path     string `yaml:"path"`
+	Required *bool  `yaml:"required,omitempty"`
+}
+
+// IsRequired reports whether a missing file is an error (compose defaults to true)
+func (f EnvFile) IsRequired() bool {
+	return f.Required == nil || *f.Required
+}
+
+// EnvFiles holds env_file, which compose accepts as a string or a list
+type EnvFiles []EnvFile
+
+// Paths returns the file paths in declaration order
+func (f EnvFiles) Paths() []string {
+	paths := make([]string, len(f))
+	for i, file := range f {
+		paths[i] = file.Path
+	}
+	return paths
+}
+
+func (f *EnvFiles) UnmarshalYAML(node *yaml.Node) error {
+	*f = nil
+	switch node.Kind {
+	case yaml.ScalarNode:
+		if node.Tag != "!!null" {
+			*f = EnvFiles{{Path: node.Value}}
+		}
+	case yaml.SequenceNode:
+		for _, item := range node.Content {
+			var file EnvFile
+			switch item.Kind {
+			case yaml.ScalarNode:
+				file.Path = item.Value
+			case yaml.MappingNode:
+				if err := item.Decode(&file); err != nil {
+					return err
+				}
+			default:
+				return fmt.Errorf("line %d: invalid env_file entry", item.Line)
+			}
+			*f = append(*f, file)
+		}
+	default:
+		return fmt.Errorf("line %d: env_file must be a string or a list", node.Line)
+	}
+	return nil
+}
+
+func (f EnvFiles) MarshalYAML() (interface{}, error) {
+	short := true
+	for _, file := range f {
+		if file.Required != nil {
+			short = false
+		}
+	}
+	if !short {
+		return []EnvFile(f), nil
+	}
+	return f.Paths(), nil
+}
+
+// dropMissingEnvFiles removes the optional env files that do not exist from
+// the services, missing required files are an error
+func dropMissingEnvFiles(compose *DockerCompose, baseDir string) error {
+	for _, serviceName := range sortedServiceNames(compose) {
+		service := compose.Services[serviceName]
+		var files EnvFiles
+		for _, file := range service.EnvFile {
+			if _, err := os.Stat(resolveHostPath(file.Path, baseDir)); err != nil {
+				if os.IsNotExist(err) && !file.IsRequired() {
+					continue
+				}
+				return fmt.Errorf("service %s: failed to read env_file %s: %w", serviceName, file.Path, err)
+			}
+			files = append(files, file)
+		}
+		service.EnvFile = files
+		compose.Services[serviceName] = service
+	}
+	return nil
+}
+
+// bundledEnvFiles returns the names already in the bundle's env/ directory
+func bundledEnvFiles(tempDir string) []string {
+	var names []string
+	entries, _ := os.ReadDir(filepath.Join(tempDir, "env"))
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	return names
+}
+
+// bundleEnvFiles copies the env files into the bundle's env/ directory,
+// envFiles maps their paths in the compose file to the copies like
+// composetransform.Result.EnvFiles
+func (b *Bundler) bundleEnvFiles(envFiles map[string]string, baseDir, tempDir string) error {
+	for _, written := range slices.Sorted(maps.Keys(envFiles)) {
+		target := envFiles[written]
+		data, encrypted, err := readSecretFile(resolveHostPath(written, baseDir), sopsDotenv)
+		if err != nil {
+			return fmt.Errorf("failed to read env_file %s: %w", written, err)
+		}
+		if encrypted && !b.dryRun() {
+			if data, err = b.sopsEncrypt(data, sopsDotenv, path.Clean(target)); err != nil {
+				return err
+			}
+		}
+		if err := os.MkdirAll(filepath.Join(tempDir, "env"), 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(filepath.Join(tempDir, filepath.FromSlash(target)), data, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func resolveHostPath(path, baseDir string) string {
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(baseDir, path)
+	}
+	return filepath.Clean(path)
+}
@@ -0,0 +1,487 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/user"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"docker-compose-bundler/bundlefile"
+)
+
+// Files of the event log in the state directory
+const (
+	eventsFile     = "events.jsonl"
+	eventsKeyFile  = "events.key" // ed25519 key of the host the events are signed with
+	eventsPubFile  = "events.pub"
+	eventsHeadFile = "events.head" // Signed seq and hash of the last event, tells a truncated log
+)
+
+// Actions recorded in the event log
+const (
+	EventCreated    = "created" // Taken from the manifest when the host first sees the bundle
+	EventVerified   = "verified"
+	EventLoaded     = "loaded"
+	EventDeployed   = "deployed"
+	EventUpgraded   = "upgraded"
+	EventRolledBack = "rolled-back"
+)
+
+// Event is an entry of the event log. Every event carries the hash of the
+// line before it and is signed with the key of the host, so entries that are
+// changed, removed or reordered afterwards are detected.
+type Event struct {
+	Seq             int       `json:"seq"`
+	Time            time.Time `json:"time"`
+	Action          string    `json:"action"`
+	Bundle          string    `json:"bundle"`
+	Version         string    `json:"version"`
+	PreviousVersion string    `json:"previousVersion,omitempty"` // Version an upgrade or rollback replaced
+	Host            string    `json:"host,omitempty"`
+	User            string    `json:"user,omitempty"`
+	Detail          string    `json:"detail,omitempty"`
+	Prev            string    `json:"prev"` // sha256 of the previous line, empty for the first event
+	Signature       string    `json:"signature"`
+}
+
+// EventLog is the exported event log of a host
+type EventLog struct {
+	Host      string  `json:"host"`
+	PublicKey string  `json:"publicKey"` // base64 ed25519 key the signatures verify with
+	Events    []Event `json:"events"`
+}
+
+// eventHead is the last event appended to the log. Removing events from the
+// end keeps the chain intact, the head does not match it then.
+type eventHead struct {
+	Seq       int    `json:"seq"`
+	Hash      string `json:"hash"` // sha256 of the line of the event
+	Signature string `json:"signature"`
+}
+
+func (h eventHead) signedBytes() ([]byte, error) {
+	h.Signature = ""
+	return json.Marshal(h)
+}
+
+// signedBytes is what the signature of an event covers
+func (e Event) signedBytes() ([]byte, error) {
+	e.Signature = ""
+	return json.Marshal(e)
+}
+
+// eventActor returns who runs the loader, with the user behind sudo
+func eventActor() string {
+	name := os.Getenv("USER")
+	if current, err := user.Current(); err == nil {
+		name = current.Username
+	}
+	if sudoUser := os.Getenv("SUDO_USER"); sudoUser != "" && sudoUser != name {
+		name = sudoUser + " (sudo " + name + ")"
+	}
+	return name
+}
+
+// eventKey reads the signing key of the host, generating it on first use
+func eventKey(stateDir string) (ed25519.PrivateKey, error) {
+	keyPath := filepath.Join(stateDir, eventsKeyFile)
+	data, err := os.ReadFile(keyPath)
+	if err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("%s is not a PEM key", keyPath)
+		}
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", keyPath, err)
+		}
+		private, ok := key.(ed25519.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("%s is not an ed25519 key", keyPath)
+		}
+		return private, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	privateDER, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return nil, err
+	}
+	publicDER, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(stateDir, 0755); err != nil {
+		return nil, err
+	}
+	// Created exclusively, of two first runs the later one uses the key of the other
+	file, err := os.OpenFile(keyPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if errors.Is(err, os.ErrExist) {
+		return eventKey(stateDir)
+	}
+	if err != nil {
+		return nil, err
+	}
+	_, err = file.Write(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateDER}))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return private, os.WriteFile(filepath.Join(stateDir, eventsPubFile), pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER}), 0644)
+}
+
+// readEventLines returns the lines of the event log
+func readEventLines(stateDir string) ([][]byte, error) {
+	data, err := os.ReadFile(filepath.Join(stateDir, eventsFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var lines [][]byte
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		if line := bytes.TrimSpace(scanner.Bytes()); len(line) > 0 {
+			lines = append(lines, slices.Clone(line))
+		}
+	}
+	return lines, scanner.Err()
+}
+
+func lineHash(line []byte) string {
+	sum := sha256.Sum256(line)
+	return hex.EncodeToString(sum[:])
+}
+
+// appendEvents signs events and appends them to the event log of stateDir
+func appendEvents(stateDir string, events ...Event) error {
+	key, err := eventKey(stateDir)
+	if err != nil {
+		return fmt.Errorf("failed to read the signing key: %w", err)
+	}
+	logPath := filepath.Join(stateDir, eventsFile)
+	release, err := waitRunLock(logPath, 30*time.Second)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	lines, err := readEventLines(stateDir)
+	if err != nil {
+		return err
+	}
+	seq, prev := 0, ""
+	if len(lines) > 0 {
+		var last Event
+		if err := json.Unmarshal(lines[len(lines)-1], &last); err != nil {
+			return fmt.Errorf("failed to parse the last event of %s: %w", logPath, err)
+		}
+		seq, prev = last.Seq, lineHash(lines[len(lines)-1])
+	}
+
+	host, _ := os.Hostname()
+	actor := eventActor()
+	var buf bytes.Buffer
+	for _, event := range events {
+		seq++
+		event.Seq, event.Prev = seq, prev
+		event.Time = event.Time.UTC()
+		if event.Action != EventCreated {
+			event.Host, event.User = host, actor
+		}
+		signed, err := event.signedBytes()
+		if err != nil {
+			return err
+		}
+		event.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(key, signed))
+		line, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+		prev = lineHash(line)
+	}
+
+	file, err := os.OpenFile(logPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(buf.Bytes())
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	head := eventHead{Seq: seq, Hash: prev}
+	signed, err := head.signedBytes()
+	if err != nil {
+		return err
+	}
+	head.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(key, signed))
+	data, err := json.Marshal(head)
+	if err != nil {
+		return err
+	}
+	return writeStoreFile(filepath.Join(stateDir, eventsHeadFile), append(data, '\n'))
+}
+
+// recordEvent appends the event for a bundle, preceded by its created event
+// the first time the host sees the bundle. Failures only warn, the event log
+// must not stop an installation.
+func recordEvent(stateDir string, manifest *Manifest, event Event) {
+	event.Bundle, event.Version = manifest.Name, manifest.Version
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	events := []Event{event}
+	if seen, err := bundleSeen(stateDir, manifest); err == nil && !seen {
+		created := Event{Time: manifest.CreatedAt, Action: EventCreated, Bundle: manifest.Name, Version: manifest.Version}
+		if manifest.Bundler != nil {
+			created.Detail = "docker-compose-bundler " + manifest.Bundler.Version
+		}
+		events = append([]Event{created}, events...)
+	}
+	if err := appendEvents(stateDir, events...); err != nil {
+		fmt.Printf("Warning: failed to record the %s event in %s: %v\n", event.Action, stateDir, err)
+	}
+}
+
+// bundleSeen reports whether the event log has a created event for the bundle version
+func bundleSeen(stateDir string, manifest *Manifest) (bool, error) {
+	lines, err := readEventLines(stateDir)
+	if err != nil {
+		return false, err
+	}
+	for _, line := range lines {
+		var event Event
+		if json.Unmarshal(line, &event) == nil && event.Action == EventCreated && event.Bundle == manifest.Name && event.Version == manifest.Version {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// deployEvent returns the event of deploying version over the previous
+// deployment of the same bundle
+func deployEvent(version, previous string) Event {
+	event := Event{Action: EventDeployed}
+	if previous == "" || previous == version {
+		return event
+	}
+	event.PreviousVersion = previous
+	event.Action = EventUpgraded
+	if versionOlder(version, previous) {
+		event.Action = EventRolledBack
+	}
+	return event
+}
+
+// versionOlder reports whether version a precedes b. Semantic versions are
+// compared by their numbers, other schemes like calver by their dotted
+// numbers as far as they are numeric. A pre-release precedes its release.
+func versionOlder(a, b string) bool {
+	na, nb := versionNumbers(a), versionNumbers(b)
+	for i := 0; i < len(na) && i < len(nb); i++ {
+		if na[i] != nb[i] {
+			return na[i] < nb[i]
+		}
+	}
+	if len(na) != len(nb) {
+		return len(na) < len(nb)
+	}
+	preA, preB := strings.Contains(releaseCore(a), "-"), strings.Contains(releaseCore(b), "-")
+	if preA != preB {
+		return preA
+	}
+	return releaseCore(a) < releaseCore(b)
+}
+
+func versionNumbers(version string) []int {
+	var numbers []int
+	n, digits := 0, false
+	for _, r := range releaseCore(version) {
+		switch {
+		case r >= '0' && r <= '9':
+			n, digits = n*10+int(r-'0'), true
+		case r == '.' && digits:
+			numbers = append(numbers, n)
+			n, digits = 0, false
+		default:
+			if digits {
+				numbers = append(numbers, n)
+			}
+			return numbers
+		}
+	}
+	if digits {
+		numbers = append(numbers, n)
+	}
+	return numbers
+}
+
+// ReadEventLog reads the event log of stateDir and checks the chain and the
+// signatures of its events against the key of the host
+func ReadEventLog(stateDir string) (*EventLog, error) {
+	host, _ := os.Hostname()
+	eventLog := &EventLog{Host: host, Events: []Event{}}
+	lines, err := readEventLines(stateDir)
+	if err != nil || len(lines) == 0 {
+		return eventLog, err
+	}
+	data, err := os.ReadFile(filepath.Join(stateDir, eventsPubFile))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the public key of the event log: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s is not a PEM key", eventsPubFile)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	public, ok := key.(ed25519.PublicKey)
+	if err != nil || !ok {
+		return nil, fmt.Errorf("%s is not an ed25519 public key", eventsPubFile)
+	}
+	eventLog.PublicKey = base64.StdEncoding.EncodeToString(public)
+
+	prev := ""
+	for i, line := range lines {
+		var event Event
+		if err := json.Unmarshal(line, &event); err != nil {
+			return nil, fmt.Errorf("event %d is corrupt: %w", i+1, err)
+		}
+		if event.Seq != i+1 || event.Prev != prev {
+			return nil, fmt.Errorf("event %d does not follow event %d, the log was changed", event.Seq, i)
+		}
+		signed, err := event.signedBytes()
+		if err != nil {
+			return nil, err
+		}
+		signature, err := base64.StdEncoding.DecodeString(event.Signature)
+		if err != nil || !ed25519.Verify(public, signed, signature) {
+			return nil, fmt.Errorf("event %d has an invalid signature, the log was changed", event.Seq)
+		}
+		eventLog.Events = append(eventLog.Events, event)
+		prev = lineHash(line)
+	}
+
+	// An older head is signed as well, the head must name the last event. A
+	// run that stopped after appending leaves the head behind until the next
+	// event is recorded.
+	head, err := readEventHead(stateDir, public)
+	if err != nil {
+		return nil, err
+	}
+	if head.Seq > len(lines) {
+		return nil, fmt.Errorf("the event log ends at event %d but %d events were recorded, the log was truncated", len(lines), head.Seq)
+	}
+	if head.Seq != len(lines) {
+		return nil, fmt.Errorf("%s names event %d but the log ends at event %d, the head was replaced or a run stopped while recording", eventsHeadFile, head.Seq, len(lines))
+	}
+	if lineHash(lines[head.Seq-1]) != head.Hash {
+		return nil, fmt.Errorf("event %d does not match %s, the log was changed", head.Seq, eventsHeadFile)
+	}
+	return eventLog, nil
+}
+
+// readEventHead reads the head of the event log and checks its signature
+func readEventHead(stateDir string, public ed25519.PublicKey) (*eventHead, error) {
+	data, err := os.ReadFile(filepath.Join(stateDir, eventsHeadFile))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%s is missing, the event log cannot be checked for truncation", eventsHeadFile)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var head eventHead
+	if err := json.Unmarshal(data, &head); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", eventsHeadFile, err)
+	}
+	signed, err := head.signedBytes()
+	if err != nil {
+		return nil, err
+	}
+	signature, err := base64.StdEncoding.DecodeString(head.Signature)
+	if err != nil || !ed25519.Verify(public, signed, signature) {
+		return nil, fmt.Errorf("%s has an invalid signature, the log was changed", eventsHeadFile)
+	}
+	return &head, nil
+}
+
+// bundleManifest reads the manifest of a bundle archive or directory
+func bundleManifest(source string) (*Manifest, error) {
+	bundle, err := bundlefile.Open(source)
+	if err != nil {
+		return nil, err
+	}
+	return parseManifest(bundle.Manifest().Raw)
+}
+
+func runEvents(args []string) {
+	flags := flag.NewFlagSet("events", flag.ExitOnError)
+	stateDir := flags.String("state-dir", defaultStateDir(), "`Directory` the loader records the events in")
+	output := flags.String("output", "", "Write the JSON export to this `file` instead of stdout")
+	since := flags.String("since", "", "Only export events from this `date` on (YYYY-MM-DD or RFC 3339)")
+	flags.Usage = func() {
+		fmt.Println("Usage: docker-compose-bundler events [flags]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	var from time.Time
+	if *since != "" {
+		var err error
+		if from, err = time.Parse(time.DateOnly, *since); err != nil {
+			if from, err = time.Parse(time.RFC3339, *since); err != nil {
+				log.Fatalf("invalid --since %q, use YYYY-MM-DD or RFC 3339", *since)
+			}
+		}
+	}
+
+	eventLog, err := ReadEventLog(*stateDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	eventLog.Events = slices.DeleteFunc(eventLog.Events, func(e Event) bool { return e.Time.Before(from) })
+	data, err := json.MarshalIndent(eventLog, "", "  ")
+	if err != nil {
+		log.Fatal(err)
+	}
+	data = append(data, '\n')
+	if *output == "" {
+		os.Stdout.Write(data)
+		return
+	}
+	if err := os.WriteFile(*output, data, 0644); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Fprintf(os.Stderr, "Exported %d event(s) to %s\n", len(eventLog.Events), *output)
+}
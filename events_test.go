@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeEventLog records three events in a new state directory and returns it
+func writeEventLog(t *testing.T) string {
+	t.Helper()
+	stateDir := t.TempDir()
+	start := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	if err := appendEvents(stateDir,
+		Event{Time: start, Action: EventCreated, Bundle: "shop", Version: "1.2.0"},
+		Event{Time: start.Add(time.Minute), Action: EventVerified, Bundle: "shop", Version: "1.2.0"},
+	); err != nil {
+		t.Fatal(err)
+	}
+	if err := appendEvents(stateDir, Event{Time: start.Add(2 * time.Minute), Action: EventLoaded, Bundle: "shop", Version: "1.2.0"}); err != nil {
+		t.Fatal(err)
+	}
+	return stateDir
+}
+
+// editEventLines replaces the lines of the event log with what edit returns
+func editEventLines(t *testing.T, stateDir string, edit func(lines [][]byte) [][]byte) {
+	t.Helper()
+	lines, err := readEventLines(stateDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := append(bytes.Join(edit(lines), []byte("\n")), '\n')
+	if err := os.WriteFile(filepath.Join(stateDir, eventsFile), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadEventLog(t *testing.T) {
+	stateDir := writeEventLog(t)
+	eventLog, err := ReadEventLog(stateDir)
+	if err != nil {
+		t.Fatalf("an untouched log was refused: %v", err)
+	}
+	var actions []string
+	for _, event := range eventLog.Events {
+		actions = append(actions, event.Action)
+	}
+	if want := []string{EventCreated, EventVerified, EventLoaded}; !slices.Equal(actions, want) {
+		t.Errorf("events %q, want %q", actions, want)
+	}
+	if eventLog.PublicKey == "" {
+		t.Error("the export has no public key")
+	}
+}
+
+func TestReadEventLogDetectsChanges(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		change func(t *testing.T, stateDir string)
+		err    string
+	}{
+		{"edited event", func(t *testing.T, stateDir string) {
+			editEventLines(t, stateDir, func(lines [][]byte) [][]byte {
+				lines[1] = bytes.Replace(lines[1], []byte(`"version":"1.2.0"`), []byte(`"version":"1.1.0"`), 1)
+				return lines
+			})
+		}, "event 2 has an invalid signature"},
+		{"dropped last event", func(t *testing.T, stateDir string) {
+			editEventLines(t, stateDir, func(lines [][]byte) [][]byte { return lines[:2] })
+		}, "the log was truncated"},
+		{"reordered events", func(t *testing.T, stateDir string) {
+			editEventLines(t, stateDir, func(lines [][]byte) [][]byte {
+				return [][]byte{lines[0], lines[2], lines[1]}
+			})
+		}, "does not follow"},
+		{"old head", func(t *testing.T, stateDir string) {
+			// Signed for the third event, the log goes on after it
+			old, err := os.ReadFile(filepath.Join(stateDir, eventsHeadFile))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := appendEvents(stateDir, Event{Time: time.Now(), Action: EventDeployed, Bundle: "shop", Version: "1.2.0"}); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(stateDir, eventsHeadFile), old, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}, "the head was replaced"},
+		{"missing head", func(t *testing.T, stateDir string) {
+			if err := os.Remove(filepath.Join(stateDir, eventsHeadFile)); err != nil {
+				t.Fatal(err)
+			}
+		}, "events.head is missing"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			stateDir := writeEventLog(t)
+			test.change(t, stateDir)
+			if _, err := ReadEventLog(stateDir); err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("ReadEventLog returned %v, want an error containing %q", err, test.err)
+			}
+		})
+	}
+}
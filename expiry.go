@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Policies of x-bundle.expiryPolicy
+const (
+	ExpiryWarn   = "warn"
+	ExpiryRefuse = "refuse"
+)
+
+// BundleExpiry is the end of the evaluation period of a bundle. It is only
+// enforced by the loader: the stack keeps running and the bundle can be
+// loaded by other means.
+type BundleExpiry struct {
+	Expires string `json:"expires"` // Date (last valid day in the time zone of the target) or RFC 3339 time
+	Policy  string `json:"policy"`  // warn or refuse
+}
+
+// bundleExpiry validates x-bundle.expires and expiryPolicy for the manifest
+func (b *Bundler) bundleExpiry(xBundle *XBundle) (*BundleExpiry, error) {
+	if xBundle.Expires == "" {
+		if xBundle.ExpiryPolicy != "" {
+			return nil, fmt.Errorf("x-bundle.expiryPolicy requires x-bundle.expires")
+		}
+		return nil, nil
+	}
+	expiry := &BundleExpiry{Expires: xBundle.Expires, Policy: xBundle.ExpiryPolicy}
+	switch expiry.Policy {
+	case "":
+		expiry.Policy = ExpiryWarn
+	case ExpiryWarn, ExpiryRefuse:
+	default:
+		return nil, fmt.Errorf("invalid x-bundle.expiryPolicy %q, use warn or refuse", expiry.Policy)
+	}
+	end, err := expiry.end()
+	if err != nil {
+		return nil, err
+	}
+	if !time.Now().Before(end) {
+		b.warnf("the bundle expired on %s, the loader will %s it", expiry.Expires, map[string]string{ExpiryWarn: "warn about", ExpiryRefuse: "refuse"}[expiry.Policy])
+	}
+	return expiry, nil
+}
+
+// end returns the first instant the bundle is expired, dates end at local midnight
+func (e *BundleExpiry) end() (time.Time, error) {
+	if day, err := time.ParseInLocation(time.DateOnly, e.Expires, time.Local); err == nil {
+		return day.AddDate(0, 0, 1), nil
+	}
+	if t, err := time.Parse(time.RFC3339, e.Expires); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid x-bundle.expires %q, use YYYY-MM-DD or an RFC 3339 time", e.Expires)
+}
+
+// CheckExpiry warns about or refuses an expired bundle, depending on its policy
+func (l *Loader) CheckExpiry() error {
+	expiry := l.manifest.Expiry
+	if expiry == nil {
+		return nil
+	}
+	end, err := expiry.end()
+	if err != nil {
+		return err
+	}
+	if time.Now().Before(end) {
+		return nil
+	}
+	if expiry.Policy == ExpiryRefuse {
+		return fmt.Errorf("bundle %s %s expired on %s, contact the vendor for a current bundle", l.manifest.Name, l.manifest.Version, expiry.Expires)
+	}
+	fmt.Printf("Warning: bundle %s %s expired on %s, contact the vendor for a current bundle\n", l.manifest.Name, l.manifest.Version, expiry.Expires)
+	return nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"docker-compose-bundler/composetransform"
+
+	"gopkg.in/yaml.v3"
+)
+
+// What --extensions does with x-* entries the bundler does not use, on the
+// top level and in services
+const (
+	ExtensionsPreserve = composetransform.ExtensionsPreserve // Copy them into the bundle as written
+	ExtensionsStrip    = composetransform.ExtensionsStrip
+	ExtensionsError    = composetransform.ExtensionsError
+)
+
+// composeExtensions holds the x-* entries of a compose file as written:
+// neither interpolated nor $-escaped, with their key order, quoting and
+// comments. They replace the decoded values when the file is written, so
+// tooling on the target reads what the authors wrote.
+type composeExtensions struct {
+	top      map[string]*yaml.Node
+	services map[string]map[string]*yaml.Node
+}
+
+// captureExtensions copies the x-* entries of a compose root mapping
+func captureExtensions(root *yaml.Node) *composeExtensions {
+	ext := &composeExtensions{top: make(map[string]*yaml.Node), services: make(map[string]map[string]*yaml.Node)}
+	if root == nil || root.Kind != yaml.MappingNode {
+		return ext
+	}
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		key, value := root.Content[i].Value, root.Content[i+1]
+		if composetransform.IsExtension(key) {
+			ext.top[key] = value
+		}
+		if key != "services" || value.Kind != yaml.MappingNode {
+			continue
+		}
+		for j := 0; j+1 < len(value.Content); j += 2 {
+			service := value.Content[j+1]
+			if service.Kind != yaml.MappingNode {
+				continue
+			}
+			for k := 0; k+1 < len(service.Content); k += 2 {
+				if name := service.Content[k].Value; composetransform.IsExtension(name) {
+					if ext.services[value.Content[j].Value] == nil {
+						ext.services[value.Content[j].Value] = make(map[string]*yaml.Node)
+					}
+					ext.services[value.Content[j].Value][name] = service.Content[k+1]
+				}
+			}
+		}
+	}
+	return ext
+}
+
+// restoreExtensions puts the captured x-* entries back into an encoded
+// compose mapping, replacing their decoded, escaped values
+func restoreExtensions(root *yaml.Node, ext *composeExtensions) {
+	if ext == nil || root.Kind != yaml.MappingNode {
+		return
+	}
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		key := root.Content[i].Value
+		if raw, ok := ext.top[key]; ok {
+			root.Content[i+1] = resolveAnchors(raw)
+		}
+		if key != "services" {
+			continue
+		}
+		services := root.Content[i+1]
+		for j := 0; j+1 < len(services.Content); j += 2 {
+			raws := ext.services[services.Content[j].Value]
+			service := services.Content[j+1]
+			for k := 0; k+1 < len(service.Content) && raws != nil; k += 2 {
+				if raw, ok := raws[service.Content[k].Value]; ok {
+					service.Content[k+1] = resolveAnchors(raw)
+				}
+			}
+		}
+	}
+}
+
+// checkExtensions refuses the x-* entries of compose with --extensions error
+// before any image is built, composetransform strips them when writing
+func (b *Bundler) checkExtensions(compose *DockerCompose) error {
+	var root yaml.Node
+	if err := root.Encode(compose); err != nil {
+		return err
+	}
+	return composetransform.CheckExtensions(&root, b.opts.Extensions)
+}
+
+// mergeServiceExtensions takes the extensions of the services extra replaces
+// in compose when appending
+func mergeServiceExtensions(compose, extra *DockerCompose) {
+	if compose.extensions == nil {
+		compose.extensions = captureExtensions(nil)
+	}
+	for name := range extra.Services {
+		delete(compose.extensions.services, name)
+		if extra.extensions != nil && extra.extensions.services[name] != nil {
+			compose.extensions.services[name] = extra.extensions.services[name]
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Limits of extracting a bundle archive. Bundles reach the target through
+// intermediaries, a crafted one must not fill the disk or write outside of
+// the extraction directory.
+const (
+	defaultMaxExtractSize = 64 << 30 // Bytes written to disk, images streamed into the daemon do not count
+	maxExtractEntries     = 100000
+)
+
+// validMemberPath reports whether name is a slash separated path that stays
+// below the bundle directory on every platform. Bundles never have colons in
+// member names, on Windows they start drive letters and alternate data streams.
+func validMemberPath(name string) bool {
+	return fs.ValidPath(name) && name != "." && !strings.ContainsAny(name, `\:`) && filepath.IsLocal(filepath.FromSlash(name))
+}
+
+// extractor writes archive entries below a directory. Files are created
+// through an os.Root, so symlinks already in the directory cannot redirect
+// them elsewhere.
+type extractor struct {
+	root    *os.Root
+	maxSize int64
+	written int64
+	entries int
+}
+
+func newExtractor(dir string, maxSize int64) (*extractor, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return nil, err
+	}
+	if maxSize <= 0 {
+		maxSize = defaultMaxExtractSize
+	}
+	return &extractor{root: root, maxSize: maxSize}, nil
+}
+
+// check validates an entry before it is extracted or streamed elsewhere
+func (e *extractor) check(entry *bundleEntry) error {
+	if !validMemberPath(entry.Name) {
+		return fmt.Errorf("refusing to extract %q outside of the target directory", entry.Name)
+	}
+	if entry.Name == loadStateName {
+		return fmt.Errorf("refusing to extract %s, it would fake the progress of the load", entry.Name)
+	}
+	if e.entries++; e.entries > maxExtractEntries {
+		return fmt.Errorf("bundle has more than %d entries, refusing to extract it", maxExtractEntries)
+	}
+	if entry.Size < 0 {
+		return fmt.Errorf("invalid size of %s in bundle", entry.Name)
+	}
+	return nil
+}
+
+// extract writes entry below the directory
+func (e *extractor) extract(entry *bundleEntry, content io.Reader) error {
+	if err := e.check(entry); err != nil {
+		return err
+	}
+	if entry.IsDir {
+		return e.mkdirAll(entry.Name)
+	}
+	if e.written+entry.Size > e.maxSize {
+		return fmt.Errorf("bundle extracts to more than %s, refusing to extract %s (raise the limit with --max-size)", formatBytes(e.maxSize), entry.Name)
+	}
+	if err := e.mkdirAll(path.Dir(entry.Name)); err != nil {
+		return err
+	}
+
+	// A file from an earlier run may be a symlink, replace it instead of following it
+	if info, err := e.root.Lstat(entry.Name); err == nil && !info.Mode().IsRegular() {
+		if err := e.root.Remove(entry.Name); err != nil {
+			return fmt.Errorf("failed to replace %s: %w", entry.Name, err)
+		}
+	}
+	out, err := e.root.OpenFile(entry.Name, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(entry.Mode)&0777)
+	if err != nil {
+		return err
+	}
+	// The declared size is checked by the archive readers, limit it anyway
+	n, err := io.Copy(out, io.LimitReader(content, entry.Size+1))
+	e.written += n
+	if err == nil && n != entry.Size {
+		err = fmt.Errorf("size of %s does not match the archive header", entry.Name)
+	}
+	if err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// mkdirAll creates the directory name and its parents below the root
+func (e *extractor) mkdirAll(name string) error {
+	if name == "." {
+		return nil
+	}
+	if err := e.mkdirAll(path.Dir(name)); err != nil {
+		return err
+	}
+	if err := e.root.Mkdir(name, 0755); err != nil && !errors.Is(err, fs.ErrExist) {
+		return err
+	}
+	if info, err := e.root.Lstat(name); err != nil {
+		return err
+	} else if !info.IsDir() {
+		return fmt.Errorf("refusing to extract into %s, it is not a directory", name)
+	}
+	return nil
+}
+
+func (e *extractor) Close() error {
+	return e.root.Close()
+}
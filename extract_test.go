@@ -0,0 +1,154 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidMemberPath(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		valid bool
+	}{
+		{"manifest.json", true},
+		{"images/nginx-1.27.tar", true},
+		{"env/.env", true},
+		{"", false},
+		{".", false},
+		{"..", false},
+		{"../outside", false},
+		{"images/../../outside", false},
+		{"images/./nginx.tar", false},
+		{"images//nginx.tar", false},
+		{"images/", false},
+		{"/etc/passwd", false},
+		{`..\outside`, false},
+		{`images\..\..\outside`, false},
+		{"C:/Windows/System32/evil.dll", false},
+		{"C:evil.dll", false},
+		{`C:\Windows\evil.dll`, false},
+		{"//server/share/evil", false},
+		{`\\server\share\evil`, false},
+		{"manifest.json:stream", false},
+	} {
+		if got := validMemberPath(test.name); got != test.valid {
+			t.Errorf("validMemberPath(%q) = %v, want %v", test.name, got, test.valid)
+		}
+	}
+}
+
+func TestExtractorRefusesEntries(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		entries []bundleEntry
+		maxSize int64
+		err     string
+	}{
+		{"traversal", []bundleEntry{{Name: "../outside.sh", Size: 1}}, 0, "outside of the target directory"},
+		{"absolute path", []bundleEntry{{Name: "/tmp/outside.sh", Size: 1}}, 0, "outside of the target directory"},
+		{"drive letter", []bundleEntry{{Name: "C:/outside.sh", Size: 1}}, 0, "outside of the target directory"},
+		{"UNC path", []bundleEntry{{Name: `\\server\share\outside.sh`, Size: 1}}, 0, "outside of the target directory"},
+		{"load state", []bundleEntry{{Name: loadStateName, Size: 1}}, 0, "fake the progress of the load"},
+		{"negative size", []bundleEntry{{Name: "manifest.json", Size: -1}}, 0, "invalid size"},
+		{"entry larger than the limit", []bundleEntry{{Name: "images/app.tar", Size: 11}}, 10, "more than 10 B"},
+		{"total larger than the limit", []bundleEntry{{Name: "a.txt", Size: 6}, {Name: "b.txt", Size: 6}}, 10, "refusing to extract b.txt"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			e, err := newExtractor(filepath.Join(dir, "bundle"), test.maxSize)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer e.Close()
+			for i, entry := range test.entries {
+				entry.Mode, entry.ModTime = 0644, time.Now()
+				err = e.extract(&entry, strings.NewReader(strings.Repeat("x", max(int(entry.Size), 0))))
+				if i < len(test.entries)-1 && err != nil {
+					t.Fatalf("extracting %s: %v", entry.Name, err)
+				}
+			}
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("extract returned %v, want an error containing %q", err, test.err)
+			}
+			if _, err := os.Stat(filepath.Join(dir, "outside.sh")); !os.IsNotExist(err) {
+				t.Errorf("a file was written outside of the target: %v", err)
+			}
+		})
+	}
+}
+
+func TestExtractorEntryLimit(t *testing.T) {
+	e, err := newExtractor(t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	e.entries = maxExtractEntries - 1
+	if err := e.extract(&bundleEntry{Name: "images", IsDir: true, Mode: 0755}, strings.NewReader("")); err != nil {
+		t.Fatalf("the last allowed entry was refused: %v", err)
+	}
+	err = e.extract(&bundleEntry{Name: "manifest.json", Size: 2, Mode: 0644}, strings.NewReader("{}"))
+	if err == nil || !strings.Contains(err.Error(), "more than 100000 entries") {
+		t.Errorf("extract after the entry limit returned %v", err)
+	}
+}
+
+func TestExtractorSizeMismatch(t *testing.T) {
+	e, err := newExtractor(t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	for _, content := range []string{"{", "{}}"} {
+		err := e.extract(&bundleEntry{Name: "manifest.json", Size: 2, Mode: 0644}, strings.NewReader(content))
+		if err == nil || !strings.Contains(err.Error(), "does not match the archive header") {
+			t.Errorf("extracting %q as 2 bytes returned %v", content, err)
+		}
+	}
+}
+
+func TestExtractorDoesNotFollowSymlinks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks need privileges on Windows")
+	}
+	dir := t.TempDir()
+	outside := filepath.Join(dir, "outside")
+	if err := os.MkdirAll(outside, 0755); err != nil {
+		t.Fatal(err)
+	}
+	target := filepath.Join(dir, "bundle")
+	if err := os.MkdirAll(target, 0755); err != nil {
+		t.Fatal(err)
+	}
+	// Left in the target by an earlier run or planted by someone else
+	if err := os.Symlink(filepath.Join(outside, "victim.sh"), filepath.Join(target, "load-images.sh")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(target, "images")); err != nil {
+		t.Fatal(err)
+	}
+
+	e, err := newExtractor(target, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	if err := e.extract(&bundleEntry{Name: "load-images.sh", Size: 5, Mode: 0755}, strings.NewReader("#!/sh")); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Lstat(filepath.Join(target, "load-images.sh")); err != nil || !info.Mode().IsRegular() {
+		t.Errorf("the symlink was not replaced by the file: %v", err)
+	}
+	err = e.extract(&bundleEntry{Name: "images/app.tar", Size: 3, Mode: 0644}, strings.NewReader("tar"))
+	if err == nil || !strings.Contains(err.Error(), "not a directory") {
+		t.Errorf("extracting through a symlinked directory returned %v", err)
+	}
+
+	if entries, err := os.ReadDir(outside); err != nil || len(entries) != 0 {
+		t.Errorf("files were written outside of the target: %v %v", entries, err)
+	}
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+const (
+	fatSectorSize = 512
+	// fatPartitionStart aligns the partition to 1 MiB like partitioning tools do
+	fatPartitionStart  = 2048
+	fatReservedSectors = 32
+	// fatMinClusters is the smallest cluster count detected as FAT32
+	fatMinClusters = 65525
+	fatMaxFileSize = 1<<32 - 1
+)
+
+// fatNode is a directory or file of the FAT image being written
+type fatNode struct {
+	name     string
+	file     *mediaFile
+	children []*fatNode
+	parent   *fatNode
+	cluster  uint32 // First cluster, 0 for empty files
+	clusters uint32
+	short    [11]byte
+}
+
+func (n *fatNode) isDir() bool { return n.file == nil }
+
+// writeFAT writes a raw disk image with an MBR and a single FAT32 partition,
+// which can be written to a USB stick with dd and is readable everywhere
+func writeFAT(out io.Writer, label string, files []*mediaFile) error {
+	root := &fatNode{}
+	for _, f := range files {
+		if f.Size > fatMaxFileSize {
+			return fmt.Errorf("%s is larger than 4 GiB, the limit of FAT32; use --split-size 4G", f.Name)
+		}
+		parent := root
+		dirs := strings.Split(f.Name, "/")
+		for _, dir := range dirs[:len(dirs)-1] {
+			i := slices.IndexFunc(parent.children, func(c *fatNode) bool { return c.isDir() && c.name == dir })
+			if i < 0 {
+				parent.children = append(parent.children, &fatNode{name: dir, parent: parent})
+				i = len(parent.children) - 1
+			}
+			parent = parent.children[i]
+		}
+		parent.children = append(parent.children, &fatNode{name: dirs[len(dirs)-1], file: f, parent: parent})
+	}
+
+	// Directories first, then the file data, each contiguous
+	var dirs, data []*fatNode
+	var walk func(dir *fatNode)
+	walk = func(dir *fatNode) {
+		dirs = append(dirs, dir)
+		slices.SortFunc(dir.children, func(a, b *fatNode) int { return strings.Compare(a.name, b.name) })
+		assignShortNames(dir)
+		for _, child := range dir.children {
+			if child.isDir() {
+				walk(child)
+			} else {
+				data = append(data, child)
+			}
+		}
+	}
+	walk(root)
+
+	var dataSize int64
+	for _, dir := range dirs {
+		dataSize += int64(len(fatDirectory(dir, label, time.Time{})))
+	}
+	for _, node := range data {
+		dataSize += node.file.Size
+	}
+	clusterSize := uint32(fatSectorSize)
+	for clusterSize < 32<<10 && dataSize/int64(clusterSize) > 4*fatMinClusters {
+		clusterSize *= 2
+	}
+	clusterSectors := clusterSize / fatSectorSize
+	clustersOf := func(size int64) uint32 { return uint32((size + int64(clusterSize) - 1) / int64(clusterSize)) }
+
+	next := uint32(2)
+	for _, dir := range dirs {
+		dir.clusters = max(clustersOf(int64(len(fatDirectory(dir, label, time.Time{})))), 1)
+		dir.cluster, next = next, next+dir.clusters
+	}
+	for _, node := range data {
+		if node.clusters = clustersOf(node.file.Size); node.clusters > 0 {
+			node.cluster, next = next, next+node.clusters
+		}
+	}
+	used := next - 2
+	// Room to spare on the stick, FAT32 needs a minimum number of clusters
+	total := max(used+used/50+16, fatMinClusters+16)
+	fatSectors := (4*(total+2) + fatSectorSize - 1) / fatSectorSize
+	partitionSectors := fatReservedSectors + 2*fatSectors + total*clusterSectors
+
+	w := &isoWriter{w: out}
+	w.write(fatMBR(partitionSectors))
+	w.pad((fatPartitionStart - 1) * fatSectorSize)
+	boot := fatBootSector(label, partitionSectors, fatSectors, clusterSectors)
+	info := fatInfoSector(total - used)
+	reserved := make([]byte, fatReservedSectors*fatSectorSize)
+	copy(reserved, boot)
+	copy(reserved[fatSectorSize:], info)
+	copy(reserved[6*fatSectorSize:], boot)
+	copy(reserved[7*fatSectorSize:], info)
+	w.write(reserved)
+
+	fat := make([]byte, fatSectors*fatSectorSize)
+	binary.LittleEndian.PutUint32(fat[0:], 0x0FFFFFF8)
+	binary.LittleEndian.PutUint32(fat[4:], 0x0FFFFFFF)
+	for _, node := range append(slices.Clone(dirs), data...) {
+		for i := uint32(0); i < node.clusters; i++ {
+			entry := node.cluster + i + 1
+			if i == node.clusters-1 {
+				entry = 0x0FFFFFFF
+			}
+			binary.LittleEndian.PutUint32(fat[4*(node.cluster+i):], entry)
+		}
+	}
+	w.write(fat)
+	w.write(fat)
+
+	now := time.Now()
+	for _, dir := range dirs {
+		entries := fatDirectory(dir, label, now)
+		w.write(entries)
+		w.pad(int(dir.clusters*clusterSize) - len(entries))
+	}
+	if w.err != nil {
+		return w.err
+	}
+	for _, node := range data {
+		r, err := node.file.open()
+		if err != nil {
+			return err
+		}
+		n, err := io.Copy(out, r)
+		r.Close()
+		if err != nil {
+			return err
+		}
+		if n != node.file.Size {
+			return fmt.Errorf("%s changed while writing the image", node.file.Name)
+		}
+		w.pad(int(int64(node.clusters)*int64(clusterSize) - n))
+	}
+	// The free clusters are part of the image, so it has the size of the partition
+	w.pad(int(total-used) * int(clusterSize))
+	return w.err
+}
+
+// fatMBR is a master boot record with one FAT32 (LBA) partition
+func fatMBR(partitionSectors uint32) []byte {
+	mbr := make([]byte, fatSectorSize)
+	entry := mbr[446:]
+	// CHS addresses are unused with LBA, 0xFE 0xFF 0xFF marks them as such
+	copy(entry[1:4], []byte{0xFE, 0xFF, 0xFF})
+	entry[4] = 0x0C
+	copy(entry[5:8], []byte{0xFE, 0xFF, 0xFF})
+	binary.LittleEndian.PutUint32(entry[8:], fatPartitionStart)
+	binary.LittleEndian.PutUint32(entry[12:], partitionSectors)
+	binary.LittleEndian.PutUint32(mbr[440:], rand.Uint32())
+	mbr[510], mbr[511] = 0x55, 0xAA
+	return mbr
+}
+
+func fatBootSector(label string, partitionSectors, fatSectors, clusterSectors uint32) []byte {
+	b := make([]byte, fatSectorSize)
+	copy(b, []byte{0xEB, 0x58, 0x90})
+	copy(b[3:], "MSWIN4.1")
+	binary.LittleEndian.PutUint16(b[11:], fatSectorSize)
+	b[13] = byte(clusterSectors)
+	binary.LittleEndian.PutUint16(b[14:], fatReservedSectors)
+	b[16] = 2
+	b[21] = 0xF8
+	binary.LittleEndian.PutUint16(b[24:], 63)
+	binary.LittleEndian.PutUint16(b[26:], 255)
+	binary.LittleEndian.PutUint32(b[28:], fatPartitionStart)
+	binary.LittleEndian.PutUint32(b[32:], partitionSectors)
+	binary.LittleEndian.PutUint32(b[36:], fatSectors)
+	binary.LittleEndian.PutUint32(b[44:], 2) // Root directory cluster
+	binary.LittleEndian.PutUint16(b[48:], 1) // FSInfo sector
+	binary.LittleEndian.PutUint16(b[50:], 6) // Backup boot sector
+	b[64] = 0x80
+	b[66] = 0x29
+	binary.LittleEndian.PutUint32(b[67:], rand.Uint32())
+	copy(b[71:82], fatLabel(label))
+	copy(b[82:], "FAT32   ")
+	b[510], b[511] = 0x55, 0xAA
+	return b
+}
+
+func fatInfoSector(free uint32) []byte {
+	b := make([]byte, fatSectorSize)
+	binary.LittleEndian.PutUint32(b[0:], 0x41615252)
+	binary.LittleEndian.PutUint32(b[484:], 0x61417272)
+	binary.LittleEndian.PutUint32(b[488:], free)
+	binary.LittleEndian.PutUint32(b[492:], 0xFFFFFFFF)
+	binary.LittleEndian.PutUint32(b[508:], 0xAA550000)
+	return b
+}
+
+// fatLabel is the volume label, 11 uppercase characters padded with spaces
+func fatLabel(label string) []byte {
+	name := []byte(truncate(fatShortChars(strings.ToUpper(label)), 11))
+	return append(name, []byte(strings.Repeat(" ", 11-len(name)))...)
+}
+
+// fatShortChars replaces the characters not allowed in short names
+func fatShortChars(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("!#$%&'()-@^_`{}~", r) {
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+// assignShortNames gives every child of dir a unique 8.3 name, the long name
+// is stored in VFAT entries in front of it
+func assignShortNames(dir *fatNode) {
+	seen := make(map[[11]byte]bool)
+	for _, child := range dir.children {
+		upper := strings.ToUpper(child.name)
+		base, ext := upper, ""
+		if i := strings.LastIndex(upper, "."); i > 0 {
+			base, ext = upper[:i], upper[i+1:]
+		}
+		base = fatShortChars(strings.ReplaceAll(base, ".", ""))
+		ext = truncate(fatShortChars(ext), 3)
+		for i := 1; ; i++ {
+			name := truncate(base, 8)
+			if i > 1 || len(base) > 8 || fatNeedsLongName(child.name) {
+				suffix := fmt.Sprintf("~%d", i)
+				name = truncate(base, 8-len(suffix)) + suffix
+			}
+			var short [11]byte
+			copy(short[:], fmt.Sprintf("%-8s%-3s", name, ext))
+			if !seen[short] {
+				seen[short] = true
+				child.short = short
+				break
+			}
+		}
+	}
+}
+
+// fatNeedsLongName tells whether name does not fit an 8.3 name as it is
+func fatNeedsLongName(name string) bool {
+	base, ext, _ := strings.Cut(name, ".")
+	return name != strings.ToUpper(name) || strings.Contains(ext, ".") || len(base) > 8 || len(ext) > 3 || fatShortChars(base) != base || fatShortChars(ext) != ext
+}
+
+// fatDirectory encodes the entries of a directory, the root directory
+// starts with the volume label
+func fatDirectory(dir *fatNode, label string, date time.Time) []byte {
+	var buf []byte
+	fatDate := uint16((max(date.Year(), 1980)-1980)<<9 | int(date.Month())<<5 | date.Day())
+	fatTime := uint16(date.Hour()<<11 | date.Minute()<<5 | date.Second()/2)
+	entry := func(short [11]byte, attr byte, cluster uint32, size uint32) {
+		e := make([]byte, 32)
+		copy(e, short[:])
+		e[11] = attr
+		binary.LittleEndian.PutUint16(e[14:], fatTime)
+		binary.LittleEndian.PutUint16(e[16:], fatDate)
+		binary.LittleEndian.PutUint16(e[18:], fatDate)
+		binary.LittleEndian.PutUint16(e[20:], uint16(cluster>>16))
+		binary.LittleEndian.PutUint16(e[22:], fatTime)
+		binary.LittleEndian.PutUint16(e[24:], fatDate)
+		binary.LittleEndian.PutUint16(e[26:], uint16(cluster))
+		binary.LittleEndian.PutUint32(e[28:], size)
+		buf = append(buf, e...)
+	}
+
+	if dir.parent == nil {
+		var volume [11]byte
+		copy(volume[:], fatLabel(label))
+		entry(volume, 0x08, 0, 0)
+	} else {
+		var dot, dotdot [11]byte
+		copy(dot[:], ".          ")
+		copy(dotdot[:], "..         ")
+		entry(dot, 0x10, dir.cluster, 0)
+		// The root directory is cluster 0 in ".." entries
+		parent := dir.parent.cluster
+		if dir.parent.parent == nil {
+			parent = 0
+		}
+		entry(dotdot, 0x10, parent, 0)
+	}
+
+	for _, child := range dir.children {
+		if fatNeedsLongName(child.name) {
+			buf = append(buf, fatLongNameEntries(child.name, child.short)...)
+		}
+		if child.isDir() {
+			entry(child.short, 0x10, child.cluster, 0)
+		} else {
+			entry(child.short, 0x20, child.cluster, uint32(child.file.Size))
+		}
+	}
+	return buf
+}
+
+// fatLongNameEntries encodes name as VFAT entries, last part first
+func fatLongNameEntries(name string, short [11]byte) []byte {
+	var checksum byte
+	for _, c := range short {
+		checksum = (checksum>>1 | checksum<<7) + c
+	}
+	units := append(utf16.Encode([]rune(name)), 0)
+	for len(units)%13 != 0 {
+		units = append(units, 0xFFFF)
+	}
+	count := len(units) / 13
+	var buf []byte
+	for seq := count; seq >= 1; seq-- {
+		e := make([]byte, 32)
+		e[0] = byte(seq)
+		if seq == count {
+			e[0] |= 0x40
+		}
+		e[11] = 0x0F
+		e[13] = checksum
+		part := units[(seq-1)*13 : seq*13]
+		for i, u := range part {
+			offset := []int{1, 3, 5, 7, 9, 14, 16, 18, 20, 22, 24, 28, 30}[i]
+			binary.LittleEndian.PutUint16(e[offset:], u)
+		}
+		buf = append(buf, e...)
+	}
+	return buf
+}
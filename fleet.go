@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// fleetSchemaVersion versions the fleet manifest like index.json
+const fleetSchemaVersion = "1.0"
+
+// Layouts of --fleet-format
+const (
+	FleetFormatYAML    = "yaml"
+	FleetFormatAnsible = "ansible"
+)
+
+// FleetManifest describes how to roll a bundle out, for configuration
+// management tools deploying it to many hosts
+type FleetManifest struct {
+	SchemaVersion string            `yaml:"schemaVersion"`
+	Name          string            `yaml:"name"`
+	Version       string            `yaml:"version"`
+	ProjectName   string            `yaml:"projectName"`
+	Artifact      FleetArtifact     `yaml:"artifact"`
+	RequiredVars  []string          `yaml:"requiredVars"` // Host environment variables the services need at runtime
+	Directory     string            `yaml:"directory"`    // Where the deploy command extracts the bundle
+	Deploy        string            `yaml:"deploy"`       // Shell command run in the directory of the artifact
+	Annotations   map[string]string `yaml:"annotations,omitempty"`
+}
+
+// FleetArtifact is the bundle archive, or one of its parts
+type FleetArtifact struct {
+	File   string          `yaml:"file"`
+	URL    string          `yaml:"url,omitempty"`
+	Size   int64           `yaml:"size"`
+	SHA256 string          `yaml:"sha256,omitempty"`
+	Parts  []FleetArtifact `yaml:"parts,omitempty"` // Set for split bundles, download all of them
+}
+
+func parseFleetFormat(value string) (string, error) {
+	switch value {
+	case "", FleetFormatYAML:
+		return FleetFormatYAML, nil
+	case FleetFormatAnsible:
+		return FleetFormatAnsible, nil
+	}
+	return "", fmt.Errorf("invalid fleet manifest format %q, use yaml or ansible", value)
+}
+
+// writeFleetManifest writes the --fleet-manifest of the finished bundle
+func (b *Bundler) writeFleetManifest(outputFile string, index *BundleIndex) error {
+	if b.opts.FleetManifest == "" {
+		return nil
+	}
+	format, err := parseFleetFormat(b.opts.FleetFormat)
+	if err != nil {
+		return err
+	}
+
+	artifact, err := fleetArtifact(outputFile, b.opts.ArtifactURL)
+	if err != nil {
+		return err
+	}
+	source := artifact.File
+	if len(artifact.Parts) > 0 {
+		source = artifact.Parts[0].File
+	}
+	dir := "/opt/" + index.ProjectName
+	fleet := &FleetManifest{
+		SchemaVersion: fleetSchemaVersion,
+		Name:          index.Name,
+		Version:       index.Version,
+		ProjectName:   index.ProjectName,
+		Artifact:      artifact,
+		RequiredVars:  index.RequiredEnv,
+		Directory:     dir,
+		Deploy:        fmt.Sprintf("docker-compose-bundler load --dir %s %s && docker-compose-bundler deploy --wait %s", dir, source, dir),
+		Annotations:   index.Annotations,
+	}
+
+	var doc interface{} = fleet
+	if format == FleetFormatAnsible {
+		doc = fleet.ansibleInventory()
+	}
+	data, err := yaml.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(b.opts.FleetManifest, data, 0644); err != nil {
+		return fmt.Errorf("failed to write fleet manifest: %w", err)
+	}
+	fmt.Printf("Fleet manifest written to %s\n", b.opts.FleetManifest)
+	return nil
+}
+
+// fleetArtifact describes the bundle at outputFile, or its parts if it was
+// split. baseURL is where it gets published: the URL of the archive, or a
+// directory URL ending in a slash.
+func fleetArtifact(outputFile, baseURL string) (FleetArtifact, error) {
+	urlOf := func(file string) string {
+		switch {
+		case baseURL == "":
+			return ""
+		case strings.HasSuffix(baseURL, "/"):
+			return baseURL + file
+		}
+		// Parts are published next to the archive URL
+		return baseURL + strings.TrimPrefix(file, filepath.Base(outputFile))
+	}
+	describe := func(path string) (FleetArtifact, error) {
+		size, digest, err := fileDigest(path)
+		if err != nil {
+			return FleetArtifact{}, err
+		}
+		file := filepath.Base(path)
+		return FleetArtifact{File: file, URL: urlOf(file), Size: size, SHA256: digest}, nil
+	}
+
+	// Splitting removes the archive, parts next to an existing one are stale
+	if _, err := os.Stat(outputFile); err == nil {
+		return describe(outputFile)
+	}
+	parts, err := filepath.Glob(outputFile + ".[0-9][0-9][0-9]")
+	if err != nil {
+		return FleetArtifact{}, err
+	}
+	if len(parts) == 0 {
+		return FleetArtifact{}, fmt.Errorf("bundle %s not found", outputFile)
+	}
+	artifact := FleetArtifact{File: filepath.Base(outputFile), URL: urlOf(filepath.Base(outputFile))}
+	for _, path := range parts {
+		part, err := describe(path)
+		if err != nil {
+			return FleetArtifact{}, err
+		}
+		artifact.Size += part.Size
+		artifact.Parts = append(artifact.Parts, part)
+	}
+	return artifact, nil
+}
+
+// ansibleInventory returns the manifest as an inventory whose vars apply to
+// all hosts, to be passed with -i next to the host inventory. Checksums use
+// the algorithm:hex form of the get_url module.
+func (f *FleetManifest) ansibleInventory() map[string]interface{} {
+	var parts []map[string]interface{}
+	for _, part := range f.Artifact.Parts {
+		parts = append(parts, map[string]interface{}{"file": part.File, "url": part.URL, "size": part.Size, "checksum": "sha256:" + part.SHA256})
+	}
+	vars := map[string]interface{}{
+		"bundle_name":           f.Name,
+		"bundle_version":        f.Version,
+		"bundle_project":        f.ProjectName,
+		"bundle_file":           f.Artifact.File,
+		"bundle_url":            f.Artifact.URL,
+		"bundle_size":           f.Artifact.Size,
+		"bundle_required_vars":  f.RequiredVars,
+		"bundle_dir":            f.Directory,
+		"bundle_deploy_command": f.Deploy,
+	}
+	if len(parts) > 0 {
+		vars["bundle_parts"] = parts
+	} else {
+		vars["bundle_checksum"] = "sha256:" + f.Artifact.SHA256
+	}
+	if len(f.Annotations) > 0 {
+		vars["bundle_annotations"] = f.Annotations
+	}
+	return map[string]interface{}{"all": map[string]interface{}{"vars": vars}}
+}
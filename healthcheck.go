@@ -0,0 +1,153 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HealthcheckHint is an entry of x-bundle.healthchecks. Listing a service
+// synthesizes a healthcheck for it, --synthesize-healthchecks does so for all.
+type HealthcheckHint struct {
+	Disable     bool   `yaml:"disable,omitempty"` // Never synthesize one, e.g. for images without a shell
+	Port        int    `yaml:"port,omitempty"`    // Container port to probe instead of the first TCP port
+	Interval    string `yaml:"interval,omitempty"`
+	Timeout     string `yaml:"timeout,omitempty"`
+	Retries     int    `yaml:"retries,omitempty"`
+	StartPeriod string `yaml:"start_period,omitempty"`
+}
+
+// Defaults of synthesized healthchecks, the start period covers slow starting third-party services
+const (
+	healthcheckInterval    = "10s"
+	healthcheckTimeout     = "5s"
+	healthcheckRetries     = 3
+	healthcheckStartPeriod = "30s"
+)
+
+// synthesizeHealthchecks adds a TCP port probe to the services without a
+// healthcheck, so deploy --wait can tell whether they came up
+func (b *Bundler) synthesizeHealthchecks(compose *DockerCompose) error {
+	var hints map[string]HealthcheckHint
+	if compose.XBundle != nil {
+		hints = compose.XBundle.Healthchecks
+	}
+	for _, name := range slices.Sorted(maps.Keys(hints)) {
+		if _, ok := compose.Services[name]; !ok {
+			return fmt.Errorf("x-bundle.healthchecks lists unknown service %s", name)
+		}
+		if err := hints[name].validate(); err != nil {
+			return fmt.Errorf("invalid x-bundle.healthchecks.%s: %w", name, err)
+		}
+	}
+
+	for _, name := range sortedServiceNames(compose) {
+		service := compose.Services[name]
+		hint, listed := hints[name]
+		if hint.Disable || !listed && !b.opts.Healthchecks {
+			continue
+		}
+		if _, ok := service.Extra["healthcheck"]; ok {
+			continue
+		}
+
+		port := hint.Port
+		if port == 0 {
+			port = firstTCPPort(service)
+		}
+		if service.Image != "" && !b.dryRun() && !b.isMissing(service.Image) {
+			inspect, err := b.client.ImageInspect(b.ctx, service.Image)
+			if err != nil {
+				return fmt.Errorf("failed to inspect image %s: %w", service.Image, err)
+			}
+			if config := inspect.Config; config != nil {
+				// The HEALTHCHECK of the image applies, a synthesized one would replace it
+				if config.Healthcheck != nil && len(config.Healthcheck.Test) > 0 && config.Healthcheck.Test[0] != "NONE" {
+					continue
+				}
+				if port == 0 {
+					port = firstTCPPortOf(slices.Sorted(maps.Keys(config.ExposedPorts)))
+				}
+			}
+		}
+		if port == 0 {
+			if listed {
+				b.warnf("service %s has no TCP port in ports or expose, set x-bundle.healthchecks.%s.port", name, name)
+			}
+			continue
+		}
+
+		if service.Extra == nil {
+			service.Extra = make(map[string]interface{})
+		}
+		service.Extra["healthcheck"] = hint.healthcheck(port)
+		compose.Services[name] = service
+		b.decidef("Service %s gets a healthcheck probing TCP port %d", name, port)
+	}
+	return nil
+}
+
+func (h HealthcheckHint) validate() error {
+	if h.Port < 0 || h.Port > 65535 {
+		return fmt.Errorf("invalid port %d", h.Port)
+	}
+	for _, d := range []string{h.Interval, h.Timeout, h.StartPeriod} {
+		if d == "" {
+			continue
+		}
+		if _, err := time.ParseDuration(d); err != nil {
+			return fmt.Errorf("invalid duration %q", d)
+		}
+	}
+	if h.Retries < 0 {
+		return fmt.Errorf("invalid retries %d", h.Retries)
+	}
+	return nil
+}
+
+// healthcheck returns the compose healthcheck probing port. The port counts as
+// open if the kernel lists it as listening, which needs only a shell and grep,
+// nc is the fallback for kernels without /proc/net.
+func (h HealthcheckHint) healthcheck(port int) map[string]interface{} {
+	probe := fmt.Sprintf("grep -qE '^ *[0-9]+: [0-9A-F]+:%04X [0-9A-F]+:[0-9A-F]+ 0A' /proc/net/tcp /proc/net/tcp6 2>/dev/null || nc -z 127.0.0.1 %d", port, port)
+	return map[string]interface{}{
+		"test":         []interface{}{"CMD-SHELL", probe},
+		"interval":     cmp.Or(h.Interval, healthcheckInterval),
+		"timeout":      cmp.Or(h.Timeout, healthcheckTimeout),
+		"retries":      cmp.Or(h.Retries, healthcheckRetries),
+		"start_period": cmp.Or(h.StartPeriod, healthcheckStartPeriod),
+	}
+}
+
+// firstTCPPort returns the first TCP container port of ports, then expose
+func firstTCPPort(service Service) int {
+	var specs []string
+	for _, p := range service.Ports {
+		specs = append(specs, p.Target+"/"+p.Protocol)
+	}
+	if expose, ok := service.Extra["expose"].([]interface{}); ok {
+		for _, e := range expose {
+			specs = append(specs, fmt.Sprint(e))
+		}
+	}
+	return firstTCPPortOf(specs)
+}
+
+// firstTCPPortOf returns the first TCP port of port[-range][/protocol] specs
+func firstTCPPortOf(specs []string) int {
+	for _, spec := range specs {
+		port, protocol, _ := strings.Cut(spec, "/")
+		if protocol != "" && protocol != "tcp" {
+			continue
+		}
+		port, _, _ = strings.Cut(port, "-")
+		if n, err := strconv.Atoi(port); err == nil && n > 0 && n <= 65535 {
+			return n
+		}
+	}
+	return 0
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"docker-compose-bundler/dockerclient"
+)
+
+func TestBundleSynthesizesHealthchecks(t *testing.T) {
+	compose := `services:
+  web:
+    image: nginx:1.27
+    command: ["nginx", "-g", "daemon off;"]
+  api:
+    image: shop/api:1.2.0
+    command: ["/api"]
+    ports:
+      - "9000:8080/udp"
+      - "8443:443"
+  cache:
+    image: redis:7
+    command: ["redis-server"]
+    expose: ["6379"]
+x-bundle:
+  name: shop
+  version: 1.2.0
+  healthchecks:
+    api:
+      interval: 30s
+    cache:
+      disable: true
+`
+	fake := dockerclient.NewFake()
+	fake.AddImage("nginx:1.27").Exposed = []string{"80/tcp"}
+	fake.AddImage("shop/api:1.2.0")
+	fake.AddImage("redis:7")
+
+	// Only the listed services get one without --synthesize-healthchecks
+	_, bundled, err := readBundleMetadata(bundleWith(t, fake, Options{}, writeCompose(t, compose)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := bundled.Services["web"].Extra["healthcheck"]; ok {
+		t.Error("web got a healthcheck without being listed")
+	}
+	api, ok := bundled.Services["api"].Extra["healthcheck"].(map[string]interface{})
+	if !ok {
+		t.Fatal("api got no healthcheck")
+	}
+	if test := fmt.Sprint(api["test"]); !strings.Contains(test, ":01BB ") || !strings.Contains(test, "nc -z 127.0.0.1 443") {
+		t.Errorf("api probes %s, want TCP port 443", test)
+	}
+	if api["interval"] != "30s" || api["timeout"] != healthcheckTimeout {
+		t.Errorf("api healthcheck %v", api)
+	}
+
+	_, bundled, err = readBundleMetadata(bundleWith(t, fake, Options{Healthchecks: true}, writeCompose(t, compose)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	web, ok := bundled.Services["web"].Extra["healthcheck"].(map[string]interface{})
+	if !ok || !strings.Contains(fmt.Sprint(web["test"]), "nc -z 127.0.0.1 80") {
+		t.Errorf("web healthcheck %v, want the port exposed by its image", web)
+	}
+	if _, ok := bundled.Services["cache"].Extra["healthcheck"]; ok {
+		t.Error("cache got a healthcheck although it is disabled")
+	}
+}
+
+func TestFirstTCPPortOf(t *testing.T) {
+	for _, tt := range []struct {
+		specs []string
+		want  int
+	}{
+		{[]string{"53/udp", "8080-8090/tcp"}, 8080},
+		{[]string{"5000"}, 5000},
+		{[]string{"53/udp"}, 0},
+		{nil, 0},
+	} {
+		if got := firstTCPPortOf(tt.specs); got != tt.want {
+			t.Errorf("firstTCPPortOf(%v) = %d, want %d", tt.specs, got, tt.want)
+		}
+	}
+}
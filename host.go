@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// procSysDir is where the kernel exposes the sysctls of the host
+var procSysDir = "/proc/sys"
+
+var sysctlNamePattern = regexp.MustCompile(`^[a-z0-9_]+(\.[a-zA-Z0-9_-]+)+$`)
+
+// HostRequirements is x-bundle.host, what the target host has to provide
+// besides a Docker engine. The loader checks them before starting the stack.
+type HostRequirements struct {
+	StorageDrivers []string          `yaml:"storage_drivers,omitempty" json:"storageDrivers,omitempty"` // Any of these, overlayfs and overlay2 count as the same
+	Cgroup         string            `yaml:"cgroup,omitempty" json:"cgroup,omitempty"`                  // Cgroup version, 1 or 2
+	IPv6           bool              `yaml:"ipv6,omitempty" json:"ipv6,omitempty"`
+	Sysctls        map[string]string `yaml:"sysctls,omitempty" json:"sysctls,omitempty"` // Numeric values are minimums
+}
+
+// hostRequirements validates x-bundle.host for the manifest
+func hostRequirements(xBundle *XBundle) (*HostRequirements, error) {
+	if xBundle == nil || xBundle.Host == nil {
+		return nil, nil
+	}
+	host := *xBundle.Host
+	switch strings.TrimPrefix(host.Cgroup, "v") {
+	case "":
+	case "1", "2":
+		host.Cgroup = strings.TrimPrefix(host.Cgroup, "v")
+	default:
+		return nil, fmt.Errorf("invalid x-bundle.host.cgroup %q, use 1 or 2", host.Cgroup)
+	}
+	for name := range host.Sysctls {
+		if !sysctlNamePattern.MatchString(name) {
+			return nil, fmt.Errorf("invalid sysctl %q in x-bundle.host.sysctls", name)
+		}
+	}
+	return &host, nil
+}
+
+// hostProblem is an unmet host requirement and how to fix it
+type hostProblem struct {
+	Problem string
+	Remedy  string
+}
+
+// hostProblems checks the host and its Docker daemon against the requirements of the bundle
+func (l *Loader) hostProblems() ([]hostProblem, error) {
+	host := l.manifest.Host
+	if host == nil {
+		return nil, nil
+	}
+
+	var problems []hostProblem
+	if len(host.StorageDrivers) > 0 || host.Cgroup != "" {
+		info, err := l.client.Info(l.ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query the Docker daemon: %w", err)
+		}
+		if len(host.StorageDrivers) > 0 && !slices.ContainsFunc(host.StorageDrivers, func(driver string) bool { return sameStorageDriver(driver, info.Driver) }) {
+			// overlayfs is the snapshotter of the containerd image store, the daemon setting is overlay2
+			driver := host.StorageDrivers[0]
+			if driver == "overlayfs" {
+				driver = "overlay2"
+			}
+			problems = append(problems, hostProblem{
+				Problem: fmt.Sprintf("the Docker daemon uses the %s storage driver, the bundle requires %s", info.Driver, strings.Join(host.StorageDrivers, " or ")),
+				Remedy: fmt.Sprintf("set \"storage-driver\": %q in /etc/docker/daemon.json and restart Docker (sudo systemctl restart docker); images and containers of the %s driver are not visible afterwards",
+					driver, info.Driver),
+			})
+		}
+		if host.Cgroup != "" && info.CgroupVersion != "" && info.CgroupVersion != host.Cgroup {
+			unified := map[string]string{"1": "0", "2": "1"}[host.Cgroup]
+			problems = append(problems, hostProblem{
+				Problem: fmt.Sprintf("the host uses cgroup v%s, the bundle requires cgroup v%s", info.CgroupVersion, host.Cgroup),
+				Remedy:  fmt.Sprintf("add systemd.unified_cgroup_hierarchy=%s to GRUB_CMDLINE_LINUX in /etc/default/grub, run sudo update-grub (or grub2-mkconfig -o /boot/grub2/grub.cfg) and reboot", unified),
+			})
+		}
+	}
+
+	if host.IPv6 {
+		disabled, err := readSysctl("net.ipv6.conf.all.disable_ipv6")
+		if err != nil || disabled != "0" {
+			problems = append(problems, hostProblem{
+				Problem: "IPv6 is disabled on the host, the bundle requires it",
+				Remedy:  "run sudo sysctl -w net.ipv6.conf.all.disable_ipv6=0, or remove ipv6.disable=1 from the kernel command line and reboot if the sysctl does not exist",
+			})
+		}
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(host.Sysctls)) {
+		required := host.Sysctls[name]
+		actual, err := readSysctl(name)
+		if err != nil {
+			problems = append(problems, hostProblem{
+				Problem: fmt.Sprintf("sysctl %s cannot be read: %v", name, err),
+				Remedy:  fmt.Sprintf("check that the kernel supports %s", name),
+			})
+			continue
+		}
+		if sysctlSatisfied(actual, required) {
+			continue
+		}
+		setting := name + "=" + required
+		if strings.ContainsAny(required, " \t") {
+			setting = "'" + setting + "'"
+		}
+		problems = append(problems, hostProblem{
+			Problem: fmt.Sprintf("sysctl %s is %s, the bundle requires %s", name, actual, required),
+			Remedy: fmt.Sprintf("run sudo sysctl -w %s and persist it with: echo '%s = %s' | sudo tee /etc/sysctl.d/90-%s.conf",
+				setting, name, required, l.manifest.ProjectName),
+		})
+	}
+	return problems, nil
+}
+
+// sameStorageDriver treats the overlay2 graph driver and the overlayfs
+// snapshotter of the containerd image store as the same requirement
+func sameStorageDriver(required, actual string) bool {
+	overlay := func(driver string) bool { return driver == "overlay2" || driver == "overlayfs" }
+	return required == actual || overlay(required) && overlay(actual)
+}
+
+// sysctlSatisfied compares numeric values as minimums, others as they are
+func sysctlSatisfied(actual, required string) bool {
+	want, errWant := strconv.ParseInt(required, 10, 64)
+	have, errHave := strconv.ParseInt(actual, 10, 64)
+	if errWant == nil && errHave == nil {
+		return have >= want
+	}
+	return strings.Join(strings.Fields(actual), " ") == strings.Join(strings.Fields(required), " ")
+}
+
+func readSysctl(name string) (string, error) {
+	data, err := os.ReadFile(filepath.Join(procSysDir, strings.ReplaceAll(name, ".", "/")))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// CheckHost fails with remediation steps if the host does not meet the
+// requirements of the bundle
+func (l *Loader) CheckHost() error {
+	problems, err := l.hostProblems()
+	if err != nil {
+		return err
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	return fmt.Errorf("host does not meet %d requirement(s) of the bundle:\n%s", len(problems), formatHostProblems(problems))
+}
+
+// printHostHints warns about unmet host requirements without failing, images
+// can be loaded before the host is prepared
+func (l *Loader) printHostHints() {
+	problems, err := l.hostProblems()
+	if err != nil {
+		fmt.Printf("Warning: %v\n", err)
+		return
+	}
+	if len(problems) > 0 {
+		fmt.Printf("Warning: fix the host before starting the stack:\n%s\n", formatHostProblems(problems))
+	}
+}
+
+func formatHostProblems(problems []hostProblem) string {
+	var lines []string
+	for _, problem := range problems {
+		lines = append(lines, "  - "+problem.Problem, "    fix: "+problem.Remedy)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// readmeSection lists the host requirements in the bundle README
+func (h *HostRequirements) readmeSection(c *catalog) string {
+	var sb strings.Builder
+	sb.WriteString(c.t("readme.host") + "\n")
+	if len(h.StorageDrivers) > 0 {
+		sb.WriteString("- " + c.t("readme.host.storage_driver", strings.Join(h.StorageDrivers, " / ")) + "\n")
+	}
+	if h.Cgroup != "" {
+		sb.WriteString("- " + c.t("readme.host.cgroup", h.Cgroup) + "\n")
+	}
+	if h.IPv6 {
+		sb.WriteString("- " + c.t("readme.host.ipv6") + "\n")
+	}
+	for _, name := range slices.Sorted(maps.Keys(h.Sysctls)) {
+		sb.WriteString("- " + c.t("readme.host.sysctl", name, h.Sysctls[name], name, h.Sysctls[name]) + "\n")
+	}
+	return sb.String()
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"docker-compose-bundler/dockerclient"
+)
+
+func TestCheckHost(t *testing.T) {
+	compose := strings.Replace(webCompose, "  version: 1.2.0\n", `  version: 1.2.0
+  host:
+    storage_drivers: [overlayfs]
+    cgroup: v1
+    sysctls:
+      vm.max_map_count: 262144
+`, 1)
+	source := dockerclient.NewFake()
+	source.AddImage("nginx:1.27")
+	source.AddImage("redis:7")
+	outputFile := bundleWith(t, source, Options{}, writeCompose(t, compose))
+
+	sysDir := t.TempDir()
+	defer func(dir string) { procSysDir = dir }(procSysDir)
+	procSysDir = sysDir
+	writeSysctl := func(value string) {
+		if err := os.MkdirAll(filepath.Join(sysDir, "vm"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(sysDir, "vm", "max_map_count"), []byte(value+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeSysctl("65530")
+
+	// The fake daemon runs overlay2 on cgroup v2
+	target := dockerclient.NewFake()
+	loader, err := LoadArchive(outputFile, filepath.Join(t.TempDir(), "shop"), target, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = loader.CheckHost()
+	if err == nil || !strings.Contains(err.Error(), "2 requirement(s)") {
+		t.Fatalf("CheckHost error %v, want the cgroup and sysctl requirements", err)
+	}
+	if !strings.Contains(err.Error(), "cgroup v2, the bundle requires cgroup v1") || !strings.Contains(err.Error(), "vm.max_map_count is 65530") {
+		t.Errorf("CheckHost error %v", err)
+	}
+
+	target.SystemInfo.CgroupVersion = "1"
+	writeSysctl("1048576")
+	if err := loader.CheckHost(); err != nil {
+		t.Errorf("CheckHost on a prepared host: %v", err)
+	}
+}
+
+func TestSysctlSatisfied(t *testing.T) {
+	tests := []struct {
+		actual, required string
+		want             bool
+	}{
+		{"262144", "262144", true},
+		{"1048576", "262144", true}, // Numbers are minimums
+		{"65530", "262144", false},
+		{"4096\t87380  6291456", "4096 87380 6291456", true},
+		{"cubic", "bbr", false},
+	}
+	for _, tt := range tests {
+		if got := sysctlSatisfied(tt.actual, tt.required); got != tt.want {
+			t.Errorf("sysctlSatisfied(%q, %q) = %v, want %v", tt.actual, tt.required, got, tt.want)
+		}
+	}
+}
+
+func TestHostRequirementsValidation(t *testing.T) {
+	if _, err := hostRequirements(&XBundle{Host: &HostRequirements{Cgroup: "3"}}); err == nil {
+		t.Error("cgroup 3 was accepted")
+	}
+	if _, err := hostRequirements(&XBundle{Host: &HostRequirements{Sysctls: map[string]string{"max_map_count": "1"}}}); err == nil {
+		t.Error("a sysctl without namespace was accepted")
+	}
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// localeFiles are the message catalogs of the operator-facing files and the
+// TUI, one JSON object of message ID to translation per language
+//
+//go:embed locales/*.json
+var localeFiles embed.FS
+
+// defaultLanguage is what the bundler writes without --lang and what missing
+// translations fall back to
+const defaultLanguage = "en"
+
+var formatVerbPattern = regexp.MustCompile(`%(\[\d+\])?[sdvq]`)
+
+// englishMessages are the messages of every catalog, the ID prefix tells
+// where they are used. Scripts print them with printf, so they may only use %s.
+var englishMessages = map[string]string{
+	"readme.body": `# Docker Compose Bundle
+
+This bundle contains a Docker Compose stack with all required images for offline deployment.
+
+## Contents
+
+- docker-compose.yml - The Docker Compose configuration
+- images/ - Directory containing all Docker images as tar files
+- load-images.sh - Script to load all images (Linux/Mac)
+- load-images.bat - Script to load all images (Windows)
+
+## Usage
+
+1. Extract this bundle to your desired location
+2. Load the Docker images:
+   - On Linux/Mac: ./load-images.sh
+   - On Windows: load-images.bat
+3. Start the stack: docker compose -p %s up -d
+
+## Requirements
+
+- Docker Engine installed
+- Docker Compose installed
+
+Note: No internet connection is required after extracting this bundle.
+`,
+	"readme.translations": "This README is also available in: %s\n",
+	"readme.partial": `## INCOMPLETE BUNDLE
+
+This bundle was created with --allow-partial and does not contain every image.
+The following images could not be pulled and are missing:
+`,
+	"readme.partial.provide": `Provide them on this host before starting the stack, e.g. with docker load -i
+<image>.tar from another delivery or docker pull from a reachable registry.
+docker-compose-bundler deploy refuses to start the stack until they are present.
+`,
+	"readme.capacity": `## Capacity
+
+Estimated host resources ("-" means not declared):
+`,
+	"readme.capacity.columns": "| Service | Memory | CPUs | Image size | Data |",
+	"readme.capacity.total":   "Total",
+	"readme.capacity.note":    "The total disk space counts every image once plus the declared data.\n",
+	"readme.host": "## Host Requirements\n\n" +
+		"Besides Docker, the stack needs the following on the host. `docker-compose-bundler deploy`\n" +
+		"checks them before starting the stack:\n",
+	"readme.host.storage_driver": "Docker storage driver %s",
+	"readme.host.cgroup":         "cgroup v%s",
+	"readme.host.ipv6":           "IPv6 enabled in the kernel",
+	"readme.host.sysctl":         "sysctl %s = %s, set it with: sudo sysctl -w %s=%s",
+	"readme.base_pack": `## Base Pack
+
+This bundle does not contain the layers it shares with the base pack %s %s.
+Load the base pack on this host before loading this bundle:
+
+    docker-compose-bundler load <extracted base pack directory>
+`,
+	"readme.secrets": `## Secrets and Configs
+
+Secrets and configs are not part of this bundle. Before starting the stack,
+create them on the target with ./setup-secrets.sh. The script prompts for every
+value, or accepts name=path arguments to read them from files.
+`,
+	"readme.systemd": `## Start at Boot
+
+Run ./install-service.sh as root from the extracted bundle directory to install
+a systemd unit that starts the stack at boot. Keep the directory in place, the
+unit runs compose from there. See RESTART-POLICIES.txt (if present) for
+services whose restart policy behaves differently under the unit.
+`,
+	"readme.sops": `## Encrypted Files
+
+The following files are SOPS-encrypted for this site's key. Decrypt them
+before loading or starting the stack:
+`,
+
+	"script.loading_images":    "Loading Docker images...",
+	"script.loading_image":     "Loading %s...",
+	"script.images_loaded":     "All images loaded successfully!",
+	"script.run_hint":          "You can now run: %s",
+	"script.unknown_secret":    "Unknown secret/config '%s', docker-compose.yml declares: %s",
+	"script.swarm_required":    "Warning: docker secrets and configs require swarm mode (docker swarm init)",
+	"script.secret_exists":     "The %s %s already exists, skipping",
+	"script.secret_prompt":     "Enter value for %s %s (used by %s): ",
+	"script.secrets_done":      "All secrets and configs are in place!",
+	"script.run_as_root":       "Please run as root",
+	"script.no_compose":        "Neither docker compose nor docker-compose is installed",
+	"script.compose_installed": "Installed the bundled docker compose plugin to %s",
+	"script.unit_installed":    "Installed %s, start it with: %s",
+	"script.used_by_nothing":   "no service",
+
+	"tui.step.verify":    "Verify bundle",
+	"tui.step.load":      "Load images",
+	"tui.step.configure": "Configure environment",
+	"tui.step.start":     "Start the stack",
+	"tui.intro":          "This assistant installs the bundle on this host in %d steps.",
+	"tui.keys":           "Press Enter to accept the value in [brackets], Ctrl+C to abort at any time.",
+	"tui.engine_ok":      "Docker engine is supported",
+	"tui.check":          "check %s",
+	"tui.damaged":        "checksum mismatch for %s, the bundle is damaged, please copy it again",
+	"tui.images_intact":  "All %d image(s) are intact",
+	"tui.load_confirm":   "Load %d image(s) into Docker?",
+	"tui.load":           "load  %s",
+	"tui.load_skipped":   "Skipped, images already present are used",
+	"tui.nothing":        "Nothing to configure",
+	"tui.review":         "Review the settings in %s?",
+	"tui.start_confirm":  "Start the stack now?",
+	"tui.start_later":    "Start it later with: %s",
+	"tui.running":        "%s %s is up and running!",
+	"tui.record_failed":  "Warning: the deployment could not be recorded in %s for prune: %s",
+	"tui.yes_no":         "Y/n",
+	"tui.no_yes":         "y/N",
+	"tui.yes_answers":    "y,yes",
+}
+
+// catalog holds the messages of one language
+type catalog struct {
+	lang     string
+	messages map[string]string
+}
+
+// englishCatalog is used where no language was chosen
+var englishCatalog = &catalog{lang: defaultLanguage, messages: englishMessages}
+
+// availableLanguages lists English and every embedded catalog
+func availableLanguages() []string {
+	langs := []string{defaultLanguage}
+	entries, _ := localeFiles.ReadDir("locales")
+	for _, entry := range entries {
+		langs = append(langs, strings.TrimSuffix(entry.Name(), ".json"))
+	}
+	slices.Sort(langs)
+	return langs
+}
+
+// loadCatalog reads the catalog of lang, translations have to use the same
+// placeholders as the English message
+func loadCatalog(lang string) (*catalog, error) {
+	if lang == defaultLanguage {
+		return englishCatalog, nil
+	}
+	data, err := localeFiles.ReadFile(path.Join("locales", lang+".json"))
+	if err != nil {
+		return nil, fmt.Errorf("unsupported language %q, use one of %s", lang, strings.Join(availableLanguages(), ", "))
+	}
+	messages := make(map[string]string)
+	if err := json.Unmarshal(data, &messages); err != nil {
+		return nil, fmt.Errorf("failed to parse the %s catalog: %w", lang, err)
+	}
+	for id, message := range messages {
+		english, ok := englishMessages[id]
+		if !ok {
+			return nil, fmt.Errorf("the %s catalog has the unknown message %s", lang, id)
+		}
+		if !slices.Equal(formatVerbPattern.FindAllString(message, -1), formatVerbPattern.FindAllString(english, -1)) {
+			return nil, fmt.Errorf("the %s translation of %s does not keep the placeholders of %q", lang, id, english)
+		}
+	}
+	return &catalog{lang: lang, messages: messages}, nil
+}
+
+// parseLanguages validates --lang, a comma separated list of the languages
+// generated besides English
+func parseLanguages(value string) ([]*catalog, error) {
+	var catalogs []*catalog
+	for _, lang := range strings.Split(value, ",") {
+		lang = strings.ToLower(strings.TrimSpace(lang))
+		if lang == "" || lang == defaultLanguage || slices.ContainsFunc(catalogs, func(c *catalog) bool { return c.lang == lang }) {
+			continue
+		}
+		c, err := loadCatalog(lang)
+		if err != nil {
+			return nil, err
+		}
+		catalogs = append(catalogs, c)
+	}
+	return catalogs, nil
+}
+
+// t returns the message id in the language of the catalog, falling back to English
+func (c *catalog) t(id string, args ...any) string {
+	message, ok := c.messages[id]
+	if !ok {
+		message = englishMessages[id]
+	}
+	if len(args) == 0 {
+		return message
+	}
+	return fmt.Sprintf(message, args...)
+}
+
+// environmentLanguage returns the language of the LC_ALL, LC_MESSAGES or LANG
+// locale, empty for the C and POSIX locales
+func environmentLanguage() string {
+	for _, name := range []string{"LC_ALL", "LC_MESSAGES", "LANG"} {
+		if locale := os.Getenv(name); locale != "" {
+			lang, _, _ := strings.Cut(locale, "_")
+			lang, _, _ = strings.Cut(lang, ".")
+			if lang == "C" || lang == "POSIX" {
+				return ""
+			}
+			return strings.ToLower(lang)
+		}
+	}
+	return ""
+}
+
+// operatorCatalog picks the language of the TUI: the requested one, the one
+// of the locale if there is a catalog for it, otherwise the first language
+// the bundle was generated in
+func operatorCatalog(requested string, bundled []string) (*catalog, error) {
+	if requested != "" {
+		return loadCatalog(requested)
+	}
+	if lang := environmentLanguage(); lang != "" {
+		if c, err := loadCatalog(lang); err == nil {
+			return c, nil
+		}
+	}
+	if len(bundled) > 0 {
+		return loadCatalog(bundled[0])
+	}
+	return englishCatalog, nil
+}
+
+// scriptMessages defines the messages ids as MSG_<ID> shell variables in the
+// language of the locale the script runs in. English is used for English
+// locales, the first bundled language for the others and for the C locale.
+func scriptMessages(catalogs []*catalog, ids ...string) string {
+	define := func(sb *strings.Builder, c *catalog, indent string) {
+		for _, id := range ids {
+			fmt.Fprintf(sb, "%s%s=%s\n", indent, scriptMessageVar(id), shellQuote(c.t(id)))
+		}
+	}
+	var sb strings.Builder
+	if len(catalogs) == 0 {
+		define(&sb, englishCatalog, "")
+		return sb.String()
+	}
+	sb.WriteString("case \"${LC_ALL:-${LC_MESSAGES:-$LANG}}\" in\n")
+	for _, c := range append([]*catalog{englishCatalog}, catalogs[1:]...) {
+		fmt.Fprintf(&sb, "    %s*)\n", c.lang)
+		define(&sb, c, "        ")
+		sb.WriteString("        ;;\n")
+	}
+	sb.WriteString("    *)\n")
+	define(&sb, catalogs[0], "        ")
+	sb.WriteString("        ;;\nesac\n")
+	return sb.String()
+}
+
+// scriptMessageVar is the shell variable scriptMessages defines for id
+func scriptMessageVar(id string) string {
+	id = strings.TrimPrefix(id, "script.")
+	return "MSG_" + strings.ToUpper(strings.ReplaceAll(id, ".", "_"))
+}
+
+// shellQuote quotes s for a POSIX shell
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// batchEcho escapes the characters cmd.exe interprets in an echo
+func batchEcho(s string) string {
+	return strings.NewReplacer("^", "^^", "&", "^&", "|", "^|", "<", "^<", ">", "^>", "%", "%%").Replace(s)
+}
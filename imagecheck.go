@@ -0,0 +1,105 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"maps"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// lintImageConfigs cross-checks the ports, entrypoint and user of every
+// service against the config of its image, so drift between the compose file
+// and the images is reported before the bundle ships
+func (b *Bundler) lintImageConfigs(compose *DockerCompose) error {
+	if b.dryRun() {
+		return nil
+	}
+	for _, name := range sortedServiceNames(compose) {
+		service := compose.Services[name]
+		if service.Image == "" || b.isMissing(service.Image) {
+			continue
+		}
+		inspect, err := b.client.ImageInspect(b.ctx, service.Image)
+		if err != nil {
+			return fmt.Errorf("failed to inspect image %s: %w", service.Image, err)
+		}
+		if inspect.Config == nil {
+			continue
+		}
+		config := inspect.Config
+
+		// Images without EXPOSE do not document their ports, there is nothing to compare
+		if len(config.ExposedPorts) > 0 {
+			exposed := slices.Sorted(maps.Keys(config.ExposedPorts))
+			for _, port := range unexposedPorts(service, config.ExposedPorts) {
+				b.addLint("service %s uses container port %s, but image %s only exposes %s", name, port, service.Image, strings.Join(exposed, ", "))
+			}
+		}
+
+		switch {
+		case !service.Entrypoint.IsZero() && service.Command.IsZero() && len(config.Cmd) > 0:
+			b.addLint("service %s overrides the entrypoint of image %s, which drops the image's default command %q; set command if it is still needed",
+				name, service.Image, strings.Join(config.Cmd, " "))
+		case service.Entrypoint.IsZero() && !service.Command.IsZero() && isShellFormEntrypoint(config.Entrypoint):
+			b.addLint("service %s sets a command, but image %s has a shell form ENTRYPOINT that ignores it", name, service.Image)
+		case service.Entrypoint.IsZero() && service.Command.IsZero() && len(config.Entrypoint) == 0 && len(config.Cmd) == 0:
+			b.addLint("service %s sets no command and image %s has neither ENTRYPOINT nor CMD, the container cannot start", name, service.Image)
+		}
+
+		if service.User != "" && isRootUser(service.User) && !isRootUser(config.User) {
+			b.addLint("service %s runs as root, overriding the non-root USER %s of image %s", name, config.User, service.Image)
+		}
+	}
+	return nil
+}
+
+// unexposedPorts returns the port[-range]/protocol specs of ports and expose
+// with ports that are not in exposed
+func unexposedPorts(service Service, exposed map[string]struct{}) []string {
+	var specs []string
+	for _, p := range service.Ports {
+		specs = append(specs, p.Target+"/"+p.Protocol)
+	}
+	if expose, ok := service.Extra["expose"].([]interface{}); ok {
+		for _, e := range expose {
+			specs = append(specs, fmt.Sprint(e))
+		}
+	}
+
+	var missing []string
+	for _, spec := range specs {
+		ports, protocol, _ := strings.Cut(spec, "/")
+		protocol = strings.ToLower(cmp.Or(protocol, "tcp"))
+		first, last, isRange := strings.Cut(ports, "-")
+		if !isRange {
+			last = first
+		}
+		from, err1 := strconv.Atoi(first)
+		to, err2 := strconv.Atoi(last)
+		if err1 != nil || err2 != nil || from <= 0 || to > 65535 || from > to {
+			continue // Rejected by compose itself
+		}
+		for port := from; port <= to; port++ {
+			if _, ok := exposed[fmt.Sprintf("%d/%s", port, protocol)]; !ok {
+				if spec := ports + "/" + protocol; !slices.Contains(missing, spec) {
+					missing = append(missing, spec)
+				}
+				break
+			}
+		}
+	}
+	return missing
+}
+
+// isShellFormEntrypoint reports whether entrypoint was written in shell form
+// (ENTRYPOINT cmd), which runs it with sh -c and drops the command arguments
+func isShellFormEntrypoint(entrypoint []string) bool {
+	if len(entrypoint) != 3 || entrypoint[1] != "-c" {
+		return false
+	}
+	shell := path.Base(entrypoint[0])
+	return shell == "sh" || shell == "bash"
+}
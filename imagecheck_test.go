@@ -0,0 +1,51 @@
+package main
+
+import (
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"docker-compose-bundler/dockerclient"
+)
+
+func TestLintImageConfigs(t *testing.T) {
+	compose := `services:
+  web:
+    image: nginx:1.27
+    ports: ["8080:80", "8443:8443"]
+  api:
+    image: shop/api:1.2.0
+    entrypoint: ["/debug"]
+  worker:
+    image: shop/worker:1.2.0
+    command: ["--queue", "mail"]
+  db:
+    image: postgres:16
+    user: root
+x-bundle:
+  name: shop
+  version: 1.2.0
+`
+	fake := dockerclient.NewFake()
+	web := fake.AddImage("nginx:1.27")
+	web.Exposed, web.Cmd = []string{"80/tcp"}, []string{"nginx"}
+	fake.AddImage("shop/api:1.2.0").Cmd = []string{"serve"}
+	fake.AddImage("shop/worker:1.2.0").Entrypoint = []string{"/bin/sh", "-c", "worker"}
+	db := fake.AddImage("postgres:16")
+	db.User, db.Entrypoint = "postgres", []string{"docker-entrypoint.sh"}
+
+	b := NewBundlerWithClient(Options{VersionScheme: VersionSchemeSemver}, fake)
+	if err := b.Bundle(writeCompose(t, compose), filepath.Join(t.TempDir(), "bundle.tar.gz")); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		`service api overrides the entrypoint of image shop/api:1.2.0, which drops the image's default command "serve"; set command if it is still needed`,
+		"service db runs as root, overriding the non-root USER postgres of image postgres:16",
+		"service web uses container port 8443/tcp, but image nginx:1.27 only exposes 80/tcp",
+		"service worker sets a command, but image shop/worker:1.2.0 has a shell form ENTRYPOINT that ignores it",
+	}
+	got := slices.Sorted(slices.Values(b.lint))
+	if !slices.Equal(got, want) {
+		t.Errorf("lint findings:\n%q\nwant:\n%q", got, want)
+	}
+}
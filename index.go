@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// indexSchemaVersion versions index.json independently of the manifest.
+// Bump the major version on incompatible changes only.
+const indexSchemaVersion = "1.0"
+
+// BundleIndex is a stable, machine-readable description of the bundle for
+// fleet tooling, stored as index.json in the archive root
+type BundleIndex struct {
+	SchemaVersion string            `json:"schemaVersion"`
+	Name          string            `json:"name"`
+	Version       string            `json:"version"`
+	ProjectName   string            `json:"projectName"`
+	Services      []IndexService    `json:"services"`
+	Images        []IndexImage      `json:"images"`
+	Volumes       []string          `json:"volumes"`     // Named top-level volumes
+	RequiredEnv   []string          `json:"requiredEnv"` // Union of all services' required variables
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+type IndexService struct {
+	Name        string        `json:"name"`
+	Image       string        `json:"image"`
+	Ports       []IndexPort   `json:"ports"`
+	Volumes     []IndexVolume `json:"volumes"`
+	RequiredEnv []string      `json:"requiredEnv"` // Variables taken from the host environment at runtime
+	DependsOn   []string      `json:"dependsOn"`
+}
+
+type IndexPort struct {
+	HostIP    string `json:"hostIp,omitempty"`
+	Published string `json:"published,omitempty"`
+	Target    string `json:"target"`
+	Protocol  string `json:"protocol"`
+}
+
+type IndexVolume struct {
+	Type     string `json:"type"`
+	Source   string `json:"source,omitempty"`
+	Target   string `json:"target"`
+	ReadOnly bool   `json:"readOnly"`
+}
+
+type IndexImage struct {
+	Name   string `json:"name"`
+	File   string `json:"file"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+func buildIndex(compose *DockerCompose, manifest *Manifest) *BundleIndex {
+	index := &BundleIndex{
+		SchemaVersion: indexSchemaVersion,
+		Name:          manifest.Name,
+		Version:       manifest.Version,
+		ProjectName:   manifest.ProjectName,
+		Services:      []IndexService{},
+		Images:        []IndexImage{},
+		Volumes:       sortedKeys(compose.Volumes),
+		RequiredEnv:   []string{},
+		Annotations:   manifest.Annotations,
+	}
+
+	required := make(map[string]bool)
+	for _, name := range sortedServiceNames(compose) {
+		service := compose.Services[name]
+		entry := IndexService{
+			Name:        name,
+			Image:       service.Image,
+			Ports:       []IndexPort{},
+			Volumes:     []IndexVolume{},
+			RequiredEnv: []string{},
+			DependsOn:   service.DependsOn.Services(),
+		}
+		for _, port := range service.Ports {
+			protocol := port.Protocol
+			if protocol == "" {
+				protocol = "tcp"
+			}
+			entry.Ports = append(entry.Ports, IndexPort{HostIP: port.HostIP, Published: port.Published, Target: port.Target, Protocol: protocol})
+		}
+		for _, volume := range service.Volumes {
+			entry.Volumes = append(entry.Volumes, IndexVolume{Type: volume.Type, Source: volume.Source, Target: volume.Target, ReadOnly: volume.ReadOnly})
+		}
+		for _, v := range service.Environment.Vars {
+			if v.Value == nil {
+				entry.RequiredEnv = append(entry.RequiredEnv, v.Name)
+				required[v.Name] = true
+			}
+		}
+		index.Services = append(index.Services, entry)
+	}
+
+	for name := range required {
+		index.RequiredEnv = append(index.RequiredEnv, name)
+	}
+	sort.Strings(index.RequiredEnv)
+
+	for _, img := range manifest.Images {
+		index.Images = append(index.Images, IndexImage{Name: img.Name, File: img.File, Size: img.Size, SHA256: img.SHA256})
+	}
+	return index
+}
+
+func writeIndex(bundleDir string, index *BundleIndex) error {
+	data, err := index.marshal()
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(bundleDir, "index.json"), data, 0644)
+}
+
+func (i *BundleIndex) marshal() ([]byte, error) {
+	data, err := json.MarshalIndent(i, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Range requests start small since the metadata is at the start of a bundle
+const (
+	firstRangeSize = 256 << 10
+	maxRangeSize   = 16 << 20
+)
+
+// httpRangeReader reads a remote file with HTTP range requests of growing
+// size, so only the part that is actually read is downloaded. Servers that
+// ignore ranges are read as a stream until the reader is closed.
+type httpRangeReader struct {
+	client *http.Client
+	url    string
+	offset int64 // Next byte to request
+	chunk  int64
+	body   io.ReadCloser
+	eof    bool
+	ranged bool  // The server answers with partial content
+	read   int64 // Bytes read from the responses
+	size   int64 // Bytes of the requested ranges
+}
+
+// downloaded returns the bytes fetched from the server, at least those read
+func (h *httpRangeReader) downloaded() int64 {
+	return max(h.read, h.size)
+}
+
+func newHTTPRangeReader(url string) *httpRangeReader {
+	return &httpRangeReader{client: &http.Client{Timeout: 5 * time.Minute}, url: url, chunk: firstRangeSize}
+}
+
+func (h *httpRangeReader) Read(p []byte) (int, error) {
+	for {
+		if h.body == nil {
+			if h.eof {
+				return 0, io.EOF
+			}
+			if err := h.request(); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		n, err := h.body.Read(p)
+		h.read += int64(n)
+		h.offset += int64(n)
+		if err == io.EOF {
+			h.body.Close()
+			h.body = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+// request fetches the next range, or the whole file if ranges are not supported
+func (h *httpRangeReader) request() error {
+	req, err := http.NewRequest(http.MethodGet, h.url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", h.offset, h.offset+h.chunk-1))
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to download %s: %w", h.url, err)
+	}
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		var start, end, size int64
+		if _, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-%d/%d", &start, &end, &size); err == nil {
+			h.size += end - start + 1
+			h.eof = end+1 >= size
+		}
+		h.ranged = true
+		h.chunk = min(h.chunk*2, maxRangeSize)
+	case http.StatusOK:
+		if h.offset > 0 {
+			resp.Body.Close()
+			return fmt.Errorf("%s stopped honoring range requests", h.url)
+		}
+		h.eof = true // The body is the whole file
+	case http.StatusRequestedRangeNotSatisfiable:
+		resp.Body.Close()
+		h.eof = true
+		return nil
+	default:
+		resp.Body.Close()
+		return fmt.Errorf("failed to download %s: %s", h.url, resp.Status)
+	}
+	h.body = resp.Body
+	return nil
+}
+
+func (h *httpRangeReader) Close() error {
+	if h.body != nil {
+		return h.body.Close()
+	}
+	return nil
+}
+
+func isBundleURL(source string) bool {
+	return strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://")
+}
+
+// readRemoteBundleMetadata reads the metadata of a bundle behind a URL,
+// downloading only the start of the archive
+func readRemoteBundleMetadata(url string) (*Manifest, *DockerCompose, error) {
+	reader := newHTTPRangeReader(url)
+	defer reader.Close()
+	manifest, compose, err := readBundleMetadataFrom(reader, url)
+	if err != nil {
+		return nil, nil, err
+	}
+	if reader.ranged {
+		fmt.Fprintf(os.Stderr, "Downloaded %s of %s with range requests\n", formatBytes(reader.downloaded()), url)
+	} else {
+		fmt.Fprintf(os.Stderr, "Warning: %s does not support range requests, read %s before closing the download\n", url, formatBytes(reader.downloaded()))
+	}
+	return manifest, compose, nil
+}
+
+// openBundleMetadata reads the metadata of a local bundle archive or bundle URL
+func openBundleMetadata(source string) (*Manifest, *DockerCompose, error) {
+	if isBundleURL(source) {
+		return readRemoteBundleMetadata(source)
+	}
+	return readBundleMetadata(source)
+}
+
+func printBundleInfo(manifest *Manifest, compose *DockerCompose) {
+	fmt.Printf("Name:      %s\n", manifest.Name)
+	fmt.Printf("Version:   %s\n", manifest.Version)
+	fmt.Printf("Project:   %s\n", manifest.ProjectName)
+	fmt.Printf("Created:   %s\n", manifest.CreatedAt.Format(time.RFC3339))
+	if manifest.BasePack != nil {
+		fmt.Printf("Base pack: %s %s\n", manifest.BasePack.Name, manifest.BasePack.Version)
+	}
+	if manifest.Bundler != nil {
+		fmt.Printf("Bundler:   %s\n", manifest.Bundler.Version)
+		for _, loader := range manifest.Bundler.Loaders {
+			fmt.Printf("Loader:    %s (%s)\n", loader.Platform, loader.File)
+		}
+	}
+	for _, plugin := range manifest.ComposePlugins {
+		fmt.Printf("Compose:   %s (%s)\n", plugin.Platform, plugin.File)
+	}
+	if manifest.Expiry != nil {
+		fmt.Printf("Expires:   %s (%s)\n", manifest.Expiry.Expires, manifest.Expiry.Policy)
+	}
+	for _, key := range slices.Sorted(maps.Keys(manifest.Annotations)) {
+		fmt.Printf("Annotation %s=%s\n", key, manifest.Annotations[key])
+	}
+
+	var total int64
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "\nIMAGE\tID\tSIZE")
+	for _, img := range manifest.Images {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", img.Name, orDash(shortID(img.ID)), formatBytes(img.Size))
+		total += img.Size
+	}
+	w.Flush()
+	fmt.Printf("%d service(s), %d image(s), %s\n", len(compose.Services), len(manifest.Images), formatBytes(total))
+	if len(manifest.MissingImages) > 0 {
+		fmt.Printf("\nPARTIAL bundle, %d image(s) missing:\n", len(manifest.MissingImages))
+		for _, m := range manifest.MissingImages {
+			fmt.Printf("  %s: %s (%s)\n", m.Service, m.Image, m.Reason)
+		}
+	}
+}
+
+// bundleDiff lists the differences between the metadata of two bundles
+func bundleDiff(from, to *Manifest, fromCompose, toCompose *DockerCompose) []string {
+	var changes []string
+	if from.Name != to.Name {
+		changes = append(changes, fmt.Sprintf("name: %s -> %s", from.Name, to.Name))
+	}
+	if from.Version != to.Version {
+		changes = append(changes, fmt.Sprintf("version: %s -> %s", from.Version, to.Version))
+	}
+
+	fromImages := make(map[string]ManifestImage)
+	for _, img := range from.Images {
+		fromImages[img.Name] = img
+	}
+	toImages := make(map[string]ManifestImage)
+	for _, img := range to.Images {
+		toImages[img.Name] = img
+	}
+	var imageChanges []string
+	for name, img := range toImages {
+		old, ok := fromImages[name]
+		switch {
+		case !ok:
+			imageChanges = append(imageChanges, fmt.Sprintf("+ image %s (%s)", name, formatBytes(img.Size)))
+		case old.ID != img.ID || old.SHA256 != img.SHA256:
+			imageChanges = append(imageChanges, fmt.Sprintf("~ image %s changed (%s -> %s)", name, formatBytes(old.Size), formatBytes(img.Size)))
+		}
+	}
+	for name, img := range fromImages {
+		if _, ok := toImages[name]; !ok {
+			imageChanges = append(imageChanges, fmt.Sprintf("- image %s (%s)", name, formatBytes(img.Size)))
+		}
+	}
+	sort.Slice(imageChanges, func(i, j int) bool { return imageChanges[i][2:] < imageChanges[j][2:] })
+	changes = append(changes, imageChanges...)
+
+	for _, name := range sortedServiceNames(toCompose) {
+		service, ok := fromCompose.Services[name]
+		switch {
+		case !ok:
+			changes = append(changes, fmt.Sprintf("+ service %s (%s)", name, toCompose.Services[name].Image))
+		case service.Image != toCompose.Services[name].Image:
+			changes = append(changes, fmt.Sprintf("~ service %s: %s -> %s", name, service.Image, toCompose.Services[name].Image))
+		}
+	}
+	for _, name := range sortedServiceNames(fromCompose) {
+		if _, ok := toCompose.Services[name]; !ok {
+			changes = append(changes, fmt.Sprintf("- service %s", name))
+		}
+	}
+	return changes
+}
+
+func runInspect(args []string) {
+	flags := flag.NewFlagSet("inspect", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Println("Usage: docker-compose-bundler inspect <bundle.tar.gz|url>")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	manifest, compose, err := openBundleMetadata(flags.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	printBundleInfo(manifest, compose)
+}
+
+func runDiff(args []string) {
+	flags := flag.NewFlagSet("diff", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Println("Usage: docker-compose-bundler diff <old.tar.gz|url> <new.tar.gz|url>")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	from, fromCompose, err := openBundleMetadata(flags.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	to, toCompose, err := openBundleMetadata(flags.Arg(1))
+	if err != nil {
+		log.Fatal(err)
+	}
+	changes := bundleDiff(from, to, fromCompose, toCompose)
+	if len(changes) == 0 {
+		fmt.Println("The bundles are identical")
+		return
+	}
+	for _, change := range changes {
+		fmt.Println(change)
+	}
+}
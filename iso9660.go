@@ -0,0 +1,450 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+const (
+	isoSectorSize = 2048
+	// isoMaxExtent is the largest extent of a file, larger files are stored
+	// in several extents (multi-extent, ISO 9660 level 3)
+	isoMaxExtent = 0xFFFFF800
+)
+
+// mediaFile is a file of a disc or USB image, read from Source or Data
+type mediaFile struct {
+	Name   string // Slash separated path on the medium
+	Source string
+	Data   []byte
+	Size   int64
+}
+
+func (f *mediaFile) open() (io.ReadCloser, error) {
+	if f.Source == "" {
+		return io.NopCloser(bytes.NewReader(f.Data)), nil
+	}
+	return os.Open(f.Source)
+}
+
+// isoNode is a directory or file of the image being written
+type isoNode struct {
+	name     string // Name on the medium, empty for the root
+	file     *mediaFile
+	children []*isoNode
+	parent   *isoNode
+	number   int // Position in the path table, directories only
+
+	// Location and size of the directory records in the primary and the Joliet tree
+	extent, size             uint32
+	jolietExtent, jolietSize uint32
+	dataExtent               uint32 // First sector of the file data
+	primaryName              string // Uppercase d-characters, the Joliet tree keeps name
+}
+
+func (n *isoNode) isDir() bool { return n.file == nil }
+
+// writeISO writes an ISO 9660 image with Joliet names, readable on Windows,
+// Linux and macOS without extra drivers
+func writeISO(out io.Writer, label string, files []*mediaFile) error {
+	root := &isoNode{}
+	for _, f := range files {
+		parent := root
+		dirs := strings.Split(f.Name, "/")
+		for _, dir := range dirs[:len(dirs)-1] {
+			i := slices.IndexFunc(parent.children, func(c *isoNode) bool { return c.isDir() && c.name == dir })
+			if i < 0 {
+				parent.children = append(parent.children, &isoNode{name: dir, parent: parent})
+				i = len(parent.children) - 1
+			}
+			parent = parent.children[i]
+		}
+		parent.children = append(parent.children, &isoNode{name: dirs[len(dirs)-1], file: f, parent: parent})
+	}
+
+	// Directories are numbered breadth first, as the path table lists them
+	dirs := []*isoNode{root}
+	for i := 0; i < len(dirs); i++ {
+		dir := dirs[i]
+		dir.number = i + 1
+		slices.SortFunc(dir.children, func(a, b *isoNode) int { return strings.Compare(a.name, b.name) })
+		if err := assignISONames(dir); err != nil {
+			return err
+		}
+		for _, child := range dir.children {
+			if child.isDir() {
+				dirs = append(dirs, child)
+			}
+		}
+	}
+
+	// System area and the volume descriptors: primary, Joliet, terminator
+	sector := uint32(16 + 3)
+	pathTableSize := isoPathTableSize(dirs, false)
+	jolietPathTableSize := isoPathTableSize(dirs, true)
+	lPath, mPath := sector, sector+isoSectors(int64(pathTableSize))
+	sector = mPath + isoSectors(int64(pathTableSize))
+	jlPath, jmPath := sector, sector+isoSectors(int64(jolietPathTableSize))
+	sector = jmPath + isoSectors(int64(jolietPathTableSize))
+	for _, dir := range dirs {
+		dir.size = isoDirSize(dir, false)
+		dir.extent, sector = sector, sector+dir.size/isoSectorSize
+	}
+	for _, dir := range dirs {
+		dir.jolietSize = isoDirSize(dir, true)
+		dir.jolietExtent, sector = sector, sector+dir.jolietSize/isoSectorSize
+	}
+	var data []*isoNode
+	for _, dir := range dirs {
+		for _, child := range dir.children {
+			if !child.isDir() {
+				child.dataExtent, sector = sector, sector+isoSectors(child.file.Size)
+				data = append(data, child)
+			}
+		}
+	}
+	total := sector
+
+	now := time.Now().UTC()
+	w := &isoWriter{w: out}
+	w.pad(16 * isoSectorSize)
+	w.write(isoVolumeDescriptor(1, label, total, pathTableSize, lPath, mPath, root, now, false))
+	w.write(isoVolumeDescriptor(2, label, total, jolietPathTableSize, jlPath, jmPath, root, now, true))
+	terminator := make([]byte, isoSectorSize)
+	terminator[0] = 255
+	copy(terminator[1:], "CD001")
+	terminator[6] = 1
+	w.write(terminator)
+	for _, joliet := range []bool{false, true} {
+		for _, bigEndian := range []bool{false, true} {
+			w.writeSectors(isoPathTable(dirs, joliet, bigEndian))
+		}
+	}
+	for _, joliet := range []bool{false, true} {
+		for _, dir := range dirs {
+			w.writeSectors(isoDirectory(dir, joliet, now))
+		}
+	}
+	if w.err != nil {
+		return w.err
+	}
+
+	for _, node := range data {
+		r, err := node.file.open()
+		if err != nil {
+			return err
+		}
+		n, err := io.Copy(out, r)
+		r.Close()
+		if err != nil {
+			return err
+		}
+		if n != node.file.Size {
+			return fmt.Errorf("%s changed while writing the image", node.file.Name)
+		}
+		w.pad(int(int64(isoSectors(n))*isoSectorSize - n))
+	}
+	return w.err
+}
+
+// assignISONames derives the names of the children of dir: uppercase
+// d-characters for the primary tree, the original name for Joliet
+func assignISONames(dir *isoNode) error {
+	seen := make(map[string]bool)
+	for _, child := range dir.children {
+		name := isoDString(strings.ToUpper(child.name), ".")
+		base, ext := name, ""
+		if !child.isDir() {
+			if i := strings.LastIndex(name, "."); i >= 0 {
+				base, ext = strings.ReplaceAll(name[:i], ".", "_"), name[i+1:]
+			}
+		} else {
+			base = strings.ReplaceAll(base, ".", "_")
+		}
+		base, ext = truncate(base, 30-min(len(ext), 8)), truncate(ext, 8)
+		candidate := base
+		for i := 1; seen[candidate+"."+ext]; i++ {
+			suffix := fmt.Sprintf("_%d", i)
+			candidate = truncate(base, 30-min(len(ext), 8)-len(suffix)) + suffix
+		}
+		seen[candidate+"."+ext] = true
+		child.primaryName = candidate
+		if !child.isDir() {
+			child.primaryName += "." + ext + ";1"
+		}
+
+		if len(utf16.Encode([]rune(child.name))) > 64 {
+			return fmt.Errorf("%s is too long for a disc image", child.name)
+		}
+	}
+	return nil
+}
+
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
+
+// isoDString replaces everything but A-Z, 0-9, _ and the allowed characters
+func isoDString(s, allowed string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || strings.ContainsRune(allowed, r) {
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+func isoSectors(size int64) uint32 {
+	return uint32((size + isoSectorSize - 1) / isoSectorSize)
+}
+
+func (n *isoNode) nameBytes(joliet bool) []byte {
+	if joliet {
+		return ucs2(n.name)
+	}
+	return []byte(n.primaryName)
+}
+
+// isoExtents splits a file into the extents of its directory records
+func (n *isoNode) isoExtents() []uint32 {
+	size := n.file.Size
+	var extents []uint32
+	for size > isoMaxExtent {
+		extents = append(extents, isoMaxExtent)
+		size -= isoMaxExtent
+	}
+	return append(extents, uint32(size))
+}
+
+// isoDirectoryRecord encodes a directory record, flags 2 marks directories
+// and 0x80 all but the last extent of a file
+func isoDirectoryRecord(name []byte, extent, size uint32, flags byte, date time.Time) []byte {
+	length := 33 + len(name)
+	if length%2 == 1 {
+		length++
+	}
+	r := make([]byte, length)
+	r[0] = byte(length)
+	bothEndian32(r[2:], extent)
+	bothEndian32(r[10:], size)
+	r[18] = byte(date.Year() - 1900)
+	r[19] = byte(date.Month())
+	r[20] = byte(date.Day())
+	r[21] = byte(date.Hour())
+	r[22] = byte(date.Minute())
+	r[23] = byte(date.Second())
+	r[25] = flags
+	bothEndian16(r[28:], 1)
+	r[32] = byte(len(name))
+	copy(r[33:], name)
+	return r
+}
+
+// isoRecords returns the records of a directory: itself, its parent and its children
+func isoRecords(dir *isoNode, joliet bool, date time.Time) [][]byte {
+	location := func(n *isoNode) (uint32, uint32) {
+		if joliet {
+			return n.jolietExtent, n.jolietSize
+		}
+		return n.extent, n.size
+	}
+	parent := dir.parent
+	if parent == nil {
+		parent = dir
+	}
+	self, selfSize := location(dir)
+	up, upSize := location(parent)
+	records := [][]byte{
+		isoDirectoryRecord([]byte{0}, self, selfSize, 2, date),
+		isoDirectoryRecord([]byte{1}, up, upSize, 2, date),
+	}
+	for _, child := range dir.children {
+		if child.isDir() {
+			extent, size := location(child)
+			records = append(records, isoDirectoryRecord(child.nameBytes(joliet), extent, size, 2, date))
+			continue
+		}
+		extent := child.dataExtent
+		sizes := child.isoExtents()
+		for i, size := range sizes {
+			var flags byte
+			if i < len(sizes)-1 {
+				flags = 0x80
+			}
+			records = append(records, isoDirectoryRecord(child.nameBytes(joliet), extent, size, flags, date))
+			extent += isoSectors(int64(size))
+		}
+	}
+	return records
+}
+
+// isoDirSize is the size of a directory in whole sectors, records do not
+// cross sector boundaries
+func isoDirSize(dir *isoNode, joliet bool) uint32 {
+	sectors, used := uint32(1), 0
+	for _, r := range isoRecords(dir, joliet, time.Time{}) {
+		if used+len(r) > isoSectorSize {
+			sectors++
+			used = 0
+		}
+		used += len(r)
+	}
+	return sectors * isoSectorSize
+}
+
+func isoDirectory(dir *isoNode, joliet bool, date time.Time) []byte {
+	var buf []byte
+	used := 0
+	for _, r := range isoRecords(dir, joliet, date) {
+		if used+len(r) > isoSectorSize {
+			buf = append(buf, make([]byte, isoSectorSize-used)...)
+			used = 0
+		}
+		buf = append(buf, r...)
+		used += len(r)
+	}
+	return buf
+}
+
+func isoPathTable(dirs []*isoNode, joliet, bigEndian bool) []byte {
+	order := binary.ByteOrder(binary.LittleEndian)
+	if bigEndian {
+		order = binary.BigEndian
+	}
+	var buf []byte
+	for _, dir := range dirs {
+		name := []byte{0}
+		parent := 1
+		if dir.parent != nil {
+			name = dir.nameBytes(joliet)
+			parent = dir.parent.number
+		}
+		extent := dir.extent
+		if joliet {
+			extent = dir.jolietExtent
+		}
+		entry := make([]byte, 8+len(name)+len(name)%2)
+		entry[0] = byte(len(name))
+		order.PutUint32(entry[2:], extent)
+		order.PutUint16(entry[6:], uint16(parent))
+		copy(entry[8:], name)
+		buf = append(buf, entry...)
+	}
+	return buf
+}
+
+func isoPathTableSize(dirs []*isoNode, joliet bool) uint32 {
+	return uint32(len(isoPathTable(dirs, joliet, false)))
+}
+
+// isoVolumeDescriptor encodes the primary (type 1) or the Joliet
+// supplementary (type 2) volume descriptor
+func isoVolumeDescriptor(kind byte, label string, total, pathTableSize, lPath, mPath uint32, root *isoNode, date time.Time, joliet bool) []byte {
+	d := make([]byte, isoSectorSize)
+	d[0] = kind
+	copy(d[1:], "CD001")
+	d[6] = 1
+	text := func(offset, length int, s string) {
+		field := d[offset : offset+length]
+		if joliet {
+			for i := 0; i+1 < length; i += 2 {
+				field[i], field[i+1] = 0, ' '
+			}
+			copy(field, truncate(string(ucs2(s)), length&^1))
+			return
+		}
+		for i := range field {
+			field[i] = ' '
+		}
+		copy(field, truncate(s, length))
+	}
+	text(8, 32, "")
+	volumeID := isoDString(strings.ToUpper(label), "")
+	if joliet {
+		volumeID = truncate(label, 16)
+	}
+	text(40, 32, volumeID)
+	bothEndian32(d[80:], total)
+	if joliet {
+		copy(d[88:], "%/E") // UCS-2 level 3
+	}
+	bothEndian16(d[120:], 1)
+	bothEndian16(d[124:], 1)
+	bothEndian16(d[128:], isoSectorSize)
+	bothEndian32(d[132:], pathTableSize)
+	binary.LittleEndian.PutUint32(d[140:], lPath)
+	binary.BigEndian.PutUint32(d[148:], mPath)
+	extent, size := root.extent, root.size
+	if joliet {
+		extent, size = root.jolietExtent, root.jolietSize
+	}
+	copy(d[156:], isoDirectoryRecord([]byte{0}, extent, size, 2, date))
+	text(190, 128, "")
+	text(318, 128, "")
+	text(446, 128, "")
+	text(574, 128, "DOCKER-COMPOSE-BUNDLER")
+	text(702, 37, "")
+	text(739, 37, "")
+	text(776, 37, "")
+	stamp := []byte(date.Format("20060102150405") + "00\x00")
+	copy(d[813:], stamp)
+	copy(d[830:], stamp)
+	copy(d[847:], "0000000000000000\x00")
+	copy(d[864:], stamp)
+	d[881] = 1
+	return d
+}
+
+func ucs2(s string) []byte {
+	units := utf16.Encode([]rune(s))
+	b := make([]byte, 2*len(units))
+	for i, u := range units {
+		binary.BigEndian.PutUint16(b[2*i:], u)
+	}
+	return b
+}
+
+func bothEndian16(b []byte, v uint16) {
+	binary.LittleEndian.PutUint16(b, v)
+	binary.BigEndian.PutUint16(b[2:], v)
+}
+
+func bothEndian32(b []byte, v uint32) {
+	binary.LittleEndian.PutUint32(b, v)
+	binary.BigEndian.PutUint32(b[4:], v)
+}
+
+// isoWriter keeps the first error of a sequence of writes
+type isoWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (w *isoWriter) write(b []byte) {
+	if w.err == nil {
+		_, w.err = w.w.Write(b)
+	}
+}
+
+func (w *isoWriter) pad(n int) {
+	zero := make([]byte, min(n, 1<<20))
+	for ; n > 0; n -= len(zero) {
+		w.write(zero[:min(n, len(zero))])
+	}
+}
+
+// writeSectors writes b padded to whole sectors
+func (w *isoWriter) writeSectors(b []byte) {
+	w.write(b)
+	w.pad(int(isoSectors(int64(len(b))))*isoSectorSize - len(b))
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/pkg/stdcopy"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// jobLabel marks the containers of x-bundle.jobs
+const jobLabel = "com.docker-compose-bundler.job"
+
+// BundleJob is a container the bundler runs before building the services,
+// e.g. to compile frontend assets into a build context
+type BundleJob struct {
+	Name        string       `yaml:"name"`
+	Image       string       `yaml:"image"`
+	Command     ShellCommand `yaml:"command,omitempty"` // A string runs with sh -c
+	Entrypoint  ShellCommand `yaml:"entrypoint,omitempty"`
+	WorkingDir  string       `yaml:"working_dir,omitempty"`
+	User        string       `yaml:"user,omitempty"`
+	Environment Environment  `yaml:"environment,omitempty"`
+	Volumes     []string     `yaml:"volumes,omitempty"` // source:target[:ro], paths relative to the compose file
+}
+
+func validateJobs(jobs []BundleJob) error {
+	seen := make(map[string]bool)
+	for i, job := range jobs {
+		if job.Name == "" {
+			return fmt.Errorf("x-bundle.jobs[%d] has no name", i)
+		}
+		if seen[job.Name] {
+			return fmt.Errorf("duplicate job %s in x-bundle.jobs", job.Name)
+		}
+		seen[job.Name] = true
+		if job.Image == "" {
+			return fmt.Errorf("job %s has no image", job.Name)
+		}
+	}
+	return nil
+}
+
+// runJobs runs the x-bundle.jobs in order, the first failure stops the bundle
+func (b *Bundler) runJobs(jobs []BundleJob, baseDir string) error {
+	if err := validateJobs(jobs); err != nil {
+		return err
+	}
+	for _, job := range jobs {
+		switch {
+		case b.opts.SkipJobs:
+			b.decidef("Skipping job %s", job.Name)
+		case b.dryRun():
+			fmt.Printf("Would run job %s (%s)\n", job.Name, job.Image)
+		default:
+			if err := b.runJob(job, baseDir); err != nil {
+				return fmt.Errorf("job %s failed: %w", job.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (b *Bundler) runJob(job BundleJob, baseDir string) (err error) {
+	defer b.span("job", attribute.String("job", job.Name))(&err)
+
+	// Jobs run on the bundling host, not for the target platform
+	if err := b.pullImageWithPolicy(job.Image, pullPolicyMissing, ""); err != nil {
+		return err
+	}
+	binds, err := jobBinds(job.Volumes, baseDir)
+	if err != nil {
+		return err
+	}
+	config := &container.Config{
+		Image:      job.Image,
+		WorkingDir: job.WorkingDir,
+		User:       job.User,
+		Env:        jobEnv(job.Environment),
+		Labels:     map[string]string{jobLabel: job.Name},
+	}
+	config.Cmd = job.Command.Exec
+	if job.Command.Shell != "" {
+		config.Cmd = []string{"sh", "-c", job.Command.Shell}
+	}
+	config.Entrypoint = job.Entrypoint.Exec
+	if job.Entrypoint.Shell != "" {
+		config.Entrypoint = strings.Fields(job.Entrypoint.Shell)
+	}
+
+	fmt.Printf("Running job %s (%s)...\n", job.Name, job.Image)
+	started := time.Now()
+	created, err := b.client.ContainerCreate(b.ctx, config, &container.HostConfig{Binds: binds}, nil, nil, "")
+	if err != nil {
+		return fmt.Errorf("failed to create container: %w", err)
+	}
+	defer b.client.ContainerRemove(b.ctx, created.ID, container.RemoveOptions{Force: true})
+
+	// Waiting has to start before the container, it may exit right away
+	waitC, errC := b.client.ContainerWait(b.ctx, created.ID, container.WaitConditionNextExit)
+	if err := b.client.ContainerStart(b.ctx, created.ID, container.StartOptions{}); err != nil {
+		return fmt.Errorf("failed to start container: %w", err)
+	}
+	logs, err := b.client.ContainerLogs(b.ctx, created.ID, container.LogsOptions{ShowStdout: true, ShowStderr: true, Follow: true})
+	if err != nil {
+		return fmt.Errorf("failed to read the output: %w", err)
+	}
+	prefix := "  [" + job.Name + "] "
+	_, err = stdcopy.StdCopy(&linePrefixWriter{w: os.Stdout, prefix: prefix}, &linePrefixWriter{w: os.Stderr, prefix: prefix}, logs)
+	logs.Close()
+	if err != nil {
+		return fmt.Errorf("failed to read the output: %w", err)
+	}
+
+	select {
+	case result := <-waitC:
+		if result.Error != nil {
+			return fmt.Errorf("%s", result.Error.Message)
+		}
+		if result.StatusCode != 0 {
+			return fmt.Errorf("exited with code %d", result.StatusCode)
+		}
+	case err := <-errC:
+		return err
+	}
+	b.decidef("Job %s completed in %s", job.Name, time.Since(started).Round(time.Second))
+	return nil
+}
+
+// jobBinds resolves the host paths of job volumes against baseDir, sources
+// not starting with ".", "/" or "~" are named volumes like in compose
+func jobBinds(volumes []string, baseDir string) ([]string, error) {
+	var binds []string
+	for _, volume := range volumes {
+		parts := strings.Split(volume, ":")
+		if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || !strings.HasPrefix(parts[1], "/") {
+			return nil, fmt.Errorf("invalid job volume %q, use source:target[:ro]", volume)
+		}
+		source := parts[0]
+		switch {
+		case source == "~" || strings.HasPrefix(source, "~/"):
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return nil, err
+			}
+			source = filepath.Join(home, source[1:])
+		case strings.HasPrefix(source, "."):
+			abs, err := filepath.Abs(filepath.Join(baseDir, source))
+			if err != nil {
+				return nil, err
+			}
+			source = abs
+		}
+		binds = append(binds, strings.Join(append([]string{source}, parts[1:]...), ":"))
+	}
+	return binds, nil
+}
+
+// jobEnv returns the environment of a job, variables without a value are
+// taken from the environment of the bundler like compose does
+func jobEnv(environment Environment) []string {
+	var env []string
+	for _, v := range environment.Vars {
+		if v.Value != nil {
+			env = append(env, v.Name+"="+*v.Value)
+		} else if value, ok := os.LookupEnv(v.Name); ok {
+			env = append(env, v.Name+"="+value)
+		}
+	}
+	return env
+}
+
+// linePrefixWriter prefixes every line written to w
+type linePrefixWriter struct {
+	w       io.Writer
+	prefix  string
+	midLine bool
+}
+
+func (l *linePrefixWriter) Write(p []byte) (int, error) {
+	var out bytes.Buffer
+	for _, line := range bytes.SplitAfter(p, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		if !l.midLine {
+			out.WriteString(l.prefix)
+		}
+		out.Write(line)
+		l.midLine = line[len(line)-1] != '\n'
+	}
+	if _, err := l.w.Write(out.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
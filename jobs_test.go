@@ -0,0 +1,85 @@
+package main
+
+import (
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"docker-compose-bundler/dockerclient"
+)
+
+const jobsCompose = `services:
+  web:
+    image: nginx:1.27
+    command: ["nginx", "-g", "daemon off;"]
+x-bundle:
+  name: shop
+  version: 1.2.0
+  jobs:
+    - name: assets
+      image: node:22
+      command: npm run build
+      working_dir: /src
+      environment:
+        NODE_ENV: production
+      volumes:
+        - ./web:/src
+        - npm-cache:/root/.npm
+`
+
+func TestBundleRunsJobs(t *testing.T) {
+	fake := dockerclient.NewFake()
+	fake.AddImage("nginx:1.27")
+	fake.AddImage("node:22")
+	composeFile := writeCompose(t, jobsCompose)
+
+	bundleWith(t, fake, Options{}, composeFile)
+	if len(fake.Ran) != 1 {
+		t.Fatalf("ran %d containers, want the assets job", len(fake.Ran))
+	}
+	run := fake.Ran[0]
+	if !slices.Equal(run.Config.Cmd, []string{"sh", "-c", "npm run build"}) || run.Config.WorkingDir != "/src" {
+		t.Errorf("job ran %v in %s", run.Config.Cmd, run.Config.WorkingDir)
+	}
+	if !slices.Contains(run.Config.Env, "NODE_ENV=production") || run.Config.Labels[jobLabel] != "assets" {
+		t.Errorf("job environment %v, labels %v", run.Config.Env, run.Config.Labels)
+	}
+	want := []string{filepath.Join(filepath.Dir(composeFile), "web") + ":/src", "npm-cache:/root/.npm"}
+	if !slices.Equal(run.HostConfig.Binds, want) {
+		t.Errorf("job binds %v, want %v", run.HostConfig.Binds, want)
+	}
+	if len(fake.Containers) != 0 {
+		t.Errorf("%d job container(s) were left behind", len(fake.Containers))
+	}
+}
+
+func TestBundleStopsOnFailedJob(t *testing.T) {
+	fake := dockerclient.NewFake()
+	fake.AddImage("nginx:1.27")
+	fake.AddImage("node:22")
+	fake.ExitCodes["node:22"] = 2
+
+	err := NewBundlerWithClient(Options{VersionScheme: VersionSchemeSemver}, fake).Bundle(writeCompose(t, jobsCompose), filepath.Join(t.TempDir(), "bundle.tar.gz"))
+	if err == nil || !strings.Contains(err.Error(), "job assets failed: exited with code 2") {
+		t.Fatalf("Bundle error %v, want the failed job", err)
+	}
+
+	fake.Ran = nil
+	bundleWith(t, fake, Options{SkipJobs: true}, writeCompose(t, jobsCompose))
+	if len(fake.Ran) != 0 {
+		t.Error("--skip-jobs ran the jobs")
+	}
+}
+
+func TestValidateJobs(t *testing.T) {
+	if err := validateJobs([]BundleJob{{Name: "a", Image: "x"}, {Name: "a", Image: "y"}}); err == nil {
+		t.Error("duplicate job names were accepted")
+	}
+	if err := validateJobs([]BundleJob{{Name: "a"}}); err == nil {
+		t.Error("a job without image was accepted")
+	}
+	if _, err := jobBinds([]string{"./out:relative"}, "."); err == nil {
+		t.Error("a relative container path was accepted")
+	}
+}
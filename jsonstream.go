@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// maxStreamMessage bounds the memory of a single message of a daemon stream,
+// builds can print megabytes in one step. Longer messages are skipped.
+const maxStreamMessage = 1 << 20
+
+// progressInterval is how often the progress of a pull or push is printed
+const progressInterval = 5 * time.Second
+
+// streamMessage is a message of the JSON streams of build, pull, push and load
+type streamMessage struct {
+	Stream         string `json:"stream"`
+	Status         string `json:"status"`
+	ID             string `json:"id"`
+	ProgressDetail struct {
+		Current int64 `json:"current"`
+		Total   int64 `json:"total"`
+	} `json:"progressDetail"`
+	Error       string `json:"error"`
+	ErrorDetail struct {
+		Message string `json:"message"`
+	} `json:"errorDetail"`
+	Aux json.RawMessage `json:"aux"`
+}
+
+// streamResult is what the daemon reported about the image of a stream
+type streamResult struct {
+	ImageID string // From the aux message of a build
+	Digest  string // From the aux message of a push or the status of a pull
+	Skipped int    // Messages longer than maxStreamMessage
+}
+
+// streamProgress sums up the layers of a pull or push, printed at most every
+// progressInterval instead of one line per layer update
+type streamProgress struct {
+	action  string
+	ref     string
+	layers  map[string][2]int64 // current and total bytes by layer ID
+	done    map[string]bool
+	printed time.Time
+}
+
+func newStreamProgress(action, ref string) *streamProgress {
+	return &streamProgress{action: action, ref: ref, layers: make(map[string][2]int64), done: make(map[string]bool), printed: time.Now()}
+}
+
+func (p *streamProgress) update(msg *streamMessage) {
+	if msg.ID == "" || msg.ID == p.ref || strings.Contains(msg.ID, ":") {
+		return
+	}
+	switch {
+	case msg.ProgressDetail.Total > 0:
+		p.layers[msg.ID] = [2]int64{msg.ProgressDetail.Current, msg.ProgressDetail.Total}
+	case strings.HasSuffix(msg.Status, "complete") || strings.HasPrefix(msg.Status, "Already exists") ||
+		msg.Status == "Pushed" || msg.Status == "Layer already exists":
+		p.done[msg.ID] = true
+	default:
+		if _, ok := p.layers[msg.ID]; !ok {
+			p.layers[msg.ID] = [2]int64{}
+		}
+	}
+	if time.Since(p.printed) < progressInterval {
+		return
+	}
+	p.printed = time.Now()
+
+	var current, total int64
+	for id, layer := range p.layers {
+		if p.done[id] {
+			current += layer[1]
+		} else {
+			current += layer[0]
+		}
+		total += layer[1]
+	}
+	fmt.Printf("  %s %s: %d/%d layer(s), %s of %s\n", p.action, p.ref, len(p.done), len(p.layers), formatBytes(current), formatBytes(total))
+}
+
+// readJSONStream reads a daemon JSON stream line by line, never holding more
+// than maxStreamMessage of it, and passes every message to handle. Errors
+// reported in the stream are returned, aux messages are captured.
+func readJSONStream(r io.Reader, handle func(msg *streamMessage)) (streamResult, error) {
+	var result streamResult
+	reader := bufio.NewReaderSize(r, 64<<10)
+	var line []byte
+	for {
+		chunk, isPrefix, err := reader.ReadLine()
+		if err == io.EOF {
+			return result, nil
+		}
+		if err != nil {
+			return result, err
+		}
+		if len(line)+len(chunk) > maxStreamMessage {
+			// Discard the rest of the oversized message
+			for isPrefix && err == nil {
+				_, isPrefix, err = reader.ReadLine()
+			}
+			line = line[:0]
+			result.Skipped++
+			continue
+		}
+		line = append(line, chunk...)
+		if isPrefix {
+			continue
+		}
+
+		data := bytes.TrimSpace(line)
+		line = line[:0]
+		if len(data) == 0 {
+			continue
+		}
+		var msg streamMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			return result, fmt.Errorf("invalid message from the Docker daemon: %w", err)
+		}
+		if msg.ErrorDetail.Message != "" {
+			return result, fmt.Errorf("%s", msg.ErrorDetail.Message)
+		}
+		if msg.Error != "" {
+			return result, fmt.Errorf("%s", msg.Error)
+		}
+		result.capture(&msg)
+		if handle != nil {
+			handle(&msg)
+		}
+	}
+}
+
+// capture records image IDs and digests the daemon reports
+func (r *streamResult) capture(msg *streamMessage) {
+	if digest, ok := strings.CutPrefix(msg.Status, "Digest: "); ok {
+		r.Digest = digest
+	}
+	if len(msg.Aux) == 0 {
+		return
+	}
+	var aux struct {
+		ID     string `json:"ID"`     // Classic builder
+		Digest string `json:"Digest"` // Push
+	}
+	if json.Unmarshal(msg.Aux, &aux) != nil {
+		return // BuildKit sends its traces as encoded strings
+	}
+	if aux.ID != "" {
+		r.ImageID = aux.ID
+	}
+	if aux.Digest != "" {
+		r.Digest = aux.Digest
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/api/types/build"
+
+	"docker-compose-bundler/dockerclient"
+)
+
+func TestReadJSONStream(t *testing.T) {
+	stream := `{"status":"Pulling from library/nginx","id":"1.27"}
+{"status":"Downloading","id":"abc","progressDetail":{"current":5,"total":10}}
+
+{"stream":"` + strings.Repeat("x", maxStreamMessage) + `"}
+{"status":"Digest: sha256:1234"}
+{"aux":"encoded BuildKit trace"}
+`
+	var statuses []string
+	result, err := readJSONStream(strings.NewReader(stream), func(msg *streamMessage) {
+		statuses = append(statuses, msg.Status)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Digest != "sha256:1234" || result.Skipped != 1 {
+		t.Errorf("result %+v, want the digest and one skipped message", result)
+	}
+	if len(statuses) != 4 {
+		t.Errorf("handled %d messages, want 4", len(statuses))
+	}
+}
+
+func TestReadJSONStreamError(t *testing.T) {
+	stream := `{"status":"Downloading"}
+{"errorDetail":{"message":"manifest unknown"},"error":"manifest unknown"}
+{"status":"never read"}
+`
+	if _, err := readJSONStream(strings.NewReader(stream), nil); err == nil || err.Error() != "manifest unknown" {
+		t.Errorf("error %v, want manifest unknown", err)
+	}
+	if _, err := readJSONStream(strings.NewReader("not json\n"), nil); err == nil {
+		t.Error("an invalid message was accepted")
+	}
+}
+
+func TestReadJSONStreamBuildID(t *testing.T) {
+	fake := dockerclient.NewFake()
+	resp, err := fake.ImageBuild(context.Background(), strings.NewReader(""), build.ImageBuildOptions{Tags: []string{"app:1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	result, err := readJSONStream(resp.Body, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.ImageID != fake.Images[0].ID {
+		t.Errorf("build reported %q, want %s", result.ImageID, fake.Images[0].ID)
+	}
+}
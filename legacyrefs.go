@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// resolveLegacyReferences checks the links and volumes_from of stacks
+// migrated from compose v1/v2. Both referred to containers by name back then:
+// references to the container_name of a service are rewritten to the service,
+// references to containers outside the stack fail because the target will not
+// have them.
+func (b *Bundler) resolveLegacyReferences(compose *DockerCompose) error {
+	containers := make(map[string]string) // container_name -> service
+	for _, name := range sortedServiceNames(compose) {
+		if containerName, ok := compose.Services[name].Extra["container_name"].(string); ok && containerName != "" {
+			containers[containerName] = name
+		}
+	}
+
+	var problems []string
+	for _, name := range sortedServiceNames(compose) {
+		service := compose.Services[name]
+		problems = append(problems, b.resolveLinks(compose, name, &service, containers)...)
+		problems = append(problems, b.resolveVolumesFrom(compose, name, &service, containers)...)
+		compose.Services[name] = service
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("compose file uses links or volumes_from the target cannot run:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+func (b *Bundler) resolveLinks(compose *DockerCompose, name string, service *Service, containers map[string]string) []string {
+	links, ok := service.Extra["links"].([]interface{})
+	if !ok || len(links) == 0 {
+		return nil
+	}
+
+	var problems []string
+	// Links need the network of the service, which these modes replace
+	if mode, ok := service.Extra["network_mode"].(string); ok && mode != "" && mode != "bridge" && mode != "default" {
+		problems = append(problems, fmt.Sprintf("service %s combines links with network_mode %s, which compose rejects; remove the links or the network_mode, the service does not join the stack's network with it", name, mode))
+	}
+	for i, link := range links {
+		spec := fmt.Sprint(link)
+		target, alias, _ := strings.Cut(spec, ":")
+		if _, ok := compose.Services[target]; ok {
+			continue
+		}
+		if owner, ok := containers[target]; ok {
+			// The container name stays reachable as alias of the link
+			links[i] = owner + ":" + target
+			if alias != "" {
+				links[i] = owner + ":" + alias
+			}
+			b.decidef("Service %s links to container %s, rewritten to service %s", name, target, owner)
+			continue
+		}
+		problems = append(problems, fmt.Sprintf("service %s links to %s, which is neither a service nor the container_name of one; "+
+			"add the container as a service, or use external_links if it runs on the target independently of the stack", name, target))
+	}
+	return problems
+}
+
+func (b *Bundler) resolveVolumesFrom(compose *DockerCompose, name string, service *Service, containers map[string]string) []string {
+	sources, ok := service.Extra["volumes_from"].([]interface{})
+	if !ok || len(sources) == 0 {
+		return nil
+	}
+
+	var problems []string
+	for i, source := range sources {
+		spec := fmt.Sprint(source)
+		ref, isContainer := strings.CutPrefix(spec, "container:")
+		target, mode, _ := strings.Cut(ref, ":")
+		if mode != "" && mode != "ro" && mode != "rw" {
+			problems = append(problems, fmt.Sprintf("service %s has volumes_from %s with invalid access mode %s, use ro or rw", name, spec, mode))
+			continue
+		}
+		if _, ok := compose.Services[target]; ok && !isContainer {
+			continue
+		}
+		if owner, ok := containers[target]; ok {
+			sources[i] = owner
+			if mode != "" {
+				sources[i] = owner + ":" + mode
+			}
+			b.decidef("Service %s mounts the volumes of container %s, rewritten to service %s", name, target, owner)
+			continue
+		}
+		if isContainer {
+			problems = append(problems, fmt.Sprintf("service %s mounts the volumes of container %s, which is not part of the stack and will not exist on the target; "+
+				"declare the shared data as a named volume mounted into both", name, target))
+		} else {
+			problems = append(problems, fmt.Sprintf("service %s mounts the volumes of %s, which is neither a service nor the container_name of one", name, target))
+		}
+	}
+	return problems
+}
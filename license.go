@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/distribution/reference"
+)
+
+// restrictedRegistries require a subscription or EULA acceptance, images
+// pulled from them may only be redistributed once that is acknowledged
+var restrictedRegistries = []string{
+	"container-registry.oracle.com",
+	"registry.redhat.io",
+	"registry.connect.redhat.com",
+}
+
+// LicenseConfig is x-bundle.licenses
+type LicenseConfig struct {
+	Registries   []string          `yaml:"registries,omitempty"`   // Additional restricted registries
+	Acknowledged map[string]string `yaml:"acknowledged,omitempty"` // Image or repository -> note, e.g. who accepted the EULA
+}
+
+// LicenseAcknowledgement records that redistributing an image was acknowledged
+type LicenseAcknowledgement struct {
+	Image    string `json:"image"`
+	Registry string `json:"registry"`
+	Note     string `json:"note,omitempty"`
+}
+
+// pulledImages returns the images of services that are not built, which
+// are the ones subject to third-party redistribution terms
+func pulledImages(compose *DockerCompose) []string {
+	var images []string
+	for _, serviceName := range sortedServiceNames(compose) {
+		service := compose.Services[serviceName]
+		if service.Build == nil && service.Image != "" && !slices.Contains(images, service.Image) {
+			images = append(images, service.Image)
+		}
+	}
+	return images
+}
+
+// checkLicenses refuses images from restricted registries that are not
+// acknowledged in x-bundle.licenses or with --acknowledge-license
+func (b *Bundler) checkLicenses(xBundle *XBundle, images []string) ([]LicenseAcknowledgement, error) {
+	var config LicenseConfig
+	if xBundle != nil && xBundle.Licenses != nil {
+		config = *xBundle.Licenses
+	}
+	registries := append(slices.Clone(restrictedRegistries), config.Registries...)
+
+	var acknowledgements []LicenseAcknowledgement
+	var missing []string
+	for _, imageName := range images {
+		named, err := reference.ParseNormalizedNamed(imageName)
+		if err != nil {
+			return nil, fmt.Errorf("invalid image %s: %w", imageName, err)
+		}
+		registry := reference.Domain(named)
+		if !slices.Contains(registries, registry) {
+			continue
+		}
+
+		note, ok := config.Acknowledged[imageName]
+		if !ok {
+			note, ok = config.Acknowledged[named.Name()]
+		}
+		if !ok && (slices.Contains(b.opts.AcknowledgedLicenses, imageName) || slices.Contains(b.opts.AcknowledgedLicenses, named.Name())) {
+			note, ok = "acknowledged with --acknowledge-license", true
+		}
+		if !ok {
+			missing = append(missing, imageName)
+			continue
+		}
+		acknowledgements = append(acknowledgements, LicenseAcknowledgement{Image: imageName, Registry: registry, Note: note})
+	}
+
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return nil, fmt.Errorf("image(s) from registries with redistribution terms are not acknowledged: %s\n"+
+			"Review the registry's license terms, then acknowledge them in x-bundle.licenses.acknowledged or with --acknowledge-license",
+			strings.Join(missing, ", "))
+	}
+	return acknowledgements, nil
+}
+
+// dropLicenses removes the acknowledgements of the given images
+func dropLicenses(manifest *Manifest, images []string) {
+	licenses := manifest.Licenses[:0]
+	for _, license := range manifest.Licenses {
+		if !slices.Contains(images, license.Image) {
+			licenses = append(licenses, license)
+		}
+	}
+	manifest.Licenses = licenses
+}
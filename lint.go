@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// addLint records a lint finding, printed at the end and stored in the manifest
+func (b *Bundler) addLint(format string, args ...interface{}) {
+	b.lint = append(b.lint, fmt.Sprintf(format, args...))
+}
+
+func (b *Bundler) printLintReport() {
+	if len(b.lint) == 0 {
+		return
+	}
+	fmt.Printf("Lint report (%d finding(s)):\n", len(b.lint))
+	for _, finding := range b.lint {
+		fmt.Printf("  - %s\n", finding)
+	}
+}
+
+var (
+	urlHostRegex     = regexp.MustCompile(`[A-Za-z][A-Za-z0-9+.-]*://(?:[^@/\s]*@)?([A-Za-z0-9._-]+)`)
+	hostPortRegex    = regexp.MustCompile(`^([A-Za-z0-9._-]+):\d+$`)
+	hostVarNameRegex = regexp.MustCompile(`(?i)(HOST|HOSTNAME|SERVER|ADDR|ADDRESS)$`)
+	hostnameRegex    = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9-]*[A-Za-z0-9])?(\.[A-Za-z0-9]([A-Za-z0-9-]*[A-Za-z0-9])?)*$`)
+)
+
+// hostsInValue extracts hostnames referenced by an environment or config value
+func hostsInValue(name, value string) []string {
+	var hosts []string
+	for _, match := range urlHostRegex.FindAllStringSubmatch(value, -1) {
+		hosts = append(hosts, match[1])
+	}
+	if match := hostPortRegex.FindStringSubmatch(value); match != nil {
+		hosts = append(hosts, match[1])
+	}
+	if hostVarNameRegex.MatchString(name) && hostnameRegex.MatchString(value) {
+		hosts = append(hosts, value)
+	}
+	return hosts
+}
+
+// internalHostnames returns the names containers can resolve inside the stack
+func internalHostnames(compose *DockerCompose) map[string]bool {
+	names := map[string]bool{"localhost": true, "host.docker.internal": true}
+	for serviceName, service := range compose.Services {
+		names[serviceName] = true
+		for _, key := range []string{"container_name", "hostname"} {
+			if value, ok := service.Extra[key].(string); ok {
+				names[value] = true
+			}
+		}
+		for _, network := range service.Networks.Networks {
+			aliases, _ := network.Config["aliases"].([]interface{})
+			for _, alias := range aliases {
+				if s, ok := alias.(string); ok {
+					names[s] = true
+				}
+			}
+		}
+		for _, host := range extraHostNames(service) {
+			names[host] = true
+		}
+	}
+	return names
+}
+
+// lintExternalHosts reports hostnames the services refer to that are not
+// part of the stack, air-gapped sites often cannot resolve them
+func (b *Bundler) lintExternalHosts(compose *DockerCompose, baseDir string) {
+	internal := internalHostnames(compose)
+	reported := make(map[string]bool)
+
+	report := func(serviceName, source, name, value string) {
+		for _, host := range hostsInValue(name, value) {
+			host = strings.ToLower(host)
+			if internal[host] || net.ParseIP(host) != nil || (!strings.Contains(host, ".") && !hostVarNameRegex.MatchString(name)) {
+				continue
+			}
+			if key := serviceName + "/" + host; !reported[key] {
+				reported[key] = true
+				b.addLint("service %s references external host %s in %s %s", serviceName, host, source, name)
+			}
+		}
+	}
+
+	for _, serviceName := range sortedServiceNames(compose) {
+		service := compose.Services[serviceName]
+		for _, v := range service.Environment.Vars {
+			if v.Value != nil {
+				report(serviceName, "environment", v.Name, *v.Value)
+			}
+		}
+		for _, file := range service.EnvFile {
+			path := file.Path
+			if !filepath.IsAbs(path) {
+				path = filepath.Join(baseDir, path)
+			}
+			data, _, err := readSecretFile(path, sopsDotenv)
+			if err != nil {
+				continue // Reported when the env files are bundled
+			}
+			for name, value := range parseDotEnv(data) {
+				report(serviceName, "env_file "+file.Path, name, value)
+			}
+		}
+	}
+
+	for _, name := range sortedKeys(compose.Configs) {
+		config, _ := compose.Configs[name].(map[string]interface{})
+		if content, ok := config["content"].(string); ok {
+			report("(config "+name+")", "config", name, content)
+		}
+	}
+}
+
+// loadHostsMap reads a hostname to IP mapping, either as YAML ("host: ip")
+// or in /etc/hosts format ("ip host [host...]")
+func loadHostsMap(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	hosts := make(map[string]string)
+	if err := yaml.Unmarshal(data, &hosts); err == nil && len(hosts) > 0 {
+		for host, ip := range hosts {
+			if net.ParseIP(ip) == nil {
+				return nil, fmt.Errorf("%s: invalid IP %q for host %s", path, ip, host)
+			}
+		}
+		return hosts, nil
+	}
+
+	hosts = make(map[string]string)
+	for _, line := range strings.Split(string(data), "\n") {
+		line, _, _ = strings.Cut(line, "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 || net.ParseIP(fields[0]) == nil {
+			return nil, fmt.Errorf("%s: invalid hosts line %q", path, line)
+		}
+		for _, host := range fields[1:] {
+			hosts[host] = fields[0]
+		}
+	}
+	return hosts, nil
+}
+
+// addExtraHosts adds the mapped hostnames as extra_hosts to every service
+func addExtraHosts(compose *DockerCompose, hosts map[string]string) {
+	names := make([]string, 0, len(hosts))
+	for host := range hosts {
+		names = append(names, host)
+	}
+	sort.Strings(names)
+
+	for serviceName, service := range compose.Services {
+		existing := make(map[string]bool)
+		for _, host := range extraHostNames(service) {
+			existing[host] = true
+		}
+		if service.Extra == nil {
+			service.Extra = make(map[string]interface{})
+		}
+
+		switch entries := service.Extra["extra_hosts"].(type) {
+		case map[string]interface{}:
+			for _, host := range names {
+				if !existing[host] {
+					entries[host] = hosts[host]
+				}
+			}
+		default:
+			list, _ := entries.([]interface{})
+			for _, host := range names {
+				if !existing[host] {
+					list = append(list, host+":"+hosts[host])
+				}
+			}
+			service.Extra["extra_hosts"] = list
+		}
+		compose.Services[serviceName] = service
+	}
+}
+
+// extraHostNames returns the hostnames in a service's extra_hosts (list or map syntax)
+func extraHostNames(service Service) []string {
+	var names []string
+	switch entries := service.Extra["extra_hosts"].(type) {
+	case []interface{}:
+		for _, entry := range entries {
+			if s, ok := entry.(string); ok {
+				// "host:ip" or "host=ip", IPv6 addresses contain colons themselves
+				if i := strings.IndexAny(s, ":="); i > 0 {
+					names = append(names, s[:i])
+				}
+			}
+		}
+	case map[string]interface{}:
+		for host := range entries {
+			names = append(names, host)
+		}
+	}
+	return names
+}
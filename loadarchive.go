@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"docker-compose-bundler/bundlefile"
+
+	"github.com/docker/docker/api/types/image"
+)
+
+// loadStateName records the progress of loading an archive in the extraction
+// directory, an interrupted load resumes from it
+const loadStateName = ".load-state.json"
+
+// loadState is what a previous run of loading the same archive achieved
+type loadState struct {
+	Parts  map[string]verifiedPart `json:"parts"`  // Verified parts by file name
+	Images map[string]string       `json:"images"` // sha256 of loaded image tars by bundle path
+}
+
+// verifiedPart identifies a part that matched its checksum, so it is not
+// read twice when resuming
+type verifiedPart struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+	SHA256  string    `json:"sha256"`
+}
+
+func readLoadState(dir string) *loadState {
+	state := &loadState{Parts: make(map[string]verifiedPart), Images: make(map[string]string)}
+	if data, err := os.ReadFile(filepath.Join(dir, loadStateName)); err == nil {
+		if json.Unmarshal(data, state) != nil || state.Parts == nil || state.Images == nil {
+			state = &loadState{Parts: make(map[string]verifiedPart), Images: make(map[string]string)}
+		}
+	}
+	return state
+}
+
+func (s *loadState) write(dir string) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, loadStateName), data, 0644)
+}
+
+// isBundleArchive tells whether the load source is an archive or the first
+// part of a split archive rather than an extracted bundle directory
+func isBundleArchive(source string) bool {
+	if info, err := os.Stat(source); err == nil {
+		return !info.IsDir()
+	}
+	_, err := os.Stat(source + ".001")
+	return err == nil
+}
+
+// readChecksums parses a sha256sum file into digests by file name
+func readChecksums(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	sums := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		digest, name, ok := strings.Cut(strings.TrimSpace(scanner.Text()), "  ")
+		if !ok {
+			continue
+		}
+		sums[strings.TrimPrefix(name, "*")] = digest
+	}
+	return sums, scanner.Err()
+}
+
+// verifyParts checks every part against the checksum list written by
+// --split-size before anything is loaded. The state is only written with a dir.
+func verifyParts(parts []string, base string, state *loadState, dir string) error {
+	sums, err := readChecksums(base + ".sha256")
+	if os.IsNotExist(err) {
+		if len(parts) > 1 {
+			fmt.Printf("Warning: %s.sha256 not found, the parts cannot be verified\n", filepath.Base(base))
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read checksums: %w", err)
+	}
+
+	for i, part := range parts {
+		name := filepath.Base(part)
+		want, ok := sums[name]
+		if !ok {
+			return fmt.Errorf("%s is not listed in %s.sha256", name, filepath.Base(base))
+		}
+		info, err := os.Stat(part)
+		if err != nil {
+			return err
+		}
+		if verified, ok := state.Parts[name]; ok && verified.SHA256 == want && verified.Size == info.Size() && verified.ModTime.Equal(info.ModTime()) {
+			continue
+		}
+
+		file, err := os.Open(part)
+		if err != nil {
+			return err
+		}
+		hash := sha256.New()
+		_, err = io.Copy(hash, newProgressReader(file, info.Size(), fmt.Sprintf("verify part %d/%d", i+1, len(parts))))
+		file.Close()
+		if err != nil {
+			return err
+		}
+		if got := hex.EncodeToString(hash.Sum(nil)); got != want {
+			return fmt.Errorf("%s is damaged (sha256 %s, expected %s), copy it again or repair it with par2", name, got, want)
+		}
+		state.Parts[name] = verifiedPart{Size: info.Size(), ModTime: info.ModTime(), SHA256: want}
+		if dir == "" {
+			continue
+		}
+		if err := state.write(dir); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("Verified %d part(s)\n", len(parts))
+	return nil
+}
+
+// LoadArchive loads a bundle archive, split or not, without reassembling or
+// extracting the image tars: the parts are read one after the other and the
+// images streamed into the daemon. The other files are extracted into dir.
+// Images loaded by an interrupted run are skipped. It returns the loader of
+// the extracted bundle. maxSize limits what is written to dir, 0 uses the
+// default limit.
+func LoadArchive(source, dir string, cli DockerClient, maxSize int64) (*Loader, error) {
+	parts, base, err := bundlefile.SplitParts(source)
+	if err != nil {
+		return nil, err
+	}
+	if dir == "" {
+		dir = strings.TrimSuffix(strings.TrimSuffix(base, ".gz"), ".zst")
+		dir = strings.TrimSuffix(strings.TrimSuffix(dir, ".tar"), ".tgz")
+		if dir == base {
+			dir = base + ".d"
+		}
+	}
+	extractor, err := newExtractor(dir, maxSize)
+	if err != nil {
+		return nil, err
+	}
+	defer extractor.Close()
+	state := readLoadState(dir)
+	if err := verifyParts(parts, base, state, dir); err != nil {
+		return nil, err
+	}
+
+	files := make([]io.Reader, len(parts))
+	for i, part := range parts {
+		file, err := os.Open(part)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		files[i] = file
+	}
+	reader, err := bundlefile.NewStreamReader(io.MultiReader(files...))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	var loader *Loader
+	extracted := false // Image tars before the manifest are extracted and loaded at the end
+	for {
+		entry, content, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", filepath.Base(base), err)
+		}
+
+		// The metadata files come first, the images follow
+		if loader == nil && strings.HasPrefix(entry.Name, "images/") {
+			if loader, err = newArchiveLoader(dir, cli); err != nil && !os.IsNotExist(err) {
+				return nil, err
+			}
+		}
+		img := archiveImage(loader, entry.Name)
+		if img == nil {
+			if err := extractor.extract(entry, content); err != nil {
+				return nil, err
+			}
+			extracted = extracted || strings.HasPrefix(entry.Name, "images/")
+			continue
+		}
+
+		if err := extractor.check(entry); err != nil {
+			return nil, err
+		}
+		if entry.Size != img.Size {
+			return nil, fmt.Errorf("image %s is corrupt (%d bytes, expected %d)", img.Name, entry.Size, img.Size)
+		}
+		if state.Images[img.File] == img.SHA256 {
+			fmt.Printf("Image %s was loaded before, skipping\n", img.Name)
+			continue
+		}
+		fmt.Printf("Loading %s...\n", img.Name)
+		hash := sha256.New()
+		refs, err := loader.loadImageRefs(io.TeeReader(newProgressReader(content, img.Size, img.Name), hash))
+		if err != nil {
+			return nil, fmt.Errorf("failed to load image %s: %w", img.Name, err)
+		}
+		// The checksum is only known once the daemon read the tar, a corrupt image must not stay loaded
+		if got := hex.EncodeToString(hash.Sum(nil)); got != img.SHA256 {
+			loader.removeImages(refs)
+			return nil, fmt.Errorf("image %s is corrupt (sha256 %s, expected %s), removed it again", img.Name, got, img.SHA256)
+		}
+		state.Images[img.File] = img.SHA256
+		if err := state.write(dir); err != nil {
+			return nil, err
+		}
+	}
+
+	if loader == nil {
+		if loader, err = newArchiveLoader(dir, cli); err != nil {
+			return nil, err
+		}
+	}
+	if extracted {
+		if err := verifyExtractedImages(loader); err != nil {
+			return nil, err
+		}
+		if err := loader.LoadImages(); err != nil {
+			return nil, err
+		}
+	}
+	fmt.Printf("Extracted the bundle to %s\n", dir)
+	return loader, nil
+}
+
+// removeImages removes what was loaded from a corrupt image tar
+func (l *Loader) removeImages(refs []string) {
+	for _, ref := range refs {
+		if _, err := l.client.ImageRemove(l.ctx, ref, image.RemoveOptions{PruneChildren: true}); err != nil {
+			fmt.Printf("Warning: failed to remove image %s: %v\n", ref, err)
+		}
+	}
+}
+
+// verifyExtractedImages checks the image tars that came before the manifest
+// against it, they were extracted without knowing their checksums
+func verifyExtractedImages(l *Loader) error {
+	for _, img := range l.manifest.Images {
+		path := filepath.Join(l.dir, filepath.FromSlash(img.File))
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			continue // Streamed into the daemon
+		}
+		size, digest, err := fileDigest(path)
+		if err != nil {
+			return err
+		}
+		if size != img.Size {
+			return fmt.Errorf("image %s is corrupt (%d bytes, expected %d)", img.Name, size, img.Size)
+		}
+		if digest != img.SHA256 {
+			return fmt.Errorf("image %s is corrupt (sha256 %s, expected %s)", img.Name, digest, img.SHA256)
+		}
+	}
+	return nil
+}
+
+// newArchiveLoader opens the bundle extracted so far and checks the target
+// before the first image is loaded
+func newArchiveLoader(dir string, cli DockerClient) (*Loader, error) {
+	if _, err := os.Stat(filepath.Join(dir, "manifest.json")); err != nil {
+		return nil, err
+	}
+	loader, err := NewLoaderWithClient(dir, cli)
+	if err != nil {
+		return nil, err
+	}
+	if err := loader.CheckEngine(); err != nil {
+		return nil, err
+	}
+	if err := loader.CheckExpiry(); err != nil {
+		return nil, err
+	}
+	if err := loader.CheckBasePack(); err != nil {
+		return nil, err
+	}
+	return loader, nil
+}
+
+// archiveImage returns the manifest image stored at name, nil for other files
+func archiveImage(loader *Loader, name string) *ManifestImage {
+	if loader == nil {
+		return nil
+	}
+	for i := range loader.manifest.Images {
+		if loader.manifest.Images[i].File == name {
+			return &loader.manifest.Images[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/api/types/image"
+
+	"docker-compose-bundler/dockerclient"
+)
+
+// rewriteArchive rewrites the entries of a tar.gz bundle with edit, images
+// are moved in front of the manifest if imagesFirst
+func rewriteArchive(t *testing.T, archive string, imagesFirst bool, edit func(name string, data []byte) []byte) {
+	t.Helper()
+	file, err := os.Open(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	type entry struct {
+		header *tar.Header
+		data   []byte
+	}
+	var images, others []entry
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data = edit(header.Name, data)
+		header.Size = int64(len(data))
+		if imagesFirst && strings.HasPrefix(header.Name, "images/") {
+			images = append(images, entry{header, data})
+		} else {
+			others = append(others, entry{header, data})
+		}
+	}
+
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for _, e := range append(images, others...) {
+		if err := tw.WriteHeader(e.header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(e.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(archive, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// wrongChecksum replaces the checksum of the nginx image in the manifest
+func wrongChecksum(t *testing.T, archive string) {
+	t.Helper()
+	manifest, _, err := readBundleMetadata(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, img := range manifest.Images {
+		if img.Name == "nginx:1.27" {
+			rewriteArchive(t, archive, false, func(name string, data []byte) []byte {
+				if name != "manifest.json" {
+					return data
+				}
+				return bytes.Replace(data, []byte(img.SHA256), []byte(strings.Repeat("0", 64)), 1)
+			})
+		}
+	}
+}
+
+func shopBundle(t *testing.T, opts Options) string {
+	t.Helper()
+	source := dockerclient.NewFake()
+	source.AddImage("nginx:1.27")
+	source.AddImage("redis:7")
+	return bundleWith(t, source, opts, writeCompose(t, webCompose))
+}
+
+func TestLoadArchiveSplit(t *testing.T) {
+	outputFile := shopBundle(t, Options{SplitSize: "1K"})
+	if _, err := os.Stat(outputFile + ".003"); err != nil {
+		t.Fatalf("the bundle was not split into parts: %v", err)
+	}
+
+	target := dockerclient.NewFake()
+	if _, err := LoadArchive(outputFile+".001", filepath.Join(t.TempDir(), "shop"), target, 0); err != nil {
+		t.Fatal(err)
+	}
+	for _, ref := range []string{"nginx:1.27", "redis:7"} {
+		if _, err := target.ImageInspect(t.Context(), ref); err != nil {
+			t.Errorf("%s was not loaded: %v", ref, err)
+		}
+	}
+
+	// Damaged parts are found before anything is loaded
+	data, err := os.ReadFile(outputFile + ".002")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[0] ^= 0xff
+	if err := os.WriteFile(outputFile+".002", data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err = LoadArchive(outputFile, filepath.Join(t.TempDir(), "shop"), dockerclient.NewFake(), 0)
+	if err == nil || !strings.Contains(err.Error(), "bundle.tar.gz.002 is damaged") {
+		t.Errorf("LoadArchive error %v, want the damaged part", err)
+	}
+
+	if err := os.Remove(outputFile + ".002"); err != nil {
+		t.Fatal(err)
+	}
+	_, err = LoadArchive(outputFile, filepath.Join(t.TempDir(), "shop"), dockerclient.NewFake(), 0)
+	if err == nil || !strings.Contains(err.Error(), "part bundle.tar.gz.002 is missing") {
+		t.Errorf("LoadArchive error %v, want the missing part", err)
+	}
+}
+
+func TestLoadArchiveResumes(t *testing.T) {
+	outputFile := shopBundle(t, Options{})
+	target := dockerclient.NewFake()
+	dir := filepath.Join(t.TempDir(), "shop")
+	if _, err := LoadArchive(outputFile, dir, target, 0); err != nil {
+		t.Fatal(err)
+	}
+	// Images the load state records are skipped, a removed one stays removed
+	if _, err := target.ImageRemove(t.Context(), "redis:7", image.RemoveOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadArchive(outputFile, dir, target, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := target.ImageInspect(t.Context(), "redis:7"); err == nil {
+		t.Error("redis:7 was loaded again although the load state records it")
+	}
+}
+
+func TestLoadArchiveRemovesCorruptImage(t *testing.T) {
+	outputFile := shopBundle(t, Options{})
+	wrongChecksum(t, outputFile)
+
+	target := dockerclient.NewFake()
+	_, err := LoadArchive(outputFile, filepath.Join(t.TempDir(), "shop"), target, 0)
+	if err == nil || !strings.Contains(err.Error(), "image nginx:1.27 is corrupt") {
+		t.Fatalf("LoadArchive error %v, want the corrupt image", err)
+	}
+	if _, err := target.ImageInspect(t.Context(), "nginx:1.27"); err == nil {
+		t.Error("the corrupt image stayed loaded")
+	}
+}
+
+func TestLoadArchiveVerifiesExtractedImages(t *testing.T) {
+	outputFile := shopBundle(t, Options{})
+	wrongChecksum(t, outputFile)
+	// Images before the manifest are extracted and loaded at the end
+	rewriteArchive(t, outputFile, true, func(name string, data []byte) []byte { return data })
+
+	target := dockerclient.NewFake()
+	_, err := LoadArchive(outputFile, filepath.Join(t.TempDir(), "shop"), target, 0)
+	if err == nil || !strings.Contains(err.Error(), "image nginx:1.27 is corrupt") {
+		t.Fatalf("LoadArchive error %v, want the corrupt image", err)
+	}
+	if len(target.Images) != 0 {
+		t.Errorf("%d image(s) were loaded from a corrupt bundle", len(target.Images))
+	}
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/client"
+)
+
+// Loader loads and deploys an extracted bundle on the target host
+type Loader struct {
+	client   DockerClient
+	ctx      context.Context
+	dir      string
+	manifest *Manifest
+	compose  *DockerCompose
+	msgs     *catalog // Language of the TUI
+	stateDir string   // Where deployments are recorded for prune
+}
+
+// NewLoader opens the extracted bundle in dir
+func NewLoader(dir string) (*Loader, error) {
+	return NewLoaderWithClient(dir, &lazyDockerClient{})
+}
+
+// NewLoaderWithClient opens the extracted bundle in dir using the given Docker client
+func NewLoaderWithClient(dir string, cli DockerClient) (*Loader, error) {
+	manifest, err := readManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	compose, err := readBundleCompose(filepath.Join(dir, "docker-compose.yml"))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range manifest.Encrypted {
+		data, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(file)))
+		if err == nil && isSOPSEncrypted(data, sopsDotenv) {
+			return nil, fmt.Errorf("%s is SOPS-encrypted, decrypt it first with: sops --decrypt --in-place %s", file, file)
+		}
+	}
+
+	// A bundle generated in a language the binary has no catalog for falls back to English
+	msgs, err := operatorCatalog("", manifest.Languages)
+	if err != nil {
+		msgs = englishCatalog
+	}
+	return &Loader{
+		client:   cli,
+		ctx:      context.Background(),
+		dir:      dir,
+		manifest: manifest,
+		compose:  compose,
+		msgs:     msgs,
+		stateDir: defaultStateDir(),
+	}, nil
+}
+
+func readManifest(dir string) (*Manifest, error) {
+	data, err := os.ReadFile(filepath.Join(dir, "manifest.json"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+	return parseManifest(data)
+}
+
+func parseManifest(data []byte) (*Manifest, error) {
+	var manifest Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest: %w", err)
+	}
+	if manifest.SchemaVersion > manifestSchemaVersion {
+		return nil, fmt.Errorf("bundle manifest schema %d is newer than supported (%d), please update the loader", manifest.SchemaVersion, manifestSchemaVersion)
+	}
+	// The loader opens these paths, they must not point outside of the bundle
+	for _, img := range manifest.Images {
+		if !validMemberPath(img.File) {
+			return nil, fmt.Errorf("invalid path %q of image %s in manifest", img.File, img.Name)
+		}
+	}
+	for _, file := range manifest.Encrypted {
+		if !validMemberPath(file) {
+			return nil, fmt.Errorf("invalid path %q in manifest", file)
+		}
+	}
+	return &manifest, nil
+}
+
+// LoadImages loads every image tar listed in the manifest into the daemon
+func (l *Loader) LoadImages() error {
+	if err := l.CheckBasePack(); err != nil {
+		return err
+	}
+	for _, img := range l.manifest.Images {
+		path := filepath.Join(l.dir, filepath.FromSlash(img.File))
+		// Loading an archive streams the image tars instead of extracting them
+		if _, err := os.Stat(path); os.IsNotExist(err) && img.ID != "" {
+			if _, err := l.client.ImageInspect(l.ctx, img.ID); err == nil {
+				continue
+			}
+		}
+		fmt.Printf("Loading %s...\n", img.Name)
+		if err := l.loadImage(path); err != nil {
+			return fmt.Errorf("failed to load image %s: %w", img.Name, err)
+		}
+	}
+	return nil
+}
+
+func (l *Loader) loadImage(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return l.loadImageFrom(file)
+}
+
+func (l *Loader) loadImageFrom(r io.Reader) error {
+	_, err := l.loadImageRefs(r)
+	return err
+}
+
+// loadImageRefs loads an image tar and returns the tags and IDs the daemon
+// reported as loaded
+func (l *Loader) loadImageRefs(r io.Reader) ([]string, error) {
+	resp, err := l.client.ImageLoad(l.ctx, r, client.ImageLoadWithQuiet(true))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var refs []string
+	_, err = readJSONStream(resp.Body, func(msg *streamMessage) {
+		line := strings.TrimSpace(msg.Stream)
+		if ref, ok := strings.CutPrefix(line, "Loaded image ID: "); ok {
+			refs = append(refs, ref)
+		} else if ref, ok := strings.CutPrefix(line, "Loaded image: "); ok {
+			refs = append(refs, ref)
+		}
+	})
+	if err != nil {
+		return refs, fmt.Errorf("load error: %w", err)
+	}
+	return refs, nil
+}
+
+// Up starts the stack with docker compose (v2 plugin) or docker-compose (v1)
+func (l *Loader) Up() error {
+	cmd := composeCommand("-p", l.manifest.ProjectName, "-f", "docker-compose.yml", "up", "-d")
+	cmd.Dir = l.dir
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// composeCommand prefers the compose v2 plugin and falls back to docker-compose
+func composeCommand(args ...string) *exec.Cmd {
+	if exec.Command("docker", "compose", "version").Run() == nil {
+		return exec.Command("docker", append([]string{"compose"}, args...)...)
+	}
+	return exec.Command("docker-compose", args...)
+}
+
+func bundleDirArg(flags *flag.FlagSet) string {
+	if flags.NArg() > 0 {
+		return flags.Arg(0)
+	}
+	return "."
+}
+
+func runLoad(args []string) {
+	flags := flag.NewFlagSet("load", flag.ExitOnError)
+	tui := flags.Bool("tui", false, "Guide through verifying, loading, configuring and starting the stack interactively")
+	dir := flags.String("dir", "", "Directory to extract a bundle archive to (default: the archive name without extension)")
+	lang := flags.String("lang", "", "`Language` of --tui (default from the locale, otherwise the first language the bundle was generated in)")
+	stateDir := flags.String("state-dir", defaultStateDir(), "`Directory` the loaded bundle, and the deployment with --tui, are recorded in")
+	maxSize := flags.String("max-size", "64G", "Refuse bundle archives whose files extract to more than this `size`, image tars streamed into the daemon do not count")
+	flags.Usage = func() {
+		fmt.Println("Usage: docker-compose-bundler load [flags] [bundle-dir | bundle-archive | first-part.001]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	source := bundleDirArg(flags)
+	if isBundleArchive(source) {
+		limit, err := parseByteSize(*maxSize)
+		if err != nil || limit <= 0 {
+			log.Fatalf("invalid --max-size %q", *maxSize)
+		}
+		loader, err := LoadArchive(source, *dir, &lazyDockerClient{}, limit)
+		if err != nil {
+			log.Fatal(err)
+		}
+		loader.stateDir = *stateDir
+		if err := loader.finishLoad(source); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	loader, err := NewLoader(source)
+	if err != nil {
+		log.Fatal(err)
+	}
+	loader.stateDir = *stateDir
+	if *tui {
+		if *lang != "" {
+			if loader.msgs, err = loadCatalog(*lang); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if err := loader.RunTUI(os.Stdin); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if err := loader.CheckEngine(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loader.CheckExpiry(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loader.LoadImages(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loader.finishLoad(loader.dir); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// finishLoad records the loaded bundle from source, installs the bundled
+// compose plugin if the host needs it and reports what the host still lacks
+// to start the stack, like the images a partial bundle left out
+func (l *Loader) finishLoad(source string) error {
+	fmt.Println("All images loaded successfully!")
+	recordEvent(l.stateDir, l.manifest, Event{Action: EventLoaded, Detail: source})
+	if err := l.InstallComposePlugin(); err != nil {
+		return err
+	}
+	if absent := l.CheckMissingImages(); len(absent) > 0 {
+		fmt.Printf("Warning: %v\n", missingImagesError(absent))
+	}
+	l.printHostHints()
+	return nil
+}
+
+func runDeploy(args []string) {
+	flags := flag.NewFlagSet("deploy", flag.ExitOnError)
+	skipPreflight := flags.Bool("skip-preflight", false, "Do not check for port and subnet conflicts before starting")
+	wait := flags.Bool("wait", false, "Wait for all services to be running/healthy after starting")
+	waitTimeout := flags.Duration("wait-timeout", 300*time.Second, "Maximum time to wait with --wait")
+	dryRun := flags.Bool("dry-run", false, "Only report images to load, services to create or recreate, ports and volumes, without changing anything")
+	installLoader := flags.Bool("install-loader", false, "Install the loader embedded in the bundle without asking")
+	loaderPath := flags.String("loader-path", "", "Where to install the embedded loader (default: the running binary)")
+	stateDir := flags.String("state-dir", defaultStateDir(), "`Directory` the deployment is recorded in for prune")
+	targetValues := flags.String("target-values", "", "YAML `file` with network subnets, bridge names and host IPs to rewrite for this site")
+	var subnets, bridges, hostIPs []string
+	flags.Var((*stringList)(&subnets), "subnet", "Move `network=cidr` to another subnet, with its gateway and static addresses (repeatable)")
+	flags.Var((*stringList)(&bridges), "bridge-name", "Name the Linux bridge of `network=name` (repeatable)")
+	flags.Var((*stringList)(&hostIPs), "host-ip", "Publish ports on this host IP instead, `[old=]new` replaces only old, 0.0.0.0 for ports without one (repeatable)")
+	flags.Usage = func() {
+		fmt.Println("Usage: docker-compose-bundler deploy [flags] [bundle-dir]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	rewrites, err := parseTargetRewrites(*targetValues, subnets, bridges, hostIPs)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	loader, err := NewLoader(bundleDirArg(flags))
+	if err != nil {
+		log.Fatal(err)
+	}
+	loader.stateDir = *stateDir
+	if err := loader.CheckEngine(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loader.CheckExpiry(); err != nil {
+		log.Fatal(err)
+	}
+	if !rewrites.empty() {
+		changes, err := loader.ApplyTargetRewrites(rewrites)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, change := range changes {
+			fmt.Printf("Rewrote %s\n", change)
+		}
+		// A dry run shows the effect without touching the bundle
+		if !*dryRun {
+			if err := loader.writeTargetCompose(changes); err != nil {
+				log.Fatal("Failed to write the rewritten compose file: ", err)
+			}
+		}
+	}
+	if *dryRun {
+		if err := loader.DryRun(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if !*skipPreflight {
+		if err := loader.Preflight(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := loader.LoadImages(); err != nil {
+		log.Fatal(err)
+	}
+	// A partial bundle starts once the operator provided the images it lacks
+	if absent := loader.CheckMissingImages(); len(absent) > 0 {
+		log.Fatal(missingImagesError(absent))
+	}
+	if err := loader.InstallComposePlugin(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loader.Up(); err != nil {
+		log.Fatal("Failed to start the stack: ", err)
+	}
+	if err := loader.RecordDeployment(); err != nil {
+		fmt.Printf("Warning: failed to record the deployment in %s: %v\n", loader.stateDir, err)
+	}
+	if *wait {
+		if err := loader.WaitHealthy(*waitTimeout); err != nil {
+			log.Fatal(err)
+		}
+	}
+	fmt.Printf("Stack %s %s deployed successfully!\n", loader.manifest.Name, loader.manifest.Version)
+	if *loaderPath == "" {
+		if *loaderPath, err = os.Executable(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := loader.OfferLoaderUpdate(*loaderPath, *installLoader); err != nil {
+		log.Fatal(err)
+	}
+}
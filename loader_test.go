@@ -0,0 +1,33 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"docker-compose-bundler/dockerclient"
+)
+
+func TestLoadArchiveLoadsImages(t *testing.T) {
+	source := dockerclient.NewFake()
+	web := source.AddImage("nginx:1.27")
+	source.AddImage("redis:7")
+	outputFile := bundleWith(t, source, Options{}, writeCompose(t, webCompose))
+
+	target := dockerclient.NewFake()
+	loader, err := LoadArchive(outputFile, filepath.Join(t.TempDir(), "shop"), target, 0)
+	if err != nil {
+		t.Fatalf("LoadArchive: %v", err)
+	}
+	if loader.manifest.Name != "shop" {
+		t.Errorf("loaded bundle %q, want shop", loader.manifest.Name)
+	}
+	for _, ref := range []string{"nginx:1.27", "redis:7"} {
+		if _, err := target.ImageInspect(loader.ctx, ref); err != nil {
+			t.Errorf("%s was not loaded: %v", ref, err)
+		}
+	}
+	inspect, _ := target.ImageInspect(loader.ctx, "nginx:1.27")
+	if inspect.ID != web.ID {
+		t.Errorf("nginx:1.27 loaded as %s, want %s", inspect.ID, web.ID)
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/docker/docker/api/types/versions"
+)
+
+// ManifestBundler identifies the bundler that wrote a bundle and the loader
+// binaries embedded in it
+type ManifestBundler struct {
+	Version  string           `json:"version"`
+	Revision string           `json:"revision,omitempty"`
+	Loaders  []ManifestLoader `json:"loaders,omitempty"` // Embedded with --embed-loader
+}
+
+// ManifestLoader is a loader binary in the bundle
+type ManifestLoader struct {
+	Platform string `json:"platform"` // os/arch
+	File     string `json:"file"`
+	Size     int64  `json:"size"`
+	SHA256   string `json:"sha256"`
+}
+
+// recordBundler stores the running bundler in the manifest and, with
+// --embed-loader, copies the loader binaries into bundleDir
+func (b *Bundler) recordBundler(bundleDir string, manifest *Manifest) error {
+	tool := currentTool()
+	previous := manifest.Bundler
+	manifest.Bundler = &ManifestBundler{Version: tool.Version, Revision: tool.Revision}
+	if !b.opts.EmbedLoader {
+		// Loaders embedded by an earlier run stay in an appended bundle
+		if previous != nil {
+			manifest.Bundler.Loaders = previous.Loaders
+		}
+		return nil
+	}
+
+	loaders, err := b.mediaLoaders()
+	if err != nil {
+		return err
+	}
+	for _, loader := range loaders {
+		platform, ok := loaderPlatform(path.Base(loader.Name))
+		if !ok {
+			return fmt.Errorf("loader binary %s must be named %s<os>-<arch>[.exe]", loader.Source, mediaLoaderPrefix)
+		}
+		target := filepath.Join(bundleDir, filepath.FromSlash(loader.Name))
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		if err := copyFile(loader.Source, target); err != nil {
+			return fmt.Errorf("failed to embed loader: %w", err)
+		}
+		size, digest, err := fileDigest(target)
+		if err != nil {
+			return err
+		}
+		manifest.Bundler.Loaders = append(manifest.Bundler.Loaders, ManifestLoader{Platform: platform, File: loader.Name, Size: size, SHA256: digest})
+		b.decidef("Embedded the %s loader in the bundle", platform)
+	}
+	return nil
+}
+
+// loaderPlatform returns os/arch of a docker-compose-bundler-<os>-<arch> binary name
+func loaderPlatform(name string) (string, bool) {
+	rest, ok := strings.CutPrefix(strings.TrimSuffix(name, ".exe"), mediaLoaderPrefix)
+	goos, goarch, ok2 := strings.Cut(rest, "-")
+	if !ok || !ok2 || goos == "" || goarch == "" {
+		return "", false
+	}
+	return goos + "/" + goarch, true
+}
+
+// embeddedLoader returns the loader of the bundle for this host, nil if it has none
+func (l *Loader) embeddedLoader() *ManifestLoader {
+	if l.manifest.Bundler == nil {
+		return nil
+	}
+	for i, loader := range l.manifest.Bundler.Loaders {
+		if loader.Platform == runtime.GOOS+"/"+runtime.GOARCH && validMemberPath(loader.File) {
+			return &l.manifest.Bundler.Loaders[i]
+		}
+	}
+	return nil
+}
+
+// OfferLoaderUpdate installs the loader embedded in the bundle to target if
+// it differs from the installed one and is not older than the running loader.
+// Without install the operator is asked on a terminal, otherwise only told
+// how to install it.
+func (l *Loader) OfferLoaderUpdate(target string, install bool) error {
+	embedded := l.embeddedLoader()
+	if embedded == nil {
+		return nil
+	}
+	if _, digest, err := fileDigest(target); err == nil && digest == embedded.SHA256 {
+		return nil
+	}
+	version := l.manifest.Bundler.Version
+	if running := currentTool().Version; isReleaseVersion(running) && isReleaseVersion(version) && versions.LessThan(releaseCore(version), releaseCore(running)) {
+		return nil // Never downgrade
+	}
+
+	if !install {
+		if !isTerminal(os.Stdin) {
+			fmt.Printf("This bundle contains loader %s, install it with: docker-compose-bundler deploy --install-loader --loader-path %s %s\n", version, target, l.dir)
+			return nil
+		}
+		fmt.Printf("This bundle contains loader %s. Install it to %s? [y/N] ", version, target)
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		if answer = strings.ToLower(strings.TrimSpace(answer)); answer != "y" && answer != "yes" {
+			return nil
+		}
+	}
+	if err := installLoader(filepath.Join(l.dir, filepath.FromSlash(embedded.File)), target, embedded.SHA256); err != nil {
+		return fmt.Errorf("failed to install loader: %w", err)
+	}
+	fmt.Printf("Installed loader %s to %s\n", version, target)
+	return nil
+}
+
+// installLoader replaces target with the binary at source after checking it
+// against digest. The running binary cannot be overwritten on Windows, it is
+// moved aside first.
+func installLoader(source, target, digest string) error {
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	out, err := os.CreateTemp(filepath.Dir(target), filepath.Base(target)+".*.new")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(out, hash), in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	if got := hex.EncodeToString(hash.Sum(nil)); got != digest {
+		return fmt.Errorf("%s is corrupt (sha256 %s, expected %s)", source, got, digest)
+	}
+	if err := os.Chmod(out.Name(), 0755); err != nil {
+		return err
+	}
+	if runtime.GOOS == "windows" {
+		os.Remove(target + ".old")
+		if err := os.Rename(target, target+".old"); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Rename(out.Name(), target)
+}
+
+// isReleaseVersion reports whether a build info version is a tagged release
+// like v1.4.0, local builds report (devel) or a pseudo-version
+func isReleaseVersion(version string) bool {
+	return isValidSemver(version) && !strings.Contains(version, "-")
+}
+
+// releaseCore returns the dotted numbers of a release version
+func releaseCore(version string) string {
+	core, _, _ := strings.Cut(strings.TrimPrefix(version, "v"), "+")
+	return core
+}
+
+// isTerminal reports whether f is an interactive terminal. Services started
+// by init systems get the null device, which is a character device as well.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	null, err := os.Stat(os.DevNull)
+	return err != nil || !os.SameFile(info, null)
+}
+
+// copyFile copies the file at src to dst
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
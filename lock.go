@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/distribution/reference"
+)
+
+const (
+	lockfileName    = "bundle.lock"
+	lockfileVersion = 1
+)
+
+// Lockfile pins the images of every service, stored as bundle.lock next to
+// the compose file. --locked runs fail if an image resolves differently.
+type Lockfile struct {
+	LockfileVersion int                    `json:"lockfileVersion"`
+	Services        map[string]LockedImage `json:"services"`
+}
+
+// LockedImage is the resolved image of one service
+type LockedImage struct {
+	Image      string      `json:"image"`
+	Digest     string      `json:"digest,omitempty"`     // Repo digest of a pulled image
+	BaseImages []BaseImage `json:"baseImages,omitempty"` // Base images of a built image
+}
+
+func lockfilePath(composeFile string) string {
+	return filepath.Join(filepath.Dir(composeFile), lockfileName)
+}
+
+func readLockfile(path string) (*Lockfile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var lock Lockfile
+	if err := json.Unmarshal(data, &lock); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	if lock.LockfileVersion > lockfileVersion {
+		return nil, fmt.Errorf("%s version %d is newer than supported (%d), please update the bundler", path, lock.LockfileVersion, lockfileVersion)
+	}
+	return &lock, nil
+}
+
+func (l *Lockfile) write(path string) error {
+	data, err := json.MarshalIndent(l, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// repoDigest returns the digest the daemon pulled imageName by
+func (b *Bundler) repoDigest(imageName string) (string, error) {
+	inspect, err := b.client.ImageInspect(b.ctx, imageName)
+	if err != nil {
+		return "", fmt.Errorf("failed to inspect image %s: %w", imageName, err)
+	}
+	named, err := reference.ParseNormalizedNamed(imageName)
+	if err != nil {
+		return "", err
+	}
+	digests := slices.Clone(inspect.RepoDigests)
+	sort.Strings(digests)
+	for _, digest := range digests {
+		if repo, _, _ := strings.Cut(digest, "@"); repo == reference.FamiliarName(named) || repo == named.Name() {
+			return digest, nil
+		}
+	}
+	if len(digests) > 0 {
+		return digests[0], nil // Pulled under another name, e.g. through a mirror
+	}
+	return "", nil
+}
+
+// lockService resolves the locked image of a service after it was pulled or
+// built. With --locked it has to match the lockfile that was read.
+func (b *Bundler) lockService(serviceName, imageName string, built bool) error {
+	entry := LockedImage{Image: imageName}
+	if built {
+		for _, record := range b.builds {
+			if record.Image == imageName {
+				entry.BaseImages = record.BaseImages
+			}
+		}
+	} else {
+		digest, err := b.repoDigest(imageName)
+		if err != nil {
+			return err
+		}
+		if digest == "" {
+			b.warnf("image %s of service %s has no registry digest and cannot be locked", imageName, serviceName)
+		}
+		entry.Digest = digest
+	}
+	b.lock.Services[serviceName] = entry
+
+	if b.lockfile == nil {
+		return nil
+	}
+	locked, ok := b.lockfile.Services[serviceName]
+	if !ok {
+		return fmt.Errorf("service %s is not in %s, run without --locked to update it", serviceName, lockfileName)
+	}
+	if diff := locked.diff(entry, built); diff != "" {
+		return fmt.Errorf("service %s resolves differently than %s: %s; run without --locked to update it", serviceName, lockfileName, diff)
+	}
+	return nil
+}
+
+// diff describes how a resolved image differs from the locked one
+func (l LockedImage) diff(resolved LockedImage, built bool) string {
+	if l.Image != resolved.Image && !built {
+		return fmt.Sprintf("image %s, locked %s", resolved.Image, l.Image)
+	}
+	if l.Digest != resolved.Digest {
+		return fmt.Sprintf("digest %s, locked %s", resolved.Digest, l.Digest)
+	}
+	for _, base := range resolved.BaseImages {
+		for _, lockedBase := range l.BaseImages {
+			if base.Name == lockedBase.Name && base.Digest != lockedBase.Digest {
+				return fmt.Sprintf("base image %s is %s, locked %s", base.Name, base.Digest, lockedBase.Digest)
+			}
+		}
+	}
+	return ""
+}
+
+// finishLock checks that the lockfile has no stale services with --locked,
+// otherwise it writes the resolved images
+func (b *Bundler) finishLock(composeFile string) error {
+	if b.lockfile != nil {
+		for serviceName := range b.lockfile.Services {
+			if _, ok := b.lock.Services[serviceName]; !ok && !slices.ContainsFunc(b.missingImages, func(m MissingImage) bool { return m.Service == serviceName }) {
+				return fmt.Errorf("%s locks service %s that no longer exists, run without --locked to update it", lockfileName, serviceName)
+			}
+		}
+		return nil
+	}
+	if err := b.lock.write(lockfilePath(composeFile)); err != nil {
+		return fmt.Errorf("failed to write %s: %w", lockfileName, err)
+	}
+	return nil
+}
+
+// updateBundleLock merges the services resolved during this run into the
+// bundle.lock of an extracted bundle and drops services no longer in it
+func (b *Bundler) updateBundleLock(bundleDir string, compose *DockerCompose) error {
+	path := filepath.Join(bundleDir, lockfileName)
+	lock, err := readLockfile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		lock = &Lockfile{LockfileVersion: lockfileVersion} // Bundle created before lockfiles
+	} else if err != nil {
+		return err
+	}
+	if lock.Services == nil {
+		lock.Services = make(map[string]LockedImage)
+	}
+	for serviceName, entry := range b.lock.Services {
+		lock.Services[serviceName] = entry
+	}
+	for serviceName := range lock.Services {
+		if _, ok := compose.Services[serviceName]; !ok {
+			delete(lock.Services, serviceName)
+		}
+	}
+	return lock.write(path)
+}
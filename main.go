@@ -2,136 +2,500 @@ package main
 
 import (
 	"archive/tar"
-	"compress/gzip"
+	"cmp"
 	"context"
-	"encoding/json"
+	"flag"
 	"fmt"
 	"io"
 	"log"
+	"maps"
 	"os"
 	"path/filepath"
-	"regexp"
+	"runtime"
+	"slices"
 	"strings"
+	"time"
+
+	"docker-compose-bundler/composetransform"
 
 	"github.com/docker/docker/api/types/build"
 	"github.com/docker/docker/api/types/image"
-	"github.com/docker/docker/client"
+	"go.opentelemetry.io/otel/attribute"
 	"gopkg.in/yaml.v3"
 )
 
-// XBundle holds bundle metadata
-type XBundle struct {
-	Name    string `yaml:"name"`
-	Version string `yaml:"version"`
+// Options holds the user-controllable bundling behaviour
+type Options struct {
+	ExternalSecrets      bool              // Replace compose secrets/configs with external ones created on the target
+	Overrides            []string          // Compose files merged on top of the main one
+	VersionScheme        string            // How the x-bundle version is validated (semver, calver or any)
+	ProjectName          string            // Compose project name on the target, derived from x-bundle name if empty
+	Systemd              bool              // Ship install-service.sh that installs a systemd unit for the stack
+	NonRootUser          string            // UID[:GID] set as user on services lacking one, empty to keep them as is
+	HostsMap             string            // File mapping hostnames to IPs, added as extra_hosts to all services
+	RetagPrefix          string            // Namespace all bundled images are retagged under
+	ShowComposeDiff      bool              // Dry run printing the diff between input and bundled compose file
+	SplitSize            string            // Split the archive into volumes of this size (e.g. 4G)
+	Parity               string            // Percentage of PAR2 recovery data to generate (e.g. 10%)
+	SOPSAge              string            // age recipients bundled copies of SOPS-encrypted files are encrypted for
+	SOPSPGP              string            // PGP fingerprints bundled copies of SOPS-encrypted files are encrypted for
+	Values               string            // YAML file with values for the x-bundle parameters
+	AcknowledgedLicenses []string          // Images from restricted registries whose redistribution terms were accepted
+	Sets                 []string          // path=value overrides applied to the compose model
+	MaxImageSize         string            // Default size budget of every image, overrides x-bundle.budgets.image
+	MaxBundleSize        string            // Size budget of the compressed bundle, overrides x-bundle.budgets.total
+	WarnBudgets          bool              // Only warn when a size budget is exceeded
+	MetricsFile          string            // OpenMetrics file the run's metrics are written to
+	Pushgateway          string            // Prometheus Pushgateway URL the run's metrics are pushed to
+	Locked               bool              // Fail if an image resolves differently than bundle.lock
+	KeepDevelop          bool              // Keep develop sections and the bind mounts of watched sources
+	Modernize            bool              // Rewrite legacy compose syntax into the compose spec
+	AllTags              bool              // Save every local tag of a bundled image, not just the referenced one
+	Platform             string            // os/arch[/variant] images are pulled, built and verified for, the daemon's if empty
+	Annotations          []string          // key=value pairs recorded in the manifest and set as labels on built images
+	BuildSecrets         []string          // id=<id>,env|src|vault=<ref> BuildKit secrets for the builds
+	RunReport            string            // Path of the run report, run-report.json next to the output if empty
+	EmbedRunReport       bool              // Also store the run report inside the bundle
+	Flags                map[string]string // Flags given on the command line, recorded in the run report
+	ArchiveFormat        string            // tar.gz, tar.zst or zip, derived from the output file name if empty
+	SaveCompat           string            // Layout of the saved image tars, docker-legacy or oci, as the daemon saves them if empty
+	BasePack             string            // Bundle or bundle URL of base images whose layers are left out
+	SkipJobs             bool              // Do not run x-bundle.jobs, e.g. when their output is up to date
+	Languages            string            // Comma separated languages the README, scripts and TUI are generated in besides English
+	Healthchecks         bool              // Add a TCP port probe to every service without a healthcheck
+	OutputFormat         string            // archive, or iso/img to also write a disc or USB image of the bundle
+	MediaLoaders         []string          // Loader binaries for other platforms put on the iso/img besides the running one
+	EmbedLoader          bool              // Put the loader binaries into the bundle for deploy to install
+	FleetManifest        string            // Where to write the descriptor for configuration management rollouts
+	FleetFormat          string            // yaml or ansible
+	ArtifactURL          string            // Where the bundle gets published, for the fleet manifest
+	VerifierImage        bool              // Also write an image that verifies the delivered bundle
+	ChunkStore           string            // Directory of content-addressed chunks the bundle is added to
+	Chunking             string            // fastcdc or fixed
+	ChunkSize            string            // Average (fastcdc) or exact (fixed) chunk size
+	AllowPartial         bool              // Bundle without images that fail to pull, listing them in manifest and README
+	TagConflict          string            // overwrite, fail or suffix when a build replaces a bundle tag with other content
+	Extensions           string            // preserve, strip or error for x-* entries the bundler does not use
+	ComposePlugins       []string          // docker compose plugin binaries installed on targets without compose
 }
 
-type DockerCompose struct {
-	Version  string                 `yaml:"version"`
-	Services map[string]Service     `yaml:"services"`
-	Networks map[string]interface{} `yaml:"networks,omitempty"`
-	Volumes  map[string]interface{} `yaml:"volumes,omitempty"`
-	Configs  map[string]interface{} `yaml:"configs,omitempty"`
-	Secrets  map[string]interface{} `yaml:"secrets,omitempty"`
-	XBundle  *XBundle               `yaml:"x-bundle"`
+// stringList is a repeatable string flag
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
 }
 
-type Service struct {
-	Image       string                 `yaml:"image,omitempty"`
-	Build       interface{}            `yaml:"build,omitempty"`
-	Environment interface{}            `yaml:"environment,omitempty"` // Can be []string or map[string]string
-	Volumes     []string               `yaml:"volumes,omitempty"`
-	Ports       []string               `yaml:"ports,omitempty"`
-	Networks    []string               `yaml:"networks,omitempty"`
-	DependsOn   interface{}            `yaml:"depends_on,omitempty"` // Can be []string or map[string]interface{}
-	Command     interface{}            `yaml:"command,omitempty"`
-	Entrypoint  interface{}            `yaml:"entrypoint,omitempty"`
-	Restart     string                 `yaml:"restart,omitempty"`
-	Extra       map[string]interface{} `yaml:",inline"`
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
 }
 
-type BuildConfig struct {
-	Context    string            `yaml:"context,omitempty"`
-	Dockerfile string            `yaml:"dockerfile,omitempty"`
-	Args       map[string]string `yaml:"args,omitempty"`
+// commands are the subcommands besides the default bundle command
+var commands = map[string]func(args []string){
+	"bundle":     runBundle,
+	"load":       runLoad,
+	"deploy":     runDeploy,
+	"edit":       runEdit,
+	"sync-check": runSyncCheck,
+	"audit":      runAudit,
+	"bundle-all": runBundleAll,
+	"inspect":    runInspect,
+	"diff":       runDiff,
+	"verify":     runVerify,
+	"sync":       runSync,
+	"mirror":     runMirror,
+	"prune":      runPrune,
+	"events":     runEvents,
 }
 
 func main() {
-	if len(os.Args) < 2 {
-		fmt.Println("Usage: docker-compose-bundler <docker-compose.yml> [output.tar.gz]")
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			command(os.Args[2:])
+			return
+		}
+	}
+	runBundle(os.Args[1:])
+}
+
+func runBundle(args []string) {
+	var opts Options
+	var appendTo string
+	flags := flag.NewFlagSet("bundle", flag.ExitOnError)
+	registerBundleFlags(flags, &opts)
+	flags.StringVar(&appendTo, "append", "", "Add the services of the compose file to this existing `bundle` instead of creating a new one (output defaults to the bundle itself)")
+	flags.StringVar(&opts.MetricsFile, "metrics-file", "", "Write duration, sizes, image counts and cache hit rate of the run to this OpenMetrics `file`")
+	flags.StringVar(&opts.Pushgateway, "pushgateway", "", "Push the metrics of the run to this Prometheus Pushgateway `url`")
+	flags.Usage = func() {
+		fmt.Println("Usage: docker-compose-bundler [bundle] [flags] <docker-compose.yml> [output.tar.gz]")
+		fmt.Println("       docker-compose-bundler load [flags] [bundle-dir]")
+		fmt.Println("       docker-compose-bundler deploy [flags] [bundle-dir]")
+		fmt.Println("       docker-compose-bundler edit [flags] <bundle.tar.gz>")
+		fmt.Println("       docker-compose-bundler sync-check [flags] <registry> [bundle-dir]")
+		fmt.Println("       docker-compose-bundler audit [bundle-dir]")
+		fmt.Println("       docker-compose-bundler bundle-all [flags] <docker-compose.yml>...")
+		fmt.Println("       docker-compose-bundler inspect <bundle.tar.gz|url>")
+		fmt.Println("       docker-compose-bundler diff <old.tar.gz|url> <new.tar.gz|url>")
+		fmt.Println("       docker-compose-bundler verify [flags] <bundle.tar.gz|bundle-dir>")
+		fmt.Println("       docker-compose-bundler sync [flags] <source-store|url> <target-store>")
+		fmt.Println("       docker-compose-bundler mirror --dest <directory> [flags] <docker-compose.yml>")
+		fmt.Println("       docker-compose-bundler prune [flags]")
+		fmt.Println("       docker-compose-bundler events [flags]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() < 1 {
+		flags.Usage()
 		os.Exit(1)
 	}
+	opts.Flags = givenFlags(flags)
+	if opts.ArchiveFormat != "" {
+		var err error
+		if opts.ArchiveFormat, err = parseArchiveFormat(opts.ArchiveFormat); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if _, err := parseSaveCompat(opts.SaveCompat); err != nil {
+		log.Fatal(err)
+	}
+	if _, err := parseLanguages(opts.Languages); err != nil {
+		log.Fatal(err)
+	}
+	if _, err := parseOutputFormat(opts.OutputFormat); err != nil {
+		log.Fatal(err)
+	}
+	if _, err := parseChunking(opts.Chunking); err != nil {
+		log.Fatal(err)
+	}
+	if _, err := parseChunkSize(opts.ChunkSize); err != nil {
+		log.Fatal(err)
+	}
+	if _, err := parseFleetFormat(opts.FleetFormat); err != nil {
+		log.Fatal(err)
+	}
+	if _, err := parseTagConflict(opts.TagConflict); err != nil {
+		log.Fatal(err)
+	}
+	if _, err := composetransform.ParseExtensionPolicy(opts.Extensions); err != nil {
+		log.Fatal(err)
+	}
+	if err := checkComposePlugins(opts.ComposePlugins); err != nil {
+		log.Fatal(err)
+	}
 
-	composeFile := os.Args[1]
-	outputFile := "bundle.tar.gz"
-	if len(os.Args) > 2 {
-		outputFile = os.Args[2]
+	composeFile := flags.Arg(0)
+	outputFile := "bundle." + cmp.Or(opts.ArchiveFormat, archiveTarGz)
+	if appendTo != "" {
+		outputFile = appendTo
+	}
+	if flags.NArg() > 1 {
+		outputFile = flags.Arg(1)
 	}
 
-	bundler := NewBundler()
-	if err := bundler.Bundle(composeFile, outputFile); err != nil {
+	bundler := NewBundler(opts)
+	start := time.Now()
+	err := withTracing(func() error {
+		if appendTo != "" {
+			return bundler.Append(appendTo, composeFile, outputFile)
+		}
+		return bundler.Bundle(composeFile, outputFile)
+	})
+	if metricsErr := bundler.exportMetrics(time.Since(start), err); metricsErr != nil {
+		fmt.Printf("Warning: %v\n", metricsErr)
+	}
+	if reportErr := bundler.writeRunReport(outputFile, err); reportErr != nil {
+		fmt.Printf("Warning: %v\n", reportErr)
+	}
+	if err != nil {
 		log.Fatal(err)
 	}
+	if appendTo != "" {
+		fmt.Printf("Successfully updated bundle: %s\n", outputFile)
+		return
+	}
+	if opts.ShowComposeDiff {
+		return
+	}
 
 	fmt.Printf("Successfully created bundle: %s\n", outputFile)
 }
 
+// registerBundleFlags adds the flags of the bundling options shared by bundle and bundle-all
+func registerBundleFlags(flags *flag.FlagSet, opts *Options) {
+	flags.Var((*stringList)(&opts.Overrides), "override", "Compose file merged on top of the main one (repeatable)")
+	flags.StringVar(&opts.VersionScheme, "version-scheme", VersionSchemeSemver, "Version scheme the x-bundle version must follow: semver, calver or any")
+	flags.StringVar(&opts.ProjectName, "project-name", "", "Compose project name used on the target (default derived from x-bundle name)")
+	flags.BoolVar(&opts.ExternalSecrets, "external-secrets", false, "Mark secrets/configs as external and generate setup-secrets.sh instead of bundling them")
+	flags.BoolVar(&opts.Systemd, "systemd", false, "Include install-service.sh that installs a systemd unit starting the stack at boot")
+	flags.StringVar(&opts.NonRootUser, "non-root", "", "Set `UID[:GID]` as user on every service without one and warn about root services")
+	flags.StringVar(&opts.HostsMap, "hosts-map", "", "YAML or hosts-format `file` mapping hostnames to IPs, added as extra_hosts to every service")
+	flags.StringVar(&opts.RetagPrefix, "retag-prefix", "", "Retag every bundled image under this `namespace` (e.g. customer-x/)")
+	flags.BoolVar(&opts.ShowComposeDiff, "show-compose-diff", false, "Dry run: print a unified diff between the input and the bundled compose file without building or saving images")
+	flags.StringVar(&opts.SplitSize, "split-size", "", "Split the bundle into volumes of this `size` (e.g. 4G) with a .sha256 checksum list")
+	flags.StringVar(&opts.Parity, "parity", "", "Generate this `percentage` of PAR2 recovery data for the bundle or its volumes (requires par2)")
+	flags.Var((*stringList)(&opts.Sets), "set", "Override a compose value as `path=value`, e.g. services.web.environment.LOG_LEVEL=info (repeatable)")
+	flags.Var((*stringList)(&opts.AcknowledgedLicenses), "acknowledge-license", "Acknowledge the redistribution terms of this `image` (or repository) from a restricted registry (repeatable)")
+	flags.StringVar(&opts.Values, "values", "", "YAML `file` with values for the parameters declared in x-bundle.parameters, recorded in the manifest")
+	flags.StringVar(&opts.SOPSAge, "sops-age", "", "Encrypt bundled copies of SOPS-encrypted compose/env files for these age `recipients` (comma separated)")
+	flags.StringVar(&opts.SOPSPGP, "sops-pgp", "", "Encrypt bundled copies of SOPS-encrypted compose/env files for these PGP `fingerprints` (comma separated)")
+	flags.StringVar(&opts.MaxImageSize, "max-image-size", "", "Fail if a bundled image is larger than this `size` (e.g. 500M), overrides x-bundle.budgets.image")
+	flags.StringVar(&opts.MaxBundleSize, "max-bundle-size", "", "Fail if the compressed bundle is larger than this `size` (e.g. 2G), overrides x-bundle.budgets.total")
+	flags.BoolVar(&opts.WarnBudgets, "warn-budgets", false, "Only warn when a size budget is exceeded")
+	flags.BoolVar(&opts.Locked, "locked", false, "Fail if an image resolves differently than recorded in bundle.lock instead of updating it")
+	flags.BoolVar(&opts.KeepDevelop, "keep-develop", false, "Keep the develop sections of the services and the bind mounts of their watched sources, e.g. for QA bundles")
+	flags.BoolVar(&opts.Modernize, "modernize", false, "Rewrite legacy compose 2.x/3.x syntax (version, links, v1 keys) into the current compose spec and report the changes")
+	flags.BoolVar(&opts.AllTags, "all-tags", false, "Save every local tag pointing at a bundled image, not just the one the compose file references")
+	flags.StringVar(&opts.Platform, "platform", "", "Pull and build images for this `os/arch[/variant]` and verify every bundled image matches it (default the platform of the Docker daemon)")
+	flags.Var((*stringList)(&opts.BuildSecrets), "build-secret", "Offer a BuildKit secret to the builds: `id=<id>,env=<variable>`, id=<id>,src=<file> or id=<id>,vault=<path>[#field] (repeatable)")
+	flags.Var((*stringList)(&opts.Annotations), "annotation", "Record `key=value` in the manifest and index and set it as label on every built image, e.g. ticket=OPS-1234 (repeatable)")
+	flags.StringVar(&opts.RunReport, "run-report", "", "Write the run report to this `file` instead of run-report.json next to the bundle")
+	flags.BoolVar(&opts.EmbedRunReport, "embed-run-report", false, "Also store the run report inside the bundle")
+	flags.StringVar(&opts.ArchiveFormat, "archive-format", "", "Archive `format` of the bundle: tar.gz, tar.zst or zip (default derived from the output file name, tar.gz otherwise)")
+	flags.StringVar(&opts.SaveCompat, "save-compat", "", "Store the image tars in this `layout`: docker-legacy for Docker Engine before 25, oci for OCI tooling (default as the Docker daemon saves them)")
+	flags.StringVar(&opts.BasePack, "base-pack", "", "Leave out the layers the images share with the images of this base pack `bundle` (file or URL), which has to be loaded on the target first")
+	flags.BoolVar(&opts.SkipJobs, "skip-jobs", false, "Do not run the x-bundle.jobs before building the services")
+	flags.BoolVar(&opts.Healthchecks, "synthesize-healthchecks", false, "Add a TCP port probe healthcheck to every service that defines none, so deploy --wait can tell whether it came up")
+	flags.StringVar(&opts.OutputFormat, "output-format", OutputFormatArchive, "archive, or iso/img to also write a disc image or dd-able USB stick image with the bundle, the loader and an install README")
+	flags.Var((*stringList)(&opts.MediaLoaders), "media-loader", "Also put this loader `binary` on the --output-format image, named docker-compose-bundler-<os>-<arch>[.exe] (repeatable)")
+	flags.Var((*stringList)(&opts.ComposePlugins), "compose-plugin", "Put this docker compose plugin `binary` into the bundle, named as released by Docker (docker-compose-<os>-<arch>[.exe]); load-images.sh and deploy install it on hosts without compose (repeatable)")
+	flags.BoolVar(&opts.EmbedLoader, "embed-loader", false, "Put the running binary and the --media-loader binaries into the bundle, deploy offers to install the one of the target")
+	flags.StringVar(&opts.FleetManifest, "fleet-manifest", "", "Write a `file` describing the artifact, required variables and deploy command for configuration management tools")
+	flags.StringVar(&opts.FleetFormat, "fleet-format", FleetFormatYAML, "Layout of --fleet-manifest: yaml, or ansible for an inventory with the bundle as vars of all hosts")
+	flags.StringVar(&opts.ArtifactURL, "artifact-url", "", "`URL` the bundle gets published at, for --fleet-manifest; a URL ending in / is the directory of the bundle")
+	flags.BoolVar(&opts.VerifierImage, "emit-verifier-image", false, "Also write <bundle>-verifier.tar, a docker-archive of a tiny image that verifies the delivered bundle with one docker run; needs a static Linux loader (running binary or --media-loader)")
+	flags.StringVar(&opts.ChunkStore, "chunk-store", "", "Also add the bundle to this chunk store `directory`, from which sync transfers only the chunks a site does not have yet")
+	flags.StringVar(&opts.Chunking, "chunking", ChunkingFastCDC, "How --chunk-store splits the files: fastcdc (content-defined) or fixed")
+	flags.StringVar(&opts.ChunkSize, "chunk-size", defaultChunkSize, "Average (fastcdc) or exact (fixed) `size` of the --chunk-store chunks")
+	flags.BoolVar(&opts.AllowPartial, "allow-partial", false, "Still write the bundle if pulling some images fails, marked as partial in the manifest and README with the images the operator has to provide")
+	flags.StringVar(&opts.TagConflict, "on-tag-conflict", TagConflictOverwrite, "What to do when a build replaces a bundles/<name>/<service>:<version> tag an earlier run left on other content: overwrite (with a warning), fail, or suffix the new tag with the image ID")
+	flags.StringVar(&opts.Extensions, "extensions", ExtensionsPreserve, "What to do with x-* top-level and service entries other tools consume: preserve them as written, strip them, or error")
+	flags.StringVar(&opts.Languages, "lang", "", "Also generate the README, the script messages and the load --tui texts in these comma separated `languages`, e.g. de,fr")
+}
+
+// givenFlags returns the flags set on the command line with their values
+func givenFlags(flags *flag.FlagSet) map[string]string {
+	given := make(map[string]string)
+	flags.Visit(func(f *flag.Flag) {
+		given[f.Name] = f.Value.String()
+	})
+	return given
+}
+
 type Bundler struct {
-	client              *client.Client
+	client              DockerClient
 	ctx                 context.Context
+	opts                Options
+	lint                []string        // Findings reported to the user and recorded in the manifest
 	freshlyPulledImages map[string]bool // Track images pulled during this run
+	retaggedImages      map[string]bool // Tags created by --retag-prefix
+	encryptedFiles      []string        // Bundle files encrypted with sops for the target
+	builds              []BuildRecord   // Inputs of the images built during this run
+	hubQuota            *hubQuota       // Docker Hub pull quota at the start of the run, nil if unknown
+	hubPulls            int             // Docker Hub pulls since the quota was queried
+	stats               bundleStats     // Exported with --metrics-file and --pushgateway
+	lock                *Lockfile       // Images resolved during this run
+	lockfile            *Lockfile       // bundle.lock the run has to match with --locked
+	annotations         map[string]string
+	buildSecrets        map[string]*buildSecret // --build-secret and the file and environment secrets of the compose file
+	shared              *sharedImages           // Images shared with the other bundlers of bundle-all, nil otherwise
+	report              *runReport              // Written as run-report.json when the run ends
+	basePack            *basePack               // --base-pack, read on first use
+	catalogs            []*catalog              // --lang, the languages besides English
+	missingImages       []MissingImage          // Images left out with --allow-partial
 }
 
-func NewBundler() *Bundler {
-	cli, err := client.NewClientWithOpts(client.FromEnv)
-	if err != nil {
-		log.Fatal("Failed to create Docker client:", err)
-	}
+// NewBundler creates a bundler that connects to the Docker daemon on first use
+func NewBundler(opts Options) *Bundler {
+	return NewBundlerWithClient(opts, &lazyDockerClient{})
+}
 
+// NewBundlerWithClient creates a bundler talking to the given Docker client
+func NewBundlerWithClient(opts Options, cli DockerClient) *Bundler {
 	return &Bundler{
 		client:              cli,
 		ctx:                 context.Background(),
+		opts:                opts,
 		freshlyPulledImages: make(map[string]bool),
+		retaggedImages:      make(map[string]bool),
+		report:              newRunReport(opts),
 	}
 }
 
-func (b *Bundler) Bundle(composeFile, outputFile string) error {
+func (b *Bundler) Bundle(composeFile, outputFile string) (err error) {
+	defer b.span("bundle", attribute.String("compose.file", composeFile))(&err)
+
+	// Concurrent runs, e.g. CI retries, must not write the same bundle or bundle.lock
+	if !b.dryRun() {
+		for _, path := range []string{outputFile, lockfilePath(composeFile)} {
+			release, err := acquireRunLock(path)
+			if err != nil {
+				return err
+			}
+			defer release()
+		}
+	}
+
 	// Read and parse docker-compose.yml
 	compose, err := b.parseComposeFile(composeFile)
 	if err != nil {
 		return fmt.Errorf("failed to parse compose file: %w", err)
 	}
+	b.recordInputs(composeFile)
+	if err := b.checkExtensions(compose); err != nil {
+		return err
+	}
+
+	// Snapshot the parsed input, diffing against the raw file would mostly show formatting
+	var originalCompose []byte
+	if b.dryRun() {
+		if originalCompose, err = marshalCompose(compose); err != nil {
+			return err
+		}
+	}
 
 	// Validate x-bundle
 	if compose.XBundle == nil {
 		return fmt.Errorf("missing x-bundle entry in compose file")
 	}
+	if err := renderBundleMetadata(compose.XBundle, filepath.Dir(composeFile)); err != nil {
+		return err
+	}
 	if compose.XBundle.Name == "" {
 		return fmt.Errorf("missing name in x-bundle")
 	}
 	if compose.XBundle.Version == "" {
 		return fmt.Errorf("missing version in x-bundle")
 	}
-	if !isValidSemver(compose.XBundle.Version) {
-		return fmt.Errorf("invalid version in x-bundle, must be valid semantic versioning (e.g., 1.2.3)")
+	b.stats.Name, b.stats.Version = compose.XBundle.Name, compose.XBundle.Version
+	if err := validateVersion(compose.XBundle.Version, b.opts.VersionScheme); err != nil {
+		return err
 	}
 
 	bundleName := compose.XBundle.Name
 	bundleVersion := compose.XBundle.Version
 
-	// Process services and collect image information
-	imageMap := make(map[string]string) // original -> saved tar filename
+	// Pin the compose project name so it does not depend on the extraction directory
+	projectName := b.opts.ProjectName
+	if projectName == "" {
+		projectName = normalizeProjectName(bundleName)
+	}
+	if !isValidProjectName(projectName) {
+		return fmt.Errorf("invalid project name %q, must contain only lowercase letters, digits, '-' and '_' and start with a letter or digit", projectName)
+	}
+	compose.Name = projectName
+
+	// Map external hostnames for sites without DNS, then report the remaining ones
+	if b.opts.HostsMap != "" {
+		hosts, err := loadHostsMap(b.opts.HostsMap)
+		if err != nil {
+			return fmt.Errorf("failed to read hosts map: %w", err)
+		}
+		addExtraHosts(compose, hosts)
+	}
+	if err := dropMissingEnvFiles(compose, filepath.Dir(composeFile)); err != nil {
+		return fmt.Errorf("failed to bundle env files: %w", err)
+	}
+	b.lintExternalHosts(compose, filepath.Dir(composeFile))
 
+	// Refuse images whose redistribution terms were not acknowledged
+	licenses, err := b.checkLicenses(compose.XBundle, pulledImages(compose))
+	if err != nil {
+		return err
+	}
+	budgets, err := b.sizeBudgets(compose.XBundle)
+	if err != nil {
+		return err
+	}
+	expiry, err := b.bundleExpiry(compose.XBundle)
+	if err != nil {
+		return err
+	}
+	if b.annotations, err = parseAnnotations(b.opts.Annotations); err != nil {
+		return err
+	}
+	if b.buildSecrets, err = parseBuildSecrets(b.opts.BuildSecrets, compose.Secrets, filepath.Dir(composeFile)); err != nil {
+		return err
+	}
+
+	if !b.dryRun() {
+		b.checkHubQuota(compose)
+	}
+
+	// Resolved images are recorded in bundle.lock, or have to match it with --locked
+	b.lock = &Lockfile{LockfileVersion: lockfileVersion, Services: make(map[string]LockedImage)}
+	if b.opts.Locked {
+		if b.lockfile, err = readLockfile(lockfilePath(composeFile)); err != nil {
+			return fmt.Errorf("--locked requires %s: %w", lockfileName, err)
+		}
+	}
+
+	// Prepare build contexts before any service is built
+	if err := b.runJobs(compose.XBundle.Jobs, filepath.Dir(composeFile)); err != nil {
+		return err
+	}
+
+	// Build or pull the images of the services
+	images := make(map[string]string) // service -> image built or pulled
 	for serviceName, service := range compose.Services {
-		imageName, err := b.processServiceWithBundle(serviceName, &service, filepath.Dir(composeFile), bundleName, bundleVersion)
+		built := service.Build != nil
+		imageName, err := b.processServiceWithBundle(serviceName, service, filepath.Dir(composeFile), bundleName, bundleVersion)
 		if err != nil {
+			if b.skipMissingImage(serviceName, service, err) {
+				continue
+			}
 			return fmt.Errorf("failed to process service %s: %w", serviceName, err)
 		}
-
+		if imageName != "" && !b.dryRun() {
+			if err := b.lockService(serviceName, imageName, built); err != nil {
+				return err
+			}
+		}
 		if imageName != "" {
-			tarFileName := fmt.Sprintf("%s.tar", sanitizeFilename(imageName))
-			imageMap[imageName] = tarFileName
-			// Update the service in the compose struct
-			compose.Services[serviceName] = service
+			images[serviceName] = imageName
+		}
+	}
+	if !b.dryRun() {
+		if err := b.finishLock(composeFile); err != nil {
+			return err
+		}
+	}
+
+	// Rewrite the compose file for the bundle, the images get the names it gives them
+	transformed, err := b.transformCompose(compose, bundleName, bundleVersion, filepath.Dir(composeFile), images, nil)
+	if err != nil {
+		return err
+	}
+	imageMap, err := b.bundledImages(images, transformed.Images) // bundled -> saved tar filename
+	if err != nil {
+		return err
+	}
+	if err := b.resolveLegacyReferences(compose); err != nil {
+		return err
+	}
+
+	if err := b.lintImageConfigs(compose); err != nil {
+		return err
+	}
+
+	// Run services as a non-root user
+	if b.opts.NonRootUser != "" {
+		if err := b.enforceNonRoot(compose, b.opts.NonRootUser); err != nil {
+			return err
+		}
+	}
+
+	// Give services without a healthcheck one deploy --wait can act on
+	if err := b.synthesizeHealthchecks(compose); err != nil {
+		return err
+	}
+
+	// Estimate the host resources needed by the stack
+	capacity := &CapacityEstimate{}
+	if !b.dryRun() {
+		if capacity, err = b.estimateCapacity(compose); err != nil {
+			return fmt.Errorf("failed to estimate capacity: %w", err)
 		}
 	}
 
@@ -148,16 +512,85 @@ func (b *Bundler) Bundle(composeFile, outputFile string) error {
 		return fmt.Errorf("failed to create images directory: %w", err)
 	}
 
+	// Only show what would be written to the bundle
+	if b.dryRun() {
+		return b.printComposeDiff(compose, originalCompose, composeFile, tempDir, transformed.EnvFiles)
+	}
+
+	if err := b.checkPlatforms(compose, imageMap); err != nil {
+		return err
+	}
+	if err := b.checkImageBudgets(budgets, compose, imageMap); err != nil {
+		return err
+	}
+
 	// Save images to tar files
+	manifest := newManifest(compose.XBundle, b.opts.VersionScheme)
+	manifest.ProjectName = projectName
+	manifest.Lint = b.lint
+	manifest.Capacity = capacity
+	manifest.Engine = engineRequirement(compose)
+	if manifest.Host, err = hostRequirements(compose.XBundle); err != nil {
+		return err
+	}
+	manifest.Licenses = licenses
+	manifest.Annotations = b.annotations
+	manifest.Expiry = expiry
+	manifest.MissingImages = mergeMissingImages(nil, compose, b.missingImages, nil)
+	if err := b.recordValues(manifest, compose); err != nil {
+		return fmt.Errorf("failed to record values: %w", err)
+	}
+	if err := b.useBasePack(); err != nil {
+		return err
+	}
+	if b.catalogs, err = parseLanguages(b.opts.Languages); err != nil {
+		return err
+	}
+	for _, c := range b.catalogs {
+		manifest.Languages = append(manifest.Languages, c.lang)
+	}
 	for imageName, tarFileName := range imageMap {
 		tarPath := filepath.Join(imagesDir, tarFileName)
-		if err := b.saveImage(imageName, tarPath); err != nil {
+		inspect, err := b.client.ImageInspect(b.ctx, imageName)
+		if err != nil {
+			return fmt.Errorf("failed to inspect image %s: %w", imageName, err)
+		}
+		aliases := b.imageAliases(imageName, inspect)
+		if err := b.saveImage(imageName, aliases, tarPath); err != nil {
 			return fmt.Errorf("failed to save image %s: %w", imageName, err)
 		}
+		if err := manifest.addImage(imageName, inspect, aliases, tempDir, filepath.Join("images", tarFileName)); err != nil {
+			return fmt.Errorf("failed to record image %s: %w", imageName, err)
+		}
+		if err := b.omitBaseLayers(manifest, &manifest.Images[len(manifest.Images)-1], tempDir); err != nil {
+			return err
+		}
+	}
+
+	// Ship env files with the bundle
+	if err := b.bundleEnvFiles(transformed.EnvFiles, filepath.Dir(composeFile), tempDir); err != nil {
+		return fmt.Errorf("failed to bundle env files: %w", err)
+	}
+
+	// Additional README sections contributed by optional features
+	readmeSections := []func(*catalog) string{capacity.readmeSection}
+	if manifest.Host != nil {
+		readmeSections = append(readmeSections, manifest.Host.readmeSection)
+	}
+	if manifest.BasePack != nil {
+		readmeSections = append(readmeSections, func(c *catalog) string { return basePackSection(c, manifest.BasePack) })
 	}
 
-	// Update compose file to use bundled images
-	b.updateComposeForBundle(compose, imageMap)
+	// Replace secrets/configs with external ones and generate a setup script for them
+	if b.opts.ExternalSecrets {
+		externals := externalizeSecrets(compose)
+		if err := b.createSecretsScript(tempDir, externals); err != nil {
+			return fmt.Errorf("failed to create secrets setup script: %w", err)
+		}
+		if len(externals) > 0 {
+			readmeSections = append(readmeSections, secretsReadmeSection)
+		}
+	}
 
 	// Write updated compose file
 	updatedComposePath := filepath.Join(tempDir, "docker-compose.yml")
@@ -165,68 +598,135 @@ func (b *Bundler) Bundle(composeFile, outputFile string) error {
 		return fmt.Errorf("failed to write updated compose file: %w", err)
 	}
 
+	// Write manifest
+	manifest.Encrypted = b.encryptedFiles
+	manifest.Builds = b.builds
+	if err := b.recordBundler(tempDir, manifest); err != nil {
+		return err
+	}
+	if err := b.embedComposePlugins(tempDir, manifest); err != nil {
+		return err
+	}
+	if err := manifest.write(tempDir); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+
+	// Write index for fleet tooling
+	if err := writeIndex(tempDir, buildIndex(compose, manifest)); err != nil {
+		return fmt.Errorf("failed to write index: %w", err)
+	}
+	if err := b.lock.write(filepath.Join(tempDir, lockfileName)); err != nil {
+		return fmt.Errorf("failed to write %s: %w", lockfileName, err)
+	}
+
 	// Create load script
-	if err := b.createLoadScript(tempDir); err != nil {
+	if err := b.createLoadScript(tempDir, manifest); err != nil {
 		return fmt.Errorf("failed to create load script: %w", err)
 	}
 
+	// Create systemd installer
+	if b.opts.Systemd {
+		if err := b.createSystemdInstaller(tempDir, manifest, compose); err != nil {
+			return fmt.Errorf("failed to create systemd installer: %w", err)
+		}
+		readmeSections = append(readmeSections, systemdReadmeSection)
+	}
+	if len(manifest.Encrypted) > 0 {
+		readmeSections = append(readmeSections, func(c *catalog) string { return sopsReadmeSection(c, manifest.Encrypted) })
+	}
+
 	// Create README
-	if err := b.createReadme(tempDir); err != nil {
+	if err := b.createReadme(tempDir, manifest, readmeSections); err != nil {
 		return fmt.Errorf("failed to create README: %w", err)
 	}
+	b.recordImages(manifest)
+	if err := b.embedRunReport(tempDir, outputFile); err != nil {
+		return fmt.Errorf("failed to write run report: %w", err)
+	}
+	if err := manifest.recordFiles(tempDir); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
 
-	// Create the final tar.gz bundle
-	if err := b.createTarGz(tempDir, outputFile); err != nil {
+	// Create the final bundle, an interrupted run must not leave a truncated one behind
+	partial := outputFile + ".partial"
+	if err := b.createArchive(tempDir, partial, b.archiveFormat(outputFile)); err != nil {
+		os.Remove(partial)
 		return fmt.Errorf("failed to create bundle: %w", err)
 	}
+	if err := os.Rename(partial, outputFile); err != nil {
+		return err
+	}
+	if err := b.checkBundleBudget(budgets, outputFile, manifest); err != nil {
+		return err
+	}
+	b.recordBundleStats(manifest, outputFile)
 
-	// Cleanup built and freshly pulled images
+	// Split into volumes and add parity data for unreliable transfer media
+	if err := b.splitAndProtect(outputFile); err != nil {
+		return err
+	}
+	if err := b.writeMedia(outputFile, manifest); err != nil {
+		return err
+	}
+	if err := b.writeVerifierImage(outputFile, manifest); err != nil {
+		return err
+	}
+	if err := b.writeChunkStore(outputFile, manifest); err != nil {
+		return err
+	}
+	if err := b.writeFleetManifest(outputFile, buildIndex(compose, manifest)); err != nil {
+		return err
+	}
+
+	b.printLintReport()
+	b.printPartialReport(manifest)
+
+	// Cleanup retagged, built and freshly pulled images
+	b.cleanupRetaggedImages()
 	if err := b.cleanupImages(compose); err != nil {
-		fmt.Printf("Warning: failed to cleanup some images: %v\n", err)
+		b.warnf("failed to cleanup some images: %v", err)
 	}
 	if err := b.cleanupFreshlyPulledImages(); err != nil {
-		fmt.Printf("Warning: failed to cleanup some freshly pulled images: %v\n", err)
+		b.warnf("failed to cleanup some freshly pulled images: %v", err)
 	}
 	return nil
 }
 
-func (b *Bundler) parseComposeFile(filename string) (*DockerCompose, error) {
-	data, err := os.ReadFile(filename)
-	if err != nil {
-		return nil, err
-	}
+func (b *Bundler) parseComposeFile(filename string) (compose *DockerCompose, err error) {
+	defer b.span("parse", attribute.String("compose.file", filename))(&err)
 
-	var compose DockerCompose
-	if err := yaml.Unmarshal(data, &compose); err != nil {
+	opts, err := b.loadOptions()
+	if err != nil {
 		return nil, err
 	}
-
-	return &compose, nil
+	return loadComposeFiles(append([]string{filename}, b.opts.Overrides...), opts)
 }
 
-// isValidSemver checks if a version string is valid semver (simple regex)
-func isValidSemver(version string) bool {
-	semverRegex := regexp.MustCompile(`^v?(0|[1-9]\d*)\.(0|[1-9]\d*)\.(0|[1-9]\d*)(?:-[\w\.-]+)?(?:\+[\w\.-]+)?$`)
-	return semverRegex.MatchString(version)
-}
+// processServiceWithBundle builds or pulls the image of a service and
+// returns its name, built images are tagged with bundle name and version
+func (b *Bundler) processServiceWithBundle(serviceName string, service Service, baseDir, bundleName, bundleVersion string) (string, error) {
+	policy, err := servicePullPolicy(service)
+	if err != nil {
+		return "", err
+	}
 
-// processServiceWithBundle tags built images with bundle name and version
-func (b *Bundler) processServiceWithBundle(serviceName string, service *Service, baseDir, bundleName, bundleVersion string) (string, error) {
-	if service.Build != nil {
-		imageName := fmt.Sprintf("bundles/%s/%s:%s", bundleName, serviceName, bundleVersion)
-		buildConfig, err := parseBuildConfig(service.Build)
-		if err != nil {
-			return "", err
+	if b.dryRun() {
+		// Only determine the image names
+		if service.Build != nil {
+			return composetransform.BuiltImage(bundleName, serviceName, bundleVersion), nil
 		}
-		if err := b.buildImage(buildConfig, baseDir, imageName); err != nil {
+		return service.Image, nil
+	}
+	if service.Build != nil {
+		imageName := composetransform.BuiltImage(bundleName, serviceName, bundleVersion)
+		previousID := b.existingImageID(imageName)
+		if err := b.buildImage(b.buildConfig(service), baseDir, imageName, b.servicePlatform(service)); err != nil {
 			return "", err
 		}
-		service.Image = imageName
-		service.Build = nil
-		return imageName, nil
+		return b.resolveTagConflict(imageName, previousID)
 	}
 	if service.Image != "" {
-		if err := b.pullImageIfNotExists(service.Image); err != nil {
+		if err := b.pullImageWithPolicy(service.Image, policy, b.servicePlatform(service)); err != nil {
 			return "", err
 		}
 		return service.Image, nil
@@ -234,6 +734,19 @@ func (b *Bundler) processServiceWithBundle(serviceName string, service *Service,
 	return "", nil
 }
 
+// buildConfig returns the build section of a service. --modernize moves a
+// legacy dockerfile key into it when the compose file is rewritten, after
+// the build, so the build reads it from there.
+func (b *Bundler) buildConfig(service Service) *BuildConfig {
+	dockerfile, ok := service.Extra["dockerfile"].(string)
+	if !b.opts.Modernize || !ok || service.Build.Dockerfile != "" {
+		return service.Build
+	}
+	config := *service.Build
+	config.Dockerfile = dockerfile
+	return &config
+}
+
 func (b *Bundler) cleanupImages(compose *DockerCompose) error {
 	// Track which images were built by this bundler
 	builtImages := make(map[string]bool)
@@ -253,7 +766,7 @@ func (b *Bundler) cleanupImages(compose *DockerCompose) error {
 		})
 		if err != nil {
 			// Log but don't fail the entire operation
-			fmt.Printf("Warning: failed to remove image %s: %v\n", imageName, err)
+			b.warnf("failed to remove image %s: %v", imageName, err)
 		}
 	}
 
@@ -261,6 +774,10 @@ func (b *Bundler) cleanupImages(compose *DockerCompose) error {
 }
 
 func (b *Bundler) cleanupFreshlyPulledImages() error {
+	if b.shared != nil {
+		b.shared.keep(b.freshlyPulledImages, nil)
+		return nil
+	}
 	for imageName := range b.freshlyPulledImages {
 		fmt.Printf("Removing freshly pulled image %s...\n", imageName)
 		_, err := b.client.ImageRemove(b.ctx, imageName, image.RemoveOptions{
@@ -268,32 +785,16 @@ func (b *Bundler) cleanupFreshlyPulledImages() error {
 			PruneChildren: true,
 		})
 		if err != nil {
-			fmt.Printf("Warning: failed to remove freshly pulled image %s: %v\n", imageName, err)
+			b.warnf("failed to remove freshly pulled image %s: %v", imageName, err)
 		}
+		delete(b.freshlyPulledImages, imageName)
 	}
 	return nil
 }
 
-func parseBuildConfig(build interface{}) (*BuildConfig, error) {
-	switch v := build.(type) {
-	case string:
-		return &BuildConfig{Context: v}, nil
-	case map[string]interface{}:
-		data, err := yaml.Marshal(v)
-		if err != nil {
-			return nil, err
-		}
-		var config BuildConfig
-		if err := yaml.Unmarshal(data, &config); err != nil {
-			return nil, err
-		}
-		return &config, nil
-	default:
-		return nil, fmt.Errorf("invalid build configuration type")
-	}
-}
+func (b *Bundler) buildImage(config *BuildConfig, baseDir, imageName, platform string) (err error) {
+	defer b.span("build", attribute.String("image", imageName))(&err)
 
-func (b *Bundler) buildImage(config *BuildConfig, baseDir, imageName string) error {
 	buildContext := config.Context
 	if !filepath.IsAbs(buildContext) {
 		buildContext = filepath.Join(baseDir, buildContext)
@@ -303,6 +804,15 @@ func (b *Bundler) buildImage(config *BuildConfig, baseDir, imageName string) err
 	if dockerfile == "" {
 		dockerfile = "Dockerfile"
 	}
+	if filepath.IsAbs(dockerfile) {
+		// The daemon expects the Dockerfile path relative to the context
+		rel, err := filepath.Rel(buildContext, dockerfile)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("dockerfile %s is outside of the build context %s", dockerfile, buildContext)
+		}
+		dockerfile = rel
+	}
+	dockerfile = filepath.ToSlash(dockerfile)
 
 	fmt.Printf("Building image %s from %s...\n", imageName, buildContext)
 
@@ -313,18 +823,43 @@ func (b *Bundler) buildImage(config *BuildConfig, baseDir, imageName string) err
 	}
 	defer buildContextTar.Close()
 
-	// Convert BuildArgs from map[string]string to map[string]*string
+	// Args without a value are taken from the environment, like compose does
 	buildArgs := make(map[string]*string)
-	for k, v := range config.Args {
-		value := v // Create a copy to avoid pointer to loop variable
-		buildArgs[k] = &value
+	for _, arg := range config.Args.Vars {
+		if arg.Value != nil {
+			buildArgs[arg.Name] = arg.Value
+		} else if value, ok := os.LookupEnv(arg.Name); ok {
+			buildArgs[arg.Name] = &value
+		}
 	}
 
+	// Bundle-wide annotations mark every artifact, they win over the service's labels
+	labels := config.Labels.Map()
+	maps.Copy(labels, b.annotations)
+
 	buildOptions := build.ImageBuildOptions{
 		Dockerfile: dockerfile,
 		Tags:       []string{imageName},
 		Remove:     true,
 		BuildArgs:  buildArgs,
+		Target:     config.Target,
+		Labels:     labels,
+		Platform:   platform,
+	}
+
+	// Secrets need BuildKit, which fetches them from a session instead of the build args
+	secrets, secretIDs, err := b.secretsForBuild(config)
+	if err != nil {
+		return err
+	}
+	if len(secrets) > 0 {
+		sessionID, stop, err := b.startBuildSession(secrets)
+		if err != nil {
+			return err
+		}
+		defer stop()
+		buildOptions.Version = build.BuilderBuildKit
+		buildOptions.SessionID = sessionID
 	}
 
 	resp, err := b.client.ImageBuild(b.ctx, buildContextTar, buildOptions)
@@ -334,40 +869,38 @@ func (b *Bundler) buildImage(config *BuildConfig, baseDir, imageName string) err
 	defer resp.Body.Close()
 
 	// Read build output
-	decoder := json.NewDecoder(resp.Body)
-	for {
-		var msg struct {
-			Stream string `json:"stream"`
-			Error  string `json:"error"`
-		}
-		if err := decoder.Decode(&msg); err != nil {
-			if err == io.EOF {
-				break
-			}
-			return err
-		}
-		if msg.Error != "" {
-			return fmt.Errorf("build error: %s", msg.Error)
-		}
+	result, err := readJSONStream(resp.Body, func(msg *streamMessage) {
 		if msg.Stream != "" {
 			fmt.Print(msg.Stream)
 		}
+	})
+	if err != nil {
+		return fmt.Errorf("build error: %w", err)
+	}
+	if result.Skipped > 0 {
+		fmt.Printf("Skipped %d build output message(s) larger than %s\n", result.Skipped, formatBytes(maxStreamMessage))
+	}
+	// The tag may have moved if another build used the same name meanwhile
+	if result.ImageID != "" {
+		inspect, err := b.client.ImageInspect(b.ctx, imageName)
+		if err != nil {
+			return fmt.Errorf("failed to inspect built image %s: %w", imageName, err)
+		}
+		if inspect.ID != result.ImageID {
+			return fmt.Errorf("built image %s is %s, but the tag points to %s", imageName, shortID(result.ImageID), shortID(inspect.ID))
+		}
+		b.decidef("Built image %s (%s)", imageName, shortID(result.ImageID))
 	}
 
-	return nil
+	return b.recordBuild(imageName, filepath.Join(buildContext, filepath.FromSlash(dockerfile)), dockerfile, config, buildArgs, secretIDs)
 }
 
 func (b *Bundler) pullImageIfNotExists(imageName string) error {
-	// Check if image exists locally
-	_, err := b.client.ImageInspect(b.ctx, imageName)
-	if err == nil {
-		fmt.Printf("Image %s already exists locally\n", imageName)
-		return nil
-	}
-
-	fmt.Printf("Pulling image %s...\n", imageName)
+	return b.pullImageWithPolicy(imageName, pullPolicyMissing, b.opts.Platform)
+}
 
-	reader, err := b.client.ImagePull(b.ctx, imageName, image.PullOptions{})
+func (b *Bundler) pullImage(imageName, platform string) error {
+	reader, err := b.client.ImagePull(b.ctx, imageName, image.PullOptions{Platform: platform})
 	if err != nil {
 		return err
 	}
@@ -377,30 +910,31 @@ func (b *Bundler) pullImageIfNotExists(imageName string) error {
 	b.freshlyPulledImages[imageName] = true
 
 	// Read pull output
-	decoder := json.NewDecoder(reader)
-	for {
-		var msg struct {
-			Status string `json:"status"`
-			Error  string `json:"error"`
-		}
-		if err := decoder.Decode(&msg); err != nil {
-			if err == io.EOF {
-				break
-			}
-			return err
-		}
-		if msg.Error != "" {
-			return fmt.Errorf("pull error: %s", msg.Error)
-		}
+	progress := newStreamProgress("pulling", imageName)
+	result, err := readJSONStream(reader, progress.update)
+	if err != nil {
+		return fmt.Errorf("pull error: %w", err)
+	}
+	if result.Digest != "" {
+		fmt.Printf("Pulled %s (%s)\n", imageName, result.Digest)
 	}
-
 	return nil
 }
 
-func (b *Bundler) saveImage(imageName, outputPath string) error {
+// saveImage saves an image together with the given aliases into one tar file
+func (b *Bundler) saveImage(imageName string, aliases []string, outputPath string) (err error) {
+	defer b.span("save", attribute.String("image", imageName))(&err)
+
 	fmt.Printf("Saving image %s to %s...\n", imageName, outputPath)
+	if len(aliases) > 0 {
+		fmt.Printf("  with aliases %s\n", strings.Join(aliases, ", "))
+	}
 
-	reader, err := b.client.ImageSave(b.ctx, []string{imageName})
+	platforms, err := b.savePlatforms(imageName)
+	if err != nil {
+		return err
+	}
+	reader, err := b.client.ImageSave(b.ctx, append([]string{imageName}, aliases...), platforms...)
 	if err != nil {
 		return err
 	}
@@ -412,45 +946,206 @@ func (b *Bundler) saveImage(imageName, outputPath string) error {
 	}
 	defer file.Close()
 
-	_, err = io.Copy(file, reader)
-	return err
+	if _, err := io.Copy(file, reader); err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if b.opts.SaveCompat != "" {
+		if err := convertImageTar(outputPath, b.opts.SaveCompat); err != nil {
+			return fmt.Errorf("failed to convert %s to the %s format: %w", imageName, b.opts.SaveCompat, err)
+		}
+	}
+	return nil
 }
 
-func (b *Bundler) updateComposeForBundle(compose *DockerCompose, imageMap map[string]string) {
-	// Update services to use local tar files
-	for _, service := range compose.Services {
-		if service.Image != "" && imageMap[service.Image] != "" {
-			// The image will be loaded from tar, so we keep the original image name
-			// The load script will handle loading the images
+// transformCompose rewrites compose for the bundle with
+// composetransform.TransformNode, images are the images built or pulled for
+// the services by service name
+func (b *Bundler) transformCompose(compose *DockerCompose, bundleName, bundleVersion, baseDir string, images map[string]string, usedEnvFiles []string) (*composetransform.Result, error) {
+	var root yaml.Node
+	if err := root.Encode(compose); err != nil {
+		return nil, err
+	}
+	var unbundled []string
+	for _, missing := range b.missingImages {
+		unbundled = append(unbundled, missing.Service)
+	}
+	result, err := composetransform.TransformNode(&root, composetransform.Options{
+		Name:         bundleName,
+		Version:      bundleVersion,
+		RetagPrefix:  b.opts.RetagPrefix,
+		Images:       images,
+		Unbundled:    unbundled,
+		KeepDevelop:  b.opts.KeepDevelop,
+		BaseDir:      baseDir,
+		Modernize:    b.opts.Modernize,
+		Extensions:   b.opts.Extensions,
+		UsedEnvFiles: usedEnvFiles,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to rewrite compose file: %w", err)
+	}
+
+	var transformed DockerCompose
+	if err := root.Decode(&transformed); err != nil {
+		return nil, fmt.Errorf("failed to rewrite compose file: %w", err)
+	}
+	transformed.sopsEncrypted = compose.sopsEncrypted
+	transformed.parameters = compose.parameters
+	transformed.extensions = compose.extensions
+	*compose = transformed
+
+	for _, change := range result.Changes {
+		fmt.Println(change)
+	}
+	b.recordDecisions(result.Changes...)
+	if b.opts.Modernize {
+		printModernizeReport(result.Modernized)
+		b.recordDecisions(result.Modernized...)
+	}
+	return result, nil
+}
+
+// bundledImages tags the images built or pulled for the services with the
+// names the bundled compose file uses, if they differ, and returns the
+// saved tar file names of the bundled images
+func (b *Bundler) bundledImages(images, bundled map[string]string) (map[string]string, error) {
+	imageMap := make(map[string]string)
+	for _, serviceName := range slices.Sorted(maps.Keys(images)) {
+		imageName, bundledName := images[serviceName], bundled[serviceName]
+		if bundledName != imageName {
+			if err := b.retagImage(imageName, bundledName); err != nil {
+				return nil, fmt.Errorf("failed to retag image of service %s: %w", serviceName, err)
+			}
+			b.renameBuild(imageName, bundledName)
 		}
+		imageMap[bundledName] = fmt.Sprintf("%s.tar", sanitizeFilename(bundledName))
 	}
+	return imageMap, nil
 }
 
 func (b *Bundler) writeComposeFile(compose *DockerCompose, outputPath string) error {
-	data, err := yaml.Marshal(compose)
+	data, err := marshalCompose(compose)
 	if err != nil {
 		return err
 	}
+	if compose.sopsEncrypted {
+		if data, err = b.sopsEncrypt(data, sopsYAML, filepath.Base(outputPath)); err != nil {
+			return err
+		}
+	}
 
 	return os.WriteFile(outputPath, data, 0644)
 }
 
-func (b *Bundler) createLoadScript(tempDir string) error {
+func marshalCompose(compose *DockerCompose) ([]byte, error) {
+	var node yaml.Node
+	if err := node.Encode(compose); err != nil {
+		return nil, err
+	}
+	// Variables were already interpolated, keep compose on the target from expanding literal "$" again
+	escapeDollars(&node)
+	restoreExtensions(&node, compose.extensions)
+
+	return yaml.Marshal(&node)
+}
+
+func (b *Bundler) splitAndProtect(outputFile string) error {
+	files := []string{outputFile}
+	if b.opts.SplitSize != "" {
+		partSize, err := parseByteSize(b.opts.SplitSize)
+		if err != nil || partSize <= 0 {
+			return fmt.Errorf("invalid split size %q", b.opts.SplitSize)
+		}
+		if files, err = splitFile(outputFile, partSize); err != nil {
+			return fmt.Errorf("failed to split bundle: %w", err)
+		}
+		fmt.Printf("Split bundle into %d part(s), checksums in %s.sha256\n", len(files), outputFile)
+	}
+
+	if b.opts.Parity != "" {
+		percent, err := parsePercent(b.opts.Parity)
+		if err != nil {
+			return err
+		}
+		if err := createParity(outputFile, files, percent); err != nil {
+			return fmt.Errorf("failed to create parity files: %w", err)
+		}
+	}
+	return nil
+}
+
+// dryRun reports whether images are only planned, not built, pulled or saved
+func (b *Bundler) dryRun() bool {
+	return b.opts.ShowComposeDiff
+}
+
+// printComposeDiff applies the remaining compose transformations and prints
+// a unified diff between the parsed input and the compose file of the bundle
+func (b *Bundler) printComposeDiff(compose *DockerCompose, original []byte, composeFile, tempDir string, envFiles map[string]string) error {
+	if err := b.bundleEnvFiles(envFiles, filepath.Dir(composeFile), tempDir); err != nil {
+		return fmt.Errorf("failed to bundle env files: %w", err)
+	}
+	if b.opts.ExternalSecrets {
+		externalizeSecrets(compose)
+	}
+
+	output, err := marshalCompose(compose)
+	if err != nil {
+		return err
+	}
+
+	diff := unifiedDiff(composeFile, "bundle/docker-compose.yml", string(original), string(output))
+	if diff == "" {
+		fmt.Println("The bundled compose file is identical to the input")
+	}
+	fmt.Print(diff)
+	b.printLintReport()
+	return nil
+}
+
+func escapeDollars(node *yaml.Node) {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		node.Value = strings.ReplaceAll(node.Value, "$", "$$")
+	case yaml.MappingNode:
+		// Keys are not interpolated by compose
+		for i := 1; i < len(node.Content); i += 2 {
+			escapeDollars(node.Content[i])
+		}
+	default:
+		for _, child := range node.Content {
+			escapeDollars(child)
+		}
+	}
+}
+
+func (b *Bundler) createLoadScript(tempDir string, manifest *Manifest) error {
+	// The hint names the compose the host has, the plugin unless only the standalone binary is there
+	runArgs := " -p " + manifest.ProjectName + " up -d"
 	script := `#!/bin/bash
 set -e
 
-echo "Loading Docker images..."
+` + scriptMessages(b.catalogs, "script.loading_images", "script.loading_image", "script.images_loaded", "script.run_hint", "script.compose_installed") + `
+echo "$MSG_LOADING_IMAGES"
 
 # Load all images from the images directory
 for image in images/*.tar; do
     if [ -f "$image" ]; then
-        echo "Loading $image..."
+        printf "$MSG_LOADING_IMAGE\n" "$image"
         docker load -i "$image"
     fi
 done
 
-echo "All images loaded successfully!"
-echo "You can now run: docker-compose up -d"
+echo "$MSG_IMAGES_LOADED"
+` + composePluginInstaller(manifest.ComposePlugins) + `
+COMPOSE="docker compose"
+if ! docker compose version >/dev/null 2>&1 && command -v docker-compose >/dev/null 2>&1; then
+    COMPOSE="docker-compose"
+fi
+printf "$MSG_RUN_HINT\n" "$COMPOSE` + runArgs + `"
 `
 
 	scriptPath := filepath.Join(tempDir, "load-images.sh")
@@ -458,69 +1153,96 @@ echo "You can now run: docker-compose up -d"
 		return err
 	}
 
-	// Also create a Windows batch script
+	// Also create a Windows batch script, in the first language as Windows has no locale variables
+	c := englishCatalog
+	codePage := ""
+	if len(b.catalogs) > 0 {
+		c = b.catalogs[0]
+		codePage = "chcp 65001 >nul\n"
+	}
 	batScript := `@echo off
-echo Loading Docker images...
+` + codePage + `echo ` + batchEcho(c.t("script.loading_images")) + `
 
 for %%f in (images\*.tar) do (
-    echo Loading %%f...
+    echo ` + strings.ReplaceAll(batchEcho(c.t("script.loading_image", "\x00")), "\x00", "%%f") + `
     docker load -i "%%f"
 )
 
-echo All images loaded successfully!
-echo You can now run: docker-compose up -d
+echo ` + batchEcho(c.t("script.images_loaded")) + `
+set "COMPOSE=docker compose"
+docker compose version >nul 2>&1 || (where docker-compose >nul 2>&1 && set "COMPOSE=docker-compose")
+echo ` + strings.ReplaceAll(batchEcho(c.t("script.run_hint", "\x00"+runArgs)), "\x00", "%COMPOSE%") + `
 `
 
 	batPath := filepath.Join(tempDir, "load-images.bat")
 	return os.WriteFile(batPath, []byte(batScript), 0755)
 }
 
-func (b *Bundler) createReadme(tempDir string) error {
-	readme := `# Docker Compose Bundle
-
-This bundle contains a Docker Compose stack with all required images for offline deployment.
-
-## Contents
-
-- docker-compose.yml - The Docker Compose configuration
-- images/ - Directory containing all Docker images as tar files
-- load-images.sh - Script to load all images (Linux/Mac)
-- load-images.bat - Script to load all images (Windows)
-
-## Usage
-
-1. Extract this bundle to your desired location
-2. Load the Docker images:
-   - On Linux/Mac: ./load-images.sh
-   - On Windows: load-images.bat
-3. Start the stack: docker-compose up -d
+// createReadme writes README.md and a README.<lang>.md for every --lang
+func (b *Bundler) createReadme(tempDir string, manifest *Manifest, sections []func(*catalog) string) error {
+	var translations []string
+	for _, c := range b.catalogs {
+		translations = append(translations, "README."+c.lang+".md")
+	}
 
-## Requirements
+	for _, c := range append([]*catalog{englishCatalog}, b.catalogs...) {
+		readme := c.t("readme.body", manifest.ProjectName)
+		if len(manifest.MissingImages) > 0 {
+			readme = partialSection(c, manifest.MissingImages) + "\n" + readme
+		}
+		if len(translations) > 0 {
+			readme += "\n" + c.t("readme.translations", strings.Join(append([]string{"README.md"}, translations...), ", "))
+		}
+		for _, section := range sections {
+			readme += "\n" + section(c)
+		}
 
-- Docker Engine installed
-- Docker Compose installed
+		name := "README.md"
+		if c != englishCatalog {
+			name = "README." + c.lang + ".md"
+		}
+		if err := os.WriteFile(filepath.Join(tempDir, name), []byte(readme), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-Note: No internet connection is required after extracting this bundle.
-`
+// bundleMetadataFiles are stored at the start of the archive in this order
+var bundleMetadataFiles = []string{"manifest.json", "index.json", "docker-compose.yml"}
 
-	readmePath := filepath.Join(tempDir, "README.md")
-	return os.WriteFile(readmePath, []byte(readme), 0644)
+// archiveFormat returns the format of the bundle written to outputFile:
+// --archive-format, otherwise derived from the file name
+func (b *Bundler) archiveFormat(outputFile string) string {
+	if b.opts.ArchiveFormat != "" {
+		return b.opts.ArchiveFormat
+	}
+	return archiveFormatOf(outputFile)
 }
 
-func (b *Bundler) createTarGz(sourceDir, outputFile string) error {
+// createArchive packs sourceDir into a bundle archive of the given format
+func (b *Bundler) createArchive(sourceDir, outputFile, format string) (err error) {
+	defer b.span("archive", attribute.String("output", outputFile), attribute.String("format", format))(&err)
+
 	file, err := os.Create(outputFile)
 	if err != nil {
 		return err
 	}
 	defer file.Close()
 
-	gzWriter := gzip.NewWriter(file)
-	defer gzWriter.Close()
+	writer, err := newArchiveWriter(file, format)
+	if err != nil {
+		return err
+	}
 
-	tarWriter := tar.NewWriter(gzWriter)
-	defer tarWriter.Close()
+	// The metadata comes first, so it can be read without decompressing the images
+	for _, name := range bundleMetadataFiles {
+		if err := addArchiveFile(writer, name, filepath.Join(sourceDir, name)); err != nil {
+			return err
+		}
+	}
 
-	return filepath.Walk(sourceDir, func(path string, info os.FileInfo, err error) error {
+	err = filepath.Walk(sourceDir, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
@@ -530,35 +1252,44 @@ func (b *Bundler) createTarGz(sourceDir, outputFile string) error {
 			return err
 		}
 
-		// Skip the source directory itself
-		if relPath == "." {
+		// Skip the source directory itself and the metadata written above
+		if relPath == "." || slices.Contains(bundleMetadataFiles, filepath.ToSlash(relPath)) {
 			return nil
 		}
-
-		header, err := tar.FileInfoHeader(info, "")
-		if err != nil {
-			return err
+		if !info.IsDir() && !info.Mode().IsRegular() {
+			return nil
 		}
 
-		header.Name = filepath.ToSlash(relPath)
-
-		if err := tarWriter.WriteHeader(header); err != nil {
-			return err
-		}
+		// Archive paths always use forward slashes, and the modes must not
+		// depend on the host: Windows does not keep the executable bit
+		return addArchiveFile(writer, relPath, path)
+	})
+	if err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	return file.Close()
+}
 
-		if !info.IsDir() {
-			file, err := os.Open(path)
-			if err != nil {
-				return err
-			}
-			defer file.Close()
+// writeTarEntry writes header and, for regular files, the content of path
+func writeTarEntry(tarWriter *tar.Writer, header *tar.Header, path string, info os.FileInfo) error {
+	if err := tarWriter.WriteHeader(header); err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return nil
+	}
 
-			_, err = io.Copy(tarWriter, file)
-			return err
-		}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
 
-		return nil
-	})
+	_, err = io.Copy(tarWriter, file)
+	return err
 }
 
 func createBuildContextTar(contextPath string) (io.ReadCloser, error) {
@@ -566,10 +1297,8 @@ func createBuildContextTar(contextPath string) (io.ReadCloser, error) {
 
 	go func() {
 		tarWriter := tar.NewWriter(writer)
-		defer writer.Close()
-		defer tarWriter.Close()
 
-		filepath.Walk(contextPath, func(path string, info os.FileInfo, err error) error {
+		err := filepath.Walk(contextPath, func(path string, info os.FileInfo, err error) error {
 			if err != nil {
 				return err
 			}
@@ -578,36 +1307,38 @@ func createBuildContextTar(contextPath string) (io.ReadCloser, error) {
 			if err != nil {
 				return err
 			}
+			if relPath == "." {
+				return nil
+			}
 
-			// Skip .git directory and other common ignore patterns
-			if strings.HasPrefix(relPath, ".git") {
+			// Skip the .git directory
+			if info.IsDir() && filepath.Base(relPath) == ".git" {
 				return filepath.SkipDir
 			}
 
-			header, err := tar.FileInfoHeader(info, "")
+			link := ""
+			if info.Mode()&os.ModeSymlink != 0 {
+				if link, err = os.Readlink(path); err != nil {
+					return err
+				}
+			}
+			header, err := tar.FileInfoHeader(info, filepath.ToSlash(link))
 			if err != nil {
 				return err
 			}
 
 			header.Name = filepath.ToSlash(relPath)
-
-			if err := tarWriter.WriteHeader(header); err != nil {
-				return err
+			if runtime.GOOS == "windows" {
+				// Like the docker CLI, Windows has no executable bit to preserve
+				header.Mode = 0755
 			}
 
-			if !info.IsDir() {
-				file, err := os.Open(path)
-				if err != nil {
-					return err
-				}
-				defer file.Close()
-
-				_, err = io.Copy(tarWriter, file)
-				return err
-			}
-
-			return nil
+			return writeTarEntry(tarWriter, header, path, info)
 		})
+		if err == nil {
+			err = tarWriter.Close()
+		}
+		writer.CloseWithError(err)
 	}()
 
 	return reader, nil
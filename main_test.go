@@ -0,0 +1,264 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+
+	"docker-compose-bundler/composetransform"
+	"docker-compose-bundler/dockerclient"
+
+	"gopkg.in/yaml.v3"
+)
+
+// writeCompose writes a compose file to a new directory and returns its path
+func writeCompose(t *testing.T, content string) string {
+	t.Helper()
+	composeFile := filepath.Join(t.TempDir(), "docker-compose.yml")
+	if err := os.WriteFile(composeFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return composeFile
+}
+
+// bundleWith bundles the compose file with the fake and returns the archive
+func bundleWith(t *testing.T, fake *dockerclient.Fake, opts Options, composeFile string) string {
+	t.Helper()
+	if opts.VersionScheme == "" {
+		opts.VersionScheme = VersionSchemeSemver
+	}
+	outputFile := filepath.Join(t.TempDir(), "bundle.tar.gz")
+	if err := NewBundlerWithClient(opts, fake).Bundle(composeFile, outputFile); err != nil {
+		t.Fatalf("Bundle: %v", err)
+	}
+	return outputFile
+}
+
+const webCompose = `services:
+  web:
+    image: nginx:1.27
+    command: ["nginx", "-g", "daemon off;"]
+  cache:
+    image: redis:7
+    command: ["redis-server"]
+x-bundle:
+  name: shop
+  version: 1.2.0
+`
+
+func TestBundleWritesManifest(t *testing.T) {
+	fake := dockerclient.NewFake()
+	web := fake.AddImage("nginx:1.27")
+	fake.AddImage("redis:7")
+
+	outputFile := bundleWith(t, fake, Options{}, writeCompose(t, webCompose))
+	manifest, compose, err := readBundleMetadata(outputFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.Name != "shop" || manifest.Version != "1.2.0" {
+		t.Errorf("manifest is %s %s, want shop 1.2.0", manifest.Name, manifest.Version)
+	}
+	var names []string
+	for _, img := range manifest.Images {
+		names = append(names, img.Name)
+		if img.SHA256 == "" || img.Size == 0 {
+			t.Errorf("image %s has no checksum or size", img.Name)
+		}
+		if img.Name == "nginx:1.27" && img.ID != web.ID {
+			t.Errorf("nginx:1.27 has ID %s, want %s", img.ID, web.ID)
+		}
+	}
+	slices.Sort(names)
+	if !slices.Equal(names, []string{"nginx:1.27", "redis:7"}) {
+		t.Errorf("bundled images %v, want nginx:1.27 and redis:7", names)
+	}
+	if compose.Services["web"].Image != "nginx:1.27" {
+		t.Errorf("bundled web image is %q", compose.Services["web"].Image)
+	}
+	if len(fake.Pulled) != 0 {
+		t.Errorf("pulled %v although the images are present", fake.Pulled)
+	}
+}
+
+func TestBundlePullsMissingImages(t *testing.T) {
+	fake := dockerclient.NewFake()
+	fake.AddImage("nginx:1.27")
+
+	bundleWith(t, fake, Options{}, writeCompose(t, webCompose))
+	if !slices.Equal(fake.Pulled, []string{"redis:7"}) {
+		t.Errorf("pulled %v, want redis:7", fake.Pulled)
+	}
+}
+
+func TestBundleFailsOnPullError(t *testing.T) {
+	fake := dockerclient.NewFake()
+	fake.AddImage("nginx:1.27")
+	fake.PullErrors["redis:7"] = errors.New("manifest unknown")
+
+	outputFile := filepath.Join(t.TempDir(), "bundle.tar.gz")
+	err := NewBundlerWithClient(Options{VersionScheme: VersionSchemeSemver}, fake).Bundle(writeCompose(t, webCompose), outputFile)
+	if err == nil {
+		t.Fatal("Bundle succeeded although redis:7 cannot be pulled")
+	}
+	if _, statErr := os.Stat(outputFile); !os.IsNotExist(statErr) {
+		t.Errorf("a failed bundle left %s behind", outputFile)
+	}
+}
+
+// The bundle's compose file is the one composetransform writes for the same
+// input, with the bundler's build results and flags as options
+func TestBundleComposeMatchesTransform(t *testing.T) {
+	input := `services:
+  app:
+    build: ./app
+    dockerfile: Dockerfile.prod
+    pull_policy: build
+    env_file: ./app.env
+    environment: [MODE=production]
+    command: ["/app", "--port", "8080"]
+    develop:
+      watch: [{action: sync, path: ./app/src, target: /app/src}]
+    volumes: ["./app/src:/app/src", "data:/data"]
+    links: [cache:redis]
+  cache:
+    image: redis:7
+    pull_policy: always
+    log_driver: json-file
+    x-monitoring: {port: 9121}
+volumes:
+  data:
+x-bundle:
+  name: shop
+  version: 1.2.0
+`
+	composeFile := writeCompose(t, input)
+	baseDir := filepath.Dir(composeFile)
+	if err := os.MkdirAll(filepath.Join(baseDir, "app", "src"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string]string{"app/Dockerfile.prod": "FROM alpine:3.20\n", "app.env": "LOG_LEVEL=info\n"} {
+		if err := os.WriteFile(filepath.Join(baseDir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fake := dockerclient.NewFake()
+	fake.AddImage("redis:7")
+	// An earlier run left the bundle tag on other content
+	fake.AddImage("bundles/shop/app:1.2.0", "bundles/shop/app:old")
+	opts := Options{RetagPrefix: "customer-x", Modernize: true, TagConflict: TagConflictSuffix}
+	dir := filepath.Join(t.TempDir(), "bundle")
+	if err := extractBundle(bundleWith(t, fake, opts, composeFile), dir); err != nil {
+		t.Fatal(err)
+	}
+	bundled, err := os.ReadFile(filepath.Join(dir, "docker-compose.yml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var suffixed string
+	for _, img := range fake.Images {
+		for _, tag := range img.Tags {
+			if strings.HasPrefix(tag, "bundles/shop/app:1.2.0-") {
+				suffixed = tag
+			}
+		}
+	}
+	if suffixed == "" {
+		t.Fatal("the build was not tagged with a suffix")
+	}
+	want, err := composetransform.Transform([]byte(input), composetransform.Options{
+		RetagPrefix: opts.RetagPrefix,
+		Images:      map[string]string{"app": suffixed},
+		BaseDir:     baseDir,
+		Modernize:   true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got, expected map[string]interface{}
+	if err := yaml.Unmarshal(bundled, &got); err != nil {
+		t.Fatal(err)
+	}
+	if err := yaml.Unmarshal(want.Compose, &expected); err != nil {
+		t.Fatal(err)
+	}
+	// The bundler writes env_file in list syntax
+	expectedApp := expected["services"].(map[string]interface{})["app"].(map[string]interface{})
+	expectedApp["env_file"] = []interface{}{expectedApp["env_file"]}
+	if !reflect.DeepEqual(got["services"], expected["services"]) {
+		t.Errorf("bundled services\n%s\nwant\n%s", bundled, want.Compose)
+	}
+	if app := got["services"].(map[string]interface{})["app"].(map[string]interface{}); app["image"] != "customer-x/shop/app:1.2.0-"+strings.TrimPrefix(suffixed, "bundles/shop/app:1.2.0-") {
+		t.Errorf("app is bundled as %v", app["image"])
+	}
+	if _, err := os.Stat(filepath.Join(dir, "env", "app.env")); err != nil {
+		t.Errorf("env file is not bundled: %v", err)
+	}
+}
+
+func TestLoadScriptNamesInstalledCompose(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("load-images.sh needs a POSIX shell")
+	}
+	bash, err := exec.LookPath("bash")
+	if err != nil {
+		t.Skip("bash is not installed")
+	}
+	dir := filepath.Join(t.TempDir(), "shop")
+	if err := extractBundle(shopBundle(t, Options{}), dir); err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := readManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name       string
+		plugin     bool
+		standalone bool
+		want       string
+	}{
+		{"plugin", true, false, "docker compose"},
+		{"plugin and standalone", true, true, "docker compose"},
+		{"standalone only", false, true, "docker-compose"},
+		{"no compose", false, false, "docker compose"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			bin := t.TempDir()
+			pluginExit := 1
+			if test.plugin {
+				pluginExit = 0
+			}
+			fake := fmt.Sprintf("#!/bin/sh\n[ \"$1\" = compose ] && exit %d\nexit 0\n", pluginExit)
+			if err := os.WriteFile(filepath.Join(bin, "docker"), []byte(fake), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if test.standalone {
+				if err := os.WriteFile(filepath.Join(bin, "docker-compose"), []byte("#!/bin/sh\n"), 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			cmd := exec.Command(bash, "load-images.sh")
+			cmd.Dir = dir
+			cmd.Env = []string{"PATH=" + bin, "LANG=C"}
+			output, err := cmd.CombinedOutput()
+			if err != nil {
+				t.Fatalf("load-images.sh failed: %v\n%s", err, output)
+			}
+			if want := test.want + " -p " + manifest.ProjectName + " up -d"; !strings.Contains(string(output), want) {
+				t.Errorf("the hint does not name %q:\n%s", want, output)
+			}
+		})
+	}
+}
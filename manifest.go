@@ -0,0 +1,193 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"docker-compose-bundler/bundlefile"
+
+	"github.com/docker/docker/api/types/image"
+)
+
+// manifestSchemaVersion is bumped whenever the manifest layout changes incompatibly
+const manifestSchemaVersion = 1
+
+// Manifest describes the bundle contents, stored as manifest.json in the
+// archive root. The fields tooling reads are the ones of bundlefile.Manifest.
+type Manifest struct {
+	bundlefile.Manifest
+	VersionScheme  string                   `json:"versionScheme"`
+	Lint           []string                 `json:"lint,omitempty"`
+	Capacity       *CapacityEstimate        `json:"capacity,omitempty"`
+	Encrypted      []string                 `json:"encrypted,omitempty"` // SOPS-encrypted files to decrypt on the target
+	Values         *ManifestValues          `json:"values,omitempty"`    // Values file the parameters were taken from
+	Sets           []string                 `json:"sets,omitempty"`      // --set overrides applied
+	Engine         *EngineRequirement       `json:"engine,omitempty"`
+	Licenses       []LicenseAcknowledgement `json:"licenses,omitempty"`       // Images redistributed under acknowledged terms
+	Builds         []BuildRecord            `json:"builds,omitempty"`         // Reproducibility inputs of built images
+	Host           *HostRequirements        `json:"host,omitempty"`           // x-bundle.host, checked by the loader
+	BasePack       *BasePackRef             `json:"basePack,omitempty"`       // Bundle that has to be loaded first, see --base-pack
+	Expiry         *BundleExpiry            `json:"expiry,omitempty"`         // x-bundle.expires, checked by the loader
+	Bundler        *ManifestBundler         `json:"bundler,omitempty"`        // Bundler that wrote the bundle and its embedded loaders
+	MissingImages  []MissingImage           `json:"missingImages,omitempty"`  // Images a partial bundle lacks, see --allow-partial
+	ComposePlugins []ManifestComposePlugin  `json:"composePlugins,omitempty"` // Installed on targets without compose, see --compose-plugin
+	Files          []ManifestFile           `json:"files,omitempty"`          // Checksums of the members not listed above besides manifest.json
+}
+
+// ManifestFile is a member of the bundle with its checksum
+type ManifestFile struct {
+	File   string `json:"file"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// ManifestValues identifies the values file a bundle was built with
+type ManifestValues struct {
+	File   string `json:"file"`
+	SHA256 string `json:"sha256"`
+}
+
+// ManifestImage is a saved image inside the bundle
+type ManifestImage = bundlefile.Image
+
+func newManifest(xBundle *XBundle, versionScheme string) *Manifest {
+	return &Manifest{
+		Manifest: bundlefile.Manifest{
+			SchemaVersion: manifestSchemaVersion,
+			Name:          xBundle.Name,
+			Version:       xBundle.Version,
+			CreatedAt:     time.Now().UTC(),
+			Images:        []ManifestImage{},
+		},
+		VersionScheme: versionScheme,
+	}
+}
+
+// addImage records a saved image, hashing the file at bundleDir/file
+func (m *Manifest) addImage(imageName string, inspect image.InspectResponse, aliases []string, bundleDir, file string) error {
+	size, digest, err := fileDigest(filepath.Join(bundleDir, file))
+	if err != nil {
+		return err
+	}
+	format, err := imageTarFormat(filepath.Join(bundleDir, file))
+	if err != nil {
+		return err
+	}
+	layers, err := imageTarLayers(filepath.Join(bundleDir, file))
+	if err != nil {
+		return err
+	}
+	m.Images = append(m.Images, ManifestImage{
+		Name:    imageName,
+		ID:      inspect.ID,
+		File:    filepath.ToSlash(file),
+		Size:    size,
+		SHA256:  digest,
+		Aliases: aliases,
+		Parent:  inspect.Parent,
+		Format:  format,
+		Layers:  layers,
+	})
+	return nil
+}
+
+// checksummedFiles returns the members whose checksums the manifest records
+// elsewhere than in Files
+func (m *Manifest) checksummedFiles() map[string]bool {
+	files := make(map[string]bool)
+	for _, img := range m.Images {
+		files[img.File] = true
+	}
+	if m.Bundler != nil {
+		for _, loader := range m.Bundler.Loaders {
+			files[loader.File] = true
+		}
+	}
+	for _, plugin := range m.ComposePlugins {
+		files[plugin.File] = true
+	}
+	return files
+}
+
+// recordFiles records the checksums of the files in bundleDir the manifest
+// does not cover yet and writes it, after all other files are final
+func (m *Manifest) recordFiles(bundleDir string) error {
+	checksummed := m.checksummedFiles()
+	m.Files = nil
+	err := filepath.WalkDir(bundleDir, func(path string, d os.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(bundleDir, path)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if name == "manifest.json" || checksummed[name] {
+			return nil
+		}
+		size, digest, err := fileDigest(path)
+		if err != nil {
+			return err
+		}
+		m.Files = append(m.Files, ManifestFile{File: name, Size: size, SHA256: digest})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return m.write(bundleDir)
+}
+
+// setFile records the checksum of data as member name if the manifest
+// lists files, bundles of older versions do not
+func (m *Manifest) setFile(name string, data []byte) {
+	if len(m.Files) == 0 {
+		return
+	}
+	sum := sha256.Sum256(data)
+	file := ManifestFile{File: name, Size: int64(len(data)), SHA256: hex.EncodeToString(sum[:])}
+	if i := slices.IndexFunc(m.Files, func(f ManifestFile) bool { return f.File == name }); i >= 0 {
+		m.Files[i] = file
+	} else {
+		m.Files = append(m.Files, file)
+	}
+}
+
+func (m *Manifest) write(bundleDir string) error {
+	data, err := m.marshal()
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(bundleDir, "manifest.json"), data, 0644)
+}
+
+func (m *Manifest) marshal() ([]byte, error) {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+// fileDigest returns the size and hex encoded sha256 of a file
+func fileDigest(path string) (int64, string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return 0, "", err
+	}
+	return size, hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+)
+
+// Output formats of --output-format, besides the plain archive
+const (
+	OutputFormatArchive = "archive"
+	OutputFormatISO     = "iso"
+	OutputFormatImage   = "img"
+)
+
+// mediaLoaderPrefix names the loader binaries on the medium, followed by -<os>-<arch>
+const mediaLoaderPrefix = "docker-compose-bundler-"
+
+func parseOutputFormat(value string) (string, error) {
+	switch strings.ToLower(value) {
+	case "", OutputFormatArchive:
+		return OutputFormatArchive, nil
+	case OutputFormatISO:
+		return OutputFormatISO, nil
+	case OutputFormatImage, "raw":
+		return OutputFormatImage, nil
+	}
+	return "", fmt.Errorf("invalid output format %q, use archive, iso or img", value)
+}
+
+// writeMedia wraps the bundle, its parts, checksums and parity files, the
+// loader binaries and an install README into a disc image (iso) or a raw
+// USB stick image (img) next to the bundle
+func (b *Bundler) writeMedia(outputFile string, manifest *Manifest) error {
+	format, err := parseOutputFormat(b.opts.OutputFormat)
+	if err != nil || format == OutputFormatArchive {
+		return err
+	}
+
+	imagePath := mediaImagePath(outputFile, format)
+	bundleName := filepath.Base(outputFile)
+	files, err := mediaBundleFiles(outputFile)
+	if err != nil {
+		return err
+	}
+	loaders, err := b.mediaLoaders()
+	if err != nil {
+		return err
+	}
+	files = append(files, loaders...)
+
+	label := manifest.Name
+	if manifest.Version != "" {
+		label += " " + manifest.Version
+	}
+	target := "/opt/" + manifest.ProjectName
+	files = append(files,
+		mediaText("README.txt", mediaReadme(label, bundleName, target, loaders), true),
+		mediaText("autorun.inf", fmt.Sprintf("[autorun]\nlabel=%s\nshellexecute=README.txt\n", label), true),
+		mediaText("install.sh", mediaInstallScript(bundleName, target), false),
+		mediaText("install.bat", mediaInstallBatch(bundleName, manifest.ProjectName), true),
+	)
+
+	out, err := os.Create(imagePath)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", imagePath, err)
+	}
+	write := writeISO
+	if format == OutputFormatImage {
+		write = writeFAT
+	}
+	err = write(out, label, files)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(imagePath)
+		return fmt.Errorf("failed to write %s: %w", imagePath, err)
+	}
+	fmt.Printf("Wrote %s image: %s\n", format, imagePath)
+	return nil
+}
+
+// mediaImagePath is the output file with the extension of the image format
+func mediaImagePath(outputFile, format string) string {
+	for _, ext := range []string{".tar.gz", ".tgz", ".tar.zst", ".tzst", ".zip"} {
+		if strings.HasSuffix(outputFile, ext) {
+			return strings.TrimSuffix(outputFile, ext) + "." + format
+		}
+	}
+	return outputFile + "." + format
+}
+
+// mediaBundleFiles returns the bundle or its parts with the checksum and
+// parity files, as splitAndProtect left them
+func mediaBundleFiles(outputFile string) ([]*mediaFile, error) {
+	paths, err := filepath.Glob(outputFile + ".[0-9][0-9][0-9]")
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		paths = []string{outputFile}
+	}
+	extras, err := filepath.Glob(outputFile + "*.par2")
+	if err != nil {
+		return nil, err
+	}
+	paths = append(paths, extras...)
+	if _, err := os.Stat(outputFile + ".sha256"); err == nil {
+		paths = append(paths, outputFile+".sha256")
+	}
+
+	var files []*mediaFile
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, &mediaFile{Name: filepath.Base(path), Source: path, Size: info.Size()})
+	}
+	return files, nil
+}
+
+// mediaLoaders returns the running binary and the --media-loader binaries,
+// which are named docker-compose-bundler-<os>-<arch> so install.sh finds them
+func (b *Bundler) mediaLoaders() ([]*mediaFile, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("failed to locate the loader binary: %w", err)
+	}
+	name := mediaLoaderPrefix + runtime.GOOS + "-" + runtime.GOARCH
+	if runtime.GOOS == "windows" {
+		name += ".exe"
+	}
+	sources := map[string]string{name: self}
+	for _, path := range b.opts.MediaLoaders {
+		sources[filepath.Base(path)] = path
+	}
+
+	var loaders []*mediaFile
+	for _, name := range slices.Sorted(maps.Keys(sources)) {
+		info, err := os.Stat(sources[name])
+		if err != nil {
+			return nil, fmt.Errorf("failed to add loader: %w", err)
+		}
+		loaders = append(loaders, &mediaFile{Name: "loader/" + name, Source: sources[name], Size: info.Size()})
+	}
+	return loaders, nil
+}
+
+// mediaText is a generated text file, with CRLF line endings for Windows
+func mediaText(name, text string, crlf bool) *mediaFile {
+	if crlf {
+		text = strings.ReplaceAll(text, "\n", "\r\n")
+	}
+	return &mediaFile{Name: name, Data: []byte(text), Size: int64(len(text))}
+}
+
+func mediaReadme(label, bundleName, target string, loaders []*mediaFile) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s\n%s\n\n", label, strings.Repeat("=", len(label)))
+	fmt.Fprintf(&sb, "This medium contains the Docker Compose bundle %s and the loader\n", bundleName)
+	sb.WriteString("to install it on a host without internet access.\n\n")
+	sb.WriteString("Linux:\n\n")
+	fmt.Fprintf(&sb, "    sh install.sh [directory]    (default %s)\n\n", target)
+	sb.WriteString("Windows:\n\n")
+	sb.WriteString("    install.bat [directory]\n\n")
+	sb.WriteString("The bundle is verified, extracted to the directory and its images are\n")
+	sb.WriteString("loaded into Docker. Then start the stack from that directory with:\n\n")
+	sb.WriteString("    docker-compose-bundler deploy\n\n")
+	sb.WriteString("Loaders on this medium:\n\n")
+	for _, loader := range loaders {
+		fmt.Fprintf(&sb, "    %s\n", loader.Name)
+	}
+	return sb.String()
+}
+
+// mediaInstallScript picks the loader of the host and loads the bundle from
+// the medium. Media are mounted without the executable bit, so the loader
+// is copied to a temporary file first.
+func mediaInstallScript(bundleName, target string) string {
+	return `#!/bin/sh
+set -e
+
+here=$(cd "$(dirname "$0")" && pwd)
+os=$(uname -s | tr '[:upper:]' '[:lower:]')
+case "$(uname -m)" in
+    x86_64|amd64) arch=amd64 ;;
+    aarch64|arm64) arch=arm64 ;;
+    armv7*|armv6*) arch=arm ;;
+    *) arch=$(uname -m) ;;
+esac
+loader="$here/loader/` + mediaLoaderPrefix + `$os-$arch"
+if [ ! -f "$loader" ]; then
+    echo "No loader for $os/$arch on this medium, see $here/loader" >&2
+    exit 1
+fi
+
+tmp=$(mktemp)
+trap 'rm -f "$tmp"' EXIT
+cp "$loader" "$tmp"
+chmod +x "$tmp"
+"$tmp" load --dir "${1:-` + target + `}" "$here/` + bundleName + `"
+`
+}
+
+func mediaInstallBatch(bundleName, projectName string) string {
+	return `@echo off
+set target=%~1
+if "%target%"=="" set target=%USERPROFILE%\` + projectName + `
+set loader=%~dp0loader\` + mediaLoaderPrefix + `windows-amd64.exe
+if not exist "%loader%" (
+    echo No Windows loader on this medium, see %~dp0loader
+    exit /b 1
+)
+"%loader%" load --dir "%target%" "%~dp0` + bundleName + `"
+`
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// bundleStats are collected while bundling and exported with --metrics-file
+// and --pushgateway
+type bundleStats struct {
+	Name        string
+	Version     string
+	CacheHits   int   // Images that were already present locally
+	Pulls       int   // Images pulled during the run
+	Images      int   // Images in the bundle
+	ImageBytes  int64 // Size of the saved image tars
+	BundleBytes int64 // Size of the compressed archive before splitting
+	PrunedBytes int64 // Content of other platforms left out of multi-platform images
+}
+
+// recordBundleStats captures the sizes of a written bundle
+func (b *Bundler) recordBundleStats(manifest *Manifest, outputFile string) {
+	b.stats.Name, b.stats.Version = manifest.Name, manifest.Version
+	b.stats.Images, b.stats.ImageBytes = len(manifest.Images), 0
+	for _, img := range manifest.Images {
+		b.stats.ImageBytes += img.Size
+	}
+	if info, err := os.Stat(outputFile); err == nil {
+		b.stats.BundleBytes = info.Size()
+	}
+}
+
+type metric struct {
+	name  string
+	help  string
+	value float64
+}
+
+// metrics returns the run as gauges, failed runs report the stats collected so far
+func (b *Bundler) metrics(duration time.Duration, runErr error) []metric {
+	failed, hitRatio := 0.0, 0.0
+	if runErr != nil {
+		failed = 1
+	}
+	if lookups := b.stats.CacheHits + b.stats.Pulls; lookups > 0 {
+		hitRatio = float64(b.stats.CacheHits) / float64(lookups)
+	}
+	return []metric{
+		{"duration_seconds", "Duration of the bundle run", duration.Seconds()},
+		{"failed", "1 if the bundle run failed", failed},
+		{"last_run_timestamp_seconds", "Unix time the bundle run finished", float64(time.Now().Unix())},
+		{"bundle_size_bytes", "Size of the compressed bundle", float64(b.stats.BundleBytes)},
+		{"images", "Number of images in the bundle", float64(b.stats.Images)},
+		{"images_size_bytes", "Size of the saved image tars", float64(b.stats.ImageBytes)},
+		{"pruned_platforms_bytes", "Content of other platforms left out of multi-platform images", float64(b.stats.PrunedBytes)},
+		{"images_built", "Images built during the run", float64(len(b.builds))},
+		{"images_pulled", "Images pulled during the run", float64(b.stats.Pulls)},
+		{"image_cache_hits", "Images that were already present locally", float64(b.stats.CacheHits)},
+		{"image_cache_hit_ratio", "Share of pulled service images that were already present locally", hitRatio},
+	}
+}
+
+// formatMetrics renders the metrics in the Prometheus text format, with the
+// bundle as labels unless they are part of the pushgateway grouping key
+func formatMetrics(metrics []metric, labels string) string {
+	var sb strings.Builder
+	for _, m := range metrics {
+		name := "docker_compose_bundler_" + m.name
+		fmt.Fprintf(&sb, "# HELP %s %s\n# TYPE %s gauge\n%s%s %s\n", name, m.help, name, name, labels, strconv.FormatFloat(m.value, 'f', -1, 64))
+	}
+	return sb.String()
+}
+
+// exportMetrics writes the OpenMetrics file and pushes to the pushgateway if configured
+func (b *Bundler) exportMetrics(duration time.Duration, runErr error) error {
+	if b.opts.MetricsFile == "" && b.opts.Pushgateway == "" {
+		return nil
+	}
+	metrics := b.metrics(duration, runErr)
+
+	if b.opts.MetricsFile != "" {
+		labels := fmt.Sprintf("{bundle=%q,version=%q}", b.stats.Name, b.stats.Version)
+		data := formatMetrics(metrics, labels) + "# EOF\n"
+		if err := os.WriteFile(b.opts.MetricsFile, []byte(data), 0644); err != nil {
+			return fmt.Errorf("failed to write metrics file: %w", err)
+		}
+	}
+
+	if b.opts.Pushgateway != "" {
+		bundle := b.stats.Name
+		if bundle == "" {
+			bundle = "unknown" // Failed before the compose file was read
+		}
+		target := strings.TrimSuffix(b.opts.Pushgateway, "/") + "/metrics/job/docker-compose-bundler/bundle/" + url.PathEscape(bundle)
+		req, err := http.NewRequest(http.MethodPut, target, bytes.NewBufferString(formatMetrics(metrics, "")))
+		if err != nil {
+			return fmt.Errorf("invalid pushgateway URL: %w", err)
+		}
+		req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+		resp, err := (&http.Client{Timeout: 30 * time.Second}).Do(req)
+		if err != nil {
+			return fmt.Errorf("failed to push metrics: %w", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			return fmt.Errorf("failed to push metrics: pushgateway returned %s", resp.Status)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// ociIndex is the index.json of an OCI image layout, unknown fields of the
+// descriptors are kept
+type ociIndex struct {
+	SchemaVersion int                      `json:"schemaVersion"`
+	MediaType     string                   `json:"mediaType,omitempty"`
+	Manifests     []map[string]interface{} `json:"manifests"`
+}
+
+// Mirror resolves the images of a compose file like Bundle, pulling and
+// building them, and writes them into the OCI image layout dest. The compose
+// file is not rewritten and no bundle is written.
+func (b *Bundler) Mirror(composeFile, dest string) error {
+	compose, err := b.parseComposeFile(composeFile)
+	if err != nil {
+		return fmt.Errorf("failed to parse compose file: %w", err)
+	}
+	var bundleName, bundleVersion string
+	if compose.XBundle != nil {
+		bundleName, bundleVersion = compose.XBundle.Name, compose.XBundle.Version
+	}
+
+	b.lock = &Lockfile{LockfileVersion: lockfileVersion, Services: make(map[string]LockedImage)}
+	if b.opts.Locked {
+		if b.lockfile, err = readLockfile(lockfilePath(composeFile)); err != nil {
+			return fmt.Errorf("--locked requires %s: %w", lockfileName, err)
+		}
+	}
+	b.checkHubQuota(compose)
+
+	imageMap := make(map[string]string)
+	for _, serviceName := range sortedServiceNames(compose) {
+		service := compose.Services[serviceName]
+		built := service.Build != nil
+		if built && (bundleName == "" || bundleVersion == "") {
+			return fmt.Errorf("service %s has a build section, naming its image needs the x-bundle name and version", serviceName)
+		}
+		imageName, err := b.processServiceWithBundle(serviceName, service, filepath.Dir(composeFile), bundleName, bundleVersion)
+		if err != nil {
+			return fmt.Errorf("failed to process service %s: %w", serviceName, err)
+		}
+		if imageName == "" {
+			continue
+		}
+		if err := b.lockService(serviceName, imageName, built); err != nil {
+			return err
+		}
+		imageMap[imageName] = sanitizeFilename(imageName) + ".tar"
+		service.Image = imageName
+		compose.Services[serviceName] = service
+	}
+	if b.opts.Locked {
+		if err := b.finishLock(composeFile); err != nil {
+			return err
+		}
+	}
+	if err := b.checkPlatforms(compose, imageMap); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Join(dest, "blobs"), 0755); err != nil {
+		return err
+	}
+	tempDir, err := os.MkdirTemp("", "docker-compose-mirror-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temp directory: %w", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	// Saved as OCI layouts, their blobs and index entries are merged into dest
+	b.opts.SaveCompat = saveFormatOCI
+	var added []map[string]interface{}
+	for _, imageName := range slices.Sorted(maps.Keys(imageMap)) {
+		tarPath := filepath.Join(tempDir, imageMap[imageName])
+		if err := b.saveImage(imageName, nil, tarPath); err != nil {
+			return fmt.Errorf("failed to save image %s: %w", imageName, err)
+		}
+		manifests, err := copyLayoutBlobs(tarPath, dest)
+		if err != nil {
+			return fmt.Errorf("failed to copy image %s: %w", imageName, err)
+		}
+		added = append(added, manifests...)
+		os.Remove(tarPath)
+	}
+	if err := writeLayoutIndex(dest, added); err != nil {
+		return err
+	}
+
+	fmt.Printf("Mirrored %d image(s) of %d service(s) to %s\n", len(imageMap), len(compose.Services), dest)
+	b.cleanupRetaggedImages()
+	if err := b.cleanupFreshlyPulledImages(); err != nil {
+		b.warnf("failed to cleanup some freshly pulled images: %v", err)
+	}
+	return nil
+}
+
+// copyLayoutBlobs copies the blobs of a saved OCI layout tar into the layout
+// dest, skipping blobs dest has, and returns the manifests of its index
+func copyLayoutBlobs(tarPath, dest string) ([]map[string]interface{}, error) {
+	file, err := os.Open(tarPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var index ociIndex
+	tr := tar.NewReader(file)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		name := path.Clean(header.Name)
+		if name == "index.json" {
+			if err := json.NewDecoder(io.LimitReader(tr, maxImageMetadataBytes)).Decode(&index); err != nil {
+				return nil, fmt.Errorf("failed to parse index.json: %w", err)
+			}
+			continue
+		}
+		algorithm, encoded, ok := strings.Cut(strings.TrimPrefix(name, "blobs/"), "/")
+		if header.Typeflag != tar.TypeReg || !strings.HasPrefix(name, "blobs/") || !ok || algorithm != "sha256" || !chunkDigestRegex.MatchString(encoded) {
+			continue
+		}
+		if err := writeLayoutBlob(dest, encoded, header.Size, tr); err != nil {
+			return nil, err
+		}
+	}
+	if len(index.Manifests) == 0 {
+		return nil, fmt.Errorf("%s has no OCI index", filepath.Base(tarPath))
+	}
+	return index.Manifests, nil
+}
+
+// writeLayoutBlob stores a blob after checking its digest
+func writeLayoutBlob(dest, encoded string, size int64, r io.Reader) error {
+	target := filepath.Join(dest, "blobs", "sha256", encoded)
+	if info, err := os.Stat(target); err == nil && info.Size() == size {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(target), encoded+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmp, hash), r)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if hex.EncodeToString(hash.Sum(nil)) != encoded {
+		return fmt.Errorf("blob sha256:%s does not match its digest", encoded)
+	}
+	return os.Rename(tmp.Name(), target)
+}
+
+// writeLayoutIndex adds manifests to the index.json of dest, replacing
+// entries for the same image name, and writes the oci-layout marker
+func writeLayoutIndex(dest string, manifests []map[string]interface{}) error {
+	index := ociIndex{SchemaVersion: 2, MediaType: ociIndexMediaType}
+	if data, err := os.ReadFile(filepath.Join(dest, "index.json")); err == nil {
+		if err := json.Unmarshal(data, &index); err != nil {
+			return fmt.Errorf("failed to parse %s: %w", filepath.Join(dest, "index.json"), err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	for _, manifest := range manifests {
+		name := descriptorImageName(manifest)
+		index.Manifests = slices.DeleteFunc(index.Manifests, func(existing map[string]interface{}) bool {
+			if name == "" {
+				return existing["digest"] == manifest["digest"]
+			}
+			return descriptorImageName(existing) == name
+		})
+		index.Manifests = append(index.Manifests, manifest)
+	}
+
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dest, "index.json"), data, 0644); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dest, ociLayoutFile), []byte(`{"imageLayoutVersion":"1.0.0"}`), 0644)
+}
+
+// descriptorImageName returns the full image name Docker and containerd
+// annotate index entries with
+func descriptorImageName(descriptor map[string]interface{}) string {
+	annotations, _ := descriptor["annotations"].(map[string]interface{})
+	name, _ := annotations["io.containerd.image.name"].(string)
+	return name
+}
+
+func runMirror(args []string) {
+	var opts Options
+	var dest string
+	flags := flag.NewFlagSet("mirror", flag.ExitOnError)
+	flags.StringVar(&dest, "dest", "", "OCI image layout `directory` the images are written to, images already in it are kept")
+	flags.Var((*stringList)(&opts.Overrides), "override", "Compose file merged on top of the main one (repeatable)")
+	flags.StringVar(&opts.Values, "values", "", "YAML `file` with values for the parameters declared in x-bundle.parameters")
+	flags.Var((*stringList)(&opts.Sets), "set", "Override a compose value as `path=value`, e.g. services.web.environment.LOG_LEVEL=info (repeatable)")
+	flags.StringVar(&opts.Platform, "platform", "", "Pull and build images for this `os/arch[/variant]` and verify every image matches it (default the platform of the Docker daemon)")
+	flags.BoolVar(&opts.Locked, "locked", false, "Fail if an image resolves differently than bundle.lock")
+	flags.Usage = func() {
+		fmt.Println("Usage: docker-compose-bundler mirror --dest <directory> [flags] <docker-compose.yml>")
+		fmt.Println("Example: docker-compose-bundler mirror --dest ./images-oci/ docker-compose.yml")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 || dest == "" {
+		flags.Usage()
+		os.Exit(1)
+	}
+	if opts.Platform != "" {
+		if _, err := parsePlatform(opts.Platform); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if err := NewBundler(opts).Mirror(flags.Arg(0), dest); err != nil {
+		log.Fatal(err)
+	}
+}
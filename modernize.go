@@ -0,0 +1,14 @@
+package main
+
+import "fmt"
+
+func printModernizeReport(changes []string) {
+	if len(changes) == 0 {
+		fmt.Println("Compose file already uses the current syntax")
+		return
+	}
+	fmt.Printf("Modernized compose file (%d change(s)):\n", len(changes))
+	for _, change := range changes {
+		fmt.Printf("  - %s\n", change)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var userSpecRegex = regexp.MustCompile(`^[\w.-]+(:[\w.-]+)?$`)
+
+// isRootUser reports whether a compose/image user spec resolves to root
+func isRootUser(user string) bool {
+	name, _, _ := strings.Cut(user, ":")
+	return name == "" || name == "0" || name == "root"
+}
+
+// enforceNonRoot sets user on every service that does not define one and
+// warns about services that will (or likely need to) run as root
+func (b *Bundler) enforceNonRoot(compose *DockerCompose, user string) error {
+	if !userSpecRegex.MatchString(user) || isRootUser(user) {
+		return fmt.Errorf("invalid non-root user %q, use UID[:GID] other than root", user)
+	}
+
+	for _, name := range sortedServiceNames(compose) {
+		service := compose.Services[name]
+
+		if service.User != "" {
+			if isRootUser(service.User) {
+				b.warnf("service %s explicitly runs as root (user: %s)", name, service.User)
+			}
+			continue
+		}
+
+		if privileged, _ := service.Extra["privileged"].(bool); privileged {
+			b.warnf("service %s is privileged, running it as %s may not be sufficient", name, user)
+		}
+		if service.Image != "" && !b.dryRun() && !b.isMissing(service.Image) {
+			inspect, err := b.client.ImageInspect(b.ctx, service.Image)
+			if err != nil {
+				return fmt.Errorf("failed to inspect image %s: %w", service.Image, err)
+			}
+			if inspect.Config == nil || isRootUser(inspect.Config.User) {
+				b.warnf("image %s of service %s runs as root by default, verify it works as %s", service.Image, name, user)
+			}
+		}
+
+		service.User = user
+		compose.Services[name] = service
+		fmt.Printf("Service %s will run as %s\n", name, user)
+	}
+	return nil
+}
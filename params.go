@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// BundleParameter declares a value substituted into the compose file at
+// bundle time, e.g. a port or hostname that differs per customer
+type BundleParameter struct {
+	Default     *string `yaml:"default,omitempty"`
+	Description string  `yaml:"description,omitempty"`
+}
+
+// loadValuesFile reads a flat YAML mapping of parameter names to values
+func loadValuesFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read values file: %w", err)
+	}
+	values := make(map[string]string)
+	if err := yaml.Unmarshal(data, &values); err != nil {
+		return nil, fmt.Errorf("failed to parse values file %s, expected name: value pairs: %w", path, err)
+	}
+	return values, nil
+}
+
+// loadOptions returns the --values and --set inputs for loading compose files
+func (b *Bundler) loadOptions() (loadOptions, error) {
+	opts := loadOptions{sets: b.opts.Sets}
+	if b.opts.Values != "" {
+		values, err := loadValuesFile(b.opts.Values)
+		if err != nil {
+			return opts, err
+		}
+		opts.values = values
+	}
+	return opts, nil
+}
+
+// resolveParameters collects the x-bundle parameters declared in the compose
+// files and resolves them from the values file, the environment or their
+// defaults, in that order. Values for undeclared parameters are an error so
+// typos in a values file do not go unnoticed.
+func resolveParameters(roots []*yaml.Node, values, env map[string]string) (map[string]string, error) {
+	declared := make(map[string]BundleParameter)
+	for _, root := range roots {
+		if root == nil {
+			continue
+		}
+		xBundle := mappingValue(root, "x-bundle")
+		if xBundle == nil {
+			continue
+		}
+		var doc struct {
+			Parameters map[string]BundleParameter `yaml:"parameters"`
+		}
+		if err := xBundle.Decode(&doc); err != nil {
+			return nil, fmt.Errorf("invalid x-bundle parameters: %w", err)
+		}
+		for name, parameter := range doc.Parameters {
+			declared[name] = parameter
+		}
+	}
+
+	var unknown []string
+	for name := range values {
+		if _, ok := declared[name]; !ok {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return nil, fmt.Errorf("values file sets undeclared parameter(s): %s", strings.Join(unknown, ", "))
+	}
+
+	resolved := make(map[string]string)
+	var missing []string
+	for name, parameter := range declared {
+		if value, ok := values[name]; ok {
+			resolved[name] = value
+		} else if value, ok := env[name]; ok {
+			resolved[name] = value
+		} else if parameter.Default != nil {
+			resolved[name] = *parameter.Default
+		} else {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return nil, fmt.Errorf("no value for parameter(s) %s, set them in a --values file", strings.Join(missing, ", "))
+	}
+	return resolved, nil
+}
+
+// recordValues stores the parameters, the values file and the --set overrides
+// used in the manifest
+func (b *Bundler) recordValues(manifest *Manifest, compose *DockerCompose) error {
+	if len(compose.parameters) > 0 {
+		manifest.Parameters = compose.parameters
+	}
+	manifest.Sets = b.opts.Sets
+	if b.opts.Values == "" {
+		return nil
+	}
+	_, digest, err := fileDigest(b.opts.Values)
+	if err != nil {
+		return err
+	}
+	manifest.Values = &ManifestValues{File: filepath.Base(b.opts.Values), SHA256: digest}
+	return nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// MissingImage is an image a partial bundle does not contain, the operator
+// has to provide it on the target
+type MissingImage struct {
+	Service string `json:"service"`
+	Image   string `json:"image"`
+	Reason  string `json:"reason"` // Why it could not be pulled
+}
+
+// pullError is a failed pull from a registry, the only error --allow-partial
+// leaves an image out for. Configuration errors like an invalid pull_policy fail the run.
+type pullError struct {
+	err error
+}
+
+func (e *pullError) Error() string { return e.err.Error() }
+func (e *pullError) Unwrap() error { return e.err }
+
+// skipMissingImage records an image that failed to pull with --allow-partial.
+// It reports false if the bundle cannot go without it.
+func (b *Bundler) skipMissingImage(serviceName string, service Service, err error) bool {
+	var pullErr *pullError
+	if !b.opts.AllowPartial || service.Build != nil || service.Image == "" || !errors.As(err, &pullErr) {
+		return false
+	}
+	b.missingImages = append(b.missingImages, MissingImage{Service: serviceName, Image: service.Image, Reason: err.Error()})
+	b.warnf("image %s of service %s is left out of the bundle: %v", service.Image, serviceName, err)
+	return true
+}
+
+// isMissing reports whether image was left out with --allow-partial, it
+// cannot be inspected
+func (b *Bundler) isMissing(image string) bool {
+	return slices.ContainsFunc(b.missingImages, func(m MissingImage) bool { return m.Image == image })
+}
+
+// mergeMissingImages updates the missing images of an appended bundle:
+// images bundled now are no longer missing, the services of extra replace
+// their earlier entries
+func mergeMissingImages(missing []MissingImage, extra *DockerCompose, added []MissingImage, images []ManifestImage) []MissingImage {
+	missing = slices.DeleteFunc(missing, func(m MissingImage) bool {
+		_, replaced := extra.Services[m.Service]
+		return replaced || slices.ContainsFunc(images, func(img ManifestImage) bool { return img.Name == m.Image })
+	})
+	missing = append(missing, added...)
+	slices.SortFunc(missing, func(a, b MissingImage) int { return strings.Compare(a.Service, b.Service) })
+	return missing
+}
+
+// partialSection leads the README of a partial bundle
+func partialSection(c *catalog, missing []MissingImage) string {
+	var sb strings.Builder
+	sb.WriteString(c.t("readme.partial") + "\n")
+	for _, m := range missing {
+		sb.WriteString(fmt.Sprintf("- %s: %s (%s)\n", m.Service, m.Image, m.Reason))
+	}
+	sb.WriteString("\n" + c.t("readme.partial.provide"))
+	return sb.String()
+}
+
+// CheckMissingImages reports the images a partial bundle left out that are
+// not present on this host
+func (l *Loader) CheckMissingImages() []MissingImage {
+	var absent []MissingImage
+	for _, m := range l.manifest.MissingImages {
+		if _, err := l.client.ImageInspect(l.ctx, m.Image); err != nil {
+			absent = append(absent, m)
+		}
+	}
+	return absent
+}
+
+// missingImagesError explains what the operator has to provide before a
+// partial bundle can be deployed
+func missingImagesError(absent []MissingImage) error {
+	var names []string
+	for _, m := range absent {
+		names = append(names, fmt.Sprintf("%s (service %s)", m.Image, m.Service))
+	}
+	return fmt.Errorf("this is a partial bundle, provide the missing images with docker load or docker pull first: %s", strings.Join(names, ", "))
+}
+
+// printPartialReport repeats at the end of the run that the bundle lacks images
+func (b *Bundler) printPartialReport(manifest *Manifest) {
+	if len(manifest.MissingImages) == 0 {
+		return
+	}
+	var images []string
+	for _, m := range manifest.MissingImages {
+		images = append(images, m.Image)
+	}
+	b.warnf("the bundle is PARTIAL, the operator has to provide %d image(s) on the target: %s", len(images), strings.Join(images, ", "))
+}
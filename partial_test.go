@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"docker-compose-bundler/dockerclient"
+)
+
+func TestAllowPartialSkipsFailedPulls(t *testing.T) {
+	fake := dockerclient.NewFake()
+	fake.AddImage("nginx:1.27")
+	fake.PullErrors = map[string]error{"redis:7": errors.New("registry unreachable")}
+
+	manifest, compose, err := readBundleMetadata(bundleWith(t, fake, Options{AllowPartial: true}, writeCompose(t, webCompose)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.MissingImages) != 1 || manifest.MissingImages[0].Image != "redis:7" || !strings.Contains(manifest.MissingImages[0].Reason, "registry unreachable") {
+		t.Errorf("missing images %+v, want redis:7", manifest.MissingImages)
+	}
+	if compose.Services["cache"].Image != "redis:7" {
+		t.Errorf("cache is bundled with image %q", compose.Services["cache"].Image)
+	}
+}
+
+func TestAllowPartialFailsOnConfigurationErrors(t *testing.T) {
+	for name, service := range map[string]string{
+		"invalid pull_policy":    "image: redis:7\n    pull_policy: evry_1d",
+		"build without build":    "image: redis:7\n    pull_policy: build",
+		"never and image absent": "image: redis:7\n    pull_policy: never",
+	} {
+		t.Run(name, func(t *testing.T) {
+			fake := dockerclient.NewFake()
+			composeFile := writeCompose(t, "services:\n  cache:\n    "+service+"\nx-bundle:\n  name: shop\n  version: 1.2.0\n")
+			opts := Options{AllowPartial: true, VersionScheme: VersionSchemeSemver}
+			err := NewBundlerWithClient(opts, fake).Bundle(composeFile, filepath.Join(t.TempDir(), "bundle.tar.gz"))
+			if err == nil {
+				t.Fatal("the service was left out of the bundle")
+			}
+		})
+	}
+}
+
+// captureStdout returns what fn prints
+func captureStdout(t *testing.T, fn func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+	var out bytes.Buffer
+	done := make(chan struct{})
+	go func() {
+		io.Copy(&out, r)
+		close(done)
+	}()
+	fn()
+	w.Close()
+	<-done
+	return out.String()
+}
+
+func TestLoadArchiveWarnsAboutMissingImages(t *testing.T) {
+	source := dockerclient.NewFake()
+	source.AddImage("nginx:1.27")
+	source.PullErrors = map[string]error{"redis:7": errors.New("registry unreachable")}
+	archive := bundleWith(t, source, Options{AllowPartial: true}, writeCompose(t, webCompose))
+
+	target := dockerclient.NewFake()
+	loader, err := LoadArchive(archive, filepath.Join(t.TempDir(), "shop"), target, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loader.stateDir = t.TempDir()
+	var finishErr error
+	out := captureStdout(t, func() { finishErr = loader.finishLoad(archive) })
+	if finishErr != nil {
+		t.Fatal(finishErr)
+	}
+	if !strings.Contains(out, "Warning: this is a partial bundle") || !strings.Contains(out, "redis:7 (service cache)") {
+		t.Errorf("loading a partial bundle printed %q", out)
+	}
+
+	target.AddImage("redis:7")
+	out = captureStdout(t, func() { finishErr = loader.finishLoad(archive) })
+	if finishErr != nil || strings.Contains(out, "partial bundle") {
+		t.Errorf("loading with the missing image provided printed %q: %v", out, finishErr)
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/versions"
+	"github.com/docker/docker/client"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// platformSaveAPIVersion is the first API version saving single platforms of an image
+const platformSaveAPIVersion = "1.48"
+
+// platformSpec is an os/arch[/variant] platform like linux/arm64/v8
+type platformSpec struct {
+	OS, Arch, Variant string
+}
+
+// archAliases maps the names uname and some registries use to the OCI ones
+var archAliases = map[string]string{
+	"x86_64":  "amd64",
+	"x86-64":  "amd64",
+	"aarch64": "arm64",
+	"armhf":   "arm",
+	"i386":    "386",
+}
+
+func normalizeArch(arch string) string {
+	arch = strings.ToLower(arch)
+	if alias, ok := archAliases[arch]; ok {
+		return alias
+	}
+	return arch
+}
+
+func parsePlatform(spec string) (platformSpec, error) {
+	parts := strings.Split(spec, "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return platformSpec{}, fmt.Errorf("invalid platform %q, use os/arch[/variant] like linux/amd64", spec)
+	}
+	p := platformSpec{OS: strings.ToLower(parts[0]), Arch: normalizeArch(parts[1])}
+	if len(parts) == 3 {
+		p.Variant = parts[2]
+	}
+	return p, nil
+}
+
+func (p platformSpec) String() string {
+	if p.Variant == "" {
+		return p.OS + "/" + p.Arch
+	}
+	return p.OS + "/" + p.Arch + "/" + p.Variant
+}
+
+// matches compares the image platform with the requested one, variants only
+// if both specify one (arm64 images rarely record v8)
+func (p platformSpec) matches(requested platformSpec) bool {
+	if p.OS != requested.OS || p.Arch != requested.Arch {
+		return false
+	}
+	return p.Variant == "" || requested.Variant == "" || p.Variant == requested.Variant
+}
+
+// servicePlatform returns the platform requested for a service: its compose
+// platform, otherwise --platform. Empty if neither is set.
+func (b *Bundler) servicePlatform(service Service) string {
+	if platform, ok := service.Extra["platform"].(string); ok && platform != "" {
+		return platform
+	}
+	return b.opts.Platform
+}
+
+// checkPlatforms verifies that every bundled image was built for the platform
+// requested for its services, by default the platform of the Docker daemon.
+// A locally cached image of another architecture would only fail on site.
+func (b *Bundler) checkPlatforms(compose *DockerCompose, imageMap map[string]string) error {
+	var daemon platformSpec
+	var mismatches []string
+	for _, serviceName := range sortedServiceNames(compose) {
+		service := compose.Services[serviceName]
+		if _, ok := imageMap[service.Image]; !ok {
+			continue
+		}
+
+		requested := b.servicePlatform(service)
+		var want platformSpec
+		if requested != "" {
+			var err error
+			if want, err = parsePlatform(requested); err != nil {
+				return fmt.Errorf("service %s: %w", serviceName, err)
+			}
+		} else {
+			if daemon.OS == "" {
+				version, err := b.client.ServerVersion(b.ctx)
+				if err != nil {
+					return fmt.Errorf("failed to get the Docker daemon platform: %w", err)
+				}
+				daemon = platformSpec{OS: version.Os, Arch: normalizeArch(version.Arch)}
+			}
+			want = daemon
+		}
+
+		inspect, err := b.client.ImageInspect(b.ctx, service.Image)
+		if err != nil {
+			return fmt.Errorf("failed to inspect image %s: %w", service.Image, err)
+		}
+		got := platformSpec{OS: inspect.Os, Arch: normalizeArch(inspect.Architecture), Variant: inspect.Variant}
+		if !got.matches(want) {
+			mismatches = append(mismatches, fmt.Sprintf("service %s: image %s is %s, expected %s", serviceName, service.Image, got, want))
+		}
+	}
+	if len(mismatches) == 0 {
+		return nil
+	}
+	sort.Strings(mismatches)
+	return fmt.Errorf("%d image(s) do not match the target platform, remove the local copies or pull them with --platform:\n  %s", len(mismatches), strings.Join(mismatches, "\n  "))
+}
+
+// savePlatforms returns the options saving only the platform the image
+// resolves to, when the image store holds other platforms of it too, e.g.
+// images built with buildx for several platforms or pulled with
+// --all-platforms. Single-platform images are saved as they are.
+func (b *Bundler) savePlatforms(imageName string) ([]client.ImageSaveOption, error) {
+	inspect, err := b.client.ImageInspect(b.ctx, imageName, client.ImageInspectWithManifests(true))
+	if err != nil {
+		return nil, fmt.Errorf("failed to inspect image %s: %w", imageName, err)
+	}
+	want := platformSpec{OS: inspect.Os, Arch: normalizeArch(inspect.Architecture), Variant: inspect.Variant}
+
+	var kept []string
+	var others int
+	var otherBytes int64
+	for _, m := range inspect.Manifests {
+		if !m.Available {
+			continue
+		}
+		if m.Kind == image.ManifestKindImage && m.ImageData != nil {
+			p := m.ImageData.Platform
+			if (platformSpec{OS: p.OS, Arch: normalizeArch(p.Architecture), Variant: p.Variant}).matches(want) {
+				kept = append(kept, m.ID)
+				continue
+			}
+		}
+		// Attestations of the saved image are kept with it
+		if m.Kind == image.ManifestKindAttestation && m.AttestationData != nil && slices.Contains(kept, m.AttestationData.For.String()) {
+			continue
+		}
+		others++
+		otherBytes += m.Size.Content
+	}
+	if others == 0 || len(kept) == 0 {
+		return nil, nil
+	}
+
+	version, err := b.client.ServerVersion(b.ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the Docker daemon version: %w", err)
+	}
+	if versions.LessThan(version.APIVersion, platformSaveAPIVersion) {
+		b.warnf("image %s holds %d other platform manifest(s) (%s), Docker %s cannot save %s alone (API %s required)",
+			imageName, others, formatBytes(otherBytes), version.Version, want, platformSaveAPIVersion)
+		return nil, nil
+	}
+	b.stats.PrunedBytes += otherBytes
+	b.decidef("Saving only %s of multi-platform image %s, leaving out %d other platform manifest(s) (%s)", want, imageName, others, formatBytes(otherBytes))
+	return []client.ImageSaveOption{client.ImageSaveWithPlatforms(ocispec.Platform{OS: want.OS, Architecture: want.Arch, Variant: want.Variant})}, nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"docker-compose-bundler/dockerclient"
+)
+
+func TestPlatformMatches(t *testing.T) {
+	tests := []struct {
+		image, requested string
+		want             bool
+	}{
+		{"linux/amd64", "linux/x86_64", true},
+		{"linux/arm64", "linux/arm64/v8", true}, // Images rarely record the variant
+		{"linux/arm/v6", "linux/arm/v7", false},
+		{"linux/arm64", "linux/amd64", false},
+		{"windows/amd64", "linux/amd64", false},
+	}
+	for _, tt := range tests {
+		image, err := parsePlatform(tt.image)
+		if err != nil {
+			t.Fatal(err)
+		}
+		requested, err := parsePlatform(tt.requested)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := image.matches(requested); got != tt.want {
+			t.Errorf("%s matches %s = %v, want %v", tt.image, tt.requested, got, tt.want)
+		}
+	}
+	if _, err := parsePlatform("amd64"); err == nil {
+		t.Error("a platform without os was accepted")
+	}
+}
+
+func TestBundleRejectsOtherPlatforms(t *testing.T) {
+	fake := dockerclient.NewFake()
+	fake.AddImage("nginx:1.27").Platform = "linux/arm64"
+	fake.AddImage("redis:7")
+
+	outputFile := filepath.Join(t.TempDir(), "bundle.tar.gz")
+	err := NewBundlerWithClient(Options{VersionScheme: VersionSchemeSemver}, fake).Bundle(writeCompose(t, webCompose), outputFile)
+	if err == nil || !strings.Contains(err.Error(), "image nginx:1.27 is linux/arm64, expected linux/amd64") {
+		t.Fatalf("Bundle error %v, want the platform of nginx:1.27", err)
+	}
+}
+
+func TestBundlePullsRequestedPlatform(t *testing.T) {
+	fake := dockerclient.NewFake()
+	fake.AddImage("nginx:1.27").Platform = "linux/arm64"
+
+	manifest, _, err := readBundleMetadata(bundleWith(t, fake, Options{Platform: "linux/arm64"}, writeCompose(t, webCompose)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The fake gives every platform of a tag its own image ID
+	sum := sha256.Sum256([]byte("redis:7@linux/arm64"))
+	for _, img := range manifest.Images {
+		if img.Name == "redis:7" && img.ID != "sha256:"+hex.EncodeToString(sum[:]) {
+			t.Errorf("bundled redis:7 %s is not the linux/arm64 image", img.ID)
+		}
+	}
+}
+
+func TestSavePlatforms(t *testing.T) {
+	fake := dockerclient.NewFake()
+	fake.AddImage("nginx:1.27").OtherPlatforms = map[string]int64{"linux/arm64": 5 << 20, "linux/arm/v7": 3 << 20}
+	fake.AddImage("redis:7")
+
+	b := NewBundlerWithClient(Options{}, fake)
+	opts, err := b.savePlatforms("nginx:1.27")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(opts) != 1 || b.stats.PrunedBytes != 8<<20 {
+		t.Errorf("saving nginx:1.27 with %d option(s) leaves out %d bytes, want only linux/amd64 without 8 MiB", len(opts), b.stats.PrunedBytes)
+	}
+	if opts, err := b.savePlatforms("redis:7"); err != nil || opts != nil {
+		t.Errorf("a single-platform image is saved with %v, %v", opts, err)
+	}
+
+	// Older daemons save every platform
+	fake.Version.APIVersion = "1.47"
+	if opts, err := NewBundlerWithClient(Options{}, fake).savePlatforms("nginx:1.27"); err != nil || opts != nil {
+		t.Errorf("API 1.47 saves nginx:1.27 with %v, %v", opts, err)
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/network"
+)
+
+// composeProjectLabel is set by compose on every container and network it creates
+const composeProjectLabel = "com.docker.compose.project"
+
+// Preflight reports host ports and subnets the stack needs but that are
+// already taken on this host, before compose half-starts the stack
+func (l *Loader) Preflight() error {
+	fmt.Println("Running preflight checks...")
+
+	if err := l.CheckHost(); err != nil {
+		return err
+	}
+	var conflicts []string
+	portConflicts, err := l.portConflicts()
+	if err != nil {
+		return fmt.Errorf("failed to check ports: %w", err)
+	}
+	conflicts = append(conflicts, portConflicts...)
+
+	subnetConflicts, err := l.subnetConflicts()
+	if err != nil {
+		return fmt.Errorf("failed to check networks: %w", err)
+	}
+	conflicts = append(conflicts, subnetConflicts...)
+
+	if len(conflicts) > 0 {
+		return fmt.Errorf("preflight found %d conflict(s):\n  %s", len(conflicts), strings.Join(conflicts, "\n  "))
+	}
+	fmt.Println("Preflight checks passed")
+	return nil
+}
+
+func (l *Loader) portConflicts() ([]string, error) {
+	// Ports held by a previous deployment of this project are freed by compose on recreate
+	owned := make(map[string]bool)
+	containers, err := l.client.ContainerList(l.ctx, container.ListOptions{
+		Filters: filters.NewArgs(filters.Arg("label", composeProjectLabel+"="+l.manifest.ProjectName)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range containers {
+		for _, p := range c.Ports {
+			if p.PublicPort != 0 {
+				owned[fmt.Sprintf("%s/%d", p.Type, p.PublicPort)] = true
+			}
+		}
+	}
+
+	var conflicts []string
+	for _, serviceName := range sortedServiceNames(l.compose) {
+		for _, port := range l.compose.Services[serviceName].Ports {
+			if port.Published == "" {
+				continue // Ephemeral host port
+			}
+			protocol := port.Protocol
+			if protocol == "" {
+				protocol = "tcp"
+			}
+			hostPorts, err := expandPortRange(port.Published)
+			if err != nil {
+				return nil, fmt.Errorf("service %s: %w", serviceName, err)
+			}
+			for _, hostPort := range hostPorts {
+				if owned[fmt.Sprintf("%s/%d", protocol, hostPort)] {
+					continue
+				}
+				if err := checkPortFree(port.HostIP, hostPort, protocol); err != nil {
+					conflicts = append(conflicts, fmt.Sprintf("service %s: host port %d/%s is not available: %v", serviceName, hostPort, protocol, err))
+				}
+			}
+		}
+	}
+	return conflicts, nil
+}
+
+// expandPortRange turns "8080" or "8000-8010" into the individual ports
+func expandPortRange(spec string) ([]int, error) {
+	startSpec, endSpec, isRange := strings.Cut(spec, "-")
+	start, err := strconv.Atoi(startSpec)
+	if err != nil {
+		return nil, fmt.Errorf("invalid published port %q", spec)
+	}
+	end := start
+	if isRange {
+		if end, err = strconv.Atoi(endSpec); err != nil || end < start {
+			return nil, fmt.Errorf("invalid published port range %q", spec)
+		}
+	}
+	ports := make([]int, 0, end-start+1)
+	for p := start; p <= end; p++ {
+		ports = append(ports, p)
+	}
+	return ports, nil
+}
+
+// checkPortFree tries to bind the port the same way the daemon would
+func checkPortFree(hostIP string, port int, protocol string) error {
+	address := net.JoinHostPort(hostIP, strconv.Itoa(port))
+	if protocol == "udp" {
+		conn, err := net.ListenPacket("udp", address)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	return listener.Close()
+}
+
+func (l *Loader) subnetConflicts() ([]string, error) {
+	existing, err := l.client.NetworkList(l.ctx, network.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	var conflicts []string
+	for _, name := range sortedKeys(l.compose.Networks) {
+		for _, subnet := range networkSubnets(l.compose.Networks[name]) {
+			_, wanted, err := net.ParseCIDR(subnet)
+			if err != nil {
+				return nil, fmt.Errorf("network %s: invalid subnet %q", name, subnet)
+			}
+			for _, other := range existing {
+				if other.Labels[composeProjectLabel] == l.manifest.ProjectName {
+					continue // Reused by compose
+				}
+				for _, config := range other.IPAM.Config {
+					_, taken, err := net.ParseCIDR(config.Subnet)
+					if err != nil {
+						continue
+					}
+					if wanted.Contains(taken.IP) || taken.Contains(wanted.IP) {
+						conflicts = append(conflicts, fmt.Sprintf("network %s: subnet %s overlaps %s of existing network %s", name, subnet, config.Subnet, other.Name))
+					}
+				}
+			}
+		}
+	}
+	return conflicts, nil
+}
+
+// networkSubnets returns the ipam subnets of a top-level network definition
+func networkSubnets(definition interface{}) []string {
+	config, ok := definition.(map[string]interface{})
+	if !ok || config["external"] == true {
+		return nil
+	}
+	ipam, _ := config["ipam"].(map[string]interface{})
+	pools, _ := ipam["config"].([]interface{})
+
+	var subnets []string
+	for _, pool := range pools {
+		if m, ok := pool.(map[string]interface{}); ok {
+			if subnet, ok := m["subnet"].(string); ok {
+				subnets = append(subnets, subnet)
+			}
+		}
+	}
+	return subnets
+}
+
+func sortedServiceNames(compose *DockerCompose) []string {
+	names := make([]string, 0, len(compose.Services))
+	for name := range compose.Services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// BuildRecord describes how a built image was produced
+type BuildRecord struct {
+	Image            string            `json:"image"`
+	Context          string            `json:"context"`
+	Dockerfile       string            `json:"dockerfile"`
+	DockerfileSHA256 string            `json:"dockerfileSha256"`
+	Target           string            `json:"target,omitempty"`
+	Args             map[string]string `json:"args,omitempty"`    // Secret-looking values are masked
+	Secrets          []string          `json:"secrets,omitempty"` // IDs of the BuildKit secrets, never their values
+	BaseImages       []BaseImage       `json:"baseImages"`
+}
+
+// BaseImage is an image referenced by FROM, with the digest used for the build
+type BaseImage struct {
+	Name   string `json:"name"`
+	Digest string `json:"digest,omitempty"` // Empty if the daemon has no repo digest, e.g. locally built
+}
+
+var (
+	secretArgRegex = regexp.MustCompile(`(?i)(PASSWORD|PASSWD|SECRET|TOKEN|CREDENTIAL|PRIVATE|API_?KEY|ACCESS_?KEY|AUTH)`)
+	argRefRegex    = regexp.MustCompile(`\$\{?([A-Za-z_][A-Za-z0-9_]*)\}?`)
+)
+
+// maskBuildArgs returns the build args with secret-looking values replaced
+func maskBuildArgs(args map[string]*string) map[string]string {
+	if len(args) == 0 {
+		return nil
+	}
+	masked := make(map[string]string, len(args))
+	for name, value := range args {
+		switch {
+		case value == nil:
+			masked[name] = ""
+		case secretArgRegex.MatchString(name):
+			masked[name] = "********"
+		default:
+			masked[name] = *value
+		}
+	}
+	return masked
+}
+
+// dockerfileBaseImages returns the external images referenced by FROM
+// instructions, skipping scratch and earlier build stages. ARGs declared
+// before the first FROM are substituted from buildArgs or their defaults.
+func dockerfileBaseImages(dockerfile []byte, buildArgs map[string]*string) []string {
+	args := make(map[string]string)
+	for name, value := range buildArgs {
+		if value != nil {
+			args[name] = *value
+		}
+	}
+	stages := make(map[string]bool)
+	var images []string
+	seenFrom := false
+
+	scanner := bufio.NewScanner(bytes.NewReader(dockerfile))
+	var line string
+	for scanner.Scan() {
+		text := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(text, "#") {
+			continue
+		}
+		if strings.HasSuffix(text, "\\") {
+			line += strings.TrimSuffix(text, "\\") + " "
+			continue
+		}
+		line += text
+		fields := strings.Fields(line)
+		line = ""
+		if len(fields) < 2 {
+			continue
+		}
+
+		switch strings.ToUpper(fields[0]) {
+		case "ARG":
+			if seenFrom {
+				continue // Only global ARGs apply to FROM
+			}
+			name, value, hasDefault := strings.Cut(fields[1], "=")
+			if _, ok := args[name]; !ok && hasDefault {
+				args[name] = strings.Trim(value, `"'`)
+			}
+		case "FROM":
+			seenFrom = true
+			fields = fields[1:]
+			for len(fields) > 0 && strings.HasPrefix(fields[0], "--") {
+				fields = fields[1:] // --platform=...
+			}
+			if len(fields) == 0 {
+				continue
+			}
+			name := argRefRegex.ReplaceAllStringFunc(fields[0], func(ref string) string {
+				return args[argRefRegex.FindStringSubmatch(ref)[1]]
+			})
+			external := name != "scratch" && !stages[strings.ToLower(name)]
+			if len(fields) >= 3 && strings.EqualFold(fields[1], "AS") {
+				stages[strings.ToLower(fields[2])] = true
+			}
+			if external && !slices.Contains(images, name) {
+				images = append(images, name)
+			}
+		}
+	}
+	return images
+}
+
+// recordBuild captures the inputs of a finished build
+func (b *Bundler) recordBuild(imageName, dockerfilePath, dockerfile string, config *BuildConfig, buildArgs map[string]*string, secretIDs []string) error {
+	content, err := os.ReadFile(dockerfilePath)
+	if err != nil {
+		return fmt.Errorf("failed to read Dockerfile: %w", err)
+	}
+	sum := sha256.Sum256(content)
+
+	record := BuildRecord{
+		Image:            imageName,
+		Context:          filepath.ToSlash(config.Context),
+		Dockerfile:       dockerfile,
+		DockerfileSHA256: hex.EncodeToString(sum[:]),
+		Target:           config.Target,
+		Args:             maskBuildArgs(buildArgs),
+		Secrets:          secretIDs,
+		BaseImages:       []BaseImage{},
+	}
+	for _, name := range dockerfileBaseImages(content, buildArgs) {
+		base := BaseImage{Name: name}
+		if inspect, err := b.client.ImageInspect(b.ctx, name); err == nil && len(inspect.RepoDigests) > 0 {
+			digests := append([]string(nil), inspect.RepoDigests...)
+			sort.Strings(digests)
+			base.Digest = digests[0]
+		}
+		record.BaseImages = append(record.BaseImages, base)
+	}
+	b.builds = append(b.builds, record)
+	return nil
+}
+
+// renameBuild updates the record of a built image that was retagged
+func (b *Bundler) renameBuild(from, to string) {
+	for i := range b.builds {
+		if b.builds[i].Image == from {
+			b.builds[i].Image = to
+		}
+	}
+}
+
+// mergeBuilds replaces records of rebuilt images and drops those of images
+// no longer in the bundle
+func mergeBuilds(existing, built []BuildRecord, images []ManifestImage) []BuildRecord {
+	bundled := make(map[string]bool, len(images))
+	for _, image := range images {
+		bundled[image.Name] = true
+	}
+	rebuilt := make(map[string]bool, len(built))
+	for _, record := range built {
+		rebuilt[record.Image] = true
+	}
+
+	var merged []BuildRecord
+	for _, record := range existing {
+		if bundled[record.Image] && !rebuilt[record.Image] {
+			merged = append(merged, record)
+		}
+	}
+	return append(merged, built...)
+}
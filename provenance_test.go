@@ -0,0 +1,80 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"docker-compose-bundler/dockerclient"
+)
+
+func TestDockerfileBaseImages(t *testing.T) {
+	dockerfile := `ARG BASE=alpine:3.20
+# FROM commented:out
+FROM --platform=$BUILDPLATFORM golang:1.24 AS build
+FROM ${BASE}
+COPY --from=build /app /app
+FROM build AS test
+FROM scratch
+`
+	got := dockerfileBaseImages([]byte(dockerfile), nil)
+	if want := []string{"golang:1.24", "alpine:3.20"}; !slices.Equal(got, want) {
+		t.Errorf("base images %v, want %v", got, want)
+	}
+	base := "debian:12"
+	got = dockerfileBaseImages([]byte(dockerfile), map[string]*string{"BASE": &base})
+	if want := []string{"golang:1.24", "debian:12"}; !slices.Equal(got, want) {
+		t.Errorf("base images with a build arg %v, want %v", got, want)
+	}
+}
+
+func TestMaskBuildArgs(t *testing.T) {
+	version, token := "1.2.0", "s3cr3t"
+	masked := maskBuildArgs(map[string]*string{"VERSION": &version, "NPM_TOKEN": &token, "UNSET": nil})
+	if masked["VERSION"] != "1.2.0" || masked["NPM_TOKEN"] != "********" || masked["UNSET"] != "" {
+		t.Errorf("masked build args %v", masked)
+	}
+}
+
+func TestBundleRecordsBuilds(t *testing.T) {
+	composeFile := writeCompose(t, `services:
+  app:
+    image: shop/app:1.2.0
+    build:
+      context: ./app
+      args:
+        API_KEY: abc
+    command: ["/app"]
+x-bundle:
+  name: shop
+  version: 1.2.0
+`)
+	appDir := filepath.Join(filepath.Dir(composeFile), "app")
+	if err := os.Mkdir(appDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(appDir, "Dockerfile"), []byte("FROM alpine:3.20\nCOPY . /app\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fake := dockerclient.NewFake()
+	fake.AddImage("alpine:3.20").RepoDigests = []string{"alpine@sha256:1111"}
+
+	manifest, _, err := readBundleMetadata(bundleWith(t, fake, Options{}, composeFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Builds) != 1 {
+		t.Fatalf("recorded %d builds, want 1", len(manifest.Builds))
+	}
+	record := manifest.Builds[0]
+	if record.Image != "bundles/shop/app:1.2.0" || record.Dockerfile != "Dockerfile" || record.DockerfileSHA256 == "" {
+		t.Errorf("build record %+v", record)
+	}
+	if record.Args["API_KEY"] != "********" {
+		t.Errorf("API_KEY is recorded as %q, want it masked", record.Args["API_KEY"])
+	}
+	if len(record.BaseImages) != 1 || record.BaseImages[0] != (BaseImage{Name: "alpine:3.20", Digest: "alpine@sha256:1111"}) {
+		t.Errorf("base images %+v, want alpine:3.20 with its digest", record.BaseImages)
+	}
+}
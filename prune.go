@@ -0,0 +1,216 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/image"
+)
+
+// PruneOptions select what Prune removes of the bundle versions beyond the retention count
+type PruneOptions struct {
+	Keep    int  // Newest versions of each bundle to keep, at least 1
+	Volumes bool // Also remove volumes no kept version uses
+	DryRun  bool // Only report what would be removed
+}
+
+// PruneResult lists what Prune removed, or would remove with DryRun
+type PruneResult struct {
+	Versions []InstalledBundle
+	Images   []string
+	Volumes  []string
+	Dirs     []string
+}
+
+// Prune removes the images, volumes and extracted bundle directories of
+// installed bundle versions beyond opts.Keep per bundle name. Images and
+// volumes still used by a kept version or by a container are left alone, as
+// is an image tag that moved to another image since.
+func Prune(cli DockerClient, stateDir string, opts PruneOptions) (*PruneResult, error) {
+	if opts.Keep < 1 {
+		return nil, fmt.Errorf("--keep must be at least 1, the running version is always kept")
+	}
+	release, err := lockInstalled(stateDir)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	installed, err := readInstalled(stateDir)
+	if err != nil {
+		return nil, err
+	}
+	kept, removed := splitRetention(installed, opts.Keep)
+	printInstalled(installed, removed)
+
+	result := &PruneResult{Versions: removed}
+	if len(removed) == 0 {
+		return result, nil
+	}
+
+	ctx := context.Background()
+	containers, err := cli.ContainerList(ctx, container.ListOptions{All: true})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list containers: %w", err)
+	}
+	usedImages := make(map[string]bool)
+	usedVolumes := make(map[string]bool)
+	keptDirs := make(map[string]bool)
+	for _, c := range containers {
+		usedImages[c.ImageID] = true
+		for _, mount := range c.Mounts {
+			if mount.Name != "" {
+				usedVolumes[mount.Name] = true
+			}
+		}
+	}
+	for _, bundle := range kept {
+		for _, img := range bundle.Images {
+			usedImages[img.ID] = true
+			usedImages[img.Name] = true
+		}
+		for _, v := range bundle.Volumes {
+			usedVolumes[v] = true
+		}
+		keptDirs[bundle.Dir] = true
+	}
+
+	for _, bundle := range removed {
+		for _, img := range bundle.Images {
+			if usedImages[img.ID] || usedImages[img.Name] || slices.Contains(result.Images, img.Name) {
+				continue
+			}
+			// The tag may point to a newer image pulled or loaded by hand
+			if inspect, err := cli.ImageInspect(ctx, img.Name); err != nil || inspect.ID != img.ID {
+				continue
+			}
+			if !opts.DryRun {
+				if _, err := cli.ImageRemove(ctx, img.Name, image.RemoveOptions{PruneChildren: true}); err != nil {
+					fmt.Printf("Warning: failed to remove image %s: %v\n", img.Name, err)
+					continue
+				}
+			}
+			result.Images = append(result.Images, img.Name)
+		}
+		if opts.Volumes {
+			for _, v := range bundle.Volumes {
+				if usedVolumes[v] || slices.Contains(result.Volumes, v) {
+					continue
+				}
+				if _, err := cli.VolumeInspect(ctx, v); err != nil {
+					continue
+				}
+				if !opts.DryRun {
+					if err := cli.VolumeRemove(ctx, v, false); err != nil {
+						fmt.Printf("Warning: failed to remove volume %s: %v\n", v, err)
+						continue
+					}
+				}
+				result.Volumes = append(result.Volumes, v)
+			}
+		}
+		if keptDirs[bundle.Dir] || !isBundleDir(bundle) {
+			continue
+		}
+		if !opts.DryRun {
+			if err := os.RemoveAll(bundle.Dir); err != nil {
+				fmt.Printf("Warning: failed to remove %s: %v\n", bundle.Dir, err)
+				continue
+			}
+		}
+		result.Dirs = append(result.Dirs, bundle.Dir)
+	}
+
+	if opts.DryRun {
+		return result, nil
+	}
+	return result, writeInstalled(stateDir, kept)
+}
+
+// splitRetention keeps the newest deployments of each bundle name, the
+// others are removed. Both keep the order of installed.
+func splitRetention(installed []InstalledBundle, keep int) (kept, removed []InstalledBundle) {
+	newest := slices.Clone(installed)
+	slices.SortStableFunc(newest, func(a, b InstalledBundle) int { return b.DeployedAt.Compare(a.DeployedAt) })
+	count := make(map[string]int)
+	keepSet := make(map[string]bool)
+	for _, bundle := range newest {
+		if count[bundle.Name] < keep {
+			keepSet[bundle.Name+"\x00"+bundle.Version] = true
+		}
+		count[bundle.Name]++
+	}
+	for _, bundle := range installed {
+		if keepSet[bundle.Name+"\x00"+bundle.Version] {
+			kept = append(kept, bundle)
+		} else {
+			removed = append(removed, bundle)
+		}
+	}
+	return kept, removed
+}
+
+// isBundleDir reports whether the recorded directory still holds the bundle,
+// so a directory reused for something else is not removed
+func isBundleDir(bundle InstalledBundle) bool {
+	manifest, err := readManifest(bundle.Dir)
+	return err == nil && manifest.Name == bundle.Name && manifest.Version == bundle.Version
+}
+
+// printInstalled lists the installed bundle versions and whether they are pruned
+func printInstalled(installed, removed []InstalledBundle) {
+	if len(installed) == 0 {
+		fmt.Println("No bundles are recorded as installed")
+		return
+	}
+	sorted := slices.Clone(installed)
+	slices.SortStableFunc(sorted, func(a, b InstalledBundle) int {
+		return cmp.Or(strings.Compare(a.Name, b.Name), b.DeployedAt.Compare(a.DeployedAt))
+	})
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tVERSION\tDEPLOYED\tDIRECTORY\tACTION")
+	for _, bundle := range sorted {
+		action := "keep"
+		if slices.ContainsFunc(removed, func(r InstalledBundle) bool { return r.Name == bundle.Name && r.Version == bundle.Version }) {
+			action = "remove"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", bundle.Name, bundle.Version, bundle.DeployedAt.Local().Format(time.DateTime), bundle.Dir, action)
+	}
+	w.Flush()
+	fmt.Println()
+}
+
+func runPrune(args []string) {
+	flags := flag.NewFlagSet("prune", flag.ExitOnError)
+	keep := flags.Int("keep", 3, "Number of the most recently deployed versions of each bundle to keep")
+	volumes := flags.Bool("volumes", false, "Also remove the volumes of pruned versions no kept version or container uses")
+	dryRun := flags.Bool("dry-run", false, "Only list what would be removed")
+	stateDir := flags.String("state-dir", defaultStateDir(), "`Directory` deploy records the installed bundles in")
+	flags.Usage = func() {
+		fmt.Println("Usage: docker-compose-bundler prune [flags]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	result, err := Prune(&lazyDockerClient{}, *stateDir, PruneOptions{Keep: *keep, Volumes: *volumes, DryRun: *dryRun})
+	if err != nil {
+		log.Fatal(err)
+	}
+	verb := "Removed"
+	if *dryRun {
+		verb = "Would remove"
+	}
+	fmt.Printf("%s %d version(s): %d image(s), %d volume(s), %d bundle directory(ies)\n", verb, len(result.Versions), len(result.Images), len(result.Volumes), len(result.Dirs))
+	for _, dir := range result.Dirs {
+		fmt.Printf("  %s\n", filepath.Clean(dir))
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/volume"
+
+	"docker-compose-bundler/dockerclient"
+)
+
+// installVersions extracts a bundle of every version and records them as
+// deployed one hour apart, each with its own app image and data volume
+func installVersions(t *testing.T, fake *dockerclient.Fake, stateDir string, versions ...string) []InstalledBundle {
+	t.Helper()
+	var installed []InstalledBundle
+	deployed := time.Now().Add(-time.Duration(len(versions)) * time.Hour)
+	for _, version := range versions {
+		app := fake.AddImage("shop/app:" + version)
+		fake.AddImage("redis:7")
+		compose := strings.NewReplacer("nginx:1.27", "shop/app:"+version, "1.2.0", version).Replace(webCompose)
+		dir := filepath.Join(t.TempDir(), "shop-"+version)
+		if err := extractBundle(bundleWith(t, fake, Options{}, writeCompose(t, compose)), dir); err != nil {
+			t.Fatal(err)
+		}
+		redis, _ := fake.ImageInspect(t.Context(), "redis:7")
+		data := "shop_data_" + strings.ReplaceAll(version, ".", "")
+		fake.Volumes[data] = volume.Volume{Name: data}
+		installed = append(installed, InstalledBundle{
+			Name: "shop", Version: version, Project: "shop", Dir: dir, DeployedAt: deployed,
+			Images:  []InstalledImage{{Name: "shop/app:" + version, ID: app.ID}, {Name: "redis:7", ID: redis.ID}},
+			Volumes: []string{data},
+		})
+		deployed = deployed.Add(time.Hour)
+	}
+	if err := writeInstalled(stateDir, installed); err != nil {
+		t.Fatal(err)
+	}
+	return installed
+}
+
+func TestPrune(t *testing.T) {
+	fake := dockerclient.NewFake()
+	stateDir := t.TempDir()
+	installed := installVersions(t, fake, stateDir, "1.0.0", "1.1.0", "1.2.0", "1.3.0")
+	// A container still runs the 1.0.0 app image
+	app, _ := fake.ImageInspect(t.Context(), "shop/app:1.0.0")
+	fake.Containers = append(fake.Containers, dockerclient.FakeContainer{Summary: container.Summary{ID: "legacy", ImageID: app.ID}})
+
+	result, err := Prune(fake, stateDir, PruneOptions{Keep: 2, Volumes: true, DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Versions) != 2 || !slices.Equal(result.Images, []string{"shop/app:1.1.0"}) {
+		t.Errorf("dry run removes %d version(s) and images %v, want 2 versions and shop/app:1.1.0", len(result.Versions), result.Images)
+	}
+	if _, err := fake.ImageInspect(t.Context(), "shop/app:1.1.0"); err != nil {
+		t.Error("the dry run removed an image")
+	}
+
+	result, err = Prune(fake, stateDir, PruneOptions{Keep: 2, Volumes: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// redis:7 is shared with the kept versions
+	for _, ref := range []string{"shop/app:1.0.0", "redis:7", "shop/app:1.2.0"} {
+		if _, err := fake.ImageInspect(t.Context(), ref); err != nil {
+			t.Errorf("%s was removed: %v", ref, err)
+		}
+	}
+	if _, err := fake.ImageInspect(t.Context(), "shop/app:1.1.0"); err == nil {
+		t.Error("shop/app:1.1.0 was kept")
+	}
+	if !slices.Equal(result.Volumes, []string{"shop_data_100", "shop_data_110"}) {
+		t.Errorf("removed volumes %v", result.Volumes)
+	}
+	for i, bundle := range installed {
+		_, err := os.Stat(bundle.Dir)
+		if removed := i < 2; removed != os.IsNotExist(err) {
+			t.Errorf("directory of %s: removed %v, want %v", bundle.Version, !removed, removed)
+		}
+	}
+	remaining, err := readInstalled(stateDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(remaining) != 2 || remaining[0].Version != "1.2.0" {
+		t.Errorf("installed.json lists %+v after pruning", remaining)
+	}
+
+	if _, err := Prune(fake, stateDir, PruneOptions{Keep: 0}); err == nil {
+		t.Error("--keep 0 was accepted")
+	}
+}
+
+func TestPruneWaitsForLock(t *testing.T) {
+	fake := dockerclient.NewFake()
+	stateDir := t.TempDir()
+	installVersions(t, fake, stateDir, "1.0.0", "1.1.0")
+
+	release, err := lockInstalled(stateDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.AfterFunc(300*time.Millisecond, release)
+	result, err := Prune(fake, stateDir, PruneOptions{Keep: 1})
+	if err != nil {
+		t.Fatalf("Prune did not wait for the lock: %v", err)
+	}
+	if len(result.Versions) != 1 {
+		t.Errorf("pruned %d version(s), want 1", len(result.Versions))
+	}
+}
+
+func TestRecordDeployment(t *testing.T) {
+	source := dockerclient.NewFake()
+	source.AddImage("nginx:1.27")
+	source.AddImage("redis:7")
+	target := dockerclient.NewFake()
+	stateDir := t.TempDir()
+
+	var loaders []*Loader
+	for _, version := range []string{"1.2.0", "1.3.0", "1.2.0"} {
+		compose := strings.Replace(webCompose, "1.2.0", version, 1)
+		loader, err := LoadArchive(bundleWith(t, source, Options{}, writeCompose(t, compose)), filepath.Join(t.TempDir(), "shop"), target, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		loader.stateDir = stateDir
+		if err := loader.RecordDeployment(); err != nil {
+			t.Fatal(err)
+		}
+		loaders = append(loaders, loader)
+	}
+
+	installed, err := readInstalled(stateDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Deploying 1.2.0 again replaces its earlier record
+	if len(installed) != 2 || installed[0].Version != "1.3.0" || installed[1].Version != "1.2.0" {
+		t.Fatalf("installed.json lists %+v", installed)
+	}
+	if installed[1].Dir != loaders[2].dir && !strings.HasSuffix(installed[1].Dir, filepath.Base(loaders[2].dir)) {
+		t.Errorf("1.2.0 is recorded in %s, want %s", installed[1].Dir, loaders[2].dir)
+	}
+	if len(installed[1].Images) != 2 {
+		t.Errorf("1.2.0 records images %v", installed[1].Images)
+	}
+}
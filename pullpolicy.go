@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Compose pull_policy values, "daily", "weekly" and "every_<duration>"
+// refresh images whose last pull is older than the interval
+const (
+	pullPolicyAlways       = "always"
+	pullPolicyNever        = "never"
+	pullPolicyMissing      = "missing"
+	pullPolicyIfNotPresent = "if_not_present" // Alias of missing
+	pullPolicyBuild        = "build"
+)
+
+// servicePullPolicy returns the pull_policy of a service, missing by default
+func servicePullPolicy(service Service) (string, error) {
+	policy, _ := service.Extra["pull_policy"].(string)
+	switch policy {
+	case "", pullPolicyMissing, pullPolicyIfNotPresent:
+		return pullPolicyMissing, nil
+	case pullPolicyAlways, pullPolicyNever:
+		return policy, nil
+	case pullPolicyBuild:
+		if service.Build == nil {
+			return "", fmt.Errorf("pull_policy build requires a build section")
+		}
+		return policy, nil
+	}
+	if _, err := pullInterval(policy); err != nil {
+		return "", err
+	}
+	return policy, nil
+}
+
+// pullInterval parses the refresh policies daily, weekly and every_<duration>,
+// durations accept the units w, d, h, m and s like compose, e.g. every_1d12h
+func pullInterval(policy string) (time.Duration, error) {
+	switch policy {
+	case "daily":
+		return 24 * time.Hour, nil
+	case "weekly":
+		return 7 * 24 * time.Hour, nil
+	}
+	spec, ok := strings.CutPrefix(policy, "every_")
+	if !ok || spec == "" {
+		return 0, fmt.Errorf("invalid pull_policy %q, use always, never, missing, build, daily, weekly or every_<duration>", policy)
+	}
+
+	var interval time.Duration
+	units := map[byte]time.Duration{'w': 7 * 24 * time.Hour, 'd': 24 * time.Hour, 'h': time.Hour, 'm': time.Minute, 's': time.Second}
+	for spec != "" {
+		i := strings.IndexFunc(spec, func(r rune) bool { return r < '0' || r > '9' })
+		if i <= 0 {
+			return 0, fmt.Errorf("invalid pull_policy %q: duration needs a unit", policy)
+		}
+		n, err := strconv.Atoi(spec[:i])
+		unit, ok := units[spec[i]]
+		if err != nil || !ok {
+			return 0, fmt.Errorf("invalid pull_policy %q: unknown duration %s", policy, spec)
+		}
+		interval += time.Duration(n) * unit
+		spec = spec[i+1:]
+	}
+	return interval, nil
+}
+
+// pullImageWithPolicy makes sure imageName is available locally as the
+// service's pull_policy demands
+func (b *Bundler) pullImageWithPolicy(imageName, policy, platform string) (err error) {
+	defer b.span("pull", attribute.String("image", imageName), attribute.String("pull_policy", policy))(&err)
+	if b.shared != nil {
+		defer b.shared.lock(imageName)()
+	}
+
+	inspect, inspectErr := b.client.ImageInspect(b.ctx, imageName)
+	exists := inspectErr == nil
+	if exists && b.shared != nil && b.shared.wasPulled(imageName) {
+		b.decidef("Image %s was pulled for another bundle", imageName)
+		b.stats.CacheHits++
+		return nil
+	}
+	switch policy {
+	case pullPolicyMissing, pullPolicyNever:
+		if exists {
+			b.decidef("Image %s already exists locally", imageName)
+			b.stats.CacheHits++
+			return nil
+		}
+		if policy == pullPolicyNever {
+			return fmt.Errorf("image %s does not exist locally and pull_policy is never", imageName)
+		}
+		b.decidef("Pulling image %s...", imageName)
+		return b.pullWithBackoff(imageName, platform)
+	case pullPolicyAlways:
+	default:
+		interval, err := pullInterval(policy)
+		if err != nil {
+			return err
+		}
+		// The daemon updates LastTagTime when a pull tags the image
+		if exists && !inspect.Metadata.LastTagTime.IsZero() && time.Since(inspect.Metadata.LastTagTime) < interval {
+			b.decidef("Image %s was pulled within %s", imageName, interval)
+			b.stats.CacheHits++
+			return nil
+		}
+	}
+
+	b.decidef("Pulling image %s (pull_policy %s)...", imageName, policy)
+	if err := b.pullWithBackoff(imageName, platform); err != nil {
+		return err
+	}
+	if exists {
+		// Refreshed, but the image was there before and stays after bundling
+		delete(b.freshlyPulledImages, imageName)
+	}
+	return nil
+}
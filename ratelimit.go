@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/distribution/reference"
+)
+
+// dockerHubRegistry serves the rate limit headers, HEAD requests for its
+// ratelimitpreview/test repository do not count against the quota
+const (
+	dockerHubRegistry  = "registry-1.docker.io"
+	dockerHubQuotaRepo = "ratelimitpreview/test"
+)
+
+// rateLimitBackoff is how long to wait before retrying a rate-limited pull
+var rateLimitBackoff = []time.Duration{15 * time.Second, 30 * time.Second, 60 * time.Second}
+
+// hubQuota is the Docker Hub pull quota of this host (per IP when anonymous)
+type hubQuota struct {
+	Limit     int
+	Remaining int
+	Window    time.Duration
+}
+
+// hubRegistryClient queries Docker Hub anonymously, giving up quickly on
+// hosts without internet access
+func hubRegistryClient() *registryClient {
+	reg := newRegistryClient(dockerHubRegistry, false, "", "", nil)
+	reg.http.Timeout = 10 * time.Second
+	return reg
+}
+
+// queryHubQuota reads the quota from the ratelimit headers, nil if Docker Hub
+// reports no limit (e.g. for paid accounts)
+func queryHubQuota(reg *registryClient) (*hubQuota, error) {
+	resp, err := reg.do(http.MethodHead, "/v2/"+dockerHubQuotaRepo+"/manifests/latest", "repository:"+dockerHubQuotaRepo+":pull")
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("docker hub returned %s", resp.Status)
+	}
+
+	limit, window, ok := parseRateLimitHeader(resp.Header.Get("ratelimit-limit"))
+	if !ok {
+		return nil, nil
+	}
+	remaining, _, ok := parseRateLimitHeader(resp.Header.Get("ratelimit-remaining"))
+	if !ok {
+		return nil, nil
+	}
+	return &hubQuota{Limit: limit, Remaining: remaining, Window: window}, nil
+}
+
+// parseRateLimitHeader parses values like "100;w=21600"
+func parseRateLimitHeader(value string) (int, time.Duration, bool) {
+	count, params, _ := strings.Cut(value, ";")
+	n, err := strconv.Atoi(strings.TrimSpace(count))
+	if err != nil {
+		return 0, 0, false
+	}
+	var window time.Duration
+	if seconds, ok := strings.CutPrefix(strings.TrimSpace(params), "w="); ok {
+		if s, err := strconv.Atoi(seconds); err == nil {
+			window = time.Duration(s) * time.Second
+		}
+	}
+	return n, window, true
+}
+
+// isDockerHubImage reports whether an image is pulled from Docker Hub
+func isDockerHubImage(imageName string) bool {
+	named, err := reference.ParseNormalizedNamed(imageName)
+	return err == nil && reference.Domain(named) == "docker.io"
+}
+
+// isRateLimited reports whether a pull failed because of the registry's rate limit
+func isRateLimited(err error) bool {
+	message := strings.ToLower(err.Error())
+	return strings.Contains(message, "toomanyrequests") || strings.Contains(message, "pull rate limit")
+}
+
+const hubQuotaAdvice = `Log in with "docker login" to raise the limit, or configure a pull-through
+mirror as "registry-mirrors" in /etc/docker/daemon.json`
+
+// checkHubQuota reports the Docker Hub pull quota before any image is pulled
+// and warns if it does not cover the images that still have to be pulled
+func (b *Bundler) checkHubQuota(compose *DockerCompose) {
+	var pending []string
+	for _, imageName := range pulledImages(compose) {
+		if !isDockerHubImage(imageName) {
+			continue
+		}
+		if _, err := b.client.ImageInspect(b.ctx, imageName); err != nil {
+			pending = append(pending, imageName)
+		}
+	}
+	if len(pending) == 0 {
+		return
+	}
+
+	quota, err := queryHubQuota(hubRegistryClient())
+	if err != nil {
+		b.warnf("failed to query the Docker Hub pull quota: %v", err)
+		return
+	}
+	if quota == nil {
+		return
+	}
+	b.hubQuota, b.hubPulls = quota, 0
+	fmt.Printf("Docker Hub pull quota: %d of %d left (per %s), %d image(s) to pull\n", quota.Remaining, quota.Limit, quota.Window, len(pending))
+	if quota.Remaining < len(pending) {
+		b.warnf("the Docker Hub pull quota does not cover all %d images, the run will fail after %d pull(s).\n%s", len(pending), quota.Remaining, hubQuotaAdvice)
+	}
+}
+
+// pullWithBackoff pulls an image, retrying when the registry rate-limits.
+// An exhausted Docker Hub quota is not retried, it only resets after hours.
+func (b *Bundler) pullWithBackoff(imageName, platform string) (err error) {
+	defer func() {
+		if err != nil {
+			err = &pullError{err: err}
+		}
+	}()
+	for attempt := 0; ; attempt++ {
+		err := b.pullImage(imageName, platform)
+		if err == nil {
+			b.stats.Pulls++
+			if b.shared != nil {
+				b.shared.markPulled(imageName)
+			}
+			if isDockerHubImage(imageName) && b.hubQuota != nil {
+				b.hubPulls++
+				fmt.Printf("Docker Hub pull quota: about %d left\n", max(b.hubQuota.Remaining-b.hubPulls, 0))
+			}
+			return nil
+		}
+		if !isRateLimited(err) {
+			return err
+		}
+
+		if isDockerHubImage(imageName) {
+			if quota, qerr := queryHubQuota(hubRegistryClient()); qerr == nil && quota != nil && quota.Remaining == 0 {
+				return fmt.Errorf("pull quota of Docker Hub exhausted (%d per %s): %w\n%s", quota.Limit, quota.Window, err, hubQuotaAdvice)
+			}
+		}
+		if attempt == len(rateLimitBackoff) {
+			return fmt.Errorf("still rate-limited after %d retries: %w", attempt, err)
+		}
+		b.warnf("pull of %s was rate-limited, retrying in %s", imageName, rateLimitBackoff[attempt])
+		time.Sleep(rateLimitBackoff[attempt])
+	}
+}
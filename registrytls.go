@@ -0,0 +1,69 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// registryTLS holds the --registry-ca, --registry-cert and --registry-key
+// flags. Values are a file or host=file to apply only to that registry.
+type registryTLS struct {
+	CAs   stringList
+	Certs stringList
+	Keys  stringList
+}
+
+// registryFile returns the file of the last value that applies to host
+func registryFile(values []string, host string) string {
+	file := ""
+	for _, value := range values {
+		if target, path, ok := strings.Cut(value, "="); ok && !strings.ContainsAny(target, `/\`) {
+			if target == host {
+				file = path
+			}
+			continue
+		}
+		file = value
+	}
+	return file
+}
+
+// config builds the TLS configuration for host, nil if no flag applies to it
+func (r registryTLS) config(host string) (*tls.Config, error) {
+	caFile := registryFile(r.CAs, host)
+	certFile := registryFile(r.Certs, host)
+	keyFile := registryFile(r.Keys, host)
+	if caFile == "" && certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read registry CA: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in registry CA %s", caFile)
+		}
+		config.RootCAs = pool
+	}
+	if (certFile == "") != (keyFile == "") {
+		return nil, fmt.Errorf("--registry-cert and --registry-key must be given together for %s", host)
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load registry client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	runReportName          = "run-report.json"
+	runReportSchemaVersion = 1
+)
+
+// runReport documents how a bundle was produced: the tool, flags and inputs,
+// the resolved images, the decisions taken and warnings printed on the way,
+// and how long each step took
+type runReport struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	Tool          ReportTool        `json:"tool"`
+	Command       string            `json:"command"`
+	Args          []string          `json:"args"`
+	Flags         map[string]string `json:"flags,omitempty"` // Flags given on the command line
+	StartedAt     time.Time         `json:"startedAt"`
+	FinishedAt    *time.Time        `json:"finishedAt,omitempty"` // Unset in the copy inside the bundle
+	Status        string            `json:"status"`               // succeeded, failed or archiving
+	Error         string            `json:"error,omitempty"`
+	Output        string            `json:"output,omitempty"`
+	Name          string            `json:"name,omitempty"`
+	Version       string            `json:"version,omitempty"`
+	Inputs        []ReportInput     `json:"inputs"`
+	Images        []ReportImage     `json:"images"`
+	Decisions     []string          `json:"decisions"`
+	Warnings      []string          `json:"warnings"`
+	Lint          []string          `json:"lint,omitempty"`
+	Timings       []ReportTiming    `json:"timings"`
+
+	TargetRewrites []string `json:"targetRewrites,omitempty"` // Changes deploy made to the compose file for the target site
+}
+
+// ReportTool identifies the bundler binary that produced a bundle
+type ReportTool struct {
+	Version   string `json:"version"`
+	Revision  string `json:"revision,omitempty"`
+	GoVersion string `json:"goVersion"`
+	Platform  string `json:"platform"`
+}
+
+// ReportInput is a file the bundle was produced from
+type ReportInput struct {
+	Kind   string `json:"kind"` // compose, override, values or hosts-map
+	Path   string `json:"path"`
+	SHA256 string `json:"sha256"`
+}
+
+// ReportImage is the image a service resolved to
+type ReportImage struct {
+	Service string `json:"service"`
+	Image   string `json:"image"`
+	Source  string `json:"source"` // built or pulled
+	ID      string `json:"id,omitempty"`
+	Digest  string `json:"digest,omitempty"`
+}
+
+// ReportTiming is the duration of one traced step
+type ReportTiming struct {
+	Step     string    `json:"step"`
+	Target   string    `json:"target,omitempty"`
+	Started  time.Time `json:"startedAt"`
+	Seconds  float64   `json:"seconds"`
+	Failed   bool      `json:"failed,omitempty"`
+	finished bool
+}
+
+// currentTool identifies the running binary
+func currentTool() ReportTool {
+	tool := ReportTool{Version: "(devel)", GoVersion: runtime.Version(), Platform: runtime.GOOS + "/" + runtime.GOARCH}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		tool.Version = info.Main.Version
+		for _, setting := range info.Settings {
+			if setting.Key == "vcs.revision" {
+				tool.Revision = setting.Value
+			}
+		}
+	}
+	return tool
+}
+
+func newRunReport(opts Options) *runReport {
+	args := []string{}
+	if len(os.Args) > 1 {
+		args = os.Args[1:]
+	}
+	return &runReport{
+		SchemaVersion: runReportSchemaVersion,
+		Tool:          currentTool(),
+		Command:       filepath.Base(os.Args[0]),
+		Args:          args,
+		Flags:         opts.Flags,
+		StartedAt:     time.Now().UTC(),
+		Inputs:        []ReportInput{},
+		Images:        []ReportImage{},
+		Decisions:     []string{},
+		Warnings:      []string{},
+		Timings:       []ReportTiming{},
+	}
+}
+
+// warnf prints a warning and records it in the run report
+func (b *Bundler) warnf(format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	fmt.Printf("Warning: %s\n", message)
+	b.report.Warnings = append(b.report.Warnings, message)
+}
+
+// decidef prints a decision taken while bundling and records it in the run report
+func (b *Bundler) decidef(format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	fmt.Println(message)
+	b.recordDecisions(message)
+}
+
+// recordDecisions records decisions that were already printed
+func (b *Bundler) recordDecisions(messages ...string) {
+	b.report.Decisions = append(b.report.Decisions, messages...)
+}
+
+// startTiming records the start of a traced step, the returned function its end
+func (b *Bundler) startTiming(step string, attrs []attribute.KeyValue) func(failed bool) {
+	var target string
+	if len(attrs) > 0 {
+		target = attrs[0].Value.Emit()
+	}
+	i := len(b.report.Timings)
+	b.report.Timings = append(b.report.Timings, ReportTiming{Step: step, Target: target, Started: time.Now()})
+	return func(failed bool) {
+		timing := &b.report.Timings[i]
+		timing.Seconds = time.Since(timing.Started).Round(time.Millisecond).Seconds()
+		timing.Failed, timing.finished = failed, true
+	}
+}
+
+// recordInputs hashes the files the bundle is produced from
+func (b *Bundler) recordInputs(composeFile string) {
+	inputs := []ReportInput{{Kind: "compose", Path: composeFile}}
+	for _, override := range b.opts.Overrides {
+		inputs = append(inputs, ReportInput{Kind: "override", Path: override})
+	}
+	if b.opts.Values != "" {
+		inputs = append(inputs, ReportInput{Kind: "values", Path: b.opts.Values})
+	}
+	if b.opts.HostsMap != "" {
+		inputs = append(inputs, ReportInput{Kind: "hosts-map", Path: b.opts.HostsMap})
+	}
+	for i := range inputs {
+		if _, digest, err := fileDigest(inputs[i].Path); err == nil {
+			inputs[i].SHA256 = digest
+		}
+	}
+	b.report.Inputs = inputs
+}
+
+// recordImages records the images the services resolved to, with their IDs
+// once they are saved into the manifest
+func (b *Bundler) recordImages(manifest *Manifest) {
+	built := make(map[string]bool)
+	for _, record := range b.builds {
+		built[record.Image] = true
+	}
+	ids := make(map[string]string)
+	if manifest != nil {
+		for _, img := range manifest.Images {
+			ids[img.Name] = img.ID
+		}
+	}
+
+	images := []ReportImage{}
+	for _, service := range slices.Sorted(maps.Keys(b.lock.Services)) {
+		locked := b.lock.Services[service]
+		image := ReportImage{Service: service, Image: locked.Image, Source: "pulled", ID: ids[locked.Image], Digest: locked.Digest}
+		if built[locked.Image] || locked.BaseImages != nil {
+			image.Source = "built"
+		}
+		images = append(images, image)
+	}
+	b.report.Name, b.report.Version = b.stats.Name, b.stats.Version
+	b.report.Images = images
+	b.report.Lint = b.lint
+}
+
+func (r *runReport) marshal() ([]byte, error) {
+	// Steps still running, e.g. the archive in the copy inside the bundle, are left out
+	report := *r
+	report.Timings = []ReportTiming{}
+	for _, timing := range r.Timings {
+		if timing.finished {
+			report.Timings = append(report.Timings, timing)
+		}
+	}
+	data, err := json.MarshalIndent(&report, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+// embedRunReport writes the report as it is before archiving into the bundle
+func (b *Bundler) embedRunReport(bundleDir, outputFile string) error {
+	path := filepath.Join(bundleDir, runReportName)
+	if !b.opts.EmbedRunReport {
+		// An appended bundle must not keep the report of the original run
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	b.report.Status, b.report.Output = "archiving", filepath.Base(outputFile)
+	data, err := b.report.marshal()
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// runReportPath returns where the report of a run writing outputFile is stored
+func (b *Bundler) runReportPath(outputFile string) string {
+	if b.opts.RunReport != "" {
+		return b.opts.RunReport
+	}
+	return filepath.Join(filepath.Dir(outputFile), runReportName)
+}
+
+// writeRunReport completes the report with the outcome of the run and writes
+// it next to the output, failed runs included
+func (b *Bundler) writeRunReport(outputFile string, runErr error) error {
+	if b.dryRun() {
+		return nil
+	}
+	finished := time.Now().UTC()
+	b.report.FinishedAt, b.report.Status, b.report.Output = &finished, "succeeded", outputFile
+	if runErr != nil {
+		b.report.Status, b.report.Error = "failed", runErr.Error()
+		if b.lock != nil && len(b.report.Images) == 0 {
+			b.recordImages(nil)
+		}
+	}
+
+	data, err := b.report.marshal()
+	if err != nil {
+		return err
+	}
+	path := b.runReportPath(outputFile)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("failed to write run report: %w", err)
+	}
+	fmt.Printf("Run report written to %s\n", path)
+	return nil
+}
@@ -0,0 +1,33 @@
+package main
+
+import "github.com/docker/docker/api/types/image"
+
+// retagImage tags imageName as retagged, the name composetransform gave it
+// under the retag prefix
+func (b *Bundler) retagImage(imageName, retagged string) error {
+	if b.dryRun() {
+		return nil
+	}
+	b.decidef("Retagging %s as %s...", imageName, retagged)
+	if err := b.client.ImageTag(b.ctx, imageName, retagged); err != nil {
+		return err
+	}
+	b.retaggedImages[retagged] = true
+	return nil
+}
+
+// cleanupRetaggedImages removes the tags created for the bundle, the images
+// themselves stay as long as their original tag exists
+func (b *Bundler) cleanupRetaggedImages() {
+	if b.shared != nil {
+		b.shared.keep(nil, b.retaggedImages)
+		return
+	}
+	for imageName := range b.retaggedImages {
+		_, err := b.client.ImageRemove(b.ctx, imageName, image.RemoveOptions{})
+		if err != nil {
+			b.warnf("failed to remove tag %s: %v", imageName, err)
+		}
+		delete(b.retaggedImages, imageName)
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"time"
+)
+
+// runLockSuffix marks a file a bundler run is writing, next to the file itself
+const runLockSuffix = ".inprogress"
+
+// runLock is the owner of a file being written, recorded in its lock file
+type runLock struct {
+	PID     int       `json:"pid"`
+	Host    string    `json:"host"`
+	Started time.Time `json:"started"`
+}
+
+// acquireRunLock makes sure no other bundler run writes path at the same
+// time. The lock is advisory: a lock file created exclusively next to path.
+// Locks of processes that no longer run on this host are stale and taken over.
+func acquireRunLock(path string) (release func(), err error) {
+	lockPath := path + runLockSuffix
+	host, _ := os.Hostname()
+	owner := runLock{PID: os.Getpid(), Host: host, Started: time.Now().UTC()}
+	data, err := json.Marshal(owner)
+	if err != nil {
+		return nil, err
+	}
+
+	for attempt := 0; ; attempt++ {
+		created, err := createLockFile(lockPath, data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to lock %s: %w", path, err)
+		}
+		if created {
+			return func() { os.Remove(lockPath) }, nil
+		}
+
+		other, stale := readRunLock(lockPath, host)
+		if other != nil && stale {
+			err = takeOverRunLock(lockPath, host, other, data)
+			if err != nil {
+				return nil, err
+			}
+		}
+		// A lock that was released or is taken over is retried, for a while
+		if stale && attempt < runLockRetries {
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+		if other == nil {
+			return nil, fmt.Errorf("another bundle is in progress for %s, remove %s if no other run is writing it", path, lockPath)
+		}
+		return nil, fmt.Errorf("another bundle is in progress for %s (pid %d on %s since %s), remove %s if that run is gone",
+			path, other.PID, other.Host, other.Started.Local().Format(time.DateTime), lockPath)
+	}
+}
+
+// runLockRetries bounds the retries of acquireRunLock when the lock changes under it
+const runLockRetries = 100
+
+// createLockFile creates lockPath with data unless it exists. The data is
+// written to a temporary file first and linked into place, so others never
+// read a lock without its owner. File systems without hard links, like
+// FAT32 media, fall back to an exclusive create.
+func createLockFile(lockPath string, data []byte) (bool, error) {
+	temp, err := os.CreateTemp(filepath.Dir(lockPath), filepath.Base(lockPath)+".*")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(temp.Name())
+	_, err = temp.Write(data)
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return false, err
+	}
+
+	err = os.Link(temp.Name(), lockPath)
+	if errors.Is(err, os.ErrExist) {
+		return false, nil
+	}
+	if err == nil {
+		return true, nil
+	}
+
+	file, err := os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if errors.Is(err, os.ErrExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	_, err = file.Write(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(lockPath)
+		return false, err
+	}
+	return true, nil
+}
+
+// takeOverRunLock removes the stale lock of a gone process. Only the run
+// holding the takeover guard next to the lock removes it, after checking the
+// lock still belongs to the gone process, so runs taking over at the same
+// time cannot remove the new lock of another.
+func takeOverRunLock(lockPath, host string, stale *runLock, data []byte) error {
+	guardPath := lockPath + ".takeover"
+	created, err := createLockFile(guardPath, data)
+	if err != nil {
+		return fmt.Errorf("failed to take over the stale lock %s: %w", lockPath, err)
+	}
+	if !created {
+		if other, guardStale := readRunLock(guardPath, host); other != nil && guardStale {
+			return fmt.Errorf("a run taking over the stale lock %s is gone, remove %s", lockPath, guardPath)
+		}
+		// Another run is taking over
+		return nil
+	}
+	defer os.Remove(guardPath)
+
+	current, _ := readRunLock(lockPath, host)
+	if current == nil || current.PID != stale.PID || current.Host != stale.Host || !current.Started.Equal(stale.Started) {
+		return nil
+	}
+	fmt.Printf("Warning: taking over the stale lock of pid %d on %s\n", stale.PID, stale.Host)
+	if err := os.Remove(lockPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove the stale lock %s: %w", lockPath, err)
+	}
+	return nil
+}
+
+// waitRunLock is acquireRunLock for short updates of shared files, another
+// run holding the lock is waited for up to timeout
+func waitRunLock(path string, timeout time.Duration) (release func(), err error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		release, err = acquireRunLock(path)
+		if err == nil || time.Now().After(deadline) {
+			return release, err
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// readRunLock returns the owner of a lock file and whether it is stale.
+// Owners on other hosts cannot be checked and are never stale.
+func readRunLock(lockPath, host string) (*runLock, bool) {
+	data, err := os.ReadFile(lockPath)
+	if err != nil {
+		// Removed in the meantime, the caller tries again
+		return nil, os.IsNotExist(err)
+	}
+	var owner runLock
+	if err := json.Unmarshal(data, &owner); err != nil || owner.PID == 0 {
+		// The owner may not have written it yet
+		return nil, false
+	}
+	return &owner, owner.Host == host && !processAlive(owner.PID)
+}
+
+// processAlive tells whether a process with the pid runs on this host
+func processAlive(pid int) bool {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	// FindProcess only fails for missing processes on Windows, signals are not supported there
+	if runtime.GOOS == "windows" {
+		return true
+	}
+	err = process.Signal(syscall.Signal(0))
+	return err == nil || errors.Is(err, os.ErrPermission)
+}
+
+// lockBundleFiles locks the bundle a command reads and the one it writes
+func lockBundleFiles(bundleFile, outputFile string) (release func(), err error) {
+	var releases []func()
+	release = func() {
+		for _, r := range releases {
+			r()
+		}
+	}
+	paths := []string{bundleFile}
+	if outputFile != bundleFile {
+		paths = append(paths, outputFile)
+	}
+	for _, path := range paths {
+		r, err := acquireRunLock(path)
+		if err != nil {
+			release()
+			return nil, err
+		}
+		releases = append(releases, r)
+	}
+	return release, nil
+}
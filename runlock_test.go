@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// writeStaleLock writes the lock of a process that exited on this host
+func writeStaleLock(t *testing.T, path string) {
+	t.Helper()
+	cmd := exec.Command("true")
+	if err := cmd.Run(); err != nil {
+		t.Skipf("no process to take the pid of: %v", err)
+	}
+	host, _ := os.Hostname()
+	data, err := json.Marshal(runLock{PID: cmd.ProcessState.Pid(), Host: host, Started: time.Now().UTC()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path+runLockSuffix, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRunLockTakesOverStaleLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bundle.tar.gz")
+	writeStaleLock(t, path)
+	release, err := acquireRunLock(path)
+	if err != nil {
+		t.Fatalf("the stale lock was not taken over: %v", err)
+	}
+	if _, err := acquireRunLock(path); err == nil {
+		t.Error("a held lock was acquired again")
+	}
+	release()
+	if _, err := os.Stat(path + runLockSuffix + ".takeover"); !os.IsNotExist(err) {
+		t.Errorf("the takeover guard is left: %v", err)
+	}
+}
+
+func TestRunLockConcurrentTakeovers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bundle.tar.gz")
+	for round := 0; round < 20; round++ {
+		writeStaleLock(t, path)
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		var releases []func()
+		start := make(chan struct{})
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				<-start
+				if release, err := acquireRunLock(path); err == nil {
+					mu.Lock()
+					releases = append(releases, release)
+					mu.Unlock()
+				}
+			}()
+		}
+		close(start)
+		wg.Wait()
+		if len(releases) != 1 {
+			t.Fatalf("round %d: %d runs hold the lock, want 1", round, len(releases))
+		}
+		releases[0]()
+	}
+}
+
+func TestRunLockTakeoverInterleaved(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bundle.tar.gz")
+	lockPath := path + runLockSuffix
+	host, _ := os.Hostname()
+	writeStaleLock(t, path)
+	// Both runs read the stale lock before either took it over
+	stale, isStale := readRunLock(lockPath, host)
+	if stale == nil || !isStale {
+		t.Fatalf("the lock is not stale: %v", stale)
+	}
+	release, err := acquireRunLock(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	if err := takeOverRunLock(lockPath, host, stale, []byte(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+	if owner, _ := readRunLock(lockPath, host); owner == nil || owner.PID != os.Getpid() {
+		t.Fatalf("the late takeover removed the new lock, the owner is %v", owner)
+	}
+	if _, err := acquireRunLock(path); err == nil {
+		t.Error("the late run acquired the lock too")
+	}
+}
+
+func TestRunLockVanishingLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bundle.tar.gz")
+	host, _ := os.Hostname()
+	// Another run holding the lock only briefly, acquiring must never see a lock without owner
+	data, err := json.Marshal(runLock{PID: os.Getpid(), Host: host, Started: time.Now().UTC()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if os.WriteFile(path+runLockSuffix, data, 0644) == nil {
+				os.Remove(path + runLockSuffix)
+			}
+		}
+	}()
+
+	acquired := 0
+	for i := 0; i < 2000; i++ {
+		release, err := acquireRunLock(path)
+		if err == nil {
+			acquired++
+			release()
+		}
+	}
+	if acquired == 0 {
+		t.Error("the lock was never acquired while it was free in between")
+	}
+}
+
+func TestReadRunLockMissing(t *testing.T) {
+	other, retry := readRunLock(filepath.Join(t.TempDir(), "missing"+runLockSuffix), "host")
+	if other != nil || !retry {
+		t.Errorf("readRunLock of a missing lock returned %v, %v", other, retry)
+	}
+}
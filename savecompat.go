@@ -0,0 +1,378 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Formats of saved image tars. Docker Engine 25+ saves an OCI image layout
+// with a Docker manifest.json for compatibility, older engines only know the
+// legacy layout of <id>.json configs and <layer>/layer.tar directories.
+const (
+	saveFormatLegacy = "docker-legacy"
+	saveFormatOCI    = "oci"
+)
+
+const (
+	ociLayoutFile         = "oci-layout"
+	ociIndexMediaType     = "application/vnd.oci.image.index.v1+json"
+	ociManifestMediaType  = "application/vnd.oci.image.manifest.v1+json"
+	ociConfigMediaType    = "application/vnd.oci.image.config.v1+json"
+	ociLayerMediaType     = "application/vnd.oci.image.layer.v1.tar"
+	maxImageMetadataBytes = 16 << 20 // Configs, manifests and indexes are kept in memory
+)
+
+func parseSaveCompat(format string) (string, error) {
+	switch format {
+	case "", saveFormatLegacy, saveFormatOCI:
+		return format, nil
+	}
+	return "", fmt.Errorf("invalid save format %q, use docker-legacy or oci", format)
+}
+
+// savedEntry is a file of a saved image tar
+type savedEntry struct {
+	size   int64
+	digest string // Hex encoded sha256
+	magic  []byte // First bytes, to tell compressed layers apart
+	data   []byte // Content of small files
+}
+
+// savedManifest is an entry of the manifest.json of docker save, unknown
+// fields are kept
+type savedManifest struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+	extra    map[string]json.RawMessage
+}
+
+func (m *savedManifest) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &m.extra); err != nil {
+		return err
+	}
+	for key, target := range map[string]interface{}{"Config": &m.Config, "RepoTags": &m.RepoTags, "Layers": &m.Layers} {
+		if raw, ok := m.extra[key]; ok {
+			if err := json.Unmarshal(raw, target); err != nil {
+				return fmt.Errorf("invalid %s in manifest.json: %w", key, err)
+			}
+			delete(m.extra, key)
+		}
+	}
+	return nil
+}
+
+func (m savedManifest) MarshalJSON() ([]byte, error) {
+	fields := make(map[string]interface{}, len(m.extra)+3)
+	for key, value := range m.extra {
+		fields[key] = value
+	}
+	fields["Config"], fields["RepoTags"], fields["Layers"] = m.Config, m.RepoTags, m.Layers
+	return json.Marshal(fields)
+}
+
+// scanImageTar reads every entry of a saved image once, hashing the content
+// and keeping small metadata files
+func scanImageTar(tarPath string) (map[string]*savedEntry, error) {
+	file, err := os.Open(tarPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	entries := make(map[string]*savedEntry)
+	tr := tar.NewReader(file)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		entry := &savedEntry{size: header.Size}
+		hash := sha256.New()
+		var head bytes.Buffer
+		writers := []io.Writer{hash, &head}
+		if header.Size > maxImageMetadataBytes || path.Base(header.Name) == "layer.tar" {
+			writers = []io.Writer{hash, &limitedBuffer{buf: &head, remaining: 4}}
+		}
+		if _, err := io.Copy(io.MultiWriter(writers...), tr); err != nil {
+			return nil, err
+		}
+		entry.digest = hex.EncodeToString(hash.Sum(nil))
+		entry.magic = head.Bytes()[:min(4, head.Len())]
+		if header.Size <= maxImageMetadataBytes && path.Base(header.Name) != "layer.tar" {
+			entry.data = head.Bytes()
+		}
+		entries[path.Clean(header.Name)] = entry
+	}
+}
+
+// limitedBuffer keeps the first bytes written to it
+type limitedBuffer struct {
+	buf       *bytes.Buffer
+	remaining int
+}
+
+func (l *limitedBuffer) Write(p []byte) (int, error) {
+	if l.remaining > 0 {
+		n := min(l.remaining, len(p))
+		l.buf.Write(p[:n])
+		l.remaining -= n
+	}
+	return len(p), nil
+}
+
+// readSavedManifests returns the manifest.json of a scanned image tar
+func readSavedManifests(tarPath string, entries map[string]*savedEntry) ([]savedManifest, error) {
+	manifestEntry, ok := entries["manifest.json"]
+	if !ok || manifestEntry.data == nil {
+		return nil, fmt.Errorf("%s has no manifest.json", tarPath)
+	}
+	var manifests []savedManifest
+	if err := json.Unmarshal(manifestEntry.data, &manifests); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest.json: %w", err)
+	}
+	return manifests, nil
+}
+
+// imageTarLayers returns the sha256 of the layer files of the first image of
+// a saved image tar, base first
+func imageTarLayers(tarPath string) ([]string, error) {
+	entries, err := scanImageTar(tarPath)
+	if err != nil {
+		return nil, err
+	}
+	manifests, err := readSavedManifests(tarPath, entries)
+	if err != nil || len(manifests) == 0 {
+		return nil, err
+	}
+	var layers []string
+	for _, layer := range manifests[0].Layers {
+		entry, ok := entries[path.Clean(layer)]
+		if !ok {
+			return nil, fmt.Errorf("manifest.json references the missing layer %s", layer)
+		}
+		layers = append(layers, entry.digest)
+	}
+	return layers, nil
+}
+
+// imageTarFormat tells whether a saved image uses the OCI or the legacy layout
+func imageTarFormat(tarPath string) (string, error) {
+	file, err := os.Open(tarPath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	tr := tar.NewReader(file)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return saveFormatLegacy, nil
+		}
+		if err != nil {
+			return "", err
+		}
+		if path.Clean(header.Name) == ociLayoutFile {
+			return saveFormatOCI, nil
+		}
+	}
+}
+
+// convertImageTar rewrites a saved image into the given format in place.
+// Layers are copied unchanged, only their paths and the metadata change.
+func convertImageTar(tarPath, format string) error {
+	current, err := imageTarFormat(tarPath)
+	if err != nil {
+		return err
+	}
+	if current == format {
+		return nil
+	}
+
+	entries, err := scanImageTar(tarPath)
+	if err != nil {
+		return err
+	}
+	manifests, err := readSavedManifests(tarPath, entries)
+	if err != nil {
+		return err
+	}
+
+	// Target path of every copied entry, and the metadata files to write
+	renames := make(map[string]string)
+	metadata := make(map[string][]byte)
+	var index []map[string]interface{}
+	repositories := make(map[string]map[string]string)
+	for i := range manifests {
+		m := &manifests[i]
+		config, ok := entries[path.Clean(m.Config)]
+		if !ok || config.data == nil {
+			return fmt.Errorf("manifest.json references the missing config %s", m.Config)
+		}
+
+		var layers []map[string]interface{}
+		for j, layer := range m.Layers {
+			entry, ok := entries[path.Clean(layer)]
+			if !ok {
+				return fmt.Errorf("manifest.json references the missing layer %s", layer)
+			}
+			target := "blobs/sha256/" + entry.digest
+			if format == saveFormatLegacy {
+				if bytes.HasPrefix(entry.magic, zstdMagic) {
+					return fmt.Errorf("layer %s is zstd compressed, which engines that need the legacy format cannot load", layer)
+				}
+				target = entry.digest + "/layer.tar"
+			}
+			renames[path.Clean(layer)] = target
+			m.Layers[j] = target
+			layers = append(layers, map[string]interface{}{"mediaType": layerMediaType(entry.magic), "digest": "sha256:" + entry.digest, "size": entry.size})
+		}
+
+		if format == saveFormatLegacy {
+			m.Config = config.digest + ".json"
+			metadata[m.Config] = config.data
+			for _, repoTag := range m.RepoTags {
+				if i := strings.LastIndex(repoTag, ":"); i > 0 && len(m.Layers) > 0 {
+					repo, tag := repoTag[:i], repoTag[i+1:]
+					if repositories[repo] == nil {
+						repositories[repo] = make(map[string]string)
+					}
+					repositories[repo][tag] = strings.TrimSuffix(m.Layers[len(m.Layers)-1], "/layer.tar")
+				}
+			}
+			continue
+		}
+
+		m.Config = "blobs/sha256/" + config.digest
+		metadata[m.Config] = config.data
+		manifestData, err := json.Marshal(map[string]interface{}{
+			"schemaVersion": 2,
+			"mediaType":     ociManifestMediaType,
+			"config":        map[string]interface{}{"mediaType": ociConfigMediaType, "digest": "sha256:" + config.digest, "size": config.size},
+			"layers":        layers,
+		})
+		if err != nil {
+			return err
+		}
+		manifestSum := sha256.Sum256(manifestData)
+		manifestDigest := hex.EncodeToString(manifestSum[:])
+		metadata["blobs/sha256/"+manifestDigest] = manifestData
+		for _, repoTag := range m.RepoTags {
+			descriptor := map[string]interface{}{"mediaType": ociManifestMediaType, "digest": "sha256:" + manifestDigest, "size": len(manifestData)}
+			descriptor["annotations"] = map[string]string{"io.containerd.image.name": repoTag, "org.opencontainers.image.ref.name": repoTag[strings.LastIndex(repoTag, ":")+1:]}
+			index = append(index, descriptor)
+		}
+	}
+
+	manifestData, err := json.Marshal(manifests)
+	if err != nil {
+		return err
+	}
+	metadata["manifest.json"] = manifestData
+	if format == saveFormatLegacy {
+		if len(repositories) > 0 {
+			if metadata["repositories"], err = json.Marshal(repositories); err != nil {
+				return err
+			}
+		}
+	} else {
+		metadata[ociLayoutFile] = []byte(`{"imageLayoutVersion":"1.0.0"}`)
+		if metadata["index.json"], err = json.Marshal(map[string]interface{}{"schemaVersion": 2, "mediaType": ociIndexMediaType, "manifests": index}); err != nil {
+			return err
+		}
+	}
+	return rewriteImageTar(tarPath, renames, metadata)
+}
+
+// layerMediaType returns the OCI media type of a layer from its first bytes
+func layerMediaType(magic []byte) string {
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		return ociLayerMediaType + "+gzip"
+	case bytes.HasPrefix(magic, zstdMagic):
+		return ociLayerMediaType + "+zstd"
+	}
+	return ociLayerMediaType
+}
+
+// rewriteImageTar writes the metadata files followed by the renamed layers,
+// every other entry of the original tar is dropped
+func rewriteImageTar(tarPath string, renames map[string]string, metadata map[string][]byte) error {
+	in, err := os.Open(tarPath)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	partial := tarPath + ".partial"
+	out, err := os.Create(partial)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(partial)
+	defer out.Close()
+
+	tw := tar.NewWriter(out)
+	names := make([]string, 0, len(metadata))
+	for name := range metadata {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(metadata[name]))}); err != nil {
+			return err
+		}
+		if _, err := tw.Write(metadata[name]); err != nil {
+			return err
+		}
+	}
+
+	// Layers shared by several images are stored once
+	written := make(map[string]bool)
+	tr := tar.NewReader(in)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		target, ok := renames[path.Clean(header.Name)]
+		if !ok || written[target] || metadata[target] != nil {
+			continue
+		}
+		written[target] = true
+		if err := tw.WriteHeader(&tar.Header{Name: target, Mode: 0644, Size: header.Size, ModTime: header.ModTime}); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(partial, tarPath)
+}
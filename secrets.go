@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// externalObject describes a secret or config the target has to provide
+type externalObject struct {
+	Kind     string   // "secret" or "config"
+	Name     string   // Name as declared in the compose file
+	Services []string // Services referencing it
+}
+
+// externalizeSecrets marks all top-level secrets and configs as external so
+// their content never ends up inside the archive
+func externalizeSecrets(compose *DockerCompose) []externalObject {
+	var externals []externalObject
+
+	collect := func(kind, serviceKey string, declared map[string]interface{}) {
+		names := make([]string, 0, len(declared))
+		for name := range declared {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			declared[name] = map[string]interface{}{"external": true}
+			externals = append(externals, externalObject{
+				Kind:     kind,
+				Name:     name,
+				Services: servicesReferencing(compose, serviceKey, name),
+			})
+		}
+	}
+
+	collect("secret", "secrets", compose.Secrets)
+	collect("config", "configs", compose.Configs)
+
+	return externals
+}
+
+// servicesReferencing returns the services listing name under key (short or long syntax)
+func servicesReferencing(compose *DockerCompose, key, name string) []string {
+	var services []string
+	for serviceName, service := range compose.Services {
+		refs, ok := service.Extra[key].([]interface{})
+		if !ok {
+			continue
+		}
+		for _, ref := range refs {
+			source := ""
+			switch v := ref.(type) {
+			case string:
+				source = v
+			case map[string]interface{}:
+				source, _ = v["source"].(string)
+			}
+			if source == name {
+				services = append(services, serviceName)
+				break
+			}
+		}
+	}
+	sort.Strings(services)
+	return services
+}
+
+func secretsReadmeSection(c *catalog) string {
+	return c.t("readme.secrets")
+}
+
+func (b *Bundler) createSecretsScript(tempDir string, externals []externalObject) error {
+	if len(externals) == 0 {
+		return nil
+	}
+
+	var declared []string
+	var creates strings.Builder
+	for _, obj := range externals {
+		declared = append(declared, obj.Name)
+		usedBy := strings.Join(obj.Services, ", ")
+		fmt.Fprintf(&creates, "create %s %q %q \"$@\"\n", obj.Kind, obj.Name, usedBy)
+	}
+
+	script := `#!/bin/bash
+set -e
+
+# Creates the docker secrets and configs this bundle expects to exist on the target.
+# Values are prompted for, or read from files passed as name=path arguments.
+
+` + scriptMessages(b.catalogs, "script.unknown_secret", "script.swarm_required", "script.secret_exists", "script.secret_prompt", "script.secrets_done", "script.used_by_nothing") + `
+DECLARED="` + strings.Join(declared, " ") + `"
+
+is_declared() {
+    case " $DECLARED " in
+        *" $1 "*) return 0 ;;
+    esac
+    return 1
+}
+
+for arg in "$@"; do
+    name="${arg%%=*}"
+    if [ "$name" = "$arg" ] || ! is_declared "$name"; then
+        printf "$MSG_UNKNOWN_SECRET\n" "$name" "$DECLARED" >&2
+        exit 1
+    fi
+done
+
+if [ "$(docker info --format '{{.Swarm.LocalNodeState}}' 2>/dev/null)" != "active" ]; then
+    echo "$MSG_SWARM_REQUIRED" >&2
+fi
+
+create() {
+    kind="$1"
+    name="$2"
+    used_by="${3:-$MSG_USED_BY_NOTHING}"
+    shift 3
+
+    if docker "$kind" inspect "$name" >/dev/null 2>&1; then
+        printf "$MSG_SECRET_EXISTS\n" "$kind" "$name"
+        return
+    fi
+
+    for arg in "$@"; do
+        if [ "${arg%%=*}" = "$name" ]; then
+            docker "$kind" create "$name" "${arg#*=}"
+            return
+        fi
+    done
+
+    read -r -s -p "$(printf "$MSG_SECRET_PROMPT" "$kind" "$name" "$used_by")" value
+    echo
+    printf '%s' "$value" | docker "$kind" create "$name" -
+}
+
+` + creates.String() + `
+echo "$MSG_SECRETS_DONE"
+`
+
+	scriptPath := filepath.Join(tempDir, "setup-secrets.sh")
+	return os.WriteFile(scriptPath, []byte(script), 0755)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// applySet applies a Helm-style "path=value" override to the compose document.
+// Path segments are separated by dots (escape literal dots as "\."), list
+// items are addressed as "ports[0]" and KEY=VALUE lists such as environment
+// are addressed by key. The value is parsed as YAML.
+func applySet(root *yaml.Node, expr string) error {
+	path, raw, ok := strings.Cut(expr, "=")
+	if !ok || path == "" {
+		return fmt.Errorf("invalid --set %q, expected path=value", expr)
+	}
+	segments, err := parseSetPath(path)
+	if err != nil {
+		return fmt.Errorf("invalid --set %q: %w", expr, err)
+	}
+
+	value := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: ""}
+	if raw != "" {
+		var doc yaml.Node
+		if err := yaml.Unmarshal([]byte(raw), &doc); err != nil {
+			return fmt.Errorf("invalid --set %q: %w", expr, err)
+		}
+		value = doc.Content[0]
+	}
+
+	node := root
+	for i, segment := range segments {
+		last := i == len(segments)-1
+		child, err := setChild(node, segment, last, raw, value)
+		if err != nil {
+			return fmt.Errorf("--set %s: %s: %w", path, strings.ReplaceAll(strings.Join(segments[:i+1], "."), ".[", "["), err)
+		}
+		if last {
+			return nil
+		}
+		if child.Kind == yaml.ScalarNode && child.Tag == "!!null" {
+			// Fill empty entries like "volumes: {data: }"
+			child.Kind, child.Tag, child.Value = yaml.MappingNode, "", ""
+			if strings.HasPrefix(segments[i+1], "[") {
+				child.Kind = yaml.SequenceNode
+			}
+		}
+		node = child
+	}
+	return nil
+}
+
+// setChild returns the child of node addressed by segment, creating it if
+// needed, or sets it to value if it is the last segment
+func setChild(node *yaml.Node, segment string, last bool, raw string, value *yaml.Node) (*yaml.Node, error) {
+	if strings.HasPrefix(segment, "[") {
+		if node.Kind != yaml.SequenceNode {
+			return nil, fmt.Errorf("not a list")
+		}
+		index, _ := strconv.Atoi(strings.Trim(segment, "[]"))
+		switch {
+		case index < len(node.Content) && last:
+			node.Content[index] = value
+		case index < len(node.Content):
+		case index == len(node.Content):
+			node.Content = append(node.Content, newSetNode(last, value))
+		default:
+			return nil, fmt.Errorf("index %d out of range, the list has %d items", index, len(node.Content))
+		}
+		return node.Content[index], nil
+	}
+
+	switch node.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if node.Content[i].Value == segment {
+				if last {
+					node.Content[i+1] = value
+				}
+				return node.Content[i+1], nil
+			}
+		}
+		child := newSetNode(last, value)
+		node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: segment}, child)
+		return child, nil
+	case yaml.SequenceNode:
+		// KEY=VALUE lists (environment, labels, args)
+		if !last {
+			return nil, fmt.Errorf("cannot descend into a KEY=VALUE list")
+		}
+		entry := &yaml.Node{Kind: yaml.ScalarNode, Value: segment + "=" + raw}
+		for i, item := range node.Content {
+			if name, _, _ := strings.Cut(item.Value, "="); name == segment {
+				node.Content[i] = entry
+				return entry, nil
+			}
+		}
+		node.Content = append(node.Content, entry)
+		return entry, nil
+	default:
+		return nil, fmt.Errorf("not a mapping")
+	}
+}
+
+// newSetNode returns value for the last segment, otherwise an empty mapping
+// that is converted on demand
+func newSetNode(last bool, value *yaml.Node) *yaml.Node {
+	if last {
+		return value
+	}
+	return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!null"}
+}
+
+// parseSetPath splits "services.web.ports[0]" into services, web, ports, [0]
+func parseSetPath(path string) ([]string, error) {
+	var segments []string
+	var current strings.Builder
+	flush := func() error {
+		if current.Len() == 0 {
+			return fmt.Errorf("empty path segment")
+		}
+		segments = append(segments, current.String())
+		current.Reset()
+		return nil
+	}
+
+	for i := 0; i < len(path); i++ {
+		switch c := path[i]; {
+		case c == '\\' && i+1 < len(path) && path[i+1] == '.':
+			current.WriteByte('.')
+			i++
+		case c == '.':
+			if len(segments) > 0 && strings.HasPrefix(segments[len(segments)-1], "[") && current.Len() == 0 {
+				continue // "ports[0].target"
+			}
+			if err := flush(); err != nil {
+				return nil, err
+			}
+		case c == '[':
+			if current.Len() > 0 {
+				if err := flush(); err != nil {
+					return nil, err
+				}
+			}
+			end := strings.IndexByte(path[i:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("missing ]")
+			}
+			index := path[i+1 : i+end]
+			if n, err := strconv.Atoi(index); err != nil || n < 0 {
+				return nil, fmt.Errorf("invalid list index %q", index)
+			}
+			segments = append(segments, "["+index+"]")
+			i += end
+		default:
+			current.WriteByte(c)
+		}
+	}
+	if current.Len() > 0 || len(segments) == 0 {
+		if err := flush(); err != nil {
+			return nil, err
+		}
+	}
+	return segments, nil
+}
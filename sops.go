@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// SOPS file formats used by the bundler
+const (
+	sopsYAML   = "yaml"
+	sopsDotenv = "dotenv"
+)
+
+// isSOPSEncrypted reports whether data carries the metadata sops adds when
+// encrypting a file of the given format
+func isSOPSEncrypted(data []byte, format string) bool {
+	if format == sopsDotenv {
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for scanner.Scan() {
+			if strings.HasPrefix(strings.TrimSpace(scanner.Text()), "sops_mac=") {
+				return true
+			}
+		}
+		return false
+	}
+
+	var doc struct {
+		SOPS map[string]interface{} `yaml:"sops"`
+	}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return false
+	}
+	_, ok := doc.SOPS["mac"]
+	return ok
+}
+
+// readSecretFile reads a file, decrypting it in memory if it is SOPS-encrypted
+func readSecretFile(path, format string) ([]byte, bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, false, err
+	}
+	if !isSOPSEncrypted(data, format) {
+		return data, false, nil
+	}
+	plain, err := runSOPS(nil, "--decrypt", "--input-type", format, "--output-type", format, path)
+	if err != nil {
+		return nil, true, fmt.Errorf("failed to decrypt %s: %w", path, err)
+	}
+	return plain, true, nil
+}
+
+// sopsEncrypt encrypts the bundled copy of an encrypted input for the keys
+// of the target, plaintext of encrypted inputs never ends up in the archive
+func (b *Bundler) sopsEncrypt(data []byte, format, name string) ([]byte, error) {
+	var args []string
+	if b.opts.SOPSAge != "" {
+		args = append(args, "--age", b.opts.SOPSAge)
+	}
+	if b.opts.SOPSPGP != "" {
+		args = append(args, "--pgp", b.opts.SOPSPGP)
+	}
+	if len(args) == 0 {
+		return nil, fmt.Errorf("%s is SOPS-encrypted, pass --sops-age or --sops-pgp to encrypt the bundled copy for the target", name)
+	}
+
+	args = append([]string{"--encrypt", "--input-type", format, "--output-type", format}, args...)
+	encrypted, err := runSOPS(data, append(args, "/dev/stdin")...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt %s: %w", name, err)
+	}
+	b.encryptedFiles = append(b.encryptedFiles, name)
+	return encrypted, nil
+}
+
+func runSOPS(stdin []byte, args ...string) ([]byte, error) {
+	if _, err := exec.LookPath("sops"); err != nil {
+		return nil, fmt.Errorf("SOPS-encrypted files require sops to be installed")
+	}
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("sops", args...)
+	if stdin != nil {
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+// sopsReadmeSection lists the files that have to be decrypted on the target
+func sopsReadmeSection(c *catalog, files []string) string {
+	var sb strings.Builder
+	sb.WriteString(c.t("readme.sops") + "\n")
+	for _, file := range files {
+		fmt.Fprintf(&sb, "    sops --decrypt --in-place %s\n", file)
+	}
+	return sb.String()
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"docker-compose-bundler/dockerclient"
+)
+
+// fakeSOPS puts a sops on PATH that "decrypts" rot13 files marked with
+// sops_mac and "encrypts" stdin to base64
+func fakeSOPS(t *testing.T) {
+	t.Helper()
+	dir := t.TempDir()
+	script := `#!/bin/sh
+for last; do :; done
+case "$1" in
+--decrypt) grep -v '^sops_' "$last" | tr 'A-Za-z' 'N-ZA-Mn-za-m' ;;
+--encrypt) printf 'sops_mac=fake\nDATA=%s\n' "$(base64 | tr -d '\n')" ;;
+esac
+`
+	if err := os.WriteFile(filepath.Join(dir, "sops"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func rot13(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case 'a' <= r && r <= 'z':
+			return 'a' + (r-'a'+13)%26
+		case 'A' <= r && r <= 'Z':
+			return 'A' + (r-'A'+13)%26
+		}
+		return r
+	}, s)
+}
+
+func TestBundleEncryptsValuesOfEncryptedDotEnv(t *testing.T) {
+	fakeSOPS(t)
+	const secret = "hunter2-secret"
+	composeFile := writeCompose(t, `services:
+  db:
+    image: postgres:16
+    environment:
+      POSTGRES_PASSWORD: ${DB_PASSWORD}
+x-bundle:
+  name: shop
+  version: 1.2.0
+`)
+	dotEnv := rot13("DB_PASSWORD="+secret) + "\nsops_mac=fake\n"
+	if err := os.WriteFile(filepath.Join(filepath.Dir(composeFile), ".env"), []byte(dotEnv), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fake := dockerclient.NewFake()
+	fake.AddImage("postgres:16")
+
+	dir := t.TempDir()
+	if err := extractBundle(bundleWith(t, fake, Options{SOPSAge: "age1target"}, composeFile), dir); err != nil {
+		t.Fatal(err)
+	}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if bytes.Contains(data, []byte(secret)) {
+			t.Errorf("%s contains the secret from the encrypted .env", strings.TrimPrefix(path, dir))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	compose, err := os.ReadFile(filepath.Join(dir, "docker-compose.yml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isSOPSEncrypted(compose, sopsDotenv) {
+		t.Errorf("the bundled compose file is not encrypted:\n%s", compose)
+	}
+
+	// Without target keys the plaintext must not be written at all
+	outputFile := filepath.Join(t.TempDir(), "bundle.tar.gz")
+	err = NewBundlerWithClient(Options{VersionScheme: VersionSchemeSemver}, fake).Bundle(composeFile, outputFile)
+	if err == nil || !strings.Contains(err.Error(), "--sops-age") {
+		t.Errorf("bundling without target keys: %v", err)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// splitFile splits path into numbered parts (path.001, path.002, ...) of at
+// most partSize bytes, removes the original and writes path.sha256 listing
+// the parts in sha256sum format
+func splitFile(path string, partSize int64) ([]string, error) {
+	source, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer source.Close()
+
+	var parts []string
+	var sums strings.Builder
+	for i := 1; ; i++ {
+		partPath := fmt.Sprintf("%s.%03d", path, i)
+		part, err := os.Create(partPath)
+		if err != nil {
+			return nil, err
+		}
+		written, err := io.CopyN(part, source, partSize)
+		part.Close()
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if written == 0 {
+			os.Remove(partPath)
+			break
+		}
+
+		_, digest, err := fileDigest(partPath)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(&sums, "%s  %s\n", digest, filepath.Base(partPath))
+		parts = append(parts, partPath)
+		if written < partSize {
+			break
+		}
+	}
+
+	if err := os.WriteFile(path+".sha256", []byte(sums.String()), 0644); err != nil {
+		return nil, err
+	}
+	source.Close()
+	return parts, os.Remove(path)
+}
+
+// parsePercent parses "10%" or "10" into a percentage between 1 and 100
+func parsePercent(s string) (int, error) {
+	percent, err := strconv.Atoi(strings.TrimSuffix(strings.TrimSpace(s), "%"))
+	if err != nil || percent < 1 || percent > 100 {
+		return 0, fmt.Errorf("invalid percentage %q, use a value between 1%% and 100%%", s)
+	}
+	return percent, nil
+}
+
+// createParity generates PAR2 recovery files for the given files using
+// par2cmdline, so damaged parts can be repaired at the destination with
+// "par2 repair <output>.par2"
+func createParity(outputFile string, files []string, percent int) error {
+	if _, err := exec.LookPath("par2"); err != nil {
+		return fmt.Errorf("--parity requires par2 (par2cmdline) to be installed")
+	}
+
+	names := make([]string, len(files))
+	for i, file := range files {
+		names[i] = filepath.Base(file)
+	}
+	args := append([]string{"create", "-q", fmt.Sprintf("-r%d", percent), filepath.Base(outputFile) + ".par2"}, names...)
+
+	fmt.Printf("Creating %d%% parity data...\n", percent)
+	cmd := exec.Command("par2", args...)
+	cmd.Dir = filepath.Dir(outputFile)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
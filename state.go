@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"time"
+)
+
+// installedFile lists the bundles deployed on the host, in the state directory
+const installedFile = "installed.json"
+
+// InstalledBundle is a bundle version deploy started on the host
+type InstalledBundle struct {
+	Name       string           `json:"name"`
+	Version    string           `json:"version"`
+	Project    string           `json:"project"`
+	Dir        string           `json:"dir"` // Absolute path of the extracted bundle
+	DeployedAt time.Time        `json:"deployedAt"`
+	Images     []InstalledImage `json:"images,omitempty"`
+	Volumes    []string         `json:"volumes,omitempty"` // Volumes compose creates for the stack, external ones are left out
+}
+
+// InstalledImage is an image of a deployed bundle with the ID its tag had
+type InstalledImage struct {
+	Name string `json:"name"`
+	ID   string `json:"id"`
+}
+
+// defaultStateDir is where the loader keeps what it installed: system wide
+// for root on Linux, in the user's config directory otherwise
+func defaultStateDir() string {
+	if runtime.GOOS == "linux" && os.Geteuid() == 0 {
+		return "/var/lib/docker-compose-bundler"
+	}
+	if config, err := os.UserConfigDir(); err == nil {
+		return filepath.Join(config, "docker-compose-bundler")
+	}
+	return ".docker-compose-bundler"
+}
+
+// lockInstalled keeps deployments and prune from updating installed.json at
+// the same time
+func lockInstalled(stateDir string) (release func(), err error) {
+	if err := os.MkdirAll(stateDir, 0755); err != nil {
+		return nil, err
+	}
+	return waitRunLock(filepath.Join(stateDir, installedFile), time.Minute)
+}
+
+// readInstalled returns the bundles recorded in stateDir, oldest first
+func readInstalled(stateDir string) ([]InstalledBundle, error) {
+	data, err := os.ReadFile(filepath.Join(stateDir, installedFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var installed []InstalledBundle
+	if err := json.Unmarshal(data, &installed); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", filepath.Join(stateDir, installedFile), err)
+	}
+	return installed, nil
+}
+
+// writeInstalled replaces the list of installed bundles in stateDir
+func writeInstalled(stateDir string, installed []InstalledBundle) error {
+	if err := os.MkdirAll(stateDir, 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(installed, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(stateDir, installedFile+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	_, err = tmp.Write(append(data, '\n'))
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(stateDir, installedFile))
+}
+
+// RecordDeployment adds the bundle to the installed bundles of the host,
+// replacing an earlier deployment of the same version, and records whether
+// it was deployed, upgraded or rolled back in the event log
+func (l *Loader) RecordDeployment() error {
+	dir, err := filepath.Abs(l.dir)
+	if err != nil {
+		return err
+	}
+	entry := InstalledBundle{
+		Name:       l.manifest.Name,
+		Version:    l.manifest.Version,
+		Project:    l.manifest.ProjectName,
+		Dir:        dir,
+		DeployedAt: time.Now().UTC(),
+	}
+	for _, img := range l.manifest.Images {
+		inspect, err := l.client.ImageInspect(l.ctx, img.Name)
+		if err != nil {
+			continue
+		}
+		entry.Images = append(entry.Images, InstalledImage{Name: img.Name, ID: inspect.ID})
+	}
+	for _, name := range sortedKeys(l.compose.Volumes) {
+		if volumeName, external := l.resourceName(name, l.compose.Volumes[name]); !external {
+			entry.Volumes = append(entry.Volumes, volumeName)
+		}
+	}
+
+	release, err := lockInstalled(l.stateDir)
+	if err != nil {
+		return err
+	}
+	defer release()
+	installed, err := readInstalled(l.stateDir)
+	if err != nil {
+		return err
+	}
+	var previous InstalledBundle
+	for _, other := range installed {
+		if other.Name == entry.Name && !other.DeployedAt.Before(previous.DeployedAt) {
+			previous = other
+		}
+	}
+	installed = slices.DeleteFunc(installed, func(other InstalledBundle) bool {
+		return other.Name == entry.Name && other.Version == entry.Version
+	})
+	if err := writeInstalled(l.stateDir, append(installed, entry)); err != nil {
+		return err
+	}
+	event := deployEvent(entry.Version, previous.Version)
+	event.Time, event.Detail = entry.DeployedAt, dir
+	recordEvent(l.stateDir, l.manifest, event)
+	return nil
+}
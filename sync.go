@@ -0,0 +1,281 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// chunkDigestRegex matches the chunk names of a store, they become paths
+var chunkDigestRegex = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// chunkSource reads the files of a chunk store from a directory or a URL
+type chunkSource interface {
+	Open(name string) (io.ReadCloser, error)
+}
+
+type dirChunkSource string
+
+func (d dirChunkSource) Open(name string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(string(d), filepath.FromSlash(name)))
+}
+
+// httpChunkSource reads a store published by any static file server
+type httpChunkSource struct {
+	client *http.Client
+	base   string
+}
+
+func (h *httpChunkSource) Open(name string) (io.ReadCloser, error) {
+	url := h.base + "/" + name
+	resp, err := h.client.Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download %s: %w", url, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("failed to download %s: %s", url, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+func newChunkSource(source string) chunkSource {
+	if isBundleURL(source) {
+		return &httpChunkSource{client: &http.Client{Timeout: 5 * time.Minute}, base: strings.TrimSuffix(source, "/")}
+	}
+	return dirChunkSource(source)
+}
+
+// readChunkJSON reads a JSON file of the store, limited to keep a broken
+// server from exhausting memory
+func readChunkJSON(source chunkSource, name string, v interface{}) error {
+	rc, err := source.Open(name)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(io.LimitReader(rc, 256<<20))
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", name, err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", name, err)
+	}
+	return nil
+}
+
+// syncChunkStore copies a bundle from source into target, transferring only
+// the chunks target does not have. selector is name-version or version of
+// the bundle, empty for the latest one.
+func syncChunkStore(source chunkSource, target chunkStore, selector string) (*ChunkIndex, error) {
+	var catalog ChunkCatalog
+	if err := readChunkJSON(source, chunkCatalogName, &catalog); err != nil {
+		return nil, err
+	}
+	var entry *ChunkCatalogEntry
+	for i, e := range catalog.Bundles {
+		if selector == "" || selector == e.Version || selector == e.Name+"-"+e.Version {
+			entry = &catalog.Bundles[i]
+		}
+	}
+	if entry == nil {
+		if selector == "" {
+			return nil, fmt.Errorf("the chunk store holds no bundles")
+		}
+		return nil, fmt.Errorf("bundle %s not found in the chunk store", selector)
+	}
+	indexPath, err := chunkIndexPath(*entry)
+	if err != nil {
+		return nil, err
+	}
+	var index ChunkIndex
+	if err := readChunkJSON(source, indexPath, &index); err != nil {
+		return nil, err
+	}
+	if index.SchemaVersion > chunkIndexSchemaVersion {
+		return nil, fmt.Errorf("chunk index schema %d is newer than supported (%d), please update the loader", index.SchemaVersion, chunkIndexSchemaVersion)
+	}
+	// Name and version become the index path in the target
+	if index.Name != entry.Name || index.Version != entry.Version || strings.ContainsAny(index.Name+index.Version, `/\`) || !validMemberPath(index.Name+"-"+index.Version) {
+		return nil, fmt.Errorf("index %s does not describe bundle %s %s", indexPath, entry.Name, entry.Version)
+	}
+
+	var missing []ChunkRef
+	var total, transfer int64
+	seen := make(map[string]bool)
+	for _, file := range index.Files {
+		if !validMemberPath(file.Name) {
+			return nil, fmt.Errorf("invalid path %q in chunk index", file.Name)
+		}
+		for _, ref := range file.Chunks {
+			if !chunkDigestRegex.MatchString(ref.SHA256) || ref.Size <= 0 || ref.Size > 8*64<<20 {
+				return nil, fmt.Errorf("invalid chunk %q in chunk index", ref.SHA256)
+			}
+			if seen[ref.SHA256] {
+				continue
+			}
+			seen[ref.SHA256] = true
+			total += ref.Size
+			if !target.hasChunk(ref) {
+				missing = append(missing, ref)
+				transfer += ref.Size
+			}
+		}
+	}
+
+	fmt.Printf("Syncing %s %s: %d of %d chunks missing (%s of %s)\n", index.Name, index.Version, len(missing), len(seen), formatBytes(transfer), formatBytes(total))
+	progress := newProgressReader(nil, transfer, "transfer")
+	for _, ref := range missing {
+		if err := fetchChunk(source, target, ref); err != nil {
+			return nil, err
+		}
+		progress.read += ref.Size
+		progress.draw()
+	}
+	if len(missing) > 0 {
+		progress.finish()
+	}
+	if err := target.addIndex(&index); err != nil {
+		return nil, err
+	}
+	return &index, nil
+}
+
+// fetchChunk copies a chunk after checking its size and digest. Chunks are
+// stored one by one, an interrupted sync resumes with the missing ones.
+func fetchChunk(source chunkSource, target chunkStore, ref ChunkRef) error {
+	name := "chunks/" + ref.SHA256[:2] + "/" + ref.SHA256
+	rc, err := source.Open(name)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(io.LimitReader(rc, ref.Size+1))
+	if err != nil {
+		return fmt.Errorf("failed to read chunk %s: %w", ref.SHA256, err)
+	}
+	sum := sha256.Sum256(data)
+	if int64(len(data)) != ref.Size || hex.EncodeToString(sum[:]) != ref.SHA256 {
+		return fmt.Errorf("chunk %s is damaged, run sync again", ref.SHA256)
+	}
+	_, err = target.putChunk(ref, data)
+	return err
+}
+
+// materializeChunks writes the files of a bundle in the store to dir, which
+// then loads and deploys like an extracted bundle
+func materializeChunks(store chunkStore, index *ChunkIndex, dir string, maxSize int64) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	extractor, err := newExtractor(dir, maxSize)
+	if err != nil {
+		return err
+	}
+	defer extractor.Close()
+	for _, file := range index.Files {
+		entry := &bundleEntry{Name: file.Name, Mode: file.Mode, Size: file.Size, ModTime: file.ModTime, IsDir: file.IsDir}
+		content := &chunkFileReader{store: store, file: file, hash: sha256.New()}
+		err := extractor.extract(entry, content)
+		content.Close()
+		if err != nil {
+			return fmt.Errorf("failed to write %s: %w", file.Name, err)
+		}
+	}
+	return nil
+}
+
+// chunkFileReader reads a file from its chunks, checking the digest of the
+// whole file at the end
+type chunkFileReader struct {
+	store chunkStore
+	file  ChunkedFile
+	next  int
+	chunk *os.File
+	hash  hash.Hash
+}
+
+func (c *chunkFileReader) Read(p []byte) (int, error) {
+	for {
+		if c.chunk == nil {
+			if c.next == len(c.file.Chunks) {
+				if hex.EncodeToString(c.hash.Sum(nil)) != c.file.SHA256 {
+					return 0, fmt.Errorf("%s does not match its checksum, the chunk store is damaged", c.file.Name)
+				}
+				return 0, io.EOF
+			}
+			ref := c.file.Chunks[c.next]
+			if !c.store.hasChunk(ref) {
+				return 0, fmt.Errorf("chunk %s is missing, run sync first", ref.SHA256)
+			}
+			chunk, err := os.Open(c.store.chunkPath(ref.SHA256))
+			if err != nil {
+				return 0, err
+			}
+			c.chunk = chunk
+			c.next++
+		}
+		n, err := c.chunk.Read(p)
+		c.hash.Write(p[:n])
+		if err == io.EOF {
+			c.chunk.Close()
+			c.chunk = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+func (c *chunkFileReader) Close() error {
+	if c.chunk != nil {
+		return c.chunk.Close()
+	}
+	return nil
+}
+
+func runSync(args []string) {
+	flags := flag.NewFlagSet("sync", flag.ExitOnError)
+	bundle := flags.String("bundle", "", "Sync this `name-version` or version instead of the latest bundle of the source")
+	extract := flags.String("extract", "", "Write the synced bundle to this `directory`, ready for load and deploy")
+	maxSize := flags.String("max-size", "64G", "Refuse to --extract bundles larger than this `size`")
+	flags.Usage = func() {
+		fmt.Println("Usage: docker-compose-bundler sync [flags] <source-store|url> <target-store>")
+		fmt.Println("Example: docker-compose-bundler sync --extract /opt/my-stack https://files.example.com/store /var/lib/bundles")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		flags.Usage()
+		os.Exit(1)
+	}
+	limit, err := parseByteSize(*maxSize)
+	if err != nil {
+		log.Fatalf("invalid --max-size %q", *maxSize)
+	}
+
+	target := chunkStore(flags.Arg(1))
+	index, err := syncChunkStore(newChunkSource(flags.Arg(0)), target, *bundle)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *extract != "" {
+		if err := materializeChunks(target, index, *extract, limit); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("Extracted %s %s to %s\n", index.Name, index.Version, *extract)
+	}
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"docker-compose-bundler/composetransform"
+
+	"github.com/distribution/reference"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/registry"
+)
+
+// Sync states of a bundled image in the target registry
+const (
+	syncPresent  = "present"  // The tag points to the bundled image
+	syncOutdated = "outdated" // The tag exists with different content
+	syncMissing  = "missing"
+)
+
+// manifestMediaTypes are the manifest formats requested from the registry
+var manifestMediaTypes = []string{
+	"application/vnd.docker.distribution.manifest.v2+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.oci.image.index.v1+json",
+}
+
+// syncResult is the state of one bundled image in the registry
+type syncResult struct {
+	Image  ManifestImage
+	Target string // Reference the image is pushed as
+	Status string
+}
+
+// registryClient speaks the registry HTTP API v2, following the token
+// challenges of Docker Hub, Harbor and the distribution registry
+type registryClient struct {
+	http     *http.Client
+	base     string // scheme://host
+	username string
+	password string
+	tokens   map[string]string // Bearer tokens by scope
+}
+
+// newRegistryClient creates a client for host, tlsConfig adds a custom CA
+// or client certificate and may be nil
+func newRegistryClient(host string, insecure bool, username, password string, tlsConfig *tls.Config) *registryClient {
+	scheme := "https"
+	if insecure {
+		scheme = "http"
+	}
+	transport := http.DefaultTransport
+	if tlsConfig != nil {
+		custom := http.DefaultTransport.(*http.Transport).Clone()
+		custom.TLSClientConfig = tlsConfig
+		transport = custom
+	}
+	return &registryClient{
+		http:     &http.Client{Timeout: 60 * time.Second, Transport: transport},
+		base:     scheme + "://" + host,
+		username: username,
+		password: password,
+		tokens:   make(map[string]string),
+	}
+}
+
+var challengeParamRegex = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+func (r *registryClient) get(path, scope string) (*http.Response, error) {
+	return r.do(http.MethodGet, path, scope)
+}
+
+// do requests path, authenticating once if the registry asks for it
+func (r *registryClient) do(method, path, scope string) (*http.Response, error) {
+	send := func() (*http.Response, error) {
+		req, err := http.NewRequest(method, r.base+path, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", strings.Join(manifestMediaTypes, ", "))
+		if token, ok := r.tokens[scope]; ok {
+			req.Header.Set("Authorization", "Bearer "+token)
+		} else if r.username != "" {
+			req.SetBasicAuth(r.username, r.password)
+		}
+		return r.http.Do(req)
+	}
+
+	resp, err := send()
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	challenge := resp.Header.Get("WWW-Authenticate")
+	resp.Body.Close()
+	if !strings.HasPrefix(strings.ToLower(challenge), "bearer ") {
+		return nil, fmt.Errorf("registry requires authentication, use --username")
+	}
+	if err := r.fetchToken(challenge, scope); err != nil {
+		return nil, err
+	}
+	return send()
+}
+
+// fetchToken requests a bearer token from the realm of the challenge
+func (r *registryClient) fetchToken(challenge, scope string) error {
+	params := make(map[string]string)
+	for _, match := range challengeParamRegex.FindAllStringSubmatch(challenge, -1) {
+		params[strings.ToLower(match[1])] = match[2]
+	}
+	if params["realm"] == "" {
+		return fmt.Errorf("invalid registry auth challenge %q", challenge)
+	}
+
+	query := url.Values{}
+	if params["service"] != "" {
+		query.Set("service", params["service"])
+	}
+	query.Set("scope", scope)
+	req, err := http.NewRequest(http.MethodGet, params["realm"]+"?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	if r.username != "" {
+		req.SetBasicAuth(r.username, r.password)
+	}
+	resp, err := r.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to get registry token: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to get registry token: %s", resp.Status)
+	}
+
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return fmt.Errorf("failed to parse registry token: %w", err)
+	}
+	r.tokens[scope] = token.Token
+	if token.Token == "" {
+		r.tokens[scope] = token.AccessToken
+	}
+	return nil
+}
+
+// registryManifest is the part of image manifests and indexes we compare
+type registryManifest struct {
+	Config struct {
+		Digest string `json:"digest"`
+	} `json:"config"`
+	Manifests []struct {
+		Digest string `json:"digest"`
+	} `json:"manifests"`
+}
+
+// manifest fetches a manifest by tag or digest, nil if it does not exist
+func (r *registryClient) manifest(repo, ref string) (*registryManifest, string, error) {
+	resp, err := r.get("/v2/"+repo+"/manifests/"+ref, "repository:"+repo+":pull")
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, "", nil
+	default:
+		return nil, "", fmt.Errorf("registry returned %s for %s:%s", resp.Status, repo, ref)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	digest := resp.Header.Get("Docker-Content-Digest")
+	if digest == "" {
+		sum := sha256.Sum256(body)
+		digest = "sha256:" + hex.EncodeToString(sum[:])
+	}
+	var manifest registryManifest
+	if err := json.Unmarshal(body, &manifest); err != nil {
+		return nil, "", fmt.Errorf("failed to parse manifest of %s:%s: %w", repo, ref, err)
+	}
+	return &manifest, digest, nil
+}
+
+// imageStatus reports whether repo:tag holds the image with the given ID.
+// The ID is the config digest with the classic image store and the
+// manifest digest with the containerd image store, both are accepted.
+func (r *registryClient) imageStatus(repo, tag, imageID string) (string, error) {
+	manifest, digest, err := r.manifest(repo, tag)
+	if err != nil || manifest == nil {
+		return syncMissing, err
+	}
+	if imageID == "" {
+		return syncOutdated, nil // Bundles without image IDs cannot be compared
+	}
+	if digest == imageID || manifest.Config.Digest == imageID {
+		return syncPresent, nil
+	}
+	for _, child := range manifest.Manifests {
+		if child.Digest == imageID {
+			return syncPresent, nil
+		}
+		platform, _, err := r.manifest(repo, child.Digest)
+		if err != nil {
+			return "", err
+		}
+		if platform != nil && platform.Config.Digest == imageID {
+			return syncPresent, nil
+		}
+	}
+	return syncOutdated, nil
+}
+
+// syncTarget splits a registry argument like harbor.example.com/project into
+// the host and the reference prefix images are pushed under
+func syncTarget(registryArg string) (string, string, error) {
+	prefix := strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(registryArg, "https://"), "http://"), "/")
+	host, _, _ := strings.Cut(prefix, "/")
+	if host == "" || !strings.ContainsAny(host, ".:") && host != "localhost" {
+		return "", "", fmt.Errorf("invalid registry %q, expected a host like harbor.example.com/project", registryArg)
+	}
+	return host, prefix, nil
+}
+
+// SyncCheck compares the bundled images with the registry and returns what
+// it holds of them, images are pushed under the registry like --retag-prefix
+func (l *Loader) SyncCheck(reg *registryClient, prefix string) ([]syncResult, error) {
+	var results []syncResult
+	for _, img := range l.manifest.Images {
+		target, err := composetransform.Retag(img.Name, prefix)
+		if err != nil {
+			return nil, fmt.Errorf("failed to map image %s to the registry: %w", img.Name, err)
+		}
+		named, err := reference.ParseNormalizedNamed(target)
+		if err != nil {
+			return nil, err
+		}
+		status, err := reg.imageStatus(reference.Path(named), named.(reference.Tagged).Tag(), img.ID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to check %s: %w", target, err)
+		}
+		results = append(results, syncResult{Image: img, Target: target, Status: status})
+	}
+	return results, nil
+}
+
+// PushMissing loads, tags and pushes the images that are not in the
+// registry yet, the pushed tags are removed again afterwards
+func (l *Loader) PushMissing(results []syncResult, auth registry.AuthConfig) error {
+	encodedAuth, err := registry.EncodeAuthConfig(auth)
+	if err != nil {
+		return err
+	}
+
+	for _, result := range results {
+		if result.Status == syncPresent {
+			continue
+		}
+		fmt.Printf("Pushing %s as %s...\n", result.Image.Name, result.Target)
+		if err := l.loadImage(filepath.Join(l.dir, filepath.FromSlash(result.Image.File))); err != nil {
+			return fmt.Errorf("failed to load image %s: %w", result.Image.Name, err)
+		}
+		if err := l.client.ImageTag(l.ctx, result.Image.Name, result.Target); err != nil {
+			return fmt.Errorf("failed to tag image %s: %w", result.Image.Name, err)
+		}
+		err := l.pushImage(result.Target, encodedAuth)
+		if _, removeErr := l.client.ImageRemove(l.ctx, result.Target, image.RemoveOptions{}); removeErr != nil {
+			fmt.Printf("Warning: failed to remove tag %s: %v\n", result.Target, removeErr)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to push %s: %w", result.Target, err)
+		}
+	}
+	return nil
+}
+
+func (l *Loader) pushImage(ref, encodedAuth string) error {
+	reader, err := l.client.ImagePush(l.ctx, ref, image.PushOptions{RegistryAuth: encodedAuth})
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	progress := newStreamProgress("pushing", ref)
+	result, err := readJSONStream(reader, progress.update)
+	if err != nil {
+		return fmt.Errorf("push error: %w", err)
+	}
+	if result.Digest != "" {
+		fmt.Printf("Pushed %s (%s)\n", ref, result.Digest)
+	}
+	return nil
+}
+
+func printSyncResults(results []syncResult) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "IMAGE\tTARGET\tSIZE\tSTATUS")
+	var pending int
+	var pendingSize int64
+	for _, result := range results {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", result.Image.Name, result.Target, formatBytes(result.Image.Size), result.Status)
+		if result.Status != syncPresent {
+			pending++
+			pendingSize += result.Image.Size
+		}
+	}
+	w.Flush()
+	fmt.Printf("%d of %d image(s) must be pushed (%s)\n", pending, len(results), formatBytes(pendingSize))
+}
+
+func runSyncCheck(args []string) {
+	flags := flag.NewFlagSet("sync-check", flag.ExitOnError)
+	push := flags.Bool("push", false, "Push the images that are missing or outdated in the registry")
+	username := flags.String("username", "", "Registry `user`")
+	passwordStdin := flags.Bool("password-stdin", false, "Read the registry password from stdin")
+	insecure := flags.Bool("insecure", false, "Talk to the registry over plain HTTP")
+	var certs registryTLS
+	flags.Var(&certs.CAs, "registry-ca", "Trust the CA certificates in this PEM `file` for the registry, or host=file for one registry (repeatable)")
+	flags.Var(&certs.Certs, "registry-cert", "Authenticate to the registry with the client certificate in this PEM `file`, or host=file (repeatable)")
+	flags.Var(&certs.Keys, "registry-key", "Private key `file` of --registry-cert, or host=file (repeatable)")
+	flags.Usage = func() {
+		fmt.Println("Usage: docker-compose-bundler sync-check [flags] <registry> [bundle-dir]")
+		fmt.Println("Example: docker-compose-bundler sync-check --push harbor.example.com/project ./bundle")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() < 1 {
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	host, prefix, err := syncTarget(flags.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	bundleDir := "."
+	if flags.NArg() > 1 {
+		bundleDir = flags.Arg(1)
+	}
+
+	var password string
+	if *passwordStdin {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && err != io.EOF {
+			log.Fatal("Failed to read the password: ", err)
+		}
+		password = strings.TrimRight(line, "\r\n")
+	}
+
+	tlsConfig, err := certs.config(host)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	loader, err := NewLoader(bundleDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	results, err := loader.SyncCheck(newRegistryClient(host, *insecure, *username, password, tlsConfig), prefix)
+	if err != nil {
+		log.Fatal(err)
+	}
+	printSyncResults(results)
+
+	if *push {
+		auth := registry.AuthConfig{Username: *username, Password: password, ServerAddress: host}
+		if err := loader.PushMissing(results, auth); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println("Registry is in sync with the bundle")
+	}
+}
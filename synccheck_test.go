@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/api/types/registry"
+
+	"docker-compose-bundler/dockerclient"
+)
+
+// fakeRegistry serves the manifests of tags, keyed by repository:tag, with
+// the config digest as image ID
+func fakeRegistry(t *testing.T, tags map[string]string) string {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		repo, tag, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, "/v2/"), "/manifests/")
+		config, found := tags[repo+":"+tag]
+		if !ok || !found {
+			http.NotFound(w, r)
+			return
+		}
+		var manifest registryManifest
+		manifest.Config.Digest = config
+		json.NewEncoder(w).Encode(manifest)
+	}))
+	t.Cleanup(server.Close)
+	return strings.TrimPrefix(server.URL, "http://")
+}
+
+func TestSyncCheck(t *testing.T) {
+	source := dockerclient.NewFake()
+	web := source.AddImage("nginx:1.27")
+	source.AddImage("redis:7")
+	dir := filepath.Join(t.TempDir(), "shop")
+	if err := extractBundle(bundleWith(t, source, Options{}, writeCompose(t, webCompose)), dir); err != nil {
+		t.Fatal(err)
+	}
+
+	host := fakeRegistry(t, map[string]string{"mirror/nginx:1.27": web.ID})
+	target := dockerclient.NewFake()
+	loader, err := NewLoaderWithClient(dir, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err := loader.SyncCheck(newRegistryClient(host, true, "", "", nil), host+"/mirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	status := make(map[string]string)
+	for _, result := range results {
+		status[result.Target] = result.Status
+	}
+	if status[host+"/mirror/nginx:1.27"] != syncPresent || status[host+"/mirror/redis:7"] != syncMissing {
+		t.Fatalf("sync status %v, want nginx present and redis missing", status)
+	}
+
+	if err := loader.PushMissing(results, registry.AuthConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(target.Pushed) != 1 || target.Pushed[0] != host+"/mirror/redis:7" {
+		t.Errorf("pushed %v, want only redis:7", target.Pushed)
+	}
+	// The tag for the registry is removed again, the loaded image stays
+	if _, err := target.ImageInspect(loader.ctx, host+"/mirror/redis:7"); err == nil {
+		t.Error("the pushed tag was left behind")
+	}
+	if _, err := target.ImageInspect(loader.ctx, "redis:7"); err != nil {
+		t.Errorf("redis:7 was not loaded: %v", err)
+	}
+}
+
+func TestSyncTarget(t *testing.T) {
+	host, prefix, err := syncTarget("https://harbor.example.com/project/")
+	if err != nil || host != "harbor.example.com" || prefix != "harbor.example.com/project" {
+		t.Errorf("syncTarget = %q, %q, %v", host, prefix, err)
+	}
+	if _, _, err := syncTarget("project"); err == nil {
+		t.Error("a registry without host was accepted")
+	}
+}
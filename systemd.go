@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// restartPolicyNotes explains how each service's restart policy behaves when
+// the stack is started by the generated systemd unit
+func restartPolicyNotes(compose *DockerCompose) []string {
+	var notes []string
+	for _, name := range sortedServiceNames(compose) {
+		policy := compose.Services[name].Restart
+		switch {
+		case policy == "" || policy == "no":
+			notes = append(notes, fmt.Sprintf("%s: no restart policy, the service is started at boot but not restarted by Docker if it crashes", name))
+		case strings.HasPrefix(policy, "on-failure:"):
+			notes = append(notes, fmt.Sprintf("%s: %s gives up after the retry limit, only a reboot or systemctl restart brings it back", name, policy))
+		case policy == "unless-stopped":
+			notes = append(notes, fmt.Sprintf("%s: unless-stopped, a manually stopped service is started again at boot by the unit", name))
+		}
+	}
+	return notes
+}
+
+func systemdReadmeSection(c *catalog) string {
+	return c.t("readme.systemd")
+}
+
+func (b *Bundler) createSystemdInstaller(tempDir string, manifest *Manifest, compose *DockerCompose) error {
+	notes := restartPolicyNotes(compose)
+	for _, note := range notes {
+		b.warnf("restart policy mismatch: %s", note)
+	}
+
+	unitName := manifest.ProjectName + ".service"
+	script := `#!/bin/bash
+set -e
+
+# Installs a systemd unit that starts the ` + manifest.Name + ` stack at boot.
+# The unit runs compose from the directory this script is located in.
+
+` + scriptMessages(b.catalogs, "script.run_as_root", "script.no_compose", "script.unit_installed") + `
+if [ "$(id -u)" -ne 0 ]; then
+    echo "$MSG_RUN_AS_ROOT" >&2
+    exit 1
+fi
+
+BUNDLE_DIR="$(cd "$(dirname "$0")" && pwd)"
+UNIT="/etc/systemd/system/` + unitName + `"
+
+if docker compose version >/dev/null 2>&1; then
+    COMPOSE="$(command -v docker) compose"
+elif command -v docker-compose >/dev/null 2>&1; then
+    COMPOSE="$(command -v docker-compose)"
+else
+    echo "$MSG_NO_COMPOSE" >&2
+    exit 1
+fi
+
+cat > "$UNIT" <<EOF
+[Unit]
+Description=` + manifest.Name + ` ` + manifest.Version + ` (docker compose stack)
+Requires=docker.service
+After=docker.service network-online.target
+Wants=network-online.target
+
+[Service]
+Type=oneshot
+RemainAfterExit=yes
+WorkingDirectory=$BUNDLE_DIR
+ExecStart=$COMPOSE -p ` + manifest.ProjectName + ` -f docker-compose.yml up -d --remove-orphans
+ExecStop=$COMPOSE -p ` + manifest.ProjectName + ` -f docker-compose.yml down
+TimeoutStartSec=0
+
+[Install]
+WantedBy=multi-user.target
+EOF
+
+systemctl daemon-reload
+systemctl enable ` + unitName + `
+printf "$MSG_UNIT_INSTALLED\n" "$UNIT" "systemctl start ` + unitName + `"
+`
+
+	scriptPath := filepath.Join(tempDir, "install-service.sh")
+	if err := os.WriteFile(scriptPath, []byte(script), 0755); err != nil {
+		return err
+	}
+
+	if len(notes) == 0 {
+		return nil
+	}
+	report := "Restart policies that behave differently under the systemd unit:\n\n- " + strings.Join(notes, "\n- ") + "\n"
+	return os.WriteFile(filepath.Join(tempDir, "RESTART-POLICIES.txt"), []byte(report), 0644)
+}
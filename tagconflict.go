@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// What --on-tag-conflict does when a build replaces a bundle tag an earlier
+// run left on an image with other content
+const (
+	TagConflictOverwrite = "overwrite" // Move the tag to the new image, with a warning
+	TagConflictFail      = "fail"
+	TagConflictSuffix    = "suffix" // Tag the new image <version>-<id> and keep the old tag
+)
+
+func parseTagConflict(value string) (string, error) {
+	switch value {
+	case "", TagConflictOverwrite:
+		return TagConflictOverwrite, nil
+	case TagConflictFail, TagConflictSuffix:
+		return value, nil
+	}
+	return "", fmt.Errorf("invalid --on-tag-conflict %q, use overwrite, fail or suffix", value)
+}
+
+// existingImageID returns the ID of the image imageName refers to before a
+// build replaces the tag, empty if there is none
+func (b *Bundler) existingImageID(imageName string) string {
+	inspect, err := b.client.ImageInspect(b.ctx, imageName)
+	if err != nil {
+		return ""
+	}
+	return inspect.ID
+}
+
+// resolveTagConflict checks whether the build of imageName replaced an image
+// with other content and applies --on-tag-conflict. It returns the name the
+// built image is bundled under.
+func (b *Bundler) resolveTagConflict(imageName, previousID string) (string, error) {
+	if previousID == "" {
+		return imageName, nil
+	}
+	inspect, err := b.client.ImageInspect(b.ctx, imageName)
+	if err != nil {
+		return "", fmt.Errorf("failed to inspect built image %s: %w", imageName, err)
+	}
+	if inspect.ID == previousID {
+		return imageName, nil
+	}
+
+	policy, err := parseTagConflict(b.opts.TagConflict)
+	if err != nil {
+		return "", err
+	}
+	switch policy {
+	case TagConflictFail:
+		// Give the tag back, the earlier bundle may still be delivered
+		if err := b.client.ImageTag(b.ctx, previousID, imageName); err != nil {
+			b.warnf("failed to restore tag %s of image %s: %v", imageName, shortID(previousID), err)
+		}
+		return "", fmt.Errorf("%s already tagged image %s with other content, bump the bundle version or use --on-tag-conflict overwrite or suffix", imageName, shortID(previousID))
+	case TagConflictSuffix:
+		suffixed := imageName + "-" + strings.TrimPrefix(shortID(inspect.ID), "sha256:")
+		if err := b.client.ImageTag(b.ctx, inspect.ID, suffixed); err != nil {
+			return "", fmt.Errorf("failed to tag %s: %w", suffixed, err)
+		}
+		if err := b.client.ImageTag(b.ctx, previousID, imageName); err != nil {
+			return "", fmt.Errorf("failed to restore tag %s: %w", imageName, err)
+		}
+		b.decidef("%s already tagged image %s with other content, bundling the build as %s", imageName, shortID(previousID), suffixed)
+		b.renameBuild(imageName, suffixed)
+		return suffixed, nil
+	}
+	b.warnf("%s moved from image %s to %s with other content, bundles with the same version differ", imageName, shortID(previousID), shortID(inspect.ID))
+	return imageName, nil
+}
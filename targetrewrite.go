@@ -0,0 +1,332 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"math/big"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// originalComposeName keeps the bundled compose file once deploy rewrote it
+// for the target, later rewrites start from it again
+const originalComposeName = "docker-compose.yml.orig"
+
+// bridgeNameOption is the driver option naming the Linux bridge of a network
+const bridgeNameOption = "com.docker.network.bridge.name"
+
+// TargetRewrites adapt the networking of a bundle to the target site, read
+// from deploy --target-values and flags
+type TargetRewrites struct {
+	Networks map[string]NetworkRewrite `yaml:"networks,omitempty"`
+	HostIPs  map[string]string         `yaml:"hostIPs,omitempty"` // Published host IP (0.0.0.0 for unset, * for any) -> new host IP
+}
+
+// NetworkRewrite changes one network of the compose file
+type NetworkRewrite struct {
+	Subnet string `yaml:"subnet,omitempty"` // Replaces the subnet of the same IP family, gateways and static addresses move along
+	Bridge string `yaml:"bridge,omitempty"` // Name of the Linux bridge
+}
+
+// parseTargetRewrites reads the values file, if any, and applies the
+// network=value flags on top
+func parseTargetRewrites(file string, subnets, bridges, hostIPs []string) (*TargetRewrites, error) {
+	rewrites := &TargetRewrites{}
+	if file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read target values: %w", err)
+		}
+		if err := yaml.Unmarshal(data, rewrites); err != nil {
+			return nil, fmt.Errorf("failed to parse target values: %w", err)
+		}
+	}
+	if rewrites.Networks == nil {
+		rewrites.Networks = make(map[string]NetworkRewrite)
+	}
+	if rewrites.HostIPs == nil {
+		rewrites.HostIPs = make(map[string]string)
+	}
+
+	for _, spec := range subnets {
+		name, subnet, ok := strings.Cut(spec, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid --subnet %q, use network=cidr", spec)
+		}
+		network := rewrites.Networks[name]
+		network.Subnet = subnet
+		rewrites.Networks[name] = network
+	}
+	for _, spec := range bridges {
+		name, bridge, ok := strings.Cut(spec, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid --bridge-name %q, use network=name", spec)
+		}
+		network := rewrites.Networks[name]
+		network.Bridge = bridge
+		rewrites.Networks[name] = network
+	}
+	for _, spec := range hostIPs {
+		from, to, ok := strings.Cut(spec, "=")
+		if !ok {
+			from, to = "*", spec
+		}
+		rewrites.HostIPs[from] = to
+	}
+	return rewrites, nil
+}
+
+func (r *TargetRewrites) empty() bool {
+	return len(r.Networks) == 0 && len(r.HostIPs) == 0
+}
+
+// ApplyTargetRewrites rewrites the compose file of the loader, starting from
+// the bundled one if an earlier deploy rewrote it already. It returns the
+// changes made.
+func (l *Loader) ApplyTargetRewrites(rewrites *TargetRewrites) ([]string, error) {
+	if data, err := os.ReadFile(filepath.Join(l.dir, originalComposeName)); err == nil {
+		if l.compose, err = parseBundleCompose(data); err != nil {
+			return nil, err
+		}
+	}
+
+	var changes []string
+	for _, name := range slices.Sorted(maps.Keys(rewrites.Networks)) {
+		networkChanges, err := rewriteNetwork(l.compose, name, rewrites.Networks[name])
+		if err != nil {
+			return nil, fmt.Errorf("network %s: %w", name, err)
+		}
+		changes = append(changes, networkChanges...)
+	}
+	hostIPChanges, err := rewriteHostIPs(l.compose, rewrites.HostIPs)
+	if err != nil {
+		return nil, err
+	}
+	return append(changes, hostIPChanges...), nil
+}
+
+func rewriteNetwork(compose *DockerCompose, name string, rewrite NetworkRewrite) ([]string, error) {
+	definition, declared := compose.Networks[name]
+	if !declared && name != "default" {
+		return nil, fmt.Errorf("not declared in the compose file")
+	}
+	config, _ := definition.(map[string]interface{})
+	if config == nil {
+		config = make(map[string]interface{})
+	}
+	if external, _ := config["external"].(bool); external {
+		return nil, fmt.Errorf("external networks are not created by the stack, their subnet and bridge are set where they are created")
+	}
+
+	var changes []string
+	if rewrite.Subnet != "" {
+		change, err := rewriteSubnet(compose, name, config, rewrite.Subnet)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, change)
+	}
+	if rewrite.Bridge != "" {
+		if driver, _ := config["driver"].(string); driver != "" && driver != "bridge" {
+			return nil, fmt.Errorf("bridge names need the bridge driver, the network uses %s", driver)
+		}
+		// Linux limits interface names to 15 bytes
+		if len(rewrite.Bridge) > 15 || strings.ContainsAny(rewrite.Bridge, "/ :") {
+			return nil, fmt.Errorf("invalid bridge name %q", rewrite.Bridge)
+		}
+		options, _ := config["driver_opts"].(map[string]interface{})
+		if options == nil {
+			options = make(map[string]interface{})
+		}
+		previous, _ := options[bridgeNameOption].(string)
+		options[bridgeNameOption] = rewrite.Bridge
+		config["driver_opts"] = options
+		changes = append(changes, fmt.Sprintf("network %s: bridge %s -> %s", name, cmp.Or(previous, "(generated)"), rewrite.Bridge))
+	}
+
+	if compose.Networks == nil {
+		compose.Networks = make(map[string]interface{})
+	}
+	compose.Networks[name] = config
+	return changes, nil
+}
+
+// rewriteSubnet replaces the ipam subnet of the same IP family. Gateway,
+// ip_range, aux_addresses and the static addresses of services keep their
+// offset in the subnet.
+func rewriteSubnet(compose *DockerCompose, name string, config map[string]interface{}, subnet string) (string, error) {
+	to, err := netip.ParsePrefix(subnet)
+	if err != nil {
+		return "", fmt.Errorf("invalid subnet %q", subnet)
+	}
+	to = to.Masked()
+
+	ipam, _ := config["ipam"].(map[string]interface{})
+	if ipam == nil {
+		ipam = make(map[string]interface{})
+	}
+	pools, _ := ipam["config"].([]interface{})
+	var pool map[string]interface{}
+	var from netip.Prefix
+	for _, p := range pools {
+		m, _ := p.(map[string]interface{})
+		if old, err := netip.ParsePrefix(fmt.Sprint(m["subnet"])); err == nil && old.Addr().Is4() == to.Addr().Is4() {
+			pool, from = m, old.Masked()
+			break
+		}
+	}
+	if pool == nil {
+		ipam["config"] = append(pools, map[string]interface{}{"subnet": to.String()})
+		config["ipam"] = ipam
+		return fmt.Sprintf("network %s: subnet (assigned by the daemon) -> %s", name, to), nil
+	}
+
+	move := func(field, value string) (string, error) {
+		if prefix, err := netip.ParsePrefix(value); err == nil {
+			addr, err := moveAddress(prefix.Addr(), from, to)
+			if err != nil || prefix.Bits() < to.Bits() {
+				return "", fmt.Errorf("%s %s does not fit into %s", field, value, to)
+			}
+			return netip.PrefixFrom(addr, prefix.Bits()).String(), nil
+		}
+		addr, err := netip.ParseAddr(value)
+		if err != nil {
+			return "", fmt.Errorf("invalid %s %q", field, value)
+		}
+		moved, err := moveAddress(addr, from, to)
+		if err != nil {
+			return "", fmt.Errorf("%s %s: %w", field, value, err)
+		}
+		return moved.String(), nil
+	}
+	for _, field := range []string{"gateway", "ip_range"} {
+		if value, ok := pool[field].(string); ok {
+			if pool[field], err = move(field, value); err != nil {
+				return "", err
+			}
+		}
+	}
+	if aux, ok := pool["aux_addresses"].(map[string]interface{}); ok {
+		for host, value := range aux {
+			if aux[host], err = move("aux address "+host, fmt.Sprint(value)); err != nil {
+				return "", err
+			}
+		}
+	}
+	pool["subnet"] = to.String()
+	config["ipam"] = ipam
+
+	field := "ipv4_address"
+	if !to.Addr().Is4() {
+		field = "ipv6_address"
+	}
+	for _, serviceName := range sortedServiceNames(compose) {
+		service := compose.Services[serviceName]
+		for _, network := range service.Networks.Networks {
+			value, ok := network.Config[field].(string)
+			if network.Name != name || !ok {
+				continue
+			}
+			if network.Config[field], err = move("service "+serviceName+" "+field, value); err != nil {
+				return "", err
+			}
+		}
+	}
+	return fmt.Sprintf("network %s: subnet %s -> %s", name, from, to), nil
+}
+
+// moveAddress maps addr from its offset in from to the same offset in to
+func moveAddress(addr netip.Addr, from, to netip.Prefix) (netip.Addr, error) {
+	if !from.Contains(addr) {
+		return netip.Addr{}, fmt.Errorf("not in subnet %s", from)
+	}
+	offset := new(big.Int).Sub(addrInt(addr), addrInt(from.Addr()))
+	size := new(big.Int).Lsh(big.NewInt(1), uint(to.Addr().BitLen()-to.Bits()))
+	if offset.Cmp(size) >= 0 {
+		return netip.Addr{}, fmt.Errorf("does not fit into %s", to)
+	}
+	var bytes [16]byte
+	new(big.Int).Add(addrInt(to.Addr()), offset).FillBytes(bytes[16-to.Addr().BitLen()/8:])
+	if to.Addr().Is4() {
+		return netip.AddrFrom4([4]byte(bytes[12:])), nil
+	}
+	return netip.AddrFrom16(bytes), nil
+}
+
+func addrInt(addr netip.Addr) *big.Int {
+	return new(big.Int).SetBytes(addr.AsSlice())
+}
+
+// rewriteHostIPs changes the host IPs ports are published on
+func rewriteHostIPs(compose *DockerCompose, hostIPs map[string]string) ([]string, error) {
+	for from, to := range hostIPs {
+		if _, err := netip.ParseAddr(to); err != nil {
+			return nil, fmt.Errorf("invalid host IP %q", to)
+		}
+		if _, err := netip.ParseAddr(from); err != nil && from != "*" {
+			return nil, fmt.Errorf("invalid host IP %q", from)
+		}
+	}
+
+	var changes []string
+	for _, serviceName := range sortedServiceNames(compose) {
+		service := compose.Services[serviceName]
+		for i, port := range service.Ports {
+			current := cmp.Or(port.HostIP, "0.0.0.0")
+			to, ok := hostIPs[current]
+			if !ok {
+				to, ok = hostIPs["*"]
+			}
+			if !ok || to == current {
+				continue
+			}
+			service.Ports[i].HostIP = to
+			changes = append(changes, fmt.Sprintf("service %s: port %s published on %s -> %s", serviceName, port.Target, current, to))
+		}
+	}
+	return changes, nil
+}
+
+// writeTargetCompose writes the rewritten compose file, keeping the bundled
+// one as docker-compose.yml.orig, and records the changes in the run report
+// of the bundle
+func (l *Loader) writeTargetCompose(changes []string) error {
+	composePath := filepath.Join(l.dir, "docker-compose.yml")
+	originalPath := filepath.Join(l.dir, originalComposeName)
+	if _, err := os.Stat(originalPath); os.IsNotExist(err) {
+		if err := os.Rename(composePath, originalPath); err != nil {
+			return err
+		}
+	}
+	data, err := marshalCompose(l.compose)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(composePath, data, 0644); err != nil {
+		return err
+	}
+
+	// The report embedded with --embed-run-report gets the changes, other bundles a report of the deploy
+	reportPath := filepath.Join(l.dir, runReportName)
+	report := &runReport{SchemaVersion: runReportSchemaVersion, Tool: currentTool(), Command: "deploy", Args: os.Args[1:],
+		StartedAt: time.Now().UTC(), Status: "succeeded", Name: l.manifest.Name, Version: l.manifest.Version}
+	if data, err := os.ReadFile(reportPath); err == nil {
+		if err := json.Unmarshal(data, report); err != nil {
+			return fmt.Errorf("failed to read %s: %w", runReportName, err)
+		}
+	}
+	report.TargetRewrites = changes
+	data, err = report.marshal()
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(reportPath, data, 0644)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// renderBundleMetadata evaluates Go templates in the x-bundle name and
+// version, e.g. `version: '{{ env "CI_PIPELINE_TAG" }}'` or `{{ gitTag }}`
+func renderBundleMetadata(xBundle *XBundle, projectDir string) error {
+	name, err := renderMetadataTemplate("name", xBundle.Name, projectDir)
+	if err != nil {
+		return err
+	}
+	version, err := renderMetadataTemplate("version", xBundle.Version, projectDir)
+	if err != nil {
+		return err
+	}
+	xBundle.Name = name
+	xBundle.Version = version
+	return nil
+}
+
+func renderMetadataTemplate(field, text, projectDir string) (string, error) {
+	if !strings.Contains(text, "{{") {
+		return text, nil
+	}
+
+	git := func(args ...string) (string, error) {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = projectDir
+		out, err := cmd.Output()
+		if err != nil {
+			return "", fmt.Errorf("git %s failed: %w", strings.Join(args, " "), err)
+		}
+		return strings.TrimSpace(string(out)), nil
+	}
+
+	funcs := template.FuncMap{
+		"env": os.Getenv,
+		"envOr": func(name, fallback string) string {
+			if value, ok := os.LookupEnv(name); ok && value != "" {
+				return value
+			}
+			return fallback
+		},
+		"gitTag": func() (string, error) {
+			return git("describe", "--tags", "--abbrev=0")
+		},
+		"gitCommit": func() (string, error) {
+			return git("rev-parse", "--short", "HEAD")
+		},
+		"gitBranch": func() (string, error) {
+			return git("rev-parse", "--abbrev-ref", "HEAD")
+		},
+		"now": func(layout string) string {
+			return time.Now().UTC().Format(layout)
+		},
+		"trimPrefix": func(prefix, s string) string {
+			return strings.TrimPrefix(s, prefix)
+		},
+	}
+
+	tmpl, err := template.New(field).Funcs(funcs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("invalid template in x-bundle %s: %w", field, err)
+	}
+	var out strings.Builder
+	if err := tmpl.Execute(&out, nil); err != nil {
+		return "", fmt.Errorf("failed to render x-bundle %s: %w", field, err)
+	}
+	return strings.TrimSpace(out.String()), nil
+}
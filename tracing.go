@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("docker-compose-bundler")
+
+// initTracing exports spans via OTLP/HTTP when the standard
+// OTEL_EXPORTER_OTLP_(TRACES_)ENDPOINT variable is set. The returned
+// function flushes the remaining spans.
+func initTracing(ctx context.Context) (func(context.Context) error, error) {
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceName("docker-compose-bundler"),
+	))
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// withTracing runs fn with tracing set up and flushes the spans afterwards
+func withTracing(fn func() error) error {
+	shutdown, err := initTracing(context.Background())
+	if err != nil {
+		fmt.Printf("Warning: failed to set up tracing: %v\n", err)
+		return fn()
+	}
+	runErr := fn()
+	if err := shutdown(context.Background()); err != nil {
+		fmt.Printf("Warning: failed to export traces: %v\n", err)
+	}
+	return runErr
+}
+
+// span starts a span that becomes the parent of everything the bundler does
+// until the returned function is called with the operation's error:
+//
+//	defer b.span("save", attribute.String("image", imageName))(&err)
+func (b *Bundler) span(name string, attrs ...attribute.KeyValue) func(*error) {
+	parent := b.ctx
+	ctx, span := tracer.Start(parent, name, trace.WithAttributes(attrs...))
+	b.ctx = ctx
+	done := b.startTiming(name, attrs)
+	return func(err *error) {
+		failed := err != nil && *err != nil
+		if failed {
+			span.RecordError(*err)
+			span.SetStatus(codes.Error, (*err).Error())
+		}
+		span.End()
+		done(failed)
+		b.ctx = parent
+	}
+}
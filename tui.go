@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// tuiSteps are the messages of the stages the quickstart walks the operator through
+var tuiSteps = []string{"tui.step.verify", "tui.step.load", "tui.step.configure", "tui.step.start"}
+
+// quickstart is the state of an interactive `load --tui` session
+type quickstart struct {
+	loader *Loader
+	in     *bufio.Reader
+	msgs   *catalog
+}
+
+// RunTUI walks the operator through verifying the bundle, loading the images,
+// configuring the environment and starting the stack, asking before every
+// step that changes the host
+func (l *Loader) RunTUI(in io.Reader) error {
+	q := &quickstart{loader: l, in: bufio.NewReader(in), msgs: l.msgs}
+
+	fmt.Printf("\n  %s %s\n", l.manifest.Name, l.manifest.Version)
+	fmt.Printf("  %s\n", strings.Repeat("=", len(l.manifest.Name)+len(l.manifest.Version)+1))
+	fmt.Printf("  %s\n", q.msgs.t("tui.intro", len(tuiSteps)))
+	fmt.Printf("  %s\n", q.msgs.t("tui.keys"))
+
+	for i, run := range []func() error{q.verify, q.load, q.configure, q.start} {
+		fmt.Printf("\n[%d/%d] %s\n\n", i+1, len(tuiSteps), q.msgs.t(tuiSteps[i]))
+		if err := run(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verify checks the engine version and the checksum of every image tar
+func (q *quickstart) verify() error {
+	if err := q.loader.CheckEngine(); err != nil {
+		return err
+	}
+	if err := q.loader.CheckExpiry(); err != nil {
+		return err
+	}
+	fmt.Printf("  %s\n", q.msgs.t("tui.engine_ok"))
+
+	for _, img := range q.loader.manifest.Images {
+		file, err := os.Open(filepath.Join(q.loader.dir, filepath.FromSlash(img.File)))
+		if err != nil {
+			return fmt.Errorf("bundle is incomplete: %w", err)
+		}
+		hash := sha256.New()
+		_, err = io.Copy(hash, newProgressReader(file, img.Size, q.msgs.t("tui.check", img.Name)))
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", img.File, err)
+		}
+		if sum := hex.EncodeToString(hash.Sum(nil)); sum != img.SHA256 {
+			return fmt.Errorf("%s", q.msgs.t("tui.damaged", img.File))
+		}
+	}
+	fmt.Printf("  %s\n", q.msgs.t("tui.images_intact", len(q.loader.manifest.Images)))
+	return nil
+}
+
+// load loads every image with a progress bar
+func (q *quickstart) load() error {
+	if !q.confirm(q.msgs.t("tui.load_confirm", len(q.loader.manifest.Images)), true) {
+		fmt.Printf("  %s\n", q.msgs.t("tui.load_skipped"))
+		return nil
+	}
+	for _, img := range q.loader.manifest.Images {
+		file, err := os.Open(filepath.Join(q.loader.dir, filepath.FromSlash(img.File)))
+		if err != nil {
+			return err
+		}
+		progress := newProgressReader(file, img.Size, q.msgs.t("tui.load", img.Name))
+		err = q.loader.loadImageFrom(progress)
+		file.Close()
+		if err != nil {
+			fmt.Println()
+			return fmt.Errorf("failed to load image %s: %w", img.Name, err)
+		}
+		progress.finish()
+	}
+	recordEvent(q.loader.stateDir, q.loader.manifest, Event{Action: EventLoaded, Detail: q.loader.dir})
+	return nil
+}
+
+// configure asks for the variables taken from the host environment and
+// optionally lets the operator review the bundled env files
+func (q *quickstart) configure() error {
+	required := make(map[string]bool)
+	envFiles := make(map[string]bool)
+	for _, service := range q.loader.compose.Services {
+		for _, v := range service.Environment.Vars {
+			if v.Value == nil {
+				required[v.Name] = true
+			}
+		}
+		for _, file := range service.EnvFile {
+			envFiles[filepath.ToSlash(filepath.Clean(file.Path))] = true
+		}
+	}
+
+	if len(required) == 0 && len(envFiles) == 0 {
+		fmt.Printf("  %s\n", q.msgs.t("tui.nothing"))
+		return nil
+	}
+
+	for _, name := range sortedSet(required) {
+		value := q.ask(name, os.Getenv(name))
+		// The compose process started in the last step inherits the variable
+		if err := os.Setenv(name, value); err != nil {
+			return err
+		}
+	}
+
+	for _, file := range sortedSet(envFiles) {
+		if !q.confirm(q.msgs.t("tui.review", file), false) {
+			continue
+		}
+		if err := q.editEnvFile(filepath.Join(q.loader.dir, filepath.FromSlash(file))); err != nil {
+			return fmt.Errorf("failed to update %s: %w", file, err)
+		}
+	}
+	return nil
+}
+
+// editEnvFile prompts for every variable of a dotenv file and rewrites the
+// changed assignments in place, keeping comments and order
+func (q *quickstart) editEnvFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	lines := strings.Split(string(data), "\n")
+	values := parseDotEnv(data)
+	changed := false
+
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		key, _, found := strings.Cut(strings.TrimPrefix(trimmed, "export "), "=")
+		key = strings.TrimSpace(key)
+		if !found {
+			continue
+		}
+		if value := q.ask("  "+key, values[key]); value != values[key] {
+			lines[i] = key + "=" + value
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return os.WriteFile(path, []byte(strings.Join(lines, "\n")), 0644)
+}
+
+// start runs the preflight checks, starts the stack and waits for it
+func (q *quickstart) start() error {
+	if !q.confirm(q.msgs.t("tui.start_confirm"), true) {
+		fmt.Printf("  %s\n", q.msgs.t("tui.start_later", "docker-compose-bundler deploy "+q.loader.dir))
+		return nil
+	}
+	if err := q.loader.Preflight(); err != nil {
+		return err
+	}
+	if err := q.loader.InstallComposePlugin(); err != nil {
+		return err
+	}
+	if err := q.loader.Up(); err != nil {
+		return fmt.Errorf("failed to start the stack: %w", err)
+	}
+	if err := q.loader.RecordDeployment(); err != nil {
+		fmt.Printf("  %s\n", q.msgs.t("tui.record_failed", q.loader.stateDir, err.Error()))
+	}
+	if err := q.loader.WaitHealthy(5 * time.Minute); err != nil {
+		return err
+	}
+	fmt.Printf("\n  %s\n", q.msgs.t("tui.running", q.loader.manifest.Name, q.loader.manifest.Version))
+	return nil
+}
+
+// ask prompts for a value, an empty answer keeps the current one
+func (q *quickstart) ask(label, current string) string {
+	fmt.Printf("  %s [%s]: ", label, current)
+	answer, _ := q.in.ReadString('\n')
+	if answer = strings.TrimSpace(answer); answer == "" {
+		return current
+	}
+	return answer
+}
+
+// confirm asks a yes/no question, English answers are always understood
+func (q *quickstart) confirm(question string, defaultYes bool) bool {
+	hint := q.msgs.t("tui.no_yes")
+	if defaultYes {
+		hint = q.msgs.t("tui.yes_no")
+	}
+	fmt.Printf("  %s [%s] ", question, hint)
+	answer, _ := q.in.ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	if answer == "" {
+		return defaultYes
+	}
+	return slices.Contains(strings.Split(q.msgs.t("tui.yes_answers")+","+englishMessages["tui.yes_answers"], ","), answer)
+}
+
+func sortedSet(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// progressReader draws a progress bar on stdout while it is read
+type progressReader struct {
+	r     io.Reader
+	label string
+	total int64
+	read  int64
+	drawn time.Time
+	done  bool
+}
+
+func newProgressReader(r io.Reader, total int64, label string) *progressReader {
+	return &progressReader{r: r, label: label, total: total}
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.read += int64(n)
+	if err == io.EOF {
+		p.finish()
+	} else if time.Since(p.drawn) > 100*time.Millisecond {
+		p.draw()
+	}
+	return n, err
+}
+
+// finish completes the bar, the daemon may stop reading before EOF
+func (p *progressReader) finish() {
+	if p.done {
+		return
+	}
+	p.done = true
+	p.read = max(p.read, p.total)
+	p.draw()
+	fmt.Println()
+}
+
+func (p *progressReader) draw() {
+	const width = 30
+	ratio := 1.0
+	if p.total > 0 && p.read < p.total {
+		ratio = float64(p.read) / float64(p.total)
+	}
+	filled := int(ratio * width)
+	bar := strings.Repeat("=", filled) + strings.Repeat(" ", width-filled)
+	fmt.Printf("\r  %-40.40s [%s] %3d%% %s", p.label, bar, int(ratio*100), formatBytes(p.read))
+	p.drawn = time.Now()
+}
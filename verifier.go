@@ -0,0 +1,360 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"debug/elf"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"strings"
+	"time"
+
+	"docker-compose-bundler/bundlefile"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Paths inside the verifier image
+const (
+	verifierBinary   = "/verifier"
+	verifierManifest = "/bundle-manifest.json"
+	verifierMount    = "/bundle"
+)
+
+// invalidTagChars are the characters a version cannot carry into an image tag
+var invalidTagChars = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+
+// verifiedMember is a file of the bundle with a checksum in the manifest
+type verifiedMember struct {
+	what     string
+	size     int64
+	sha256   string
+	progress bool // Large enough to show the progress of reading it
+}
+
+// verifyBundle checks the parts of a bundle against their checksum list and
+// every member against the manifest, without Docker. Members the manifest
+// does not list are problems too. With expectedManifest the manifest has to
+// be identical to it. It returns the problems found.
+func verifyBundle(source string, expectedManifest []byte) ([]string, error) {
+	if info, err := os.Stat(source); err != nil || !info.IsDir() {
+		parts, base, err := bundlefile.SplitParts(source)
+		if err != nil {
+			return nil, err
+		}
+		// Nothing is written: the bundle may be mounted read-only
+		if err := verifyParts(parts, base, &loadState{Parts: make(map[string]verifiedPart)}, ""); err != nil {
+			return []string{err.Error()}, nil
+		}
+	}
+
+	bundle, err := bundlefile.Open(source)
+	if err != nil {
+		return nil, err
+	}
+	var problems []string
+	if expectedManifest != nil && !bytes.Equal(bundle.Manifest().Raw, expectedManifest) {
+		problems = append(problems, fmt.Sprintf("%s differs from the manifest the verifier was made for, this is not the delivered bundle", bundlefile.ManifestName))
+	}
+	manifest, err := parseManifest(bundle.Manifest().Raw)
+	if err != nil {
+		return nil, err
+	}
+
+	members := make(map[string]verifiedMember)
+	for _, file := range manifest.Files {
+		members[file.File] = verifiedMember{what: file.File, size: file.Size, sha256: file.SHA256}
+	}
+	for _, img := range manifest.Images {
+		members[img.File] = verifiedMember{what: "image " + img.Name, size: img.Size, sha256: img.SHA256, progress: true}
+	}
+	if manifest.Bundler != nil {
+		for _, loader := range manifest.Bundler.Loaders {
+			members[loader.File] = verifiedMember{what: loader.Platform + " loader", size: loader.Size, sha256: loader.SHA256, progress: true}
+		}
+	}
+	for _, plugin := range manifest.ComposePlugins {
+		members[plugin.File] = verifiedMember{what: plugin.Platform + " compose plugin", size: plugin.Size, sha256: plugin.SHA256, progress: true}
+	}
+
+	// Bundles of older versions only list the images, loaders and compose plugins
+	listed := len(manifest.Files) > 0
+	if !listed {
+		fmt.Printf("Warning: %s has no checksums of its other files, only the images, loaders and compose plugins are verified\n", bundlefile.ManifestName)
+	}
+	err = bundle.Walk(func(entry bundlefile.Entry, content io.Reader) error {
+		if entry.IsDir || entry.Name == bundlefile.ManifestName {
+			return nil
+		}
+		member, ok := members[entry.Name]
+		if !ok {
+			// A load of an extracted bundle records its progress next to the files
+			if listed && !(bundle.Format() == bundlefile.FormatDirectory && entry.Name == loadStateName) {
+				problems = append(problems, fmt.Sprintf("%s is not listed in %s, it was added to the bundle", entry.Name, bundlefile.ManifestName))
+			}
+			return nil
+		}
+		delete(members, entry.Name)
+		if entry.Size != member.size {
+			problems = append(problems, fmt.Sprintf("%s is corrupt (%d bytes, expected %d)", member.what, entry.Size, member.size))
+			return nil
+		}
+		hash := sha256.New()
+		if member.progress {
+			content = newProgressReader(content, member.size, member.what)
+		}
+		if _, err := io.Copy(hash, content); err != nil {
+			return err
+		}
+		if got := hex.EncodeToString(hash.Sum(nil)); got != member.sha256 {
+			problems = append(problems, fmt.Sprintf("%s is corrupt (sha256 %s, expected %s)", member.what, got, member.sha256))
+			return nil
+		}
+		fmt.Printf("OK %s\n", member.what)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read bundle: %w", err)
+	}
+	for _, name := range slices.Sorted(maps.Keys(members)) {
+		problems = append(problems, fmt.Sprintf("%s is missing (%s)", members[name].what, name))
+	}
+	return problems, nil
+}
+
+func runVerify(args []string) {
+	var expected string
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	flags.StringVar(&expected, "expect-manifest", "", "Also require the manifest.json of the bundle to be identical to this `file`")
+	stateDir := flags.String("state-dir", defaultStateDir(), "`Directory` the verification is recorded in")
+	flags.Usage = func() {
+		fmt.Println("Usage: docker-compose-bundler verify [flags] <bundle.tar.gz|bundle-dir>")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	var expectedManifest []byte
+	if expected != "" {
+		var err error
+		if expectedManifest, err = os.ReadFile(expected); err != nil {
+			log.Fatalf("failed to read expected manifest: %v", err)
+		}
+	}
+	problems, err := verifyBundle(flags.Arg(0), expectedManifest)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Failed verifications are recorded as well, the log shows what was refused
+	if manifest, err := bundleManifest(flags.Arg(0)); err == nil {
+		detail := flags.Arg(0) + ": intact"
+		if len(problems) > 0 {
+			detail = fmt.Sprintf("%s: FAILED, %s", flags.Arg(0), strings.Join(problems, "; "))
+		}
+		recordEvent(*stateDir, manifest, Event{Action: EventVerified, Detail: detail})
+	}
+	if len(problems) > 0 {
+		for _, problem := range problems {
+			fmt.Println("FAILED " + problem)
+		}
+		fmt.Printf("%s failed verification, do not install it\n", filepath.Base(flags.Arg(0)))
+		os.Exit(1)
+	}
+	fmt.Printf("%s is intact\n", filepath.Base(flags.Arg(0)))
+}
+
+// writeVerifierImage writes a docker-archive tar with a static Linux loader
+// and the manifest of the bundle, which verifies the delivered bundle with a
+// single docker run before anything else is installed
+func (b *Bundler) writeVerifierImage(outputFile string, manifest *Manifest) error {
+	if !b.opts.VerifierImage {
+		return nil
+	}
+	loader, platform, err := b.verifierLoader()
+	if err != nil {
+		return err
+	}
+	bundle, err := bundlefile.Open(outputFile)
+	if err != nil {
+		return err
+	}
+
+	version := invalidTagChars.ReplaceAllString(manifest.Version, "-")
+	if version == "" || len(version) > 128 || strings.HasPrefix(version, ".") || strings.HasPrefix(version, "-") {
+		version = "latest"
+	}
+	tag := manifest.ProjectName + "-verifier:" + version
+	imagePath := strings.TrimSuffix(mediaImagePath(outputFile, "tar"), ".tar") + "-verifier.tar"
+	bundleName := filepath.Base(outputFile)
+
+	out, err := os.Create(imagePath)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", imagePath, err)
+	}
+	err = writeVerifierArchive(out, loader.Source, bundle.Manifest().Raw, platform, tag, bundleName, manifest.CreatedAt)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(imagePath)
+		return fmt.Errorf("failed to write %s: %w", imagePath, err)
+	}
+	fmt.Printf("Wrote verifier image %s: %s\n", tag, imagePath)
+	fmt.Printf("  docker load -i %s && docker run --rm -v \"$PWD\":%s:ro %s\n", filepath.Base(imagePath), verifierMount, tag)
+	return nil
+}
+
+// verifierLoader picks the Linux loader of the verifier image, preferring the
+// architecture of the running binary
+func (b *Bundler) verifierLoader() (*mediaFile, *ocispec.Platform, error) {
+	loaders, err := b.mediaLoaders()
+	if err != nil {
+		return nil, nil, err
+	}
+	var candidates []*mediaFile
+	for _, loader := range loaders {
+		if platform, ok := loaderPlatform(path.Base(loader.Name)); ok && strings.HasPrefix(platform, "linux/") {
+			candidates = append(candidates, loader)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, nil, fmt.Errorf("--emit-verifier-image needs a Linux loader, add one with --media-loader docker-compose-bundler-linux-<arch>")
+	}
+	slices.SortStableFunc(candidates, func(a, b *mediaFile) int {
+		native := mediaLoaderPrefix + "linux-" + runtime.GOARCH
+		switch {
+		case path.Base(a.Name) == native:
+			return -1
+		case path.Base(b.Name) == native:
+			return 1
+		}
+		return 0
+	})
+
+	loader := candidates[0]
+	// The image has no libc, the dynamic linker would be missing
+	binary, err := elf.Open(loader.Source)
+	if err != nil {
+		return nil, nil, fmt.Errorf("loader %s is not a Linux binary: %w", loader.Source, err)
+	}
+	defer binary.Close()
+	for _, prog := range binary.Progs {
+		if prog.Type == elf.PT_INTERP {
+			return nil, nil, fmt.Errorf("loader %s is dynamically linked, build it with CGO_ENABLED=0 for the verifier image", loader.Source)
+		}
+	}
+	platform, _ := loaderPlatform(path.Base(loader.Name))
+	arch, variant, _ := strings.Cut(strings.TrimPrefix(platform, "linux/"), "/")
+	return loader, &ocispec.Platform{OS: "linux", Architecture: arch, Variant: variant}, nil
+}
+
+// writeVerifierArchive writes the docker-archive of the verifier image: one
+// layer with the loader and the manifest, the loader verifying /bundle as
+// entrypoint
+func writeVerifierArchive(w io.Writer, loaderPath string, manifest []byte, platform *ocispec.Platform, tag, bundleName string, created time.Time) error {
+	layer, err := os.CreateTemp("", "verifier-layer-*.tar")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(layer.Name())
+	defer layer.Close()
+
+	loader, err := os.Open(loaderPath)
+	if err != nil {
+		return err
+	}
+	defer loader.Close()
+	info, err := loader.Stat()
+	if err != nil {
+		return err
+	}
+
+	diffID := digest.SHA256.Digester()
+	layerTar := tar.NewWriter(io.MultiWriter(layer, diffID.Hash()))
+	files := []struct {
+		name    string
+		mode    int64
+		size    int64
+		content io.Reader
+	}{
+		{strings.TrimPrefix(verifierBinary, "/"), 0755, info.Size(), loader},
+		{strings.TrimPrefix(verifierManifest, "/"), 0644, int64(len(manifest)), bytes.NewReader(manifest)},
+	}
+	if err := layerTar.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: strings.TrimPrefix(verifierMount, "/") + "/", Mode: 0755, ModTime: created}); err != nil {
+		return err
+	}
+	for _, file := range files {
+		if err := layerTar.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: file.name, Mode: file.mode, Size: file.size, ModTime: created}); err != nil {
+			return err
+		}
+		if _, err := io.Copy(layerTar, file.content); err != nil {
+			return err
+		}
+	}
+	if err := layerTar.Close(); err != nil {
+		return err
+	}
+	layerSize, err := layer.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := layer.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	config, err := json.Marshal(ocispec.Image{
+		Created:  &created,
+		Platform: *platform,
+		Config: ocispec.ImageConfig{
+			Entrypoint: []string{verifierBinary, "verify", "--expect-manifest", verifierManifest},
+			Cmd:        []string{verifierMount + "/" + bundleName},
+			WorkingDir: verifierMount,
+			Labels:     map[string]string{"org.opencontainers.image.title": "Verifier of " + bundleName},
+		},
+		RootFS: ocispec.RootFS{Type: "layers", DiffIDs: []digest.Digest{diffID.Digest()}},
+	})
+	if err != nil {
+		return err
+	}
+	configName := digest.FromBytes(config).Encoded() + ".json"
+	layerName := diffID.Digest().Encoded() + "/layer.tar"
+	index, err := json.Marshal([]map[string]interface{}{{"Config": configName, "RepoTags": []string{tag}, "Layers": []string{layerName}}})
+	if err != nil {
+		return err
+	}
+
+	archive := tar.NewWriter(w)
+	for _, file := range []struct {
+		name    string
+		size    int64
+		content io.Reader
+	}{
+		{configName, int64(len(config)), bytes.NewReader(config)},
+		{layerName, layerSize, layer},
+		{"manifest.json", int64(len(index)), bytes.NewReader(index)},
+	} {
+		if err := archive.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: file.name, Mode: 0644, Size: file.size, ModTime: created}); err != nil {
+			return err
+		}
+		if _, err := io.Copy(archive, file.content); err != nil {
+			return err
+		}
+	}
+	return archive.Close()
+}
